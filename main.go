@@ -1,19 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
+	"github.com/atvirokodosprendimai/wgmesh/pkg/acl"
 	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
 	"github.com/atvirokodosprendimai/wgmesh/pkg/daemon"
+	// Importing discovery also registers the discovery factory via init()
+	"github.com/atvirokodosprendimai/wgmesh/pkg/discovery"
 	"github.com/atvirokodosprendimai/wgmesh/pkg/mesh"
-
-	// Import discovery to register the DHT factory via init()
-	_ "github.com/atvirokodosprendimai/wgmesh/pkg/discovery"
 )
 
 func main() {
@@ -29,6 +38,9 @@ func main() {
 		case "status":
 			statusCmd()
 			return
+		case "peers":
+			peersCmd()
+			return
 		case "test-peer":
 			testPeerCmd()
 			return
@@ -44,6 +56,18 @@ func main() {
 		case "rotate-secret":
 			rotateSecretCmd()
 			return
+		case "revoke":
+			revokeCmd(false)
+			return
+		case "unrevoke":
+			revokeCmd(true)
+			return
+		case "acl":
+			aclCmd()
+			return
+		case "registry-server":
+			registryServerCmd()
+			return
 		}
 	}
 
@@ -56,6 +80,18 @@ func main() {
 		deploy     = flag.Bool("deploy", false, "Deploy configuration to all nodes")
 		init       = flag.Bool("init", false, "Initialize new mesh")
 		encrypt    = flag.Bool("encrypt", false, "Encrypt state file with password (asks for password)")
+		policyFile = flag.String("policy", "", "Set the ACL policy deployed to all nodes (none to remove it)")
+		setTags    = flag.String("tags", "", "Set the ACL tags of a node (format: hostname=tag1,tag2)")
+		parallel   = flag.Int("parallel", mesh.DefaultDeployParallel, "Number of nodes to deploy at the same time")
+		plan       = flag.Bool("plan", false, "With -deploy, show the changes without applying them")
+		planOut    = flag.String("plan-out", "plan.json", "File the -plan JSON is written to")
+		applyPlan  = flag.String("apply-plan", "", "Deploy only if the live state still matches a saved plan")
+		knownHosts = flag.String("known-hosts", "", "Additional known_hosts file used to verify node host keys")
+		trustHost  = flag.String("trust-host", "", "Pin the current SSH host key of a node, replacing the old one")
+		setSSH     = flag.String("set-ssh", "", "Change the SSH settings of a node (with -ssh-user, -ssh-identity, -ssh-jump)")
+		sshUser    = flag.String("ssh-user", "", "SSH user for -add or -set-ssh, commands run with sudo if not root")
+		sshKey     = flag.String("ssh-identity", "", "SSH private key file for -add or -set-ssh")
+		sshJump    = flag.String("ssh-jump", "", "Jump hosts for -add or -set-ssh ([user@]host[:port],...)")
 	)
 
 	flag.Parse()
@@ -84,6 +120,10 @@ func main() {
 		mesh.SetEncryptionPassword(password)
 	}
 
+	if *knownHosts != "" {
+		mesh.SetKnownHostsFile(*knownHosts)
+	}
+
 	if *init {
 		if err := mesh.Initialize(*stateFile); err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to initialize mesh: %v\n", err)
@@ -105,6 +145,11 @@ func main() {
 			fmt.Fprintf(os.Stderr, "Failed to add node: %v\n", err)
 			os.Exit(1)
 		}
+		hostname := strings.Split(*addNode, ":")[0]
+		if err := m.SetNodeSSH(hostname, *sshUser, *sshKey, *sshJump); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to set SSH settings: %v\n", err)
+			os.Exit(1)
+		}
 		if err := m.Save(*stateFile); err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to save state: %v\n", err)
 			os.Exit(1)
@@ -122,11 +167,77 @@ func main() {
 		}
 		fmt.Printf("Node removed successfully\n")
 
+	case *policyFile != "":
+		path := *policyFile
+		if path == "none" {
+			path = ""
+		}
+		if err := m.SetACLPolicy(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to set ACL policy: %v\n", err)
+			os.Exit(1)
+		}
+		if err := m.Save(*stateFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save state: %v\n", err)
+			os.Exit(1)
+		}
+
+	case *setTags != "":
+		if err := m.SetNodeTags(*setTags); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to set tags: %v\n", err)
+			os.Exit(1)
+		}
+		if err := m.Save(*stateFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save state: %v\n", err)
+			os.Exit(1)
+		}
+
 	case *list:
 		m.List()
 
-	case *deploy:
-		if err := m.Deploy(); err != nil {
+	case *setSSH != "":
+		if err := m.SetNodeSSH(*setSSH, *sshUser, *sshKey, *sshJump); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to set SSH settings: %v\n", err)
+			os.Exit(1)
+		}
+		if err := m.Save(*stateFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save state: %v\n", err)
+			os.Exit(1)
+		}
+
+	case *trustHost != "":
+		if err := m.TrustHost(*trustHost); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to trust host: %v\n", err)
+			os.Exit(1)
+		}
+		if err := m.Save(*stateFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save state: %v\n", err)
+			os.Exit(1)
+		}
+
+	case *deploy && *plan:
+		p := m.Plan(mesh.DeployOptions{Parallel: *parallel})
+		savePinnedHosts(m, *stateFile)
+		fmt.Println()
+		p.Print(os.Stdout)
+		if err := p.Save(*planOut); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save plan: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("\nPlan saved to %s, apply it with: wgmesh -apply-plan %s\n", *planOut, *planOut)
+
+	case *deploy || *applyPlan != "":
+		opts := mesh.DeployOptions{Parallel: *parallel}
+		if *applyPlan != "" {
+			p, err := mesh.LoadPlan(*applyPlan)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to load plan: %v\n", err)
+				os.Exit(1)
+			}
+			opts.Plan = p
+		}
+		err := m.Deploy(opts)
+		savePinnedHosts(m, *stateFile)
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to deploy: %v\n", err)
 			os.Exit(1)
 		}
@@ -138,59 +249,130 @@ func main() {
 	}
 }
 
+// savePinnedHosts saves the state if host keys were trusted on first use, so
+// that later connections are checked against them
+func savePinnedHosts(m *mesh.Mesh, stateFile string) {
+	if len(m.PinnedHosts()) == 0 {
+		return
+	}
+	if err := m.Save(stateFile); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to save pinned host keys: %v\n", err)
+	}
+}
+
 func printUsage() {
 	fmt.Println(`wgmesh - WireGuard mesh network builder
 
 SUBCOMMANDS (decentralized mode):
   init --secret                 Generate a new mesh secret
+  init --secret --admin-key <F> Also generate an admin key, saved to <F>
   join --secret <SECRET>        Join a mesh network
-  status --secret <SECRET>      Show mesh status
+  status [--secret <SECRET>]    Show status of the running daemon
+  peers                         List peers known to the running daemon
   qr --secret <SECRET>          Display secret as QR code (text)
   install-service --secret ...  Install systemd service
   uninstall-service             Remove systemd service
-  rotate-secret                 Rotate mesh secret
+  rotate-secret --admin-key <F> Rotate the mesh secret on all nodes
+  revoke --pubkey <KEY> --admin-key <F>   Remove a node from the mesh on all nodes
+  unrevoke --pubkey <KEY> --admin-key <F> Lift a revocation
+  acl [--file <P> --admin-key <F>] Show or set the mesh ACL policy
+  registry-server               Run a self-hosted rendezvous registry
 
 FLAGS (centralized mode):
   -state <file>    Path to mesh state file (default: mesh-state.json)
   -add <spec>      Add node (format: hostname:ip:ssh_host[:ssh_port])
   -remove <name>   Remove node by hostname
   -list            List all nodes
+  -tags <spec>     Set ACL tags of a node (format: hostname=tag1,tag2)
+  -policy <file>   Set the ACL policy for all nodes (none to remove)
   -deploy          Deploy configuration to all nodes
+  -parallel <n>    Nodes to deploy at the same time (default: 8)
+  -plan            With -deploy, show the per-node changes and save them as JSON
+  -plan-out <file> Where -plan saves the JSON plan (default: plan.json)
+  -apply-plan <f>  Deploy, refusing if live state drifted since the plan was made
+  -known-hosts <f> Extra known_hosts file for verifying node host keys
+  -set-ssh <name>  Change how a node is reached over SSH (with the flags below)
+  -ssh-user <user> SSH user for -add/-set-ssh; non-root users need passwordless sudo
+  -ssh-identity <f> SSH private key for -add/-set-ssh
+  -ssh-jump <hops> Jump hosts for -add/-set-ssh ([user@]host[:port],...)
+  -trust-host <n>  Pin the current SSH host key of a node (after a reinstall)
   -init            Initialize new mesh state file
   -encrypt         Encrypt state file with password
 
 EXAMPLES:
   # Decentralized mode (automatic peer discovery):
   wgmesh init --secret                          # Generate a new mesh secret
+  wgmesh init --secret --mesh-subnet 100.64.0.0/10  # Secret URI with its own mesh subnet
+  wgmesh init --secret --admin-key admin.key    # Secret URI pinning a new admin key
+  wgmesh revoke --pubkey "..." --admin-key admin.key  # Revoke a node everywhere
   wgmesh join --secret "wgmesh://v1/K7x2..."    # Join mesh on this node
+  wgmesh join --secret "..." --name db1 --mesh-ip 10.42.0.10  # Fixed name and mesh IP
   wgmesh join --secret "..." --privacy           # Join with Dandelion++ privacy
+  wgmesh join --secret "..." --tags db --acl-policy acl.signed.json  # Tagged node enforcing a signed ACL policy
+  wgmesh join --secret "..." --use-exit-node gw1 # Send internet traffic through node gw1
+  wgmesh join --secret "..." --no-dht            # LAN and gossip only (no internet)
+  wgmesh join --secret "..." --registry http://registry.lan:8765  # Bootstrap from a self-hosted registry
 
   # Centralized mode (SSH-based deployment):
   wgmesh -init -encrypt                         # Initialize encrypted state
   wgmesh -add node1:10.99.0.1:192.168.1.10     # Add a node
-  wgmesh -deploy                               # Deploy to all nodes`)
+  wgmesh -deploy                               # Deploy to all nodes
+  wgmesh -deploy -plan                         # Preview the changes, save plan.json
+  wgmesh -apply-plan plan.json                 # Deploy exactly the previewed changes`)
 }
 
 // initCmd handles the "init --secret" subcommand
 func initCmd() {
 	fs := flag.NewFlagSet("init", flag.ExitOnError)
 	secretMode := fs.Bool("secret", false, "Generate a new mesh secret")
+	meshSubnet := fs.String("mesh-subnet", "", "IPv4 subnet for mesh IPs, embedded in the URI (default: 10.X.0.0/16 derived from the secret)")
+	adminKeyFile := fs.String("admin-key", "", "Generate a mesh admin key, save its private half to this file and pin the public half in the URI")
 	fs.Parse(os.Args[2:])
 
 	if *secretMode {
+		if *meshSubnet != "" {
+			if _, err := daemon.ParseMeshSubnet(*meshSubnet); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
 		secret, err := daemon.GenerateSecret()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to generate secret: %v\n", err)
 			os.Exit(1)
 		}
 
-		uri := daemon.FormatSecretURI(secret)
+		var adminKey string
+		if *adminKeyFile != "" {
+			if _, err := os.Stat(*adminKeyFile); err == nil {
+				fmt.Fprintf(os.Stderr, "Error: %s already exists, refusing to overwrite an admin key\n", *adminKeyFile)
+				os.Exit(1)
+			}
+			pub, priv, err := crypto.GenerateAdminKey()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			if err := crypto.SaveAdminPrivateKey(*adminKeyFile, priv); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			adminKey = crypto.EncodeAdminKey(pub)
+		}
+
+		uri := daemon.FormatSecretURIWithParams(secret, *meshSubnet, adminKey)
 		fmt.Println("Generated mesh secret:")
 		fmt.Println()
 		fmt.Println(uri)
 		fmt.Println()
 		fmt.Println("Share this secret with all nodes that should join the mesh.")
 		fmt.Println("Run: wgmesh join --secret \"" + uri + "\"")
+		if adminKey != "" {
+			fmt.Println()
+			fmt.Printf("Admin key saved to %s. Keep it off the mesh nodes: whoever holds\n", *adminKeyFile)
+			fmt.Println("it can revoke nodes and rotate the secret (--admin-key).")
+		}
 		return
 	}
 
@@ -207,6 +389,24 @@ func joinCmd() {
 	iface := fs.String("interface", "wg0", "WireGuard interface name")
 	logLevel := fs.String("log-level", "info", "Log level (debug, info, warn, error)")
 	privacyMode := fs.Bool("privacy", false, "Enable privacy mode (Dandelion++ relay)")
+	meshSubnet := fs.String("mesh-subnet", "", "IPv4 subnet for mesh IPs, must match on all nodes (default: from the secret URI, else 10.X.0.0/16)")
+	meshIP := fs.String("mesh-ip", "", "Reserve this mesh IP instead of deriving one, wins collisions with derived addresses")
+	nodeName := fs.String("name", "", "Node name advertised to peers (default: the hostname)")
+	meshName := fs.String("mesh-name", "", "Mesh name in DNS, nodes resolve as <name>.<mesh-name>.mesh (default: the interface name)")
+	noDNS := fs.Bool("no-dns", false, "Do not serve node names over DNS on the mesh IP")
+	tags := fs.String("tags", "", "Comma-separated ACL tags announced to peers (e.g. app,web)")
+	aclPolicy := fs.String("acl-policy", "", "Signed ACL policy (wgmesh acl --out) distributed to the whole mesh")
+	adminKey := fs.String("admin-key", "", "Mesh admin public key allowed to revoke nodes (default: from the secret URI)")
+	exitNode := fs.Bool("advertise-exit-node", false, "Offer peers to route their internet traffic through this node (NAT)")
+	useExitNode := fs.String("use-exit-node", "", "Route internet traffic through this peer (node name or WireGuard public key)")
+	noLAN := fs.Bool("no-lan", false, "Disable LAN multicast discovery")
+	noDHT := fs.Bool("no-dht", false, "Disable BitTorrent DHT discovery")
+	noGossip := fs.Bool("no-gossip", false, "Disable in-mesh gossip")
+	dhtStaticID := fs.Bool("dht-static-id", false, "Use the static DHT network ID instead of the hourly rotating one (compatibility)")
+	registry := fs.String("registry", "", "Rendezvous registry: github, github://owner/repo or http(s)://host:port of a registry-server")
+	stunServers := fs.String("stun-servers", strings.Join(daemon.DefaultSTUNServers, ","), "Comma-separated STUN servers used to learn the public endpoint (none to disable)")
+	noRelay := fs.Bool("no-relay", false, "Never forward traffic for peers that cannot reach each other directly")
+	metricsListen := fs.String("metrics-listen", "", "Serve Prometheus metrics on this address (e.g. 127.0.0.1:9586)")
 	fs.Parse(os.Args[2:])
 
 	if *secret == "" {
@@ -224,6 +424,12 @@ func joinCmd() {
 		}
 	}
 
+	nodeTags, err := acl.ParseTags(*tags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Create daemon config
 	cfg, err := daemon.NewConfig(daemon.DaemonOpts{
 		Secret:          *secret,
@@ -232,30 +438,62 @@ func joinCmd() {
 		AdvertiseRoutes: routes,
 		LogLevel:        *logLevel,
 		Privacy:         *privacyMode,
+		MeshSubnet:      *meshSubnet,
+		MeshIP:          *meshIP,
+		NodeName:        *nodeName,
+		MeshName:        *meshName,
+		DisableDNS:      *noDNS,
+		Tags:            nodeTags,
+		ACLPolicyFile:   *aclPolicy,
+		AdminKey:        *adminKey,
+		ExitNode:        *exitNode,
+		UseExitNode:     *useExitNode,
+		DisableLAN:      *noLAN,
+		DisableDHT:      *noDHT,
+		DisableGossip:   *noGossip,
+		DHTStaticID:     *dhtStaticID,
+		Registry:        *registry,
+		STUNServers:     parseSTUNServers(*stunServers),
+		DisableRelay:    *noRelay,
+		MetricsListen:   *metricsListen,
 	})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to create config: %v\n", err)
 		os.Exit(1)
 	}
 
-	// Create and run daemon with DHT discovery
+	// Create and run daemon with discovery
 	d, err := daemon.NewDaemon(cfg)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to create daemon: %v\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Println("Initializing mesh node with DHT discovery...")
+	fmt.Printf("Initializing mesh node with discovery (%s)...\n", cfg.DiscoveryLayers())
 	if *privacyMode {
 		fmt.Println("Privacy mode enabled (Dandelion++ relay)")
 	}
 
-	if err := d.RunWithDHTDiscovery(); err != nil {
+	if err := d.RunWithDiscovery(); err != nil {
 		fmt.Fprintf(os.Stderr, "Daemon error: %v\n", err)
 		os.Exit(1)
 	}
 }
 
+// parseSTUNServers parses the --stun-servers flag; "none" or an empty list disables STUN
+func parseSTUNServers(value string) []string {
+	servers := []string{}
+	if value == "none" {
+		return servers
+	}
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
+
 // testPeerCmd tests direct peer exchange connectivity
 func testPeerCmd() {
 	fs := flag.NewFlagSet("test-peer", flag.ExitOnError)
@@ -302,6 +540,15 @@ func testPeerCmd() {
 
 	// Create and send test message
 	announcement := crypto.CreateAnnouncement("test-pubkey", "10.0.0.1", "test:51820", nil, nil)
+	announcement.AttachMembershipToken(cfg.Keys.MembershipKey)
+
+	// Throwaway identity, the peer only checks that the HELLO is self-consistent
+	_, identity, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate identity key: %v\n", err)
+		os.Exit(1)
+	}
+	announcement.Sign(identity)
 	data, err := crypto.SealEnvelope(crypto.MessageTypeHello, announcement, cfg.Keys.GossipKey)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to create message: %v\n", err)
@@ -335,26 +582,58 @@ func testPeerCmd() {
 	// Try to decrypt
 	envelope, reply, err := crypto.OpenEnvelope(buf[:n], cfg.Keys.GossipKey)
 	if err != nil {
+		var versionErr *crypto.ProtocolVersionError
+		if errors.As(err, &versionErr) {
+			fmt.Printf("Peer speaks %s but this node speaks %s: upgrade wgmesh on both nodes\n", versionErr.Version, crypto.ProtocolVersion)
+			os.Exit(1)
+		}
 		fmt.Printf("Failed to decrypt (wrong secret?): %v\n", err)
 		os.Exit(1)
 	}
 
+	if envelope.MessageType == crypto.MessageTypeReject {
+		fmt.Println("Peer rejected the HELLO (protocol version mismatch)")
+		os.Exit(1)
+	}
+	if err := reply.VerifyMembershipToken(cfg.Keys.MembershipKey); err != nil {
+		fmt.Printf("Peer reply failed membership check: %v\n", err)
+		os.Exit(1)
+	}
+	if err := reply.VerifySignature(); err != nil {
+		fmt.Printf("Peer reply failed identity check: %v\n", err)
+		os.Exit(1)
+	}
+
 	fmt.Println("SUCCESS! Peer exchange working!")
 	fmt.Printf("  Message type: %s\n", envelope.MessageType)
 	fmt.Printf("  Peer pubkey: %s\n", reply.WGPubKey)
 	fmt.Printf("  Peer mesh IP: %s\n", reply.MeshIP)
+	fmt.Printf("  Peer identity: %s\n", base64.StdEncoding.EncodeToString(reply.IdentityKey))
 }
 
-// statusCmd handles the "status --secret" subcommand
+// statusCmd handles the "status" subcommand
 func statusCmd() {
 	fs := flag.NewFlagSet("status", flag.ExitOnError)
-	secret := fs.String("secret", "", "Mesh secret (required)")
+	secret := fs.String("secret", "", "Mesh secret (shows derived values when the daemon is not running)")
 	iface := fs.String("interface", "wg0", "WireGuard interface name")
+	jsonOutput := fs.Bool("json", false, "Print raw JSON from the daemon")
 	fs.Parse(os.Args[2:])
 
+	// Prefer live state from the running daemon
+	client := daemon.NewControlClient(daemon.ControlSocketPath(*iface))
+	status, err := client.Status()
+	if err == nil {
+		if *jsonOutput {
+			printJSON(status)
+			return
+		}
+		printDaemonStatus(status)
+		return
+	}
+
 	if *secret == "" {
-		fmt.Fprintln(os.Stderr, "Error: --secret is required")
-		fmt.Fprintln(os.Stderr, "Usage: wgmesh status --secret <SECRET>")
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		fmt.Fprintln(os.Stderr, "Pass --secret to show the values derived from the mesh secret instead.")
 		os.Exit(1)
 	}
 
@@ -368,23 +647,175 @@ func statusCmd() {
 		os.Exit(1)
 	}
 
-	fmt.Printf("Mesh Status\n")
-	fmt.Printf("===========\n")
+	fmt.Printf("Mesh Status (derived from secret, daemon not reachable)\n")
+	fmt.Printf("=======================================================\n")
 	fmt.Printf("Interface: %s\n", cfg.InterfaceName)
 	fmt.Printf("Network ID: %x\n", cfg.Keys.NetworkID[:8])
-	fmt.Printf("Mesh Subnet: 10.%d.0.0/16\n", cfg.Keys.MeshSubnet[0])
+	fmt.Printf("Mesh Subnet: %s\n", cfg.MeshSubnet)
+	fmt.Printf("Mesh Subnet (IPv6): %s/64\n", net.IP(append(cfg.Keys.MeshPrefixV6[:], make([]byte, 8)...)))
 	fmt.Printf("Gossip Port: %d\n", cfg.Keys.GossipPort)
 	fmt.Printf("Rendezvous ID: %x\n", cfg.Keys.RendezvousID)
 	fmt.Println()
 
 	// Show service status if available
-	status, err := daemon.ServiceStatus()
+	serviceStatus, err := daemon.ServiceStatus()
 	if err == nil {
-		fmt.Printf("Service Status: %s\n", status)
+		fmt.Printf("Service Status: %s\n", serviceStatus)
+	}
+}
+
+// printDaemonStatus prints the status reported by a running daemon
+func printDaemonStatus(status *daemon.StatusResponse) {
+	fmt.Printf("Mesh Status\n")
+	fmt.Printf("===========\n")
+	fmt.Printf("Interface: %s (port %d)\n", status.Interface, status.WGListenPort)
+	fmt.Printf("Public Key: %s\n", status.WGPubKey)
+	fmt.Printf("Identity Key: %s\n", status.IdentityKey)
+	if status.Name != "" {
+		fmt.Printf("Name: %s\n", status.Name)
+	}
+	if status.MeshIPReserved {
+		fmt.Printf("Mesh IP: %s (reserved)\n", status.MeshIP)
+	} else {
+		fmt.Printf("Mesh IP: %s\n", status.MeshIP)
+	}
+	if status.MeshIPv6 != "" {
+		fmt.Printf("Mesh IPv6: %s\n", status.MeshIPv6)
+	}
+	fmt.Printf("Network ID: %s\n", status.NetworkID)
+	fmt.Printf("Mesh Subnet: %s\n", status.MeshSubnet)
+	fmt.Printf("Mesh Subnet (IPv6): %s\n", status.MeshSubnetV6)
+	fmt.Printf("Gossip Port: %d\n", status.GossipPort)
+	if status.DNSDomain != "" {
+		fmt.Printf("DNS: %s on %s:%d\n", status.DNSDomain, status.MeshIP, daemon.DNSPort)
+	}
+	if status.ExitNode {
+		fmt.Printf("Exit Node: serving peers\n")
+	}
+	if status.UseExitNode != "" {
+		if status.ExitPeer != "" {
+			fmt.Printf("Exit Node: routing through %s (%s)\n", status.UseExitNode, shortKey(status.ExitPeer))
+		} else {
+			fmt.Printf("Exit Node: waiting for %s\n", status.UseExitNode)
+		}
+	}
+	fmt.Printf("Uptime: %s\n", time.Since(status.StartedAt).Round(time.Second))
+	fmt.Printf("Peers: %d active, %d known\n", status.ActivePeers, status.PeerCount)
+	fmt.Printf("Discovery: %s\n", status.DiscoveryLayers)
+	if len(status.Discovery) > 0 {
+		var out bytes.Buffer
+		if err := json.Indent(&out, status.Discovery, "  ", "  "); err == nil {
+			fmt.Printf("  %s\n", out.String())
+		}
+	}
+
+	if status.Epoch != nil {
+		fmt.Printf("Privacy Epoch: %d (started %s, %d relay peers)\n",
+			status.Epoch.ID, status.Epoch.StartedAt.Format(time.RFC3339), len(status.Epoch.RelayPeers))
+	}
+
+	if status.Rotation != nil {
+		fmt.Printf("Secret Rotation: to network %s, completes %s (%d peers on new secret only)\n",
+			status.Rotation.NewNetworkID, status.Rotation.CompletesAt.Format(time.RFC3339), status.Rotation.NewSecretOnlyPeers)
+	}
+
+	if len(status.Revoked) > 0 {
+		fmt.Printf("Revoked Peers: %d\n", len(status.Revoked))
+	}
+
+	if len(status.Tags) > 0 {
+		fmt.Printf("Tags: %s\n", strings.Join(status.Tags, ", "))
+	}
+	if status.PolicyVersion != 0 {
+		fmt.Printf("ACL Policy: %d rules (version %s)\n", status.PolicyRules, time.Unix(0, status.PolicyVersion).Format(time.RFC3339))
+	}
+
+	if len(status.Collisions) > 0 {
+		fmt.Println("Mesh IP Collisions:")
+		for _, c := range status.Collisions {
+			fmt.Printf("  %s: %s wins over %s\n", c.MeshIP, shortKey(c.Winner), shortKey(c.Loser))
+		}
 	}
 
 	fmt.Println()
-	fmt.Println("(Run 'wg show' to see connected peers)")
+	fmt.Println("(Run 'wgmesh peers' to list discovered peers)")
+}
+
+// peersCmd handles the "peers" subcommand
+func peersCmd() {
+	fs := flag.NewFlagSet("peers", flag.ExitOnError)
+	iface := fs.String("interface", "wg0", "WireGuard interface name")
+	jsonOutput := fs.Bool("json", false, "Print raw JSON from the daemon")
+	fs.Parse(os.Args[2:])
+
+	client := daemon.NewControlClient(daemon.ControlSocketPath(*iface))
+	peers, err := client.Peers()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *jsonOutput {
+		printJSON(peers)
+		return
+	}
+
+	if len(peers) == 0 {
+		fmt.Println("No peers discovered yet")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPUBKEY\tMESH IP\tENDPOINT\tRTT\tLAST SEEN\tVIA")
+	for _, p := range peers {
+		lastSeen := time.Since(p.LastSeen).Round(time.Second).String() + " ago"
+		if !p.Active {
+			lastSeen += " (dead)"
+		}
+		endpoint := p.Endpoint
+		if p.RelayedVia != "" {
+			endpoint += " (relay " + shortKey(p.RelayedVia) + ")"
+		}
+		rtt := "-"
+		if p.LatencyMs > 0 {
+			rtt = fmt.Sprintf("%.1fms", p.LatencyMs)
+		}
+		name := p.Name
+		if name == "" {
+			name = "-"
+		}
+		meshIP := p.MeshIP
+		if p.MeshIPReserved {
+			meshIP += " (reserved)"
+		}
+		if p.Blocked {
+			meshIP += " (acl)"
+		}
+		if p.ExitNode {
+			meshIP += " (exit)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			name, shortKey(p.WGPubKey), meshIP, endpoint, rtt, lastSeen, strings.Join(p.DiscoveredVia, ","))
+	}
+	w.Flush()
+}
+
+// printJSON prints v as indented JSON
+func printJSON(v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encode JSON: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(data))
+}
+
+// shortKey shortens a public key for display
+func shortKey(key string) string {
+	if len(key) > 16 {
+		return key[:16] + "..."
+	}
+	return key
 }
 
 // qrCmd handles the "qr" subcommand - displays secret as a text-based QR code
@@ -455,6 +886,24 @@ func installServiceCmd() {
 	listenPort := fs.Int("listen-port", 51820, "WireGuard listen port")
 	advertiseRoutes := fs.String("advertise-routes", "", "Comma-separated routes to advertise")
 	privacyMode := fs.Bool("privacy", false, "Enable privacy mode")
+	meshSubnet := fs.String("mesh-subnet", "", "IPv4 subnet for mesh IPs (default: from the secret URI, else 10.X.0.0/16)")
+	meshIP := fs.String("mesh-ip", "", "Reserve this mesh IP instead of deriving one")
+	nodeName := fs.String("name", "", "Node name advertised to peers (default: the hostname)")
+	meshName := fs.String("mesh-name", "", "Mesh name in DNS, nodes resolve as <name>.<mesh-name>.mesh (default: the interface name)")
+	noDNS := fs.Bool("no-dns", false, "Do not serve node names over DNS on the mesh IP")
+	tags := fs.String("tags", "", "Comma-separated ACL tags announced to peers (e.g. app,web)")
+	aclPolicy := fs.String("acl-policy", "", "Signed ACL policy (wgmesh acl --out) distributed to the whole mesh")
+	adminKey := fs.String("admin-key", "", "Mesh admin public key allowed to revoke nodes (default: from the secret URI)")
+	exitNode := fs.Bool("advertise-exit-node", false, "Offer peers to route their internet traffic through this node (NAT)")
+	useExitNode := fs.String("use-exit-node", "", "Route internet traffic through this peer (node name or WireGuard public key)")
+	noLAN := fs.Bool("no-lan", false, "Disable LAN multicast discovery")
+	noDHT := fs.Bool("no-dht", false, "Disable BitTorrent DHT discovery")
+	noGossip := fs.Bool("no-gossip", false, "Disable in-mesh gossip")
+	dhtStaticID := fs.Bool("dht-static-id", false, "Use the static DHT network ID (compatibility)")
+	registry := fs.String("registry", "", "Rendezvous registry (github, github://owner/repo or an http(s) URL)")
+	stunServers := fs.String("stun-servers", "", "Comma-separated STUN servers (default: built-in list, none to disable)")
+	noRelay := fs.Bool("no-relay", false, "Never forward traffic for other peers")
+	metricsListen := fs.String("metrics-listen", "", "Serve Prometheus metrics on this address")
 	fs.Parse(os.Args[2:])
 
 	if *secret == "" {
@@ -477,6 +926,24 @@ func installServiceCmd() {
 		ListenPort:      *listenPort,
 		AdvertiseRoutes: routes,
 		Privacy:         *privacyMode,
+		MeshSubnet:      *meshSubnet,
+		MeshIP:          *meshIP,
+		NodeName:        *nodeName,
+		MeshName:        *meshName,
+		NoDNS:           *noDNS,
+		Tags:            *tags,
+		ACLPolicy:       *aclPolicy,
+		AdminKey:        *adminKey,
+		ExitNode:        *exitNode,
+		UseExitNode:     *useExitNode,
+		NoLAN:           *noLAN,
+		NoDHT:           *noDHT,
+		NoGossip:        *noGossip,
+		DHTStaticID:     *dhtStaticID,
+		Registry:        *registry,
+		STUNServers:     *stunServers,
+		NoRelay:         *noRelay,
+		MetricsListen:   *metricsListen,
 	}
 
 	fmt.Println("Installing wgmesh systemd service...")
@@ -502,17 +969,13 @@ func uninstallServiceCmd() {
 // rotateSecretCmd handles the "rotate-secret" subcommand
 func rotateSecretCmd() {
 	fs := flag.NewFlagSet("rotate-secret", flag.ExitOnError)
-	currentSecret := fs.String("current", "", "Current mesh secret (required)")
+	currentSecret := fs.String("current", "", "Current mesh secret (only needed when the daemon is not running)")
 	newSecret := fs.String("new", "", "New mesh secret (auto-generated if empty)")
-	gracePeriod := fs.Duration("grace", 24*time.Hour, "Grace period for dual-secret mode")
+	adminKeyFile := fs.String("admin-key", "", "Mesh admin private key file the rotation is signed with (required to announce it)")
+	gracePeriod := fs.Duration("grace", daemon.DefaultRotationGracePeriod, "Grace period for dual-secret mode")
+	iface := fs.String("interface", "wg0", "WireGuard interface of the running daemon")
 	fs.Parse(os.Args[2:])
 
-	if *currentSecret == "" {
-		fmt.Fprintln(os.Stderr, "Error: --current is required")
-		fmt.Fprintln(os.Stderr, "Usage: wgmesh rotate-secret --current <OLD_SECRET> [--new <NEW_SECRET>] [--grace 24h]")
-		os.Exit(1)
-	}
-
 	// Generate new secret if not provided
 	if *newSecret == "" {
 		secret, err := daemon.GenerateSecret()
@@ -522,33 +985,213 @@ func rotateSecretCmd() {
 		}
 		*newSecret = secret
 	}
+	newURI := daemon.FormatSecretURI(*newSecret)
 
-	// Derive keys from old secret for signing
-	oldKeys, err := crypto.DeriveKeys(*currentSecret)
-	if err != nil {
+	// Hand the signed rotation to the running daemon, which gossips it to
+	// every peer with the new secret sealed to each peer's WireGuard key
+	err := fmt.Errorf("--admin-key is required to announce a rotation")
+	var status daemon.RotationStatus
+	if *adminKeyFile != "" {
+		admin, loadErr := crypto.LoadAdminPrivateKey(*adminKeyFile)
+		if loadErr != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", loadErr)
+			os.Exit(1)
+		}
+		newURI = daemon.FormatSecretURIWithParams(*newSecret, "", crypto.EncodeAdminKey(admin.Public().(ed25519.PublicKey)))
+
+		client := daemon.NewControlClient(daemon.ControlSocketPath(*iface))
+		err = client.Post("/v1/rotate", daemon.RotateRequest{
+			NewSecret:    *newSecret,
+			Announcement: crypto.CreateRotationAnnouncement(admin, *newSecret, *gracePeriod),
+		}, &status)
+	}
+	if err == nil {
+		fmt.Println("Secret Rotation Started")
+		fmt.Println("=======================")
+		fmt.Printf("New Network ID: %s\n", status.NewNetworkID)
+		fmt.Printf("Completes At: %s\n", status.CompletesAt.Local().Format(time.RFC1123))
+		fmt.Printf("New Secret URI: %s\n", newURI)
+		fmt.Println()
+		fmt.Println("The rotation is being announced to all peers over gossip.")
+		fmt.Println("Until it completes, nodes accept both secrets; afterwards they")
+		fmt.Println("switch to the new secret on their own. New nodes should join with:")
+		fmt.Printf("  wgmesh join --secret \"%s\"\n", newURI)
+		return
+	}
+
+	if *currentSecret == "" {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		fmt.Fprintln(os.Stderr, "Run this on a mesh node, or pass --current to get manual rotation instructions.")
+		fmt.Fprintln(os.Stderr, "Usage: wgmesh rotate-secret --admin-key <FILE> [--new <NEW_SECRET>] [--grace 24h] [--interface wg0]")
+		os.Exit(1)
+	}
+
+	// No daemon to announce it: check the current secret and print manual steps
+	if _, err := crypto.DeriveKeys(*currentSecret); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to derive keys from current secret: %v\n", err)
 		os.Exit(1)
 	}
 
-	// Create rotation announcement
-	announcement, err := crypto.GenerateRotationAnnouncement(oldKeys.MembershipKey[:], *newSecret, *gracePeriod)
+	fmt.Println("Daemon not reachable, rotation was not announced")
+	fmt.Println("===============================================")
+	fmt.Printf("New Secret URI: %s\n", newURI)
+	fmt.Println()
+	fmt.Println("Restart every node with the new secret:")
+	fmt.Printf("  wgmesh join --secret \"%s\"\n", newURI)
+}
+
+// revokeCmd handles the "revoke" and "unrevoke" subcommands. The record is
+// signed here with the admin key and handed to the daemon, which gossips it.
+func revokeCmd(lift bool) {
+	name := "revoke"
+	if lift {
+		name = "unrevoke"
+	}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	pubKey := fs.String("pubkey", "", "WireGuard public key of the node (required)")
+	adminKeyFile := fs.String("admin-key", "", "Mesh admin private key file, as written by wgmesh init --admin-key (required)")
+	reason := fs.String("reason", "", "Reason recorded with the revocation (e.g. \"laptop stolen\")")
+	iface := fs.String("interface", "wg0", "WireGuard interface of the running daemon")
+	fs.Parse(os.Args[2:])
+
+	if *pubKey == "" || *adminKeyFile == "" {
+		fmt.Fprintln(os.Stderr, "Error: --pubkey and --admin-key are required")
+		fmt.Fprintf(os.Stderr, "Usage: wgmesh %s --pubkey <WG_PUBKEY> --admin-key <FILE> [--reason <TEXT>] [--interface wg0]\n", name)
+		os.Exit(1)
+	}
+
+	admin, err := crypto.LoadAdminPrivateKey(*adminKeyFile)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create rotation announcement: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
-	_ = announcement // Would be broadcast via gossip in a running mesh
+	client := daemon.NewControlClient(daemon.ControlSocketPath(*iface))
+	if lift {
+		var revocation crypto.Revocation
+		if err := client.Post("/v1/unrevoke", crypto.LiftRevocation(admin, *pubKey, *reason), &revocation); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to lift revocation: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Lifted revocation of %s\n", revocation.WGPubKey)
+		fmt.Println("Peers accept the node again once the record has been gossiped to them.")
+		return
+	}
 
-	newURI := daemon.FormatSecretURI(*newSecret)
+	var revocation crypto.Revocation
+	if err := client.Post("/v1/revoke", crypto.CreateRevocation(admin, *pubKey, *reason), &revocation); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to revoke: %v\n", err)
+		os.Exit(1)
+	}
 
-	fmt.Println("Secret Rotation Initiated")
-	fmt.Println("=========================")
-	fmt.Printf("Grace Period: %v\n", *gracePeriod)
-	fmt.Printf("New Secret URI: %s\n", newURI)
-	fmt.Println()
-	fmt.Println("During the grace period, both secrets will be accepted.")
-	fmt.Printf("After %v, all nodes should use the new secret.\n", *gracePeriod)
-	fmt.Println()
-	fmt.Println("Share the new secret with all nodes:")
-	fmt.Printf("  wgmesh join --secret \"%s\"\n", newURI)
+	fmt.Printf("Revoked %s\n", revocation.WGPubKey)
+	fmt.Println("The revocation is being gossiped to all peers and removes the node everywhere.")
+	fmt.Println("The node still knows the mesh secret: rotate it (wgmesh rotate-secret) if the")
+	fmt.Println("device may be used to rejoin under a new key.")
+}
+
+// aclCmd handles the "acl" subcommand
+func aclCmd() {
+	fs := flag.NewFlagSet("acl", flag.ExitOnError)
+	file := fs.String("file", "", "Policy file to distribute to the mesh (omit to show the current policy)")
+	adminKeyFile := fs.String("admin-key", "", "Mesh admin private key file the policy is signed with (required with --file)")
+	out := fs.String("out", "", "Write the signed policy to this file for --acl-policy instead of distributing it")
+	iface := fs.String("interface", "wg0", "WireGuard interface of the running daemon")
+	fs.Parse(os.Args[2:])
+
+	client := daemon.NewControlClient(daemon.ControlSocketPath(*iface))
+	var update crypto.PolicyUpdate
+
+	if *file == "" {
+		if err := client.Get("/v1/policy", &update); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			fmt.Fprintln(os.Stderr, "Usage: wgmesh acl [--file <POLICY> --admin-key <FILE> [--out <FILE>]] [--interface wg0]")
+			os.Exit(1)
+		}
+		var out bytes.Buffer
+		if err := json.Indent(&out, update.Policy, "", "  "); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to format policy: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("# version %s\n", time.Unix(0, update.Version).Format(time.RFC3339))
+		fmt.Println(out.String())
+		return
+	}
+
+	if *adminKeyFile == "" {
+		fmt.Fprintln(os.Stderr, "Error: --admin-key is required to set a policy")
+		os.Exit(1)
+	}
+	admin, err := crypto.LoadAdminPrivateKey(*adminKeyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Validate locally first for a clear error message, and sign the
+	// re-encoded policy so formatting doesn't make equal policies differ
+	policy, err := acl.Load(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	data, err := json.Marshal(policy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	signed := crypto.CreatePolicyUpdate(admin, data)
+
+	if *out != "" {
+		encoded, err := json.MarshalIndent(signed, "", "  ")
+		if err == nil {
+			err = os.WriteFile(*out, append(encoded, '\n'), 0644)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write policy: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Signed ACL policy written to %s: %d rules\n", *out, len(policy.Rules))
+		fmt.Println("Start nodes with --acl-policy pointing at it to distribute it on start-up.")
+		return
+	}
+
+	if err := client.Post("/v1/policy", signed, &update); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set policy: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("ACL policy set: %d rules\n", len(policy.Rules))
+	fmt.Println("The policy is being gossiped to all peers; each node filters its WireGuard")
+	fmt.Println("interface with nftables and drops peerings the policy does not allow.")
+}
+
+// registryServerCmd runs a self-hosted rendezvous registry
+func registryServerCmd() {
+	fs := flag.NewFlagSet("registry-server", flag.ExitOnError)
+	listen := fs.String("listen", ":8765", "Address to serve the registry API on")
+	store := fs.String("store", "/var/lib/wgmesh/registry.json", "File to store the encrypted peer lists in")
+	token := fs.String("token", os.Getenv(discovery.RegistryTokenEnv), "Bearer token clients must send (default $"+discovery.RegistryTokenEnv+")")
+	fs.Parse(os.Args[2:])
+
+	rs, err := discovery.NewRegistryServer(*listen, *store, *token)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create registry server: %v\n", err)
+		os.Exit(1)
+	}
+	if err := rs.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start registry server: %v\n", err)
+		os.Exit(1)
+	}
+	if *token == "" {
+		fmt.Println("Warning: no --token set, anyone who can reach the registry can overwrite entries")
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
+
+	if err := rs.Stop(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to stop registry server: %v\n", err)
+	}
 }
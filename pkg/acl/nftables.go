@@ -0,0 +1,161 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Firewall describes the WireGuard interface of one node and the peers that
+// may send traffic through it
+type Firewall struct {
+	Interface string
+	Local     Node
+	Peers     []Node
+
+	// ControlPorts are UDP ports open to every peer regardless of the
+	// policy, e.g. mesh gossip and DNS
+	ControlPorts []int
+}
+
+// TableName returns the nftables table holding the rules for an interface
+func TableName(iface string) string {
+	return "wgmesh_" + strings.NewReplacer("-", "_", ".", "_").Replace(iface)
+}
+
+// Compile turns the policy into an nftables script for the local node. The
+// script replaces the interface's table atomically. Only traffic arriving on
+// the WireGuard interface is filtered; replies, pings and the control ports
+// always pass. Traffic the node forwards from the interface, to advertised
+// routes or the internet as an exit node, passes the same rules as traffic
+// to the node itself; traffic relayed from one peer to another is left to
+// the rules of the receiving peer.
+func Compile(p *Policy, fw Firewall) string {
+	table := TableName(fw.Interface)
+	iif := fmt.Sprintf("iifname %q", fw.Interface)
+
+	var b strings.Builder
+	// Creating the table first makes the delete succeed on the first run
+	fmt.Fprintf(&b, "table inet %s\n", table)
+	fmt.Fprintf(&b, "delete table inet %s\n", table)
+	fmt.Fprintf(&b, "table inet %s {\n", table)
+	b.WriteString("\tchain input {\n")
+	b.WriteString("\t\ttype filter hook input priority filter; policy accept;\n")
+	fmt.Fprintf(&b, "\t\t%s ct state established,related accept\n", iif)
+	fmt.Fprintf(&b, "\t\t%s icmp type echo-request accept\n", iif)
+	fmt.Fprintf(&b, "\t\t%s icmpv6 type echo-request accept\n", iif)
+	if len(fw.ControlPorts) > 0 {
+		ports := make([]string, len(fw.ControlPorts))
+		for i, port := range fw.ControlPorts {
+			ports[i] = strconv.Itoa(port)
+		}
+		fmt.Fprintf(&b, "\t\t%s udp dport { %s } accept\n", iif, strings.Join(ports, ", "))
+	}
+	writeRules(&b, p, fw, iif)
+	b.WriteString("\t}\n")
+
+	b.WriteString("\tchain forward {\n")
+	b.WriteString("\t\ttype filter hook forward priority filter; policy accept;\n")
+	fmt.Fprintf(&b, "\t\t%s ct state established,related accept\n", iif)
+	fmt.Fprintf(&b, "\t\t%s oifname %q accept\n", iif, fw.Interface)
+	writeRules(&b, p, fw, iif)
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// writeRules writes the accept rules for peers allowed to reach the local
+// node, followed by a drop of everything else arriving on the interface
+func writeRules(b *strings.Builder, p *Policy, fw Firewall, iif string) {
+	for _, rule := range p.Rules {
+		if !matches(rule.To, fw.Local.Tags) {
+			continue
+		}
+		var v4, v6 []string
+		for _, peer := range fw.Peers {
+			if !matches(rule.From, peer.Tags) {
+				continue
+			}
+			for _, addr := range peer.Addrs {
+				ip := net.ParseIP(addr)
+				switch {
+				case ip == nil:
+				case ip.To4() != nil:
+					v4 = append(v4, addr)
+				default:
+					v6 = append(v6, addr)
+				}
+			}
+		}
+
+		fmt.Fprintf(b, "\t\t# %s -> %s %s\n", strings.Join(rule.From, ","), strings.Join(rule.To, ","), ruleService(rule))
+		match := ruleMatch(rule)
+		if len(v4) > 0 {
+			fmt.Fprintf(b, "\t\t%s ip saddr { %s }%s accept\n", iif, joinSorted(v4), match)
+		}
+		if len(v6) > 0 {
+			fmt.Fprintf(b, "\t\t%s ip6 saddr { %s }%s accept\n", iif, joinSorted(v6), match)
+		}
+	}
+
+	fmt.Fprintf(b, "\t\t%s drop\n", iif)
+}
+
+// ruleMatch returns the protocol and port match of a rule, with a leading space
+func ruleMatch(rule Rule) string {
+	ports := strings.Join(rule.Ports, ", ")
+	switch {
+	case rule.Proto == "icmp":
+		return " meta l4proto { icmp, ipv6-icmp }"
+	case rule.Proto != "" && len(rule.Ports) > 0:
+		return fmt.Sprintf(" %s dport { %s }", rule.Proto, ports)
+	case rule.Proto != "":
+		return " meta l4proto " + rule.Proto
+	case len(rule.Ports) > 0:
+		return fmt.Sprintf(" meta l4proto { tcp, udp } th dport { %s }", ports)
+	default:
+		return ""
+	}
+}
+
+// ruleService describes the protocol and ports of a rule for comments
+func ruleService(rule Rule) string {
+	proto := rule.Proto
+	if proto == "" {
+		proto = "any"
+	}
+	if len(rule.Ports) == 0 {
+		return proto
+	}
+	return proto + "/" + strings.Join(rule.Ports, ",")
+}
+
+func joinSorted(values []string) string {
+	sort.Strings(values)
+	return strings.Join(values, ", ")
+}
+
+// Apply loads a compiled script with nft
+func Apply(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to apply nftables rules: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
+// Remove deletes the interface's table, if there is one
+func Remove(iface string) error {
+	cmd := exec.Command("nft", "delete", "table", "inet", TableName(iface))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if strings.Contains(string(output), "No such file or directory") {
+			return nil
+		}
+		return fmt.Errorf("failed to remove nftables rules: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+// Package acl implements tag-based access policies between mesh nodes.
+//
+// Nodes carry tags. A policy lists which tags may open connections to which
+// other tags, optionally limited to protocols and ports. Without a policy
+// every node may reach every other node; with one, everything not allowed by
+// a rule is dropped on the WireGuard interface of the receiving node.
+//
+// Nodes announce their own tags, so any mesh member can claim any tag. A
+// policy that assigns tags to public keys (Policy.Tags) takes that authority
+// away from the nodes: then only the assigned tags count.
+package acl
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TagPrefix marks a selector that matches nodes by tag
+const TagPrefix = "tag:"
+
+// Wildcard matches every node
+const Wildcard = "*"
+
+// Policy is a set of rules; traffic not allowed by any rule is dropped
+type Policy struct {
+	Rules []Rule `json:"rules"`
+
+	// Tags assigns tags to nodes by WireGuard public key. If set, it is the
+	// only source of tags: announced tags are ignored and unlisted nodes
+	// have none.
+	Tags map[string][]string `json:"tags,omitempty"`
+}
+
+// Rule lets nodes matching From open connections to nodes matching To.
+// Selectors are "tag:<tag>" or "*". An empty Proto means TCP and UDP (or any
+// protocol when there are no ports), empty Ports means all ports.
+type Rule struct {
+	From  []string `json:"from"`
+	To    []string `json:"to"`
+	Proto string   `json:"proto,omitempty"` // tcp, udp or icmp
+	Ports []string `json:"ports,omitempty"` // "5432" or "8000-8100"
+}
+
+// Node is a mesh node as seen by the policy
+type Node struct {
+	Name  string
+	Tags  []string
+	Addrs []string // mesh IPv4 and IPv6 addresses
+}
+
+// Parse parses and validates a JSON policy
+func Parse(data []byte) (*Policy, error) {
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Load reads a policy file
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %w", err)
+	}
+	return Parse(data)
+}
+
+// Validate checks selectors, protocols and ports of all rules
+func (p *Policy) Validate() error {
+	for i, rule := range p.Rules {
+		if len(rule.From) == 0 || len(rule.To) == 0 {
+			return fmt.Errorf("rule %d: from and to are required", i+1)
+		}
+		for _, sel := range append(append([]string{}, rule.From...), rule.To...) {
+			if !validSelector(sel) {
+				return fmt.Errorf("rule %d: invalid selector %q, use tag:<name> or *", i+1, sel)
+			}
+		}
+		switch rule.Proto {
+		case "", "tcp", "udp":
+		case "icmp":
+			if len(rule.Ports) > 0 {
+				return fmt.Errorf("rule %d: icmp has no ports", i+1)
+			}
+		default:
+			return fmt.Errorf("rule %d: unsupported protocol %q", i+1, rule.Proto)
+		}
+		for _, port := range rule.Ports {
+			if _, _, err := parsePortRange(port); err != nil {
+				return fmt.Errorf("rule %d: %w", i+1, err)
+			}
+		}
+	}
+	for key, tags := range p.Tags {
+		if key == "" {
+			return fmt.Errorf("tags: empty public key")
+		}
+		for _, tag := range tags {
+			if !ValidTag(tag) {
+				return fmt.Errorf("tags of %s: invalid tag %q", key, tag)
+			}
+		}
+	}
+	return nil
+}
+
+// NodeTags returns the tags that count for a node: the ones the policy
+// assigns to its public key if the policy assigns any, else the announced ones
+func (p *Policy) NodeTags(wgPubKey string, announced []string) []string {
+	if p == nil || len(p.Tags) == 0 {
+		return announced
+	}
+	return p.Tags[wgPubKey]
+}
+
+// Allows reports whether any rule lets from open connections to to
+func (p *Policy) Allows(from, to []string) bool {
+	for _, rule := range p.Rules {
+		if matches(rule.From, from) && matches(rule.To, to) {
+			return true
+		}
+	}
+	return false
+}
+
+// Connected reports whether two nodes need a WireGuard peering at all, i.e.
+// whether either of them may reach the other. A nil policy connects everyone.
+func (p *Policy) Connected(a, b []string) bool {
+	if p == nil {
+		return true
+	}
+	return p.Allows(a, b) || p.Allows(b, a)
+}
+
+// ValidTag reports whether tag can be announced: lowercase letters, digits,
+// hyphens and underscores
+func ValidTag(tag string) bool {
+	if tag == "" || len(tag) > 63 {
+		return false
+	}
+	for _, c := range tag {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseTags parses a comma-separated tag list, with or without the tag: prefix
+func ParseTags(value string) ([]string, error) {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), TagPrefix)
+		if tag == "" {
+			continue
+		}
+		if !ValidTag(tag) {
+			return nil, fmt.Errorf("invalid tag %q: use lowercase letters, digits, hyphens and underscores", tag)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+func validSelector(sel string) bool {
+	if sel == Wildcard {
+		return true
+	}
+	tag, ok := strings.CutPrefix(sel, TagPrefix)
+	return ok && ValidTag(tag)
+}
+
+// matches reports whether a node with tags matches any of the selectors
+func matches(selectors, tags []string) bool {
+	for _, sel := range selectors {
+		if sel == Wildcard {
+			return true
+		}
+		for _, tag := range tags {
+			if sel == TagPrefix+tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parsePortRange parses "443" or "8000-8100"
+func parsePortRange(value string) (int, int, error) {
+	lo, hi, isRange := strings.Cut(value, "-")
+	first, err := strconv.Atoi(lo)
+	if err != nil || first < 1 || first > 65535 {
+		return 0, 0, fmt.Errorf("invalid port %q", value)
+	}
+	if !isRange {
+		return first, first, nil
+	}
+	last, err := strconv.Atoi(hi)
+	if err != nil || last < first || last > 65535 {
+		return 0, 0, fmt.Errorf("invalid port range %q", value)
+	}
+	return first, last, nil
+}
@@ -0,0 +1,172 @@
+package acl
+
+import (
+	"strings"
+	"testing"
+)
+
+const testPolicy = `{
+	"rules": [
+		{"from": ["tag:app"], "to": ["tag:db"], "proto": "tcp", "ports": ["5432"]},
+		{"from": ["tag:ops"], "to": ["*"]}
+	]
+}`
+
+func TestParse(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if len(p.Rules) != 2 {
+		t.Fatalf("Expected 2 rules, got %d", len(p.Rules))
+	}
+
+	invalid := []string{
+		`{"rules": [{"from": ["app"], "to": ["tag:db"]}]}`,
+		`{"rules": [{"from": ["tag:app"], "to": []}]}`,
+		`{"rules": [{"from": ["tag:app"], "to": ["tag:db"], "proto": "sctp"}]}`,
+		`{"rules": [{"from": ["tag:app"], "to": ["tag:db"], "proto": "icmp", "ports": ["1"]}]}`,
+		`{"rules": [{"from": ["tag:app"], "to": ["tag:db"], "ports": ["70000"]}]}`,
+		`{"rules": [{"from": ["tag:app"], "to": ["tag:db"], "ports": ["90-80"]}]}`,
+		`{"rules": [{"from": ["tag:App"], "to": ["tag:db"]}]}`,
+		`not json`,
+	}
+	for _, data := range invalid {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("Expected %s to be rejected", data)
+		}
+	}
+}
+
+func TestAllowsAndConnected(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	app, db, ops, web := []string{"app"}, []string{"db"}, []string{"ops"}, []string{"web"}
+
+	if !p.Allows(app, db) {
+		t.Error("app should reach db")
+	}
+	if p.Allows(db, app) {
+		t.Error("db should not open connections to app")
+	}
+	if !p.Connected(db, app) {
+		t.Error("db and app need a peering for app's connections")
+	}
+	if p.Connected(web, db) {
+		t.Error("web and db should not be connected")
+	}
+	if !p.Connected(ops, web) {
+		t.Error("ops should reach every node")
+	}
+	if p.Connected(nil, db) {
+		t.Error("Untagged nodes should match no tag selector")
+	}
+
+	var none *Policy
+	if !none.Connected(web, db) {
+		t.Error("Without a policy every node should be connected")
+	}
+}
+
+func TestNodeTags(t *testing.T) {
+	var none *Policy
+	if got := none.NodeTags("key1", []string{"ops"}); len(got) != 1 || got[0] != "ops" {
+		t.Errorf("Without a policy announced tags should count, got %v", got)
+	}
+
+	p, err := Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if got := p.NodeTags("key1", []string{"ops"}); len(got) != 1 || got[0] != "ops" {
+		t.Errorf("Without assignments announced tags should count, got %v", got)
+	}
+
+	p, err = Parse([]byte(`{"rules": [{"from": ["tag:ops"], "to": ["*"]}], "tags": {"key1": ["ops"]}}`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if got := p.NodeTags("key1", nil); len(got) != 1 || got[0] != "ops" {
+		t.Errorf("Expected the assigned tags, got %v", got)
+	}
+	if got := p.NodeTags("key2", []string{"ops"}); len(got) != 0 {
+		t.Errorf("Announced tags should be ignored once tags are assigned, got %v", got)
+	}
+
+	if _, err := Parse([]byte(`{"rules": [], "tags": {"key1": ["Ops"]}}`)); err == nil {
+		t.Error("Expected an invalid assigned tag to be rejected")
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tags, err := ParseTags(" web, tag:app,web ,, ")
+	if err != nil {
+		t.Fatalf("ParseTags failed: %v", err)
+	}
+	if strings.Join(tags, ",") != "app,web" {
+		t.Errorf("Expected app,web, got %v", tags)
+	}
+
+	if _, err := ParseTags("web,Not Valid"); err == nil {
+		t.Error("Expected invalid tags to be rejected")
+	}
+}
+
+func TestCompile(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	script := Compile(p, Firewall{
+		Interface: "wg0",
+		Local:     Node{Name: "db1", Tags: []string{"db"}},
+		Peers: []Node{
+			{Name: "app2", Tags: []string{"app"}, Addrs: []string{"10.42.0.3"}},
+			{Name: "app1", Tags: []string{"app"}, Addrs: []string{"10.42.0.2", "fd00::2"}},
+			{Name: "web", Tags: []string{"web"}, Addrs: []string{"10.42.0.4"}},
+			{Name: "ops", Tags: []string{"ops"}, Addrs: []string{"10.42.0.5"}},
+		},
+		ControlPorts: []int{51821, 53},
+	})
+
+	for _, want := range []string{
+		"table inet wgmesh_wg0 {",
+		`iifname "wg0" udp dport { 51821, 53 } accept`,
+		`iifname "wg0" ip saddr { 10.42.0.2, 10.42.0.3 } tcp dport { 5432 } accept`,
+		`iifname "wg0" ip6 saddr { fd00::2 } tcp dport { 5432 } accept`,
+		`iifname "wg0" ip saddr { 10.42.0.5 } accept`,
+		`iifname "wg0" drop`,
+		"chain forward {",
+		`iifname "wg0" oifname "wg0" accept`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("Expected script to contain %q:\n%s", want, script)
+		}
+	}
+	if strings.Contains(script, "10.42.0.4") {
+		t.Errorf("web should not be allowed in:\n%s", script)
+	}
+
+	// Forwarded traffic passes the same rules as traffic to the node
+	_, forward, _ := strings.Cut(script, "chain forward {")
+	for _, want := range []string{
+		`iifname "wg0" ip saddr { 10.42.0.2, 10.42.0.3 } tcp dport { 5432 } accept`,
+		`iifname "wg0" drop`,
+	} {
+		if !strings.Contains(forward, want) {
+			t.Errorf("Expected forward chain to contain %q:\n%s", want, forward)
+		}
+	}
+
+	// A node matched by no rule's destination only accepts replies and control traffic
+	script = Compile(p, Firewall{Interface: "wg0", Local: Node{Tags: []string{"web"}}, Peers: []Node{
+		{Tags: []string{"app"}, Addrs: []string{"10.42.0.2"}},
+	}})
+	if strings.Contains(script, "saddr") {
+		t.Errorf("Expected no peer rules for web:\n%s", script)
+	}
+}
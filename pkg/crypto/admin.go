@@ -0,0 +1,66 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The mesh admin key is an Ed25519 key pair kept by the operator. Its public
+// half is pinned on every node (secret URI parameter "admin" or --admin-key),
+// and only updates signed with the private half are accepted for actions that
+// must not be open to every member, such as revoking nodes. Unlike the mesh
+// secret it never leaves the operator's machine and survives rotations.
+
+// GenerateAdminKey creates a new admin key pair
+func GenerateAdminKey() (ed25519.PublicKey, ed25519.PrivateKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate admin key: %w", err)
+	}
+	return pub, priv, nil
+}
+
+// EncodeAdminKey encodes an admin public key as unpadded base64url, to be
+// used in secret URIs and on the command line
+func EncodeAdminKey(pub ed25519.PublicKey) string {
+	return base64.RawURLEncoding.EncodeToString(pub)
+}
+
+// ParseAdminKey decodes an admin public key in base64url or standard base64
+func ParseAdminKey(s string) (ed25519.PublicKey, error) {
+	s = strings.TrimRight(strings.TrimSpace(s), "=")
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		raw, err = base64.RawStdEncoding.DecodeString(s)
+	}
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid admin key %q: expected a base64 Ed25519 public key", s)
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// SaveAdminPrivateKey writes an admin private key to a file readable only by its owner
+func SaveAdminPrivateKey(path string, priv ed25519.PrivateKey) error {
+	data := base64.StdEncoding.EncodeToString(priv) + "\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		return fmt.Errorf("failed to write admin key: %w", err)
+	}
+	return nil
+}
+
+// LoadAdminPrivateKey reads an admin private key written by SaveAdminPrivateKey
+func LoadAdminPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read admin key: %w", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(raw) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid admin key in %s", path)
+	}
+	return ed25519.PrivateKey(raw), nil
+}
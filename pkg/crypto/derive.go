@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"net"
 	"time"
 
 	"golang.org/x/crypto/hkdf"
@@ -19,6 +20,7 @@ type DerivedKeys struct {
 	NetworkID     [20]byte // DHT infohash (20 bytes for BEP 5)
 	GossipKey     [32]byte // Symmetric encryption key for peer exchange
 	MeshSubnet    [2]byte  // Deterministic /16 subnet
+	MeshPrefixV6  [8]byte  // Deterministic ULA /64 prefix (fd00::/8)
 	MulticastID   [4]byte  // Multicast group discriminator
 	PSK           [32]byte // WireGuard PresharedKey
 	GossipPort    uint16   // In-mesh gossip port
@@ -49,6 +51,12 @@ func DeriveKeys(secret string) (*DerivedKeys, error) {
 		return nil, fmt.Errorf("failed to derive mesh subnet: %w", err)
 	}
 
+	// mesh_prefix_v6 = fd || HKDF(secret, salt="wgmesh-ula-v1", 7 bytes)
+	keys.MeshPrefixV6[0] = 0xfd
+	if err := deriveHKDF(secret, "wgmesh-ula-v1", keys.MeshPrefixV6[1:]); err != nil {
+		return nil, fmt.Errorf("failed to derive IPv6 mesh prefix: %w", err)
+	}
+
 	// multicast_id = HKDF(secret, salt="wgmesh-mcast-v1", 4 bytes)
 	if err := deriveHKDF(secret, "wgmesh-mcast-v1", keys.MulticastID[:]); err != nil {
 		return nil, fmt.Errorf("failed to derive multicast ID: %w", err)
@@ -116,29 +124,91 @@ func GetCurrentAndPreviousNetworkIDs(secret string) (current, previous [20]byte,
 	return current, previous, nil
 }
 
+// GetDHTNetworkIDs returns the hourly network IDs a node should announce and
+// query at time t. Besides the current and previous hour it includes the next
+// hour once t is within skew of the rollover, so nodes whose clocks are a few
+// minutes apart still share at least one ID.
+func GetDHTNetworkIDs(secret string, t time.Time, skew time.Duration) ([][20]byte, error) {
+	var ids [][20]byte
+	for _, at := range []time.Time{t, t.Add(-1 * time.Hour), t.Add(skew)} {
+		id, err := DeriveNetworkIDWithTime(secret, at)
+		if err != nil {
+			return nil, err
+		}
+		if !containsNetworkID(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// containsNetworkID reports whether id is in ids
+func containsNetworkID(ids [][20]byte, id [20]byte) bool {
+	for _, existing := range ids {
+		if existing == id {
+			return true
+		}
+	}
+	return false
+}
+
 // DeriveMeshIP derives a deterministic mesh IP from WG public key and secret
 // mesh_ip = mesh_subnet_base + uint16(SHA256(wg_pubkey || secret)[0:2])
 func DeriveMeshIP(meshSubnet [2]byte, wgPubKey, secret string) string {
-	input := wgPubKey + secret
-	hash := sha256.Sum256([]byte(input))
+	return DeriveMeshIPInSubnet(DefaultMeshSubnet(meshSubnet), wgPubKey, secret)
+}
+
+// DefaultMeshSubnet returns the 10.X.0.0/16 mesh subnet derived from the secret
+func DefaultMeshSubnet(meshSubnet [2]byte) *net.IPNet {
+	return &net.IPNet{
+		IP:   net.IPv4(10, meshSubnet[0], 0, 0).To4(),
+		Mask: net.CIDRMask(16, 32),
+	}
+}
+
+// DeriveMeshIPInSubnet derives a deterministic mesh IP within an IPv4 subnet.
+// The host part is the leading bits of SHA256(wg_pubkey || secret), so in a
+// /16 the address is the same as with DeriveMeshIP.
+func DeriveMeshIPInSubnet(subnet *net.IPNet, wgPubKey, secret string) string {
+	hash := sha256.Sum256([]byte(wgPubKey + secret))
+	return MeshIPFromHash(subnet, hash[:])
+}
+
+// MeshIPFromHash places the leading bits of hash in the host part of subnet,
+// avoiding the network and broadcast addresses. subnet must be IPv4 and leave
+// at least two host bits.
+func MeshIPFromHash(subnet *net.IPNet, hash []byte) string {
+	ones, _ := subnet.Mask.Size()
+	hostMax := uint32(1)<<(32-ones) - 1
+
+	host := binary.BigEndian.Uint32(hash[:4]) >> ones
+	if host == 0 {
+		host = 1
+	} else if host == hostMax {
+		host = hostMax - 1
+	}
+
+	base := binary.BigEndian.Uint32(subnet.IP.To4()) &^ hostMax
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, base|host)
+	return ip.String()
+}
+
+// DeriveMeshIPv6 derives a deterministic IPv6 mesh address in the ULA prefix
+// mesh_ipv6 = mesh_prefix_v6 || SHA256("wgmesh-ipv6|" || wg_pubkey || secret)[0:8]
+func DeriveMeshIPv6(meshPrefix [8]byte, wgPubKey, secret string) string {
+	hash := sha256.Sum256([]byte("wgmesh-ipv6|" + wgPubKey + secret))
 
-	// Use first two bytes for IP suffix
-	suffix := binary.BigEndian.Uint16(hash[:2])
+	ip := make(net.IP, net.IPv6len)
+	copy(ip[:8], meshPrefix[:])
+	copy(ip[8:], hash[:8])
 
-	// Ensure we don't use .0 or .255
-	if suffix == 0 {
-		suffix = 1
-	} else if suffix == 65535 {
-		suffix = 65534
+	// The all-zero interface ID is the subnet-router anycast address
+	if binary.BigEndian.Uint64(ip[8:]) == 0 {
+		ip[15] = 1
 	}
 
-	// Build IP: 10.subnet[0].high(suffix).low(suffix)
-	// We use 10.x.y.z format where x is from meshSubnet[0], y.z are from suffix
-	return fmt.Sprintf("10.%d.%d.%d",
-		meshSubnet[0],
-		(suffix>>8)&0xFF,
-		suffix&0xFF,
-	)
+	return ip.String()
 }
 
 // deriveHKDF derives key material using HKDF-SHA256
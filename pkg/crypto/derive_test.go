@@ -1,6 +1,8 @@
 package crypto
 
 import (
+	"fmt"
+	"net"
 	"testing"
 	"time"
 )
@@ -128,6 +130,33 @@ func TestGetCurrentAndPreviousNetworkIDs(t *testing.T) {
 	}
 }
 
+func TestGetDHTNetworkIDsAcrossRollover(t *testing.T) {
+	secret := "test-secret-that-is-long-enough"
+	skew := 5 * time.Minute
+	hourStart := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// Mid-hour: current and previous hour only
+	ids, err := GetDHTNetworkIDs(secret, hourStart.Add(30*time.Minute), skew)
+	if err != nil {
+		t.Fatalf("GetDHTNetworkIDs failed: %v", err)
+	}
+	if len(ids) != 2 {
+		t.Errorf("Expected 2 network IDs mid-hour, got %d", len(ids))
+	}
+
+	// A node just before the rollover and one whose clock is already past it
+	// must have an ID in common
+	before, _ := GetDHTNetworkIDs(secret, hourStart.Add(-2*time.Minute), skew)
+	after, _ := GetDHTNetworkIDs(secret, hourStart.Add(2*time.Minute), skew)
+	if len(before) != 3 {
+		t.Errorf("Expected 3 network IDs near the rollover, got %d", len(before))
+	}
+	next, _ := DeriveNetworkIDWithTime(secret, hourStart)
+	if before[2] != next || after[0] != next {
+		t.Error("Nodes on either side of the rollover should share the new hour's ID")
+	}
+}
+
 func TestDeriveMeshIP(t *testing.T) {
 	meshSubnet := [2]byte{42, 0}
 	ip1 := DeriveMeshIP(meshSubnet, "pubkey1", "test-secret-that-is-long-enough")
@@ -150,6 +179,56 @@ func TestDeriveMeshIP(t *testing.T) {
 	}
 }
 
+func TestDeriveMeshIPInSubnet(t *testing.T) {
+	secret := "test-secret-that-is-long-enough"
+
+	// The default /16 keeps the addresses of DeriveMeshIP
+	if got, want := DeriveMeshIPInSubnet(DefaultMeshSubnet([2]byte{42, 0}), "pubkey1", secret), DeriveMeshIP([2]byte{42, 0}, "pubkey1", secret); got != want {
+		t.Errorf("Expected %s in the default subnet, got %s", want, got)
+	}
+
+	_, cgnat, _ := net.ParseCIDR("100.64.0.0/10")
+	for i := 0; i < 100; i++ {
+		ip := DeriveMeshIPInSubnet(cgnat, fmt.Sprintf("pubkey%d", i), secret)
+		if !cgnat.Contains(net.ParseIP(ip)) {
+			t.Fatalf("Mesh IP %s is outside %s", ip, cgnat)
+		}
+	}
+
+	// A /30 only has two usable addresses
+	_, small, _ := net.ParseCIDR("192.168.7.4/30")
+	for i := 0; i < 100; i++ {
+		ip := DeriveMeshIPInSubnet(small, fmt.Sprintf("pubkey%d", i), secret)
+		if ip != "192.168.7.5" && ip != "192.168.7.6" {
+			t.Fatalf("Expected a host address of %s, got %s", small, ip)
+		}
+	}
+}
+
+func TestDeriveMeshIPv6(t *testing.T) {
+	keys, err := DeriveKeys("test-secret-that-is-long-enough")
+	if err != nil {
+		t.Fatalf("DeriveKeys failed: %v", err)
+	}
+	if keys.MeshPrefixV6[0] != 0xfd {
+		t.Fatalf("Expected a ULA prefix, got %x", keys.MeshPrefixV6)
+	}
+
+	ip1 := DeriveMeshIPv6(keys.MeshPrefixV6, "pubkey1", "test-secret-that-is-long-enough")
+	ip2 := DeriveMeshIPv6(keys.MeshPrefixV6, "pubkey2", "test-secret-that-is-long-enough")
+	if ip1 == ip2 {
+		t.Error("Different pubkeys should produce different IPv6 mesh addresses")
+	}
+	if ip1 != DeriveMeshIPv6(keys.MeshPrefixV6, "pubkey1", "test-secret-that-is-long-enough") {
+		t.Error("Same inputs should produce the same IPv6 mesh address")
+	}
+
+	_, prefix, _ := net.ParseCIDR(net.IP(append(keys.MeshPrefixV6[:], make([]byte, 8)...)).String() + "/64")
+	if !prefix.Contains(net.ParseIP(ip1)) {
+		t.Errorf("Address %s is not in the mesh prefix %s", ip1, prefix)
+	}
+}
+
 func TestGossipPortRange(t *testing.T) {
 	// Test that gossip port is in expected range
 	keys, _ := DeriveKeys("test-secret-that-is-long-enough")
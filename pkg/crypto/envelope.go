@@ -3,8 +3,10 @@ package crypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"time"
@@ -13,28 +15,66 @@ import (
 const (
 	NonceSize           = 12
 	MaxMessageAge       = 10 * time.Minute
-	ProtocolVersion     = "wgmesh-v1"
+	ProtocolVersion     = "wgmesh-v3" // v2 adds membership tokens, v3 signed node identities
 	MessageTypeHello    = "HELLO"
 	MessageTypeReply    = "REPLY"
 	MessageTypeAnnounce = "ANNOUNCE"
+	MessageTypeReject   = "REJECT" // sent in response to a HELLO with an unsupported protocol version
+	MessageTypeRotate   = "ROTATE" // carries a RotationAnnouncement instead of a PeerAnnouncement
+	MessageTypeRevoke   = "REVOKE" // carries a list of Revocations
+	MessageTypeStem     = "STEM"   // carries a Dandelion++ stem-phase announcement (privacy mode)
+	MessageTypePunch    = "PUNCH"  // coordinates UDP hole punching between two peers
+	MessageTypePolicy   = "POLICY" // carries a PolicyUpdate
 )
 
+// ProtocolVersionError is returned by OpenEnvelope when a message decrypts
+// correctly (same secret) but was sent by a node speaking another protocol version
+type ProtocolVersionError struct {
+	MessageType string
+	Version     string
+}
+
+func (e *ProtocolVersionError) Error() string {
+	return fmt.Sprintf("unsupported protocol version %q in %s message (we speak %q)", e.Version, e.MessageType, ProtocolVersion)
+}
+
+// ErrInvalidMembershipToken is returned when an announcement's token does not match its WG pubkey
+var ErrInvalidMembershipToken = errors.New("invalid membership token")
+
+// ErrInvalidSignature is returned when an announcement is not signed by the identity key it carries
+var ErrInvalidSignature = errors.New("invalid identity signature")
+
 // PeerAnnouncement is the encrypted message format for peer discovery
 type PeerAnnouncement struct {
 	Protocol         string      `json:"protocol"`
 	WGPubKey         string      `json:"wg_pubkey"`
+	Name             string      `json:"name,omitempty"` // node name chosen by the operator, defaults to the hostname
 	MeshIP           string      `json:"mesh_ip"`
+	MeshIPNonce      int         `json:"mesh_ip_nonce,omitempty"`    // collision nonce the mesh IP was derived with
+	MeshIPReserved   bool        `json:"mesh_ip_reserved,omitempty"` // mesh IP is a static reservation, not derived
+	MeshIPv6         string      `json:"mesh_ipv6,omitempty"`
 	WGEndpoint       string      `json:"wg_endpoint"`
+	Endpoints        []string    `json:"endpoints,omitempty"` // candidate endpoints: LAN, public (STUN) and IPv6 addresses
 	RoutableNetworks []string    `json:"routable_networks,omitempty"`
+	Tags             []string    `json:"tags,omitempty"` // ACL tags of the sender
 	Timestamp        int64       `json:"timestamp"`
 	KnownPeers       []KnownPeer `json:"known_peers,omitempty"`
+	RelayCapable     bool        `json:"relay_capable,omitempty"` // sender is publicly reachable and forwards for others
+	ExitNode         bool        `json:"exit_node,omitempty"`     // sender routes internet traffic for peers
+	MembershipToken  []byte      `json:"membership_token,omitempty"`
+	IdentityKey      []byte      `json:"identity_key,omitempty"` // sender's Ed25519 public key
+	Signature        []byte      `json:"signature,omitempty"`    // Ed25519 signature over all other fields
 }
 
 // KnownPeer represents a peer that this node knows about (for transitive discovery)
 type KnownPeer struct {
-	WGPubKey   string `json:"wg_pubkey"`
-	MeshIP     string `json:"mesh_ip"`
-	WGEndpoint string `json:"wg_endpoint"`
+	WGPubKey       string `json:"wg_pubkey"`
+	Name           string `json:"name,omitempty"`
+	MeshIP         string `json:"mesh_ip"`
+	MeshIPNonce    int    `json:"mesh_ip_nonce,omitempty"`
+	MeshIPReserved bool   `json:"mesh_ip_reserved,omitempty"`
+	MeshIPv6       string `json:"mesh_ipv6,omitempty"`
+	WGEndpoint     string `json:"wg_endpoint"`
 }
 
 // Envelope wraps encrypted messages with nonce for transmission
@@ -86,6 +126,22 @@ func SealEnvelope(messageType string, payload interface{}, gossipKey [32]byte) (
 
 // OpenEnvelope decrypts a message using AES-256-GCM with the gossip key
 func OpenEnvelope(data []byte, gossipKey [32]byte) (*Envelope, *PeerAnnouncement, error) {
+	envelope, plaintext, err := OpenEnvelopeRaw(data, gossipKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	announcement, err := ParseAnnouncement(envelope, plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return envelope, announcement, nil
+}
+
+// OpenEnvelopeRaw decrypts a message and returns the plaintext payload without
+// interpreting it. Used for message types whose payload is not a PeerAnnouncement.
+func OpenEnvelopeRaw(data []byte, gossipKey [32]byte) (*Envelope, []byte, error) {
 	// Parse envelope
 	var envelope Envelope
 	if err := json.Unmarshal(data, &envelope); err != nil {
@@ -114,27 +170,32 @@ func OpenEnvelope(data []byte, gossipKey [32]byte) (*Envelope, *PeerAnnouncement
 		return nil, nil, fmt.Errorf("decryption failed (wrong key?): %w", err)
 	}
 
-	// Parse announcement
+	return &envelope, plaintext, nil
+}
+
+// ParseAnnouncement parses a decrypted payload as a PeerAnnouncement and checks
+// its protocol version and timestamp
+func ParseAnnouncement(envelope *Envelope, plaintext []byte) (*PeerAnnouncement, error) {
 	var announcement PeerAnnouncement
 	if err := json.Unmarshal(plaintext, &announcement); err != nil {
-		return nil, nil, fmt.Errorf("failed to unmarshal announcement: %w", err)
+		return nil, fmt.Errorf("failed to unmarshal announcement: %w", err)
 	}
 
 	// Verify protocol version
 	if announcement.Protocol != ProtocolVersion {
-		return nil, nil, fmt.Errorf("unsupported protocol version: %s", announcement.Protocol)
+		return nil, &ProtocolVersionError{MessageType: envelope.MessageType, Version: announcement.Protocol}
 	}
 
 	// Check timestamp to prevent replay attacks
 	msgTime := time.Unix(announcement.Timestamp, 0)
 	if time.Since(msgTime) > MaxMessageAge {
-		return nil, nil, fmt.Errorf("message too old: %v", time.Since(msgTime))
+		return nil, fmt.Errorf("message too old: %v", time.Since(msgTime))
 	}
 	if msgTime.After(time.Now().Add(MaxMessageAge)) {
-		return nil, nil, fmt.Errorf("message timestamp in future")
+		return nil, fmt.Errorf("message timestamp in future")
 	}
 
-	return &envelope, &announcement, nil
+	return &announcement, nil
 }
 
 // CreateAnnouncement creates a new peer announcement
@@ -149,3 +210,45 @@ func CreateAnnouncement(wgPubKey, meshIP, wgEndpoint string, routableNetworks []
 		KnownPeers:       knownPeers,
 	}
 }
+
+// AttachMembershipToken binds the announcement's WG pubkey to the mesh secret
+func (a *PeerAnnouncement) AttachMembershipToken(membershipKey [32]byte) {
+	a.MembershipToken = GenerateMembershipToken(membershipKey[:], []byte(a.WGPubKey))
+}
+
+// VerifyMembershipToken checks that the announcement carries a valid token for its WG pubkey
+func (a *PeerAnnouncement) VerifyMembershipToken(membershipKey [32]byte) error {
+	if len(a.MembershipToken) == 0 {
+		return fmt.Errorf("%w: missing", ErrInvalidMembershipToken)
+	}
+	if !ValidateMembershipToken(membershipKey[:], []byte(a.WGPubKey), a.MembershipToken) {
+		return fmt.Errorf("%w for pubkey %s", ErrInvalidMembershipToken, a.WGPubKey)
+	}
+	return nil
+}
+
+// Sign sets the sender's identity key and signs the announcement with it.
+// It must be called after all other fields are set.
+func (a *PeerAnnouncement) Sign(identity ed25519.PrivateKey) {
+	a.IdentityKey = identity.Public().(ed25519.PublicKey)
+	a.Signature = ed25519.Sign(identity, a.signedBytes())
+}
+
+// VerifySignature checks that the announcement is signed by the identity key it carries
+func (a *PeerAnnouncement) VerifySignature() error {
+	if len(a.IdentityKey) != ed25519.PublicKeySize || len(a.Signature) == 0 {
+		return fmt.Errorf("%w: missing", ErrInvalidSignature)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(a.IdentityKey), a.signedBytes(), a.Signature) {
+		return fmt.Errorf("%w for pubkey %s", ErrInvalidSignature, a.WGPubKey)
+	}
+	return nil
+}
+
+// signedBytes returns the canonical encoding covered by the signature
+func (a *PeerAnnouncement) signedBytes() []byte {
+	unsigned := *a
+	unsigned.Signature = nil
+	data, _ := json.Marshal(unsigned)
+	return append([]byte("wgmesh-announcement|"), data...)
+}
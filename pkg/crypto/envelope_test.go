@@ -0,0 +1,114 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestSealOpenEnvelope(t *testing.T) {
+	keys, err := DeriveKeys("test-secret-that-is-long-enough")
+	if err != nil {
+		t.Fatalf("DeriveKeys failed: %v", err)
+	}
+
+	announcement := CreateAnnouncement("pubkey", "10.1.2.3", "1.2.3.4:51820", nil, nil)
+	announcement.AttachMembershipToken(keys.MembershipKey)
+
+	data, err := SealEnvelope(MessageTypeHello, announcement, keys.GossipKey)
+	if err != nil {
+		t.Fatalf("SealEnvelope failed: %v", err)
+	}
+
+	envelope, opened, err := OpenEnvelope(data, keys.GossipKey)
+	if err != nil {
+		t.Fatalf("OpenEnvelope failed: %v", err)
+	}
+	if envelope.MessageType != MessageTypeHello {
+		t.Errorf("Expected message type %s, got %s", MessageTypeHello, envelope.MessageType)
+	}
+	if err := opened.VerifyMembershipToken(keys.MembershipKey); err != nil {
+		t.Errorf("Token should verify after round trip: %v", err)
+	}
+}
+
+func TestOpenEnvelopeProtocolVersionError(t *testing.T) {
+	keys, err := DeriveKeys("test-secret-that-is-long-enough")
+	if err != nil {
+		t.Fatalf("DeriveKeys failed: %v", err)
+	}
+
+	announcement := CreateAnnouncement("pubkey", "10.1.2.3", "1.2.3.4:51820", nil, nil)
+	announcement.Protocol = "wgmesh-v1"
+
+	data, err := SealEnvelope(MessageTypeHello, announcement, keys.GossipKey)
+	if err != nil {
+		t.Fatalf("SealEnvelope failed: %v", err)
+	}
+
+	_, _, err = OpenEnvelope(data, keys.GossipKey)
+	var versionErr *ProtocolVersionError
+	if !errors.As(err, &versionErr) {
+		t.Fatalf("Expected ProtocolVersionError, got %v", err)
+	}
+	if versionErr.Version != "wgmesh-v1" || versionErr.MessageType != MessageTypeHello {
+		t.Errorf("Unexpected error details: %+v", versionErr)
+	}
+}
+
+func TestVerifyMembershipToken(t *testing.T) {
+	keys, _ := DeriveKeys("test-secret-that-is-long-enough")
+	otherKeys, _ := DeriveKeys("another-secret-that-is-long-enough")
+
+	announcement := CreateAnnouncement("pubkey", "10.1.2.3", "", nil, nil)
+	if err := announcement.VerifyMembershipToken(keys.MembershipKey); !errors.Is(err, ErrInvalidMembershipToken) {
+		t.Errorf("Missing token should be rejected, got %v", err)
+	}
+
+	announcement.AttachMembershipToken(otherKeys.MembershipKey)
+	if err := announcement.VerifyMembershipToken(keys.MembershipKey); !errors.Is(err, ErrInvalidMembershipToken) {
+		t.Errorf("Token from another mesh should be rejected, got %v", err)
+	}
+
+	// A valid token must not be reusable for another pubkey
+	announcement.AttachMembershipToken(keys.MembershipKey)
+	announcement.WGPubKey = "attacker-pubkey"
+	if err := announcement.VerifyMembershipToken(keys.MembershipKey); !errors.Is(err, ErrInvalidMembershipToken) {
+		t.Errorf("Token should be bound to the pubkey, got %v", err)
+	}
+}
+
+func TestAnnouncementSignature(t *testing.T) {
+	keys, _ := DeriveKeys("test-secret-that-is-long-enough")
+	_, identity, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	announcement := CreateAnnouncement("pubkey", "10.1.2.3", "1.2.3.4:51820", []string{"192.168.1.0/24"}, nil)
+	if err := announcement.VerifySignature(); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Unsigned announcement should be rejected, got %v", err)
+	}
+
+	announcement.AttachMembershipToken(keys.MembershipKey)
+	announcement.Sign(identity)
+
+	data, err := SealEnvelope(MessageTypeHello, announcement, keys.GossipKey)
+	if err != nil {
+		t.Fatalf("SealEnvelope failed: %v", err)
+	}
+	_, opened, err := OpenEnvelope(data, keys.GossipKey)
+	if err != nil {
+		t.Fatalf("OpenEnvelope failed: %v", err)
+	}
+	if err := opened.VerifySignature(); err != nil {
+		t.Errorf("Signature should verify after round trip: %v", err)
+	}
+
+	// Any change to a signed field invalidates the signature
+	opened.RoutableNetworks = []string{"0.0.0.0/0"}
+	if err := opened.VerifySignature(); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Tampered announcement should be rejected, got %v", err)
+	}
+}
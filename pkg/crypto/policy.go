@@ -0,0 +1,45 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// PolicyUpdate distributes an access policy (see package acl) to all nodes.
+// It is signed with the mesh admin key. The newest version wins; older and
+// replayed updates are ignored.
+type PolicyUpdate struct {
+	Version   int64           `json:"version"` // creation time in nanoseconds
+	Policy    json.RawMessage `json:"policy"`
+	Signature []byte          `json:"signature"` // Ed25519 signature by the admin key
+}
+
+// CreatePolicyUpdate creates a policy update signed with the admin key
+func CreatePolicyUpdate(admin ed25519.PrivateKey, policy []byte) *PolicyUpdate {
+	u := &PolicyUpdate{
+		Version: time.Now().UnixNano(),
+		Policy:  json.RawMessage(policy),
+	}
+	u.Sign(admin)
+	return u
+}
+
+// Sign signs the update with the admin key, after Version and Policy are set
+func (u *PolicyUpdate) Sign(admin ed25519.PrivateKey) {
+	u.Signature = ed25519.Sign(admin, u.signedBytes())
+}
+
+// Verify checks that the update was signed with the admin key
+func (u *PolicyUpdate) Verify(adminKey ed25519.PublicKey) bool {
+	if u.Version <= 0 || len(u.Policy) == 0 || len(adminKey) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(adminKey, u.signedBytes(), u.Signature)
+}
+
+// signedBytes returns the canonical encoding covered by the signature
+func (u *PolicyUpdate) signedBytes() []byte {
+	return append([]byte(fmt.Sprintf("policy|%d|", u.Version)), u.Policy...)
+}
@@ -0,0 +1,50 @@
+package crypto
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPolicyUpdateVerify(t *testing.T) {
+	adminPub, admin, err := GenerateAdminKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, other, err := GenerateAdminKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := CreatePolicyUpdate(admin, []byte(`{"rules":[]}`))
+	if !u.Verify(adminPub) {
+		t.Error("Valid policy update should verify")
+	}
+	if u.Verify(otherPub) {
+		t.Error("Policy update should not verify with another admin key")
+	}
+	if u.Verify(nil) {
+		t.Error("Policy update should not verify without an admin key")
+	}
+
+	// The signature covers the version, an old policy can't be replayed as new
+	u.Version++
+	if u.Verify(adminPub) {
+		t.Error("Policy update should not verify after changing the version")
+	}
+	u.Version--
+
+	u.Policy = json.RawMessage(`{"rules":[{"from":["*"],"to":["*"]}]}`)
+	if u.Verify(adminPub) {
+		t.Error("Policy update should not verify after changing the policy")
+	}
+
+	forged := CreatePolicyUpdate(other, []byte(`{"rules":[]}`))
+	if forged.Verify(adminPub) {
+		t.Error("Policy update signed with another key should not verify")
+	}
+
+	empty := CreatePolicyUpdate(admin, nil)
+	if empty.Verify(adminPub) {
+		t.Error("Policy update without a policy should not verify")
+	}
+}
@@ -0,0 +1,61 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"time"
+)
+
+// Revocation removes a node from the mesh, or with Lifted set lets it back
+// in. Records are signed with the mesh admin key, gossiped between nodes and
+// kept forever; the newest record for a pubkey wins, so replaying an old one
+// is harmless.
+type Revocation struct {
+	WGPubKey  string `json:"wg_pubkey"`
+	Reason    string `json:"reason,omitempty"`
+	Lifted    bool   `json:"lifted,omitempty"` // un-revokes the pubkey
+	Timestamp int64  `json:"timestamp"`        // creation time in nanoseconds
+	Signature []byte `json:"signature"`        // Ed25519 signature by the admin key
+}
+
+// CreateRevocation creates a revocation for a WireGuard pubkey signed with the admin key
+func CreateRevocation(admin ed25519.PrivateKey, wgPubKey, reason string) *Revocation {
+	r := &Revocation{
+		WGPubKey:  wgPubKey,
+		Reason:    reason,
+		Timestamp: time.Now().UnixNano(),
+	}
+	r.Signature = ed25519.Sign(admin, r.signedBytes())
+	return r
+}
+
+// LiftRevocation creates a record that lifts an earlier revocation of a
+// WireGuard pubkey, signed with the admin key
+func LiftRevocation(admin ed25519.PrivateKey, wgPubKey, reason string) *Revocation {
+	r := &Revocation{
+		WGPubKey:  wgPubKey,
+		Reason:    reason,
+		Lifted:    true,
+		Timestamp: time.Now().UnixNano(),
+	}
+	r.Signature = ed25519.Sign(admin, r.signedBytes())
+	return r
+}
+
+// Verify checks that the record was signed with the admin key
+func (r *Revocation) Verify(adminKey ed25519.PublicKey) bool {
+	if r.WGPubKey == "" || len(adminKey) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(adminKey, r.signedBytes(), r.Signature)
+}
+
+// Newer reports whether r supersedes other, a record for the same pubkey
+func (r *Revocation) Newer(other *Revocation) bool {
+	return other == nil || r.Timestamp > other.Timestamp
+}
+
+// signedBytes returns the canonical encoding covered by the signature
+func (r *Revocation) signedBytes() []byte {
+	return []byte(fmt.Sprintf("revoke|%s|%d|%t|%s", r.WGPubKey, r.Timestamp, r.Lifted, r.Reason))
+}
@@ -0,0 +1,88 @@
+package crypto
+
+import (
+	"testing"
+)
+
+func TestRevocationVerify(t *testing.T) {
+	adminPub, admin, err := GenerateAdminKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, other, err := GenerateAdminKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := CreateRevocation(admin, "pubkey", "laptop stolen")
+	if !r.Verify(adminPub) {
+		t.Error("Valid revocation should verify")
+	}
+	if r.Verify(otherPub) {
+		t.Error("Revocation should not verify with another admin key")
+	}
+	if r.Verify(nil) {
+		t.Error("Revocation should not verify without an admin key")
+	}
+
+	// The signature covers the revoked pubkey
+	r.WGPubKey = "other-pubkey"
+	if r.Verify(adminPub) {
+		t.Error("Revocation should not verify after changing the pubkey")
+	}
+
+	// A member without the admin key cannot turn a revocation into a lift
+	r = CreateRevocation(admin, "pubkey", "laptop stolen")
+	r.Lifted = true
+	if r.Verify(adminPub) {
+		t.Error("Revocation should not verify after setting Lifted")
+	}
+
+	forged := CreateRevocation(other, "pubkey", "")
+	if forged.Verify(adminPub) {
+		t.Error("Revocation signed with another key should not verify")
+	}
+}
+
+func TestLiftRevocation(t *testing.T) {
+	adminPub, admin, err := GenerateAdminKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := CreateRevocation(admin, "pubkey", "laptop stolen")
+	lift := LiftRevocation(admin, "pubkey", "laptop found")
+	if !lift.Lifted || !lift.Verify(adminPub) {
+		t.Fatal("Lift should be marked and verify")
+	}
+	if !lift.Newer(r) || r.Newer(lift) {
+		t.Error("Later record should supersede the earlier one")
+	}
+	if !r.Newer(nil) {
+		t.Error("Any record should supersede none")
+	}
+}
+
+func TestAdminKeyEncoding(t *testing.T) {
+	pub, priv, err := GenerateAdminKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseAdminKey(EncodeAdminKey(pub))
+	if err != nil || !parsed.Equal(pub) {
+		t.Fatalf("Round trip failed: %v", err)
+	}
+	if _, err := ParseAdminKey("not-a-key"); err == nil {
+		t.Error("Invalid key should not parse")
+	}
+
+	path := t.TempDir() + "/admin.key"
+	if err := SaveAdminPrivateKey(path, priv); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadAdminPrivateKey(path)
+	if err != nil || !loaded.Equal(priv) {
+		t.Fatalf("Failed to load saved key: %v", err)
+	}
+}
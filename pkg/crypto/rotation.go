@@ -1,23 +1,38 @@
 package crypto
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"time"
 )
 
-// RotationAnnouncement is broadcast via gossip to coordinate secret rotation
+// RotationAnnouncement is broadcast via gossip to coordinate secret rotation.
+// It is signed with the mesh admin key, and the new secret travels sealed to
+// the WireGuard key of each member, so a node that only holds the old secret
+// can neither start a rotation nor learn the new secret.
 type RotationAnnouncement struct {
 	NewSecretHash []byte `json:"new_secret_hash"` // SHA256 of new secret (for verification)
 	GracePeriod   int64  `json:"grace_period"`    // Duration in seconds to maintain dual-secret mode
-	Timestamp     int64  `json:"timestamp"`
-	Signature     []byte `json:"signature"` // HMAC-SHA256(old_membership_key, announcement)
+	Timestamp     int64  `json:"timestamp"`       // start of the grace period
+	Signature     []byte `json:"signature"`       // Ed25519 signature by the admin key
+
+	// SealedSecrets maps WireGuard pubkeys to the new secret sealed to them.
+	// It is not covered by the signature, OpenSecret checks the secret
+	// against NewSecretHash.
+	SealedSecrets map[string][]byte `json:"sealed_secrets,omitempty"`
 }
 
-// GenerateRotationAnnouncement creates a rotation announcement signed with the old secret
-func GenerateRotationAnnouncement(oldMembershipKey []byte, newSecret string, gracePeriod time.Duration) (*RotationAnnouncement, error) {
+// CreateRotationAnnouncement creates a rotation announcement signed with the admin key
+func CreateRotationAnnouncement(admin ed25519.PrivateKey, newSecret string, gracePeriod time.Duration) *RotationAnnouncement {
 	newHash := sha256.Sum256([]byte(newSecret))
 
 	announcement := &RotationAnnouncement{
@@ -25,39 +40,26 @@ func GenerateRotationAnnouncement(oldMembershipKey []byte, newSecret string, gra
 		GracePeriod:   int64(gracePeriod.Seconds()),
 		Timestamp:     time.Now().Unix(),
 	}
-
-	// Sign with old membership key
-	sig, err := signRotation(oldMembershipKey, announcement)
-	if err != nil {
-		return nil, err
-	}
-	announcement.Signature = sig
-
-	return announcement, nil
+	announcement.Signature = ed25519.Sign(admin, announcement.signedBytes())
+	return announcement
 }
 
-// ValidateRotationAnnouncement validates a rotation announcement
-func ValidateRotationAnnouncement(oldMembershipKey []byte, announcement *RotationAnnouncement) bool {
-	// Check timestamp (within last hour)
-	msgTime := time.Unix(announcement.Timestamp, 0)
-	if time.Since(msgTime) > time.Hour {
+// Verify checks that the announcement was signed with the admin key and that
+// its grace period has not ended yet
+func (a *RotationAnnouncement) Verify(adminKey ed25519.PublicKey) bool {
+	if len(adminKey) != ed25519.PublicKeySize || a.GracePeriod <= 0 {
 		return false
 	}
-	if msgTime.After(time.Now().Add(time.Hour)) {
+
+	start := time.Unix(a.Timestamp, 0)
+	if start.After(time.Now().Add(time.Hour)) {
 		return false
 	}
-
-	// Verify signature
-	expectedSig, err := signRotation(oldMembershipKey, &RotationAnnouncement{
-		NewSecretHash: announcement.NewSecretHash,
-		GracePeriod:   announcement.GracePeriod,
-		Timestamp:     announcement.Timestamp,
-	})
-	if err != nil {
+	if time.Now().After(start.Add(time.Duration(a.GracePeriod) * time.Second)) {
 		return false
 	}
 
-	return hmac.Equal(announcement.Signature, expectedSig)
+	return ed25519.Verify(adminKey, a.signedBytes(), a.Signature)
 }
 
 // VerifyNewSecret checks if a new secret matches the hash in the rotation announcement
@@ -66,12 +68,110 @@ func VerifyNewSecret(newSecret string, announcement *RotationAnnouncement) bool
 	return hmac.Equal(hash[:], announcement.NewSecretHash)
 }
 
-// signRotation creates an HMAC signature for a rotation announcement
-func signRotation(membershipKey []byte, announcement *RotationAnnouncement) ([]byte, error) {
-	data := fmt.Sprintf("%x|%d|%d", announcement.NewSecretHash, announcement.GracePeriod, announcement.Timestamp)
-	mac := hmac.New(sha256.New, membershipKey)
-	mac.Write([]byte(data))
-	return mac.Sum(nil), nil
+// SealSecret adds the new secret sealed to a member's WireGuard public key
+// (base64). Only the holder of the matching private key can open it.
+func (a *RotationAnnouncement) SealSecret(newSecret, wgPubKey string) error {
+	raw, err := base64.StdEncoding.DecodeString(wgPubKey)
+	if err != nil {
+		return fmt.Errorf("invalid WireGuard key: %w", err)
+	}
+	recipient, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return fmt.Errorf("invalid WireGuard key: %w", err)
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return fmt.Errorf("failed to derive shared key: %w", err)
+	}
+
+	gcm, err := sealedSecretCipher(shared, ephemeral.PublicKey().Bytes(), raw)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, NonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := append(ephemeral.PublicKey().Bytes(), nonce...)
+	if a.SealedSecrets == nil {
+		a.SealedSecrets = make(map[string][]byte)
+	}
+	a.SealedSecrets[wgPubKey] = gcm.Seal(sealed, nonce, []byte(newSecret), nil)
+	return nil
+}
+
+// OpenSecret opens the new secret sealed to our WireGuard key pair (base64)
+// and checks it against the announced hash
+func (a *RotationAnnouncement) OpenSecret(wgPubKey, wgPrivateKey string) (string, error) {
+	sealed, ok := a.SealedSecrets[wgPubKey]
+	if !ok {
+		return "", fmt.Errorf("new secret is not sealed to our key")
+	}
+	if len(sealed) < 32+NonceSize {
+		return "", fmt.Errorf("sealed secret too short")
+	}
+
+	rawPriv, err := base64.StdEncoding.DecodeString(wgPrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid WireGuard private key: %w", err)
+	}
+	priv, err := ecdh.X25519().NewPrivateKey(rawPriv)
+	if err != nil {
+		return "", fmt.Errorf("invalid WireGuard private key: %w", err)
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(sealed[:32])
+	if err != nil {
+		return "", fmt.Errorf("invalid ephemeral key: %w", err)
+	}
+	shared, err := priv.ECDH(ephemeral)
+	if err != nil {
+		return "", fmt.Errorf("failed to derive shared key: %w", err)
+	}
+
+	gcm, err := sealedSecretCipher(shared, sealed[:32], priv.PublicKey().Bytes())
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := gcm.Open(nil, sealed[32:32+NonceSize], sealed[32+NonceSize:], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to open sealed secret: %w", err)
+	}
+
+	newSecret := string(plaintext)
+	if !VerifyNewSecret(newSecret, a) {
+		return "", fmt.Errorf("sealed secret does not match the announced hash")
+	}
+	return newSecret, nil
+}
+
+// sealedSecretCipher derives the AES-GCM cipher for a secret sealed with an
+// X25519 exchange between an ephemeral key and the recipient's WireGuard key
+func sealedSecretCipher(shared, ephemeral, recipient []byte) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write([]byte("wgmesh-rotation-secret|"))
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(recipient)
+
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return gcm, nil
+}
+
+// signedBytes returns the canonical encoding covered by the signature
+func (a *RotationAnnouncement) signedBytes() []byte {
+	return []byte(fmt.Sprintf("rotate|%x|%d|%d", a.NewSecretHash, a.GracePeriod, a.Timestamp))
 }
 
 // RotationState tracks the state of an ongoing secret rotation
@@ -81,6 +181,10 @@ type RotationState struct {
 	GracePeriod   time.Duration `json:"grace_period"`
 	StartedAt     time.Time `json:"started_at"`
 	Completed     bool      `json:"completed"`
+
+	// Announcement is the admin-signed announcement, kept so the rotation
+	// can be re-announced after a restart
+	Announcement *RotationAnnouncement `json:"announcement,omitempty"`
 }
 
 // IsInGracePeriod returns true if the rotation is still in the grace period
@@ -107,3 +211,29 @@ func (rs *RotationState) MarshalJSON() ([]byte, error) {
 		Alias:       (*Alias)(rs),
 	})
 }
+
+// UnmarshalJSON implements json.Unmarshaler, accepting the format written by MarshalJSON
+func (rs *RotationState) UnmarshalJSON(data []byte) error {
+	type Alias RotationState
+	aux := &struct {
+		GracePeriod string `json:"grace_period"`
+		*Alias
+	}{
+		Alias: (*Alias)(rs),
+	}
+	if err := json.Unmarshal(data, aux); err != nil {
+		return err
+	}
+
+	grace, err := time.ParseDuration(aux.GracePeriod)
+	if err != nil {
+		return fmt.Errorf("invalid grace period %q: %w", aux.GracePeriod, err)
+	}
+	rs.GracePeriod = grace
+	return nil
+}
+
+// CompletesAt returns the time the grace period ends
+func (rs *RotationState) CompletesAt() time.Time {
+	return rs.StartedAt.Add(rs.GracePeriod)
+}
@@ -1,65 +1,112 @@
 package crypto
 
 import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
 	"testing"
 	"time"
 )
 
-func TestGenerateRotationAnnouncement(t *testing.T) {
-	oldKey := []byte("old-membership-key-that-is-32b!!")
-	newSecret := "new-secret-that-is-long-enough!"
-	grace := 24 * time.Hour
-
-	announcement, err := GenerateRotationAnnouncement(oldKey, newSecret, grace)
+func TestRotationAnnouncementVerify(t *testing.T) {
+	adminPub, admin, err := GenerateAdminKey()
 	if err != nil {
-		t.Fatalf("GenerateRotationAnnouncement failed: %v", err)
+		t.Fatal(err)
 	}
-
-	if len(announcement.NewSecretHash) != 32 {
-		t.Errorf("Expected 32 byte hash, got %d", len(announcement.NewSecretHash))
+	otherPub, _, err := GenerateAdminKey()
+	if err != nil {
+		t.Fatal(err)
 	}
+	newSecret := "new-secret-that-is-long-enough!"
+	grace := 24 * time.Hour
 
+	announcement := CreateRotationAnnouncement(admin, newSecret, grace)
 	if announcement.GracePeriod != int64(grace.Seconds()) {
 		t.Errorf("Expected grace period %d, got %d", int64(grace.Seconds()), announcement.GracePeriod)
 	}
+	if !announcement.Verify(adminPub) {
+		t.Error("Valid announcement should pass verification")
+	}
+	if announcement.Verify(otherPub) || announcement.Verify(nil) {
+		t.Error("Announcement should only verify with the admin key")
+	}
+	if !VerifyNewSecret(newSecret, announcement) || VerifyNewSecret("wrong-secret-that-is-long!", announcement) {
+		t.Error("Only the announced secret should match the hash")
+	}
 
-	if len(announcement.Signature) == 0 {
-		t.Error("Expected non-empty signature")
+	// The signature covers the secret hash and the grace period
+	tampered := *announcement
+	tampered.GracePeriod++
+	if tampered.Verify(adminPub) {
+		t.Error("Announcement with a changed grace period should not verify")
+	}
+
+	// Announcements are accepted until the grace period ends
+	expired := &RotationAnnouncement{NewSecretHash: announcement.NewSecretHash, GracePeriod: 60, Timestamp: time.Now().Add(-2 * time.Minute).Unix()}
+	expired.Signature = ed25519.Sign(admin, expired.signedBytes())
+	if expired.Verify(adminPub) {
+		t.Error("Announcement past its grace period should not verify")
 	}
 }
 
-func TestValidateRotationAnnouncement(t *testing.T) {
-	oldKey := []byte("old-membership-key-that-is-32b!!")
+func TestRotationSealedSecret(t *testing.T) {
+	_, admin, err := GenerateAdminKey()
+	if err != nil {
+		t.Fatal(err)
+	}
 	newSecret := "new-secret-that-is-long-enough!"
+	pub, priv := generateX25519Key(t)
+	otherPub, otherPriv := generateX25519Key(t)
 
-	announcement, _ := GenerateRotationAnnouncement(oldKey, newSecret, time.Hour)
-
-	// Valid announcement should pass
-	if !ValidateRotationAnnouncement(oldKey, announcement) {
-		t.Error("Valid announcement should pass validation")
+	announcement := CreateRotationAnnouncement(admin, newSecret, time.Hour)
+	if err := announcement.SealSecret(newSecret, pub); err != nil {
+		t.Fatalf("SealSecret failed: %v", err)
 	}
 
-	// Wrong key should fail
-	if ValidateRotationAnnouncement([]byte("wrong-key-that-is-also-32-bytes!"), announcement) {
-		t.Error("Wrong key should fail validation")
+	// Travels as JSON through gossip
+	data, err := json.Marshal(announcement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received RotationAnnouncement
+	if err := json.Unmarshal(data, &received); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), newSecret) {
+		t.Error("New secret must not appear in the announcement in plaintext")
 	}
-}
-
-func TestVerifyNewSecret(t *testing.T) {
-	oldKey := []byte("old-membership-key-that-is-32b!!")
-	newSecret := "new-secret-that-is-long-enough!"
 
-	announcement, _ := GenerateRotationAnnouncement(oldKey, newSecret, time.Hour)
+	got, err := received.OpenSecret(pub, priv)
+	if err != nil || got != newSecret {
+		t.Fatalf("OpenSecret = %q, %v; want %q", got, err, newSecret)
+	}
+	if _, err := received.OpenSecret(otherPub, otherPriv); err == nil {
+		t.Error("Secret sealed to another key should not open")
+	}
+	if _, err := received.OpenSecret(pub, otherPriv); err == nil {
+		t.Error("Secret should not open with the wrong private key")
+	}
 
-	// Correct secret should verify
-	if !VerifyNewSecret(newSecret, announcement) {
-		t.Error("Correct secret should verify")
+	// A secret that does not match the signed hash is refused
+	if err := received.SealSecret("a-different-secret-entirely-xx", pub); err != nil {
+		t.Fatal(err)
 	}
+	if _, err := received.OpenSecret(pub, priv); err == nil {
+		t.Error("Sealed secret not matching the hash should be refused")
+	}
+}
 
-	// Wrong secret should not verify
-	if VerifyNewSecret("wrong-secret-that-is-long!", announcement) {
-		t.Error("Wrong secret should not verify")
+// generateX25519Key returns a WireGuard style key pair in base64
+func generateX25519Key(t *testing.T) (string, string) {
+	t.Helper()
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
 	}
+	return base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes()), base64.StdEncoding.EncodeToString(priv.Bytes())
 }
 
 func TestRotationState(t *testing.T) {
@@ -84,3 +131,29 @@ func TestRotationState(t *testing.T) {
 		t.Error("Completed state should not be in grace period")
 	}
 }
+
+func TestRotationStateJSONRoundTrip(t *testing.T) {
+	state := &RotationState{
+		OldSecret:   "old",
+		NewSecret:   "new",
+		GracePeriod: 90 * time.Minute,
+		StartedAt:   time.Unix(1700000000, 0).UTC(),
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	var loaded RotationState
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+
+	if loaded.GracePeriod != state.GracePeriod {
+		t.Errorf("Expected grace period %v, got %v", state.GracePeriod, loaded.GracePeriod)
+	}
+	if loaded.NewSecret != "new" || !loaded.StartedAt.Equal(state.StartedAt) {
+		t.Errorf("Unexpected state after round trip: %+v", loaded)
+	}
+}
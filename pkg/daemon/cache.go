@@ -7,6 +7,8 @@ import (
 	"os"
 	"path/filepath"
 	"time"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
 )
 
 const (
@@ -17,16 +19,26 @@ const (
 // PeerCacheEntry represents a cached peer entry
 type PeerCacheEntry struct {
 	WGPubKey         string   `json:"wg_pubkey"`
+	IdentityKey      string   `json:"identity_key,omitempty"`
+	Name             string   `json:"name,omitempty"`
 	MeshIP           string   `json:"mesh_ip"`
+	MeshIPNonce      int      `json:"mesh_ip_nonce,omitempty"`
+	MeshIPReserved   bool     `json:"mesh_ip_reserved,omitempty"`
+	MeshIPv6         string   `json:"mesh_ipv6,omitempty"`
 	Endpoint         string   `json:"endpoint"`
+	Endpoints        []string `json:"endpoints,omitempty"`
 	RoutableNetworks []string `json:"routable_networks,omitempty"`
+	Tags             []string `json:"tags,omitempty"`
+	RelayCapable     bool     `json:"relay_capable,omitempty"`
+	ExitNode         bool     `json:"exit_node,omitempty"`
 	LastSeen         int64    `json:"last_seen"`
 }
 
 // PeerCache manages persistent peer storage
 type PeerCache struct {
-	Peers     []PeerCacheEntry `json:"peers"`
-	UpdatedAt int64            `json:"updated_at"`
+	Peers       []PeerCacheEntry     `json:"peers"`
+	Revocations []*crypto.Revocation `json:"revocations,omitempty"`
+	UpdatedAt   int64                `json:"updated_at"`
 }
 
 // CacheFilePath returns the path for the peer cache file
@@ -54,15 +66,25 @@ func LoadPeerCache(interfaceName string) (*PeerCache, error) {
 func SavePeerCache(interfaceName string, peerStore *PeerStore) error {
 	peers := peerStore.GetAll()
 	cache := &PeerCache{
-		UpdatedAt: time.Now().Unix(),
+		Revocations: peerStore.Revocations(),
+		UpdatedAt:   time.Now().Unix(),
 	}
 
 	for _, p := range peers {
 		cache.Peers = append(cache.Peers, PeerCacheEntry{
 			WGPubKey:         p.WGPubKey,
+			IdentityKey:      p.IdentityKey,
+			Name:             p.Name,
 			MeshIP:           p.MeshIP,
+			MeshIPNonce:      p.MeshIPNonce,
+			MeshIPReserved:   p.MeshIPReserved,
+			MeshIPv6:         p.MeshIPv6,
 			Endpoint:         p.Endpoint,
+			Endpoints:        p.Endpoints,
 			RoutableNetworks: p.RoutableNetworks,
+			Tags:             p.Tags,
+			RelayCapable:     p.RelayCapable,
+			ExitNode:         p.ExitNode,
 			LastSeen:         p.LastSeen.Unix(),
 		})
 	}
@@ -91,6 +113,11 @@ func RestoreFromCache(interfaceName string, peerStore *PeerStore) int {
 		return 0
 	}
 
+	// Revocations never expire; restore them first so revoked peers are skipped
+	for _, r := range cache.Revocations {
+		peerStore.Revoke(r)
+	}
+
 	now := time.Now()
 	restored := 0
 
@@ -104,13 +131,24 @@ func RestoreFromCache(interfaceName string, peerStore *PeerStore) int {
 
 		peer := &PeerInfo{
 			WGPubKey:         entry.WGPubKey,
+			IdentityKey:      entry.IdentityKey,
+			Name:             entry.Name,
 			MeshIP:           entry.MeshIP,
+			MeshIPNonce:      entry.MeshIPNonce,
+			MeshIPReserved:   entry.MeshIPReserved,
+			MeshIPv6:         entry.MeshIPv6,
 			Endpoint:         entry.Endpoint,
+			Endpoints:        entry.Endpoints,
 			RoutableNetworks: entry.RoutableNetworks,
+			Tags:             entry.Tags,
+			RelayCapable:     entry.RelayCapable,
+			ExitNode:         entry.ExitNode,
 			LastSeen:         lastSeen,
 		}
 
-		peerStore.Update(peer, "cache")
+		if peerStore.Update(peer, "cache") != nil {
+			continue
+		}
 		restored++
 	}
 
@@ -2,14 +2,22 @@ package daemon
 
 import (
 	"crypto/sha256"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"strings"
 
 	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
 )
 
+// MaxMeshIPNonce is the highest collision nonce a mesh IP may be derived with
+const MaxMeshIPNonce = 10
+
+// ErrMeshIPMismatch is returned for announced mesh IPs that are not derived
+// from the announcing node's pubkey
+var ErrMeshIPMismatch = errors.New("mesh IP is not derived from the pubkey")
+
 // CollisionInfo represents a mesh IP collision between two peers
 type CollisionInfo struct {
 	MeshIP string
@@ -17,7 +25,9 @@ type CollisionInfo struct {
 	Peer2  *PeerInfo
 }
 
-// DetectCollisions checks for mesh IP collisions in the peer store
+// DetectCollisions checks for mesh IP collisions in the peer store. Only
+// peers bound to an identity key count, unsigned transitive entries can't
+// claim an address.
 func (ps *PeerStore) DetectCollisions() []CollisionInfo {
 	ps.mu.RLock()
 	defer ps.mu.RUnlock()
@@ -26,7 +36,7 @@ func (ps *PeerStore) DetectCollisions() []CollisionInfo {
 	var collisions []CollisionInfo
 
 	for _, peer := range ps.peers {
-		if peer.MeshIP == "" {
+		if peer.MeshIP == "" || peer.IdentityKey == "" {
 			continue
 		}
 
@@ -46,8 +56,15 @@ func (ps *PeerStore) DetectCollisions() []CollisionInfo {
 	return collisions
 }
 
-// DeterministicWinner returns the peer that wins a collision (lower pubkey wins)
+// DeterministicWinner returns the peer that wins a collision: a reserved mesh
+// IP wins over a derived one, otherwise the lower pubkey wins
 func DeterministicWinner(peer1, peer2 *PeerInfo) (*PeerInfo, *PeerInfo) {
+	if peer1.MeshIPReserved != peer2.MeshIPReserved {
+		if peer1.MeshIPReserved {
+			return peer1, peer2
+		}
+		return peer2, peer1
+	}
 	if strings.Compare(peer1.WGPubKey, peer2.WGPubKey) < 0 {
 		return peer1, peer2
 	}
@@ -55,7 +72,7 @@ func DeterministicWinner(peer1, peer2 *PeerInfo) (*PeerInfo, *PeerInfo) {
 }
 
 // ResolveCollision resolves a mesh IP collision by re-deriving the loser's IP with a nonce
-func ResolveCollision(collision CollisionInfo, meshSubnet [2]byte, secret string) string {
+func ResolveCollision(collision CollisionInfo, meshSubnet *net.IPNet, secret string) string {
 	_, loser := DeterministicWinner(collision.Peer1, collision.Peer2)
 
 	// Re-derive mesh IP with nonce
@@ -63,53 +80,89 @@ func ResolveCollision(collision CollisionInfo, meshSubnet [2]byte, secret string
 }
 
 // DeriveMeshIPWithNonce derives a mesh IP with a collision avoidance nonce
-func DeriveMeshIPWithNonce(meshSubnet [2]byte, wgPubKey, secret string, nonce int) string {
+func DeriveMeshIPWithNonce(meshSubnet *net.IPNet, wgPubKey, secret string, nonce int) string {
 	input := fmt.Sprintf("%d:%s|%d:%s|nonce=%d", len(wgPubKey), wgPubKey, len(secret), secret, nonce)
 	hash := sha256.Sum256([]byte(input))
 
-	suffix := binary.BigEndian.Uint16(hash[:2])
-
-	if suffix == 0 {
-		suffix = 1
-	} else if suffix == 65535 {
-		suffix = 65534
-	}
-
-	return fmt.Sprintf("10.%d.%d.%d",
-		meshSubnet[0],
-		(suffix>>8)&0xFF,
-		suffix&0xFF,
-	)
+	return crypto.MeshIPFromHash(meshSubnet, hash[:])
 }
 
-// CheckAndResolveCollisions checks for collisions and resolves them
+// CheckAndResolveCollisions checks for collisions and resolves them. Only the
+// loser can move, so for collisions between remote peers we wait for the loser
+// to announce its new address; a collision with us renumbers the local node.
 func (d *Daemon) CheckAndResolveCollisions() {
-	collisions := d.peerStore.DetectCollisions()
-	if len(collisions) == 0 {
-		return
-	}
+	config := d.currentConfig()
 
-	for _, collision := range collisions {
+	for _, collision := range d.peerStore.DetectCollisions() {
 		winner, loser := DeterministicWinner(collision.Peer1, collision.Peer2)
 		log.Printf("[Collision] Mesh IP collision detected: %s claimed by %s and %s",
 			collision.MeshIP, safeKeyPrefix(winner.WGPubKey), safeKeyPrefix(loser.WGPubKey))
 
-		// If we are the loser, re-derive our IP
-		if loser.WGPubKey == d.localNode.WGPubKey {
-			newIP := DeriveMeshIPWithNonce(d.config.Keys.MeshSubnet, d.localNode.WGPubKey, d.config.Secret, 1)
-			log.Printf("[Collision] We lost collision, re-deriving mesh IP: %s -> %s", d.localNode.MeshIP, newIP)
-			d.localNode.MeshIP = newIP
+		newIP := ResolveCollision(collision, config.meshSubnet(), config.Secret)
+		log.Printf("[Collision] Remote peer %s should re-derive to %s", safeKeyPrefix(loser.WGPubKey), newIP)
+	}
 
-			// Reconfigure WireGuard with new IP
-			if err := setInterfaceAddress(d.config.InterfaceName, newIP+"/16"); err != nil {
-				log.Printf("[Collision] Failed to update interface address: %v", err)
-			}
-		} else {
-			// The loser is a remote peer - update our expectation of their IP
-			newIP := ResolveCollision(collision, d.config.Keys.MeshSubnet, d.config.Secret)
-			log.Printf("[Collision] Remote peer %s should re-derive to %s", safeKeyPrefix(loser.WGPubKey), newIP)
+	d.resolveLocalCollision(config)
+}
+
+// resolveLocalCollision renumbers the local node when a peer that wins the
+// collision announces our mesh IP. The new address skips every IP in use, the
+// nonce is persisted so it survives restarts, and all discovery layers
+// announce the new address right away. A reservation only loses to another
+// reservation; we then fall back to a derived address until the operator
+// picks a free one.
+func (d *Daemon) resolveLocalCollision(config *Config) {
+	d.mu.RLock()
+	local := &PeerInfo{WGPubKey: d.localNode.WGPubKey, MeshIP: d.localNode.MeshIP, MeshIPReserved: d.localNode.MeshIPReserved}
+	d.mu.RUnlock()
+
+	var rival *PeerInfo
+	taken := make(map[string]string)
+	for _, peer := range d.peerStore.GetActive() {
+		if peer.MeshIP == "" || peer.WGPubKey == local.WGPubKey {
+			continue
 		}
+		taken[peer.MeshIP] = peer.WGPubKey
+		// Only a signed claim can make us move, not a transitive entry
+		if peer.MeshIP == local.MeshIP && peer.IdentityKey != "" {
+			rival = peer
+		}
+	}
+	if rival == nil {
+		return
+	}
+
+	if winner, _ := DeterministicWinner(local, rival); winner == local {
+		log.Printf("[Collision] %s also claims our mesh IP %s, it has to move",
+			safeKeyPrefix(rival.WGPubKey), local.MeshIP)
+		return
+	}
+
+	if local.MeshIPReserved {
+		log.Printf("[Collision] ERROR: reserved mesh IP %s is also reserved by %s, falling back to a derived address",
+			local.MeshIP, safeKeyPrefix(rival.WGPubKey))
 	}
+
+	newIP, nonce := DeriveMeshIPWithCollisionCheck(config.meshSubnet(), local.WGPubKey, config.Secret, taken)
+	log.Printf("[Collision] We lost collision with %s, re-deriving mesh IP: %s -> %s (nonce %d)",
+		safeKeyPrefix(rival.WGPubKey), local.MeshIP, newIP, nonce)
+
+	d.mu.Lock()
+	d.localNode.MeshIP = newIP
+	d.localNode.MeshIPNonce = nonce
+	d.localNode.MeshIPReserved = false
+	meshIPv6 := d.localNode.MeshIPv6
+	d.mu.Unlock()
+
+	if err := setMeshAddresses(config.InterfaceName, newIP, config.MeshPrefixLen(), meshIPv6); err != nil {
+		log.Printf("[Collision] Failed to update interface address: %v", err)
+	}
+	if err := saveLocalNode(localNodeStatePath(config.InterfaceName), d.localNode); err != nil {
+		log.Printf("[Collision] Failed to save mesh IP nonce: %v", err)
+	}
+	d.restartDNS()
+
+	d.announceLocalNode()
 }
 
 // safeKeyPrefix safely returns a prefix of a key for logging
@@ -120,17 +173,18 @@ func safeKeyPrefix(key string) string {
 	return key
 }
 
-// DeriveMeshIPWithCollisionCheck derives a mesh IP and checks for collisions
-func DeriveMeshIPWithCollisionCheck(meshSubnet [2]byte, wgPubKey, secret string, existingIPs map[string]string) string {
-	ip := crypto.DeriveMeshIP(meshSubnet, wgPubKey, secret)
+// DeriveMeshIPWithCollisionCheck derives a mesh IP that is not in existingIPs
+// and returns it with the nonce it was derived with (0 for DeriveMeshIP)
+func DeriveMeshIPWithCollisionCheck(meshSubnet *net.IPNet, wgPubKey, secret string, existingIPs map[string]string) (string, int) {
+	ip := crypto.DeriveMeshIPInSubnet(meshSubnet, wgPubKey, secret)
 
 	// Check for collision
-	for nonce := 1; nonce <= 10; nonce++ {
+	for nonce := 1; nonce <= MaxMeshIPNonce; nonce++ {
 		if owner, exists := existingIPs[ip]; !exists || owner == wgPubKey {
-			return ip
+			return ip, nonce - 1
 		}
 		ip = DeriveMeshIPWithNonce(meshSubnet, wgPubKey, secret, nonce)
 	}
 
-	return ip
+	return ip, MaxMeshIPNonce
 }
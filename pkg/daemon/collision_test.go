@@ -2,6 +2,8 @@ package daemon
 
 import (
 	"testing"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
 )
 
 func TestDetectCollisions(t *testing.T) {
@@ -14,16 +16,22 @@ func TestDetectCollisions(t *testing.T) {
 	}
 
 	// Add two peers with different IPs
-	ps.Update(&PeerInfo{WGPubKey: "key1", MeshIP: "10.0.0.1"}, "test")
-	ps.Update(&PeerInfo{WGPubKey: "key2", MeshIP: "10.0.0.2"}, "test")
+	ps.Update(&PeerInfo{WGPubKey: "key1", IdentityKey: "id1", MeshIP: "10.0.0.1"}, "test")
+	ps.Update(&PeerInfo{WGPubKey: "key2", IdentityKey: "id2", MeshIP: "10.0.0.2"}, "test")
 
 	collisions = ps.DetectCollisions()
 	if len(collisions) != 0 {
 		t.Errorf("Expected 0 collisions, got %d", len(collisions))
 	}
 
+	// A transitive entry without an identity doesn't count
+	ps.Update(&PeerInfo{WGPubKey: "key0", MeshIP: "10.0.0.1"}, "gossip")
+	if collisions = ps.DetectCollisions(); len(collisions) != 0 {
+		t.Errorf("Expected unsigned entries to be ignored, got %d collisions", len(collisions))
+	}
+
 	// Add a peer with a colliding IP
-	ps.Update(&PeerInfo{WGPubKey: "key3", MeshIP: "10.0.0.1"}, "test")
+	ps.Update(&PeerInfo{WGPubKey: "key3", IdentityKey: "id3", MeshIP: "10.0.0.1"}, "test")
 
 	collisions = ps.DetectCollisions()
 	if len(collisions) != 1 {
@@ -52,10 +60,19 @@ func TestDeterministicWinner(t *testing.T) {
 	if winner.WGPubKey != "aaa" {
 		t.Error("Lower pubkey should win regardless of order")
 	}
+
+	// A reserved mesh IP wins over a derived one
+	reserved := &PeerInfo{WGPubKey: "zzz", MeshIPReserved: true}
+	if winner, _ := DeterministicWinner(peer1, reserved); winner != reserved {
+		t.Error("Reserved mesh IP should win over a lower pubkey")
+	}
+	if winner, _ := DeterministicWinner(reserved, &PeerInfo{WGPubKey: "aab", MeshIPReserved: true}); winner.WGPubKey != "aab" {
+		t.Error("Lower pubkey should win between two reservations")
+	}
 }
 
 func TestDeriveMeshIPWithNonce(t *testing.T) {
-	meshSubnet := [2]byte{42, 0}
+	meshSubnet := crypto.DefaultMeshSubnet([2]byte{42, 0})
 
 	ip0 := DeriveMeshIPWithNonce(meshSubnet, "pubkey", "secret-that-is-long-enough!", 0)
 	ip1 := DeriveMeshIPWithNonce(meshSubnet, "pubkey", "secret-that-is-long-enough!", 1)
@@ -72,22 +89,68 @@ func TestDeriveMeshIPWithNonce(t *testing.T) {
 }
 
 func TestDeriveMeshIPWithCollisionCheck(t *testing.T) {
-	meshSubnet := [2]byte{42, 0}
+	meshSubnet := crypto.DefaultMeshSubnet([2]byte{42, 0})
 	secret := "test-secret-that-is-long-enough"
 
 	existingIPs := map[string]string{} // No existing IPs
 
-	ip := DeriveMeshIPWithCollisionCheck(meshSubnet, "pubkey1", secret, existingIPs)
+	ip, nonce := DeriveMeshIPWithCollisionCheck(meshSubnet, "pubkey1", secret, existingIPs)
 	if ip == "" {
 		t.Error("Expected non-empty IP")
 	}
+	if nonce != 0 {
+		t.Errorf("Expected nonce 0 without collisions, got %d", nonce)
+	}
 
 	// Test with a collision
 	existingIPs[ip] = "other-pubkey"
-	ip2 := DeriveMeshIPWithCollisionCheck(meshSubnet, "pubkey1", secret, existingIPs)
+	ip2, nonce2 := DeriveMeshIPWithCollisionCheck(meshSubnet, "pubkey1", secret, existingIPs)
 
 	// Should get a different IP due to nonce
 	if ip == ip2 {
 		t.Error("Should derive different IP when collision exists")
 	}
+	if nonce2 != 1 || ip2 != DeriveMeshIPWithNonce(meshSubnet, "pubkey1", secret, nonce2) {
+		t.Errorf("Expected %s to be derived with nonce 1, got nonce %d", ip2, nonce2)
+	}
+}
+
+// fakeDiscovery records how the daemon hands it a changed local node
+type fakeDiscovery struct {
+	started, stopped int
+	meshIP           string
+	nonce            int
+	reserved         bool
+	reannounced      int
+}
+
+func (f *fakeDiscovery) Start() error { f.started++; return nil }
+func (f *fakeDiscovery) Stop() error  { f.stopped++; return nil }
+func (f *fakeDiscovery) Reannounce()  { f.reannounced++ }
+
+func (f *fakeDiscovery) SetMeshIP(meshIP string, nonce int, reserved bool) {
+	f.meshIP, f.nonce, f.reserved = meshIP, nonce, reserved
+}
+
+func TestAnnounceLocalNodeKeepsDiscoveryRunning(t *testing.T) {
+	d := newTestDaemon(t)
+	discovery := &fakeDiscovery{}
+	d.discovery = discovery
+	d.localNode.MeshIP = "10.1.0.7"
+	d.localNode.MeshIPNonce = 2
+
+	d.announceLocalNode()
+
+	if discovery.started != 0 || discovery.stopped != 0 {
+		t.Errorf("Discovery was restarted (%d starts, %d stops)", discovery.started, discovery.stopped)
+	}
+	if discovery.meshIP != "10.1.0.7" || discovery.nonce != 2 || discovery.reserved {
+		t.Errorf("SetMeshIP got %s nonce %d reserved %v, want 10.1.0.7 nonce 2", discovery.meshIP, discovery.nonce, discovery.reserved)
+	}
+	if discovery.reannounced != 1 {
+		t.Errorf("Reannounce called %d times, want 1", discovery.reannounced)
+	}
+	if d.currentDiscovery() != discovery {
+		t.Error("Discovery layer was replaced")
+	}
 }
@@ -1,11 +1,17 @@
 package daemon
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
 
+	"github.com/atvirokodosprendimai/wgmesh/pkg/acl"
 	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
 )
 
@@ -14,6 +20,13 @@ const (
 	URIVersion       = "v1"
 	DefaultWGPort    = 51820
 	DefaultInterface = "wg0"
+
+	// MinMeshPrefixLen and MaxMeshPrefixLen bound the size of the mesh subnet
+	MinMeshPrefixLen = 8
+	MaxMeshPrefixLen = 30
+
+	// MaxNodeNameLen is the longest node name, one DNS label
+	MaxNodeNameLen = 63
 )
 
 // Config holds all derived configuration for the mesh daemon
@@ -25,6 +38,76 @@ type Config struct {
 	AdvertiseRoutes []string
 	LogLevel        string
 	Privacy         bool
+
+	// MeshSubnet is the IPv4 subnet mesh IPs are derived in: 10.X.0.0/16 from
+	// the secret unless the secret URI or --mesh-subnet selects another
+	MeshSubnet *net.IPNet
+
+	// MeshIP is a static mesh IP reserved with --mesh-ip, used instead of the
+	// derived one (derived if empty)
+	MeshIP string
+
+	// NodeName is advertised to peers, defaults to the hostname
+	NodeName string
+
+	// MeshName names the mesh in DNS, nodes resolve as <node>.<mesh name>.mesh.
+	// Defaults to the interface name.
+	MeshName string
+
+	// DisableDNS turns off the mesh DNS server
+	DisableDNS bool
+
+	// Tags are announced to peers and matched by the ACL policy
+	Tags []string
+
+	// ACLPolicyFile is a policy update signed with the admin key (see package
+	// acl and wgmesh acl --out) distributed to the mesh on start-up, unless
+	// the mesh already runs it or a newer policy
+	ACLPolicyFile string
+
+	// AdminKey is the mesh admin public key from --admin-key or the "admin"
+	// secret URI parameter. Revocations are only accepted when signed with
+	// it, and not at all without one.
+	AdminKey ed25519.PublicKey
+
+	// adminKeyFlag is the --admin-key value, which WithSecret keeps over the URI
+	adminKeyFlag string
+
+	// meshSubnetFlag and meshSubnetParams are the --mesh-subnet value and the
+	// secret URI parameters the subnet was chosen from, kept for WithSecret
+	meshSubnetFlag   string
+	meshSubnetParams url.Values
+
+	// Discovery layer switches (all layers run by default)
+	DisableLAN    bool
+	DisableDHT    bool
+	DisableGossip bool
+
+	// DHTStaticID announces under the static network ID instead of the hourly
+	// rotating one, for meshes that still run nodes without rotation support
+	DHTStaticID bool
+
+	// Registry is the rendezvous registry to publish to and bootstrap from:
+	// "github", "github://owner/repo" or a self-hosted http(s) URL (disabled if empty)
+	Registry string
+
+	// STUNServers are asked for the public address of the WireGuard port (STUN is off if empty)
+	STUNServers []string
+
+	// DisableRelay stops this node from offering to forward traffic between
+	// peers, even when it is publicly reachable
+	DisableRelay bool
+
+	// AdvertiseExitNode offers peers to route their internet traffic through
+	// this node, which masquerades it
+	AdvertiseExitNode bool
+
+	// UseExitNode is the name or WireGuard public key of the peer our own
+	// internet traffic goes through (none if empty)
+	UseExitNode string
+
+	// MetricsListen is the address for the Prometheus endpoint (disabled if empty)
+	MetricsListen string
 }
 
 // DaemonOpts holds options for the daemon
@@ -35,6 +118,24 @@ type DaemonOpts struct {
 	AdvertiseRoutes []string
 	LogLevel        string
 	Privacy         bool
+	MeshSubnet      string // CIDR, overrides the subnet and prefix URI parameters
+	MeshIP          string // static mesh IP reservation
+	NodeName        string // empty selects DefaultNodeName
+	MeshName        string // empty selects the interface name
+	DisableDNS      bool
+	Tags            []string
+	ACLPolicyFile   string
+	AdminKey        string // admin public key, overrides the admin URI parameter
+	DisableLAN      bool
+	DisableDHT      bool
+	DisableGossip   bool
+	DHTStaticID     bool
+	Registry        string
+	STUNServers     []string // nil selects DefaultSTUNServers
+	DisableRelay    bool
+	ExitNode        bool   // --advertise-exit-node
+	UseExitNode     string // name or pubkey of an exit node
+	MetricsListen   string
 }
 
 // NewConfig creates a new daemon configuration from options
@@ -48,23 +149,84 @@ func NewConfig(opts DaemonOpts) (*Config, error) {
 		return nil, fmt.Errorf("failed to derive keys: %w", err)
 	}
 
+	params := parseSecretParams(opts.Secret)
+	meshSubnet, err := resolveMeshSubnet(opts.MeshSubnet, params, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	adminKey, err := resolveAdminKey(opts.AdminKey, params)
+	if err != nil {
+		return nil, err
+	}
+
+	meshIP := opts.MeshIP
+	if meshIP != "" {
+		if err := checkReservedMeshIP(meshSubnet, meshIP); err != nil {
+			return nil, err
+		}
+		meshIP = net.ParseIP(meshIP).To4().String()
+	}
+
+	nodeName := opts.NodeName
+	if nodeName == "" {
+		nodeName = DefaultNodeName()
+	} else if !ValidNodeName(nodeName) {
+		return nil, fmt.Errorf("invalid node name %q: use up to %d lowercase letters, digits and hyphens", nodeName, MaxNodeNameLen)
+	}
+
+	for _, route := range opts.AdvertiseRoutes {
+		if isDefaultRoute(route) {
+			return nil, fmt.Errorf("advertising %s would take over every peer's default route, use --advertise-exit-node instead", route)
+		}
+	}
+
+	if opts.UseExitNode != "" {
+		if opts.ExitNode {
+			return nil, fmt.Errorf("a node cannot advertise itself as an exit node and use another one")
+		}
+		if !ValidNodeName(opts.UseExitNode) && !validWGKey(opts.UseExitNode) {
+			return nil, fmt.Errorf("invalid exit node %q: use a node name or WireGuard public key", opts.UseExitNode)
+		}
+	}
+
+	for _, tag := range opts.Tags {
+		if !acl.ValidTag(tag) {
+			return nil, fmt.Errorf("invalid tag %q: use lowercase letters, digits, hyphens and underscores", tag)
+		}
+	}
+
 	// Set defaults
 	ifaceName := opts.InterfaceName
 	if ifaceName == "" {
 		ifaceName = DefaultInterface
 	}
 
+	meshName := opts.MeshName
+	if meshName == "" {
+		if meshName = sanitizeNodeName(ifaceName); meshName == "" {
+			meshName = "wgmesh"
+		}
+	} else if !ValidNodeName(meshName) {
+		return nil, fmt.Errorf("invalid mesh name %q: use up to %d lowercase letters, digits and hyphens", meshName, MaxNodeNameLen)
+	}
+
 	listenPort := opts.WGListenPort
 	if listenPort == 0 {
 		listenPort = DefaultWGPort
 	}
 
+	stunServers := opts.STUNServers
+	if stunServers == nil {
+		stunServers = DefaultSTUNServers
+	}
+
 	logLevel := opts.LogLevel
 	if logLevel == "" {
 		logLevel = "info"
 	}
 
-	return &Config{
+	cfg := &Config{
 		Secret:          secret,
 		Keys:            keys,
 		InterfaceName:   ifaceName,
@@ -72,7 +234,273 @@ func NewConfig(opts DaemonOpts) (*Config, error) {
 		AdvertiseRoutes: opts.AdvertiseRoutes,
 		LogLevel:        logLevel,
 		Privacy:         opts.Privacy,
-	}, nil
+		MeshSubnet:      meshSubnet,
+		MeshIP:          meshIP,
+		NodeName:        nodeName,
+		MeshName:        meshName,
+		DisableDNS:      opts.DisableDNS,
+		Tags:            opts.Tags,
+		ACLPolicyFile:   opts.ACLPolicyFile,
+		AdminKey:        adminKey,
+		DisableLAN:      opts.DisableLAN,
+		DisableDHT:      opts.DisableDHT,
+		DisableGossip:   opts.DisableGossip,
+		DHTStaticID:     opts.DHTStaticID,
+		Registry:        opts.Registry,
+		STUNServers:     stunServers,
+		DisableRelay:    opts.DisableRelay,
+		MetricsListen:   opts.MetricsListen,
+
+		AdvertiseExitNode: opts.ExitNode,
+		UseExitNode:       opts.UseExitNode,
+	}
+	cfg.meshSubnetFlag = opts.MeshSubnet
+	cfg.meshSubnetParams = params
+	cfg.adminKeyFlag = opts.AdminKey
+	return cfg, nil
+}
+
+// WithSecret returns a copy of the config with keys derived from a different secret.
+// A subnet or admin key chosen in the old secret URI is kept unless the new
+// URI picks one, a reserved mesh IP has to fit the new subnet.
+func (c *Config) WithSecret(secret string) (*Config, error) {
+	params := parseSecretParams(secret)
+	adminKey := c.AdminKey
+	if c.adminKeyFlag == "" && params.Get("admin") != "" {
+		key, err := crypto.ParseAdminKey(params.Get("admin"))
+		if err != nil {
+			return nil, err
+		}
+		adminKey = key
+	}
+	if params.Get("subnet") == "" && params.Get("prefix") == "" && c.meshSubnetParams != nil {
+		params = c.meshSubnetParams
+	}
+	secret = parseSecret(secret)
+	keys, err := crypto.DeriveKeys(secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive keys: %w", err)
+	}
+
+	meshSubnet, err := resolveMeshSubnet(c.meshSubnetFlag, params, keys)
+	if err != nil {
+		return nil, err
+	}
+	if c.MeshIP != "" {
+		if err := checkReservedMeshIP(meshSubnet, c.MeshIP); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := *c
+	cfg.Secret = secret
+	cfg.Keys = keys
+	cfg.MeshSubnet = meshSubnet
+	cfg.meshSubnetParams = params
+	cfg.AdminKey = adminKey
+	return &cfg, nil
+}
+
+// resolveAdminKey parses the admin key from --admin-key, falling back to the
+// secret URI parameter (nil if neither is set)
+func resolveAdminKey(flag string, params url.Values) (ed25519.PublicKey, error) {
+	value := flag
+	if value == "" {
+		value = params.Get("admin")
+	}
+	if value == "" {
+		return nil, nil
+	}
+	return crypto.ParseAdminKey(value)
+}
+
+// DeriveMeshIP derives a node's mesh IP in the configured subnet
+func (c *Config) DeriveMeshIP(wgPubKey string) string {
+	return crypto.DeriveMeshIPInSubnet(c.meshSubnet(), wgPubKey, c.Secret)
+}
+
+// MeshIPForNonce derives a node's mesh IP with a collision nonce, where nonce 0
+// is the plain DeriveMeshIP address
+func (c *Config) MeshIPForNonce(wgPubKey string, nonce int) string {
+	if nonce == 0 {
+		return c.DeriveMeshIP(wgPubKey)
+	}
+	return DeriveMeshIPWithNonce(c.meshSubnet(), wgPubKey, c.Secret, nonce)
+}
+
+// NodeMeshIP returns the local node's mesh IP: the reservation if there is
+// one, otherwise the address derived with the collision nonce
+func (c *Config) NodeMeshIP(wgPubKey string, nonce int) (string, bool) {
+	if c.MeshIP != "" {
+		return c.MeshIP, true
+	}
+	return c.MeshIPForNonce(wgPubKey, nonce), false
+}
+
+// VerifyMeshIP checks that announced mesh addresses are the ones derived from
+// the node's pubkey, so no node can claim another node's address. Reserved
+// addresses cannot be derived and only have to be host addresses in the
+// mesh subnet; collisions with them are resolved in their favour.
+func (c *Config) VerifyMeshIP(wgPubKey, meshIP, meshIPv6 string, nonce int, reserved bool) error {
+	if reserved {
+		if err := checkReservedMeshIP(c.meshSubnet(), meshIP); err != nil {
+			return fmt.Errorf("%w: reserved %s for %s", ErrMeshIPMismatch, meshIP, safeKeyPrefix(wgPubKey))
+		}
+	} else if nonce < 0 || nonce > MaxMeshIPNonce || meshIP != c.MeshIPForNonce(wgPubKey, nonce) {
+		return fmt.Errorf("%w: %s (nonce %d) for %s", ErrMeshIPMismatch, meshIP, nonce, safeKeyPrefix(wgPubKey))
+	}
+	if meshIPv6 != "" && meshIPv6 != crypto.DeriveMeshIPv6(c.Keys.MeshPrefixV6, wgPubKey, c.Secret) {
+		return fmt.Errorf("%w: %s for %s", ErrMeshIPMismatch, meshIPv6, safeKeyPrefix(wgPubKey))
+	}
+	return nil
+}
+
+// MeshPrefixLen returns the prefix length of the mesh subnet
+func (c *Config) MeshPrefixLen() int {
+	ones, _ := c.meshSubnet().Mask.Size()
+	return ones
+}
+
+// meshSubnet returns the mesh subnet, falling back to the one derived from
+// the secret for configs not built by NewConfig
+func (c *Config) meshSubnet() *net.IPNet {
+	if c.MeshSubnet != nil {
+		return c.MeshSubnet
+	}
+	return crypto.DefaultMeshSubnet(c.Keys.MeshSubnet)
+}
+
+// resolveMeshSubnet picks the mesh subnet: the --mesh-subnet flag, then the
+// subnet and prefix parameters of the secret URI, then 10.X.0.0/16. With only
+// a prefix length the subnet stays in 10.0.0.0/8, based at the address derived
+// from the secret, so all nodes with the same URI end up with the same subnet.
+func resolveMeshSubnet(flagValue string, params url.Values, keys *crypto.DerivedKeys) (*net.IPNet, error) {
+	value := flagValue
+	if value == "" {
+		value = params.Get("subnet")
+	}
+	if value != "" {
+		return ParseMeshSubnet(value)
+	}
+
+	prefix := params.Get("prefix")
+	if prefix == "" {
+		return crypto.DefaultMeshSubnet(keys.MeshSubnet), nil
+	}
+	ones, err := strconv.Atoi(strings.TrimPrefix(prefix, "/"))
+	if err != nil || ones < MinMeshPrefixLen || ones > MaxMeshPrefixLen {
+		return nil, fmt.Errorf("invalid mesh prefix %q: must be between /%d and /%d", prefix, MinMeshPrefixLen, MaxMeshPrefixLen)
+	}
+	base := net.IPv4(10, keys.MeshSubnet[0], keys.MeshSubnet[1], 0)
+	mask := net.CIDRMask(ones, 32)
+	return &net.IPNet{IP: base.Mask(mask), Mask: mask}, nil
+}
+
+// ParseMeshSubnet parses an IPv4 mesh subnet in CIDR notation
+func ParseMeshSubnet(value string) (*net.IPNet, error) {
+	_, subnet, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mesh subnet %q: %w", value, err)
+	}
+	ones, bits := subnet.Mask.Size()
+	if bits != 32 {
+		return nil, fmt.Errorf("invalid mesh subnet %q: must be IPv4", value)
+	}
+	if ones < MinMeshPrefixLen || ones > MaxMeshPrefixLen {
+		return nil, fmt.Errorf("invalid mesh subnet %q: prefix must be between /%d and /%d", value, MinMeshPrefixLen, MaxMeshPrefixLen)
+	}
+	return subnet, nil
+}
+
+// checkReservedMeshIP checks that a reserved mesh IP is a host address in the
+// mesh subnet
+func checkReservedMeshIP(subnet *net.IPNet, value string) error {
+	ip := net.ParseIP(value).To4()
+	if ip == nil {
+		return fmt.Errorf("invalid mesh IP %q: must be an IPv4 address", value)
+	}
+	if !subnet.Contains(ip) {
+		return fmt.Errorf("invalid mesh IP %s: not in the mesh subnet %s", value, subnet)
+	}
+	network := subnet.IP.To4()
+	broadcast := make(net.IP, len(network))
+	for i := range network {
+		broadcast[i] = network[i] | ^subnet.Mask[i]
+	}
+	if ip.Equal(network) || ip.Equal(broadcast) {
+		return fmt.Errorf("invalid mesh IP %s: network or broadcast address of %s", value, subnet)
+	}
+	return nil
+}
+
+// ValidNodeName reports whether name can be used as a node name: a DNS label
+// of lowercase letters, digits and hyphens
+func ValidNodeName(name string) bool {
+	if name == "" || len(name) > MaxNodeNameLen || name[0] == '-' || name[len(name)-1] == '-' {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// DefaultNodeName returns the first label of the hostname made into a valid
+// node name, or "" if nothing usable is left
+func DefaultNodeName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	label, _, _ := strings.Cut(hostname, ".")
+	return sanitizeNodeName(label)
+}
+
+// sanitizeNodeName turns s into a valid node name by lowercasing it and
+// replacing other characters with hyphens, "" if nothing usable is left
+func sanitizeNodeName(s string) string {
+	name := strings.Map(func(c rune) rune {
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' {
+			return c
+		}
+		return '-'
+	}, strings.ToLower(s))
+	if len(name) > MaxNodeNameLen {
+		name = name[:MaxNodeNameLen]
+	}
+	name = strings.Trim(name, "-")
+	if !ValidNodeName(name) {
+		return ""
+	}
+	return name
+}
+
+// DNSDomain returns the domain node names resolve under
+func (c *Config) DNSDomain() string {
+	return c.MeshName + "." + DNSTopLevelDomain
+}
+
+// DiscoveryLayers returns a human-readable list of the enabled discovery layers
+func (c *Config) DiscoveryLayers() string {
+	var layers []string
+	if !c.DisableLAN {
+		layers = append(layers, "lan")
+	}
+	if !c.DisableDHT {
+		layers = append(layers, "dht")
+	}
+	if !c.DisableGossip {
+		layers = append(layers, "gossip")
+	}
+	if c.Registry != "" {
+		layers = append(layers, "registry")
+	}
+	if len(layers) == 0 {
+		return "none"
+	}
+	return strings.Join(layers, ", ")
 }
 
 // GenerateSecret generates a new random mesh secret
@@ -94,6 +522,28 @@ func FormatSecretURI(secret string) string {
 	return fmt.Sprintf("%s%s/%s", URIPrefix, URIVersion, secret)
 }
 
+// FormatSecretURIWithSubnet formats a secret as a wgmesh:// URI that selects
+// a mesh subnet, so every node joining with it derives the same addresses
+func FormatSecretURIWithSubnet(secret, subnet string) string {
+	return FormatSecretURIWithParams(secret, subnet, "")
+}
+
+// FormatSecretURIWithParams formats a secret as a wgmesh:// URI that selects
+// a mesh subnet and pins an admin public key (both optional)
+func FormatSecretURIWithParams(secret, subnet, adminKey string) string {
+	var params []string
+	if subnet != "" {
+		params = append(params, "subnet="+subnet)
+	}
+	if adminKey != "" {
+		params = append(params, "admin="+adminKey)
+	}
+	if len(params) == 0 {
+		return FormatSecretURI(secret)
+	}
+	return FormatSecretURI(secret) + "?" + strings.Join(params, "&")
+}
+
 // parseSecret extracts the raw secret from various input formats
 func parseSecret(input string) string {
 	input = strings.TrimSpace(input)
@@ -115,3 +565,20 @@ func parseSecret(input string) string {
 
 	return input
 }
+
+// parseSecretParams returns the query parameters of a wgmesh:// URI
+func parseSecretParams(input string) url.Values {
+	input = strings.TrimSpace(input)
+	if !strings.HasPrefix(input, URIPrefix) {
+		return url.Values{}
+	}
+	_, query, ok := strings.Cut(input, "?")
+	if !ok {
+		return url.Values{}
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return url.Values{}
+	}
+	return params
+}
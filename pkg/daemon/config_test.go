@@ -0,0 +1,204 @@
+package daemon
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
+)
+
+func TestMeshSubnetFromURI(t *testing.T) {
+	secret := "test-secret-that-is-long-enough"
+
+	cfg, err := NewConfig(DaemonOpts{Secret: FormatSecretURIWithSubnet(secret, "100.64.0.0/10")})
+	if err != nil {
+		t.Fatalf("NewConfig failed: %v", err)
+	}
+	if cfg.Secret != secret {
+		t.Errorf("Expected the query to be stripped from the secret, got %q", cfg.Secret)
+	}
+	if cfg.MeshSubnet.String() != "100.64.0.0/10" || cfg.MeshPrefixLen() != 10 {
+		t.Errorf("Expected 100.64.0.0/10, got %s", cfg.MeshSubnet)
+	}
+	if ip := cfg.DeriveMeshIP("pubkey"); !cfg.MeshSubnet.Contains(net.ParseIP(ip)) {
+		t.Errorf("Mesh IP %s is outside %s", ip, cfg.MeshSubnet)
+	}
+
+	// The flag takes precedence over the URI
+	cfg, err = NewConfig(DaemonOpts{Secret: FormatSecretURIWithSubnet(secret, "100.64.0.0/10"), MeshSubnet: "172.30.0.0/16"})
+	if err != nil {
+		t.Fatalf("NewConfig failed: %v", err)
+	}
+	if cfg.MeshSubnet.String() != "172.30.0.0/16" {
+		t.Errorf("Expected 172.30.0.0/16 from the flag, got %s", cfg.MeshSubnet)
+	}
+
+	// Without parameters the subnet is derived from the secret as before
+	plain, err := NewConfig(DaemonOpts{Secret: FormatSecretURI(secret)})
+	if err != nil {
+		t.Fatalf("NewConfig failed: %v", err)
+	}
+	if plain.MeshPrefixLen() != 16 || plain.MeshSubnet.IP[0] != 10 || plain.MeshSubnet.IP[1] != plain.Keys.MeshSubnet[0] {
+		t.Errorf("Expected 10.%d.0.0/16, got %s", plain.Keys.MeshSubnet[0], plain.MeshSubnet)
+	}
+
+	// A prefix length alone stays in 10.0.0.0/8 and is the same on every node
+	cfg, err = NewConfig(DaemonOpts{Secret: FormatSecretURI(secret) + "?prefix=20"})
+	if err != nil {
+		t.Fatalf("NewConfig failed: %v", err)
+	}
+	if cfg.MeshPrefixLen() != 20 || !plain.MeshSubnet.Contains(cfg.MeshSubnet.IP) {
+		t.Errorf("Expected a /20 inside %s, got %s", plain.MeshSubnet, cfg.MeshSubnet)
+	}
+
+	for _, uri := range []string{
+		FormatSecretURIWithSubnet(secret, "fd00::/64"),
+		FormatSecretURIWithSubnet(secret, "10.0.0.0/31"),
+		FormatSecretURI(secret) + "?prefix=4",
+	} {
+		if _, err := NewConfig(DaemonOpts{Secret: uri}); err == nil {
+			t.Errorf("Expected %s to be rejected", uri)
+		}
+	}
+}
+
+func TestWithSecretKeepsMeshSubnet(t *testing.T) {
+	cfg, err := NewConfig(DaemonOpts{Secret: FormatSecretURIWithSubnet("test-secret-that-is-long-enough", "100.64.0.0/10")})
+	if err != nil {
+		t.Fatalf("NewConfig failed: %v", err)
+	}
+
+	rotated, err := cfg.WithSecret(FormatSecretURI("another-secret-that-is-long-enough"))
+	if err != nil {
+		t.Fatalf("WithSecret failed: %v", err)
+	}
+	if rotated.MeshSubnet.String() != "100.64.0.0/10" {
+		t.Errorf("Expected the subnet to survive rotation, got %s", rotated.MeshSubnet)
+	}
+
+	rotated, err = cfg.WithSecret(FormatSecretURIWithSubnet("another-secret-that-is-long-enough", "172.30.0.0/16"))
+	if err != nil {
+		t.Fatalf("WithSecret failed: %v", err)
+	}
+	if rotated.MeshSubnet.String() != "172.30.0.0/16" {
+		t.Errorf("Expected the new URI's subnet, got %s", rotated.MeshSubnet)
+	}
+}
+
+func TestAdminKeyFromURI(t *testing.T) {
+	pub, _, err := crypto.GenerateAdminKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := crypto.EncodeAdminKey(pub)
+
+	cfg, err := NewConfig(DaemonOpts{Secret: FormatSecretURIWithParams("test-secret-that-is-long-enough", "100.64.0.0/10", encoded)})
+	if err != nil {
+		t.Fatalf("NewConfig failed: %v", err)
+	}
+	if !cfg.AdminKey.Equal(pub) || cfg.MeshSubnet.String() != "100.64.0.0/10" {
+		t.Errorf("Expected admin key and subnet from the URI, got %v %s", cfg.AdminKey, cfg.MeshSubnet)
+	}
+
+	// The admin key outlives secret rotations
+	rotated, err := cfg.WithSecret(FormatSecretURI("another-secret-that-is-long-enough"))
+	if err != nil {
+		t.Fatalf("WithSecret failed: %v", err)
+	}
+	if !rotated.AdminKey.Equal(pub) {
+		t.Error("Expected the admin key to survive rotation")
+	}
+
+	if _, err := NewConfig(DaemonOpts{Secret: "test-secret-that-is-long-enough", AdminKey: "bogus"}); err == nil {
+		t.Error("Expected an invalid admin key to be rejected")
+	}
+}
+
+func TestVerifyMeshIP(t *testing.T) {
+	cfg, err := NewConfig(DaemonOpts{Secret: "test-secret-that-is-long-enough"})
+	if err != nil {
+		t.Fatalf("NewConfig failed: %v", err)
+	}
+
+	ipv6 := crypto.DeriveMeshIPv6(cfg.Keys.MeshPrefixV6, "pubkey", cfg.Secret)
+	if err := cfg.VerifyMeshIP("pubkey", cfg.DeriveMeshIP("pubkey"), ipv6, 0, false); err != nil {
+		t.Errorf("Derived address rejected: %v", err)
+	}
+	if err := cfg.VerifyMeshIP("pubkey", cfg.MeshIPForNonce("pubkey", 2), "", 2, false); err != nil {
+		t.Errorf("Address derived with a nonce rejected: %v", err)
+	}
+
+	// Another node's address, a nonce that does not match and a nonce out of range
+	if err := cfg.VerifyMeshIP("pubkey", cfg.DeriveMeshIP("other"), "", 0, false); !errors.Is(err, ErrMeshIPMismatch) {
+		t.Errorf("Expected ErrMeshIPMismatch for another node's address, got %v", err)
+	}
+	if err := cfg.VerifyMeshIP("pubkey", cfg.MeshIPForNonce("pubkey", 2), "", 1, false); !errors.Is(err, ErrMeshIPMismatch) {
+		t.Errorf("Expected ErrMeshIPMismatch for the wrong nonce, got %v", err)
+	}
+	if err := cfg.VerifyMeshIP("pubkey", cfg.MeshIPForNonce("pubkey", MaxMeshIPNonce+1), "", MaxMeshIPNonce+1, false); !errors.Is(err, ErrMeshIPMismatch) {
+		t.Errorf("Expected ErrMeshIPMismatch for a nonce above the limit, got %v", err)
+	}
+	if err := cfg.VerifyMeshIP("pubkey", cfg.DeriveMeshIP("pubkey"), "fd00::1", 0, false); !errors.Is(err, ErrMeshIPMismatch) {
+		t.Errorf("Expected ErrMeshIPMismatch for a foreign IPv6 address, got %v", err)
+	}
+}
+
+func TestVerifyReservedMeshIP(t *testing.T) {
+	cfg, err := NewConfig(DaemonOpts{Secret: FormatSecretURIWithSubnet("test-secret-that-is-long-enough", "10.50.0.0/24")})
+	if err != nil {
+		t.Fatalf("NewConfig failed: %v", err)
+	}
+
+	if err := cfg.VerifyMeshIP("pubkey", "10.50.0.7", "", 0, true); err != nil {
+		t.Errorf("Reserved address rejected: %v", err)
+	}
+	for _, ip := range []string{"10.50.1.7", "10.50.0.0", "10.50.0.255", "not-an-ip"} {
+		if err := cfg.VerifyMeshIP("pubkey", ip, "", 0, true); !errors.Is(err, ErrMeshIPMismatch) {
+			t.Errorf("Expected ErrMeshIPMismatch for reserved %s, got %v", ip, err)
+		}
+	}
+	// Without the reserved flag the address has to be derived
+	if err := cfg.VerifyMeshIP("pubkey", "10.50.0.7", "", 0, false); !errors.Is(err, ErrMeshIPMismatch) {
+		t.Errorf("Expected ErrMeshIPMismatch for an unflagged reservation, got %v", err)
+	}
+}
+
+func TestMeshIPReservation(t *testing.T) {
+	secret := FormatSecretURIWithSubnet("test-secret-that-is-long-enough", "10.50.0.0/24")
+	cfg, err := NewConfig(DaemonOpts{Secret: secret, MeshIP: "10.50.0.7"})
+	if err != nil {
+		t.Fatalf("NewConfig failed: %v", err)
+	}
+	if ip, reserved := cfg.NodeMeshIP("pubkey", 3); ip != "10.50.0.7" || !reserved {
+		t.Errorf("Expected the reservation, got %s (reserved %v)", ip, reserved)
+	}
+
+	for _, ip := range []string{"10.51.0.7", "10.50.0.255", "fd00::7", "host"} {
+		if _, err := NewConfig(DaemonOpts{Secret: secret, MeshIP: ip}); err == nil {
+			t.Errorf("Expected reservation %s to be rejected", ip)
+		}
+	}
+
+	// The reservation has to fit the subnet of a rotated secret too
+	if _, err := cfg.WithSecret(FormatSecretURIWithSubnet("another-secret-that-is-long-enough", "172.30.0.0/16")); err == nil {
+		t.Error("Expected rotation to a subnet without the reservation to fail")
+	}
+}
+
+func TestValidNodeName(t *testing.T) {
+	for _, name := range []string{"web1", "db-eu-2", "a"} {
+		if !ValidNodeName(name) {
+			t.Errorf("Expected %q to be valid", name)
+		}
+	}
+	for _, name := range []string{"", "-web", "web-", "Web", "web.example", "web_1", strings.Repeat("a", MaxNodeNameLen+1)} {
+		if ValidNodeName(name) {
+			t.Errorf("Expected %q to be invalid", name)
+		}
+	}
+	if _, err := NewConfig(DaemonOpts{Secret: "test-secret-that-is-long-enough", NodeName: "Web_1"}); err == nil {
+		t.Error("Expected an invalid node name to be rejected")
+	}
+}
@@ -0,0 +1,489 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
+)
+
+const (
+	// ControlSocketDir is where the daemon creates its control sockets
+	ControlSocketDir = "/run/wgmesh"
+
+	controlRequestTimeout = 5 * time.Second
+)
+
+// ControlSocketPath returns the control socket path for an interface
+func ControlSocketPath(interfaceName string) string {
+	return filepath.Join(ControlSocketDir, interfaceName+".sock")
+}
+
+// StatusResponse is returned by GET /v1/status
+type StatusResponse struct {
+	Interface       string            `json:"interface"`
+	WGPubKey        string            `json:"wg_pubkey"`
+	IdentityKey     string            `json:"identity_key"`
+	Name            string            `json:"name,omitempty"`
+	MeshIP          string            `json:"mesh_ip"`
+	MeshIPReserved  bool              `json:"mesh_ip_reserved,omitempty"` // set with --mesh-ip
+	MeshIPv6        string            `json:"mesh_ipv6,omitempty"`
+	WGListenPort    int               `json:"wg_listen_port"`
+	NetworkID       string            `json:"network_id"`
+	MeshSubnet      string            `json:"mesh_subnet"`
+	MeshSubnetV6    string            `json:"mesh_subnet_v6"`
+	GossipPort      uint16            `json:"gossip_port"`
+	DNSDomain       string            `json:"dns_domain,omitempty"` // empty if the DNS server is off
+	Privacy         bool              `json:"privacy"`
+	DiscoveryLayers string            `json:"discovery_layers"`
+	Discovery       json.RawMessage   `json:"discovery,omitempty"`
+	Epoch           *EpochStatus      `json:"epoch,omitempty"`
+	Collisions      []CollisionStatus `json:"collisions"`
+	PeerCount       int               `json:"peer_count"`
+	ActivePeers     int               `json:"active_peers"`
+	StartedAt       time.Time         `json:"started_at"`
+	Rotation        *RotationStatus   `json:"rotation,omitempty"`
+	Revoked         []string          `json:"revoked,omitempty"`
+	Tags            []string          `json:"tags,omitempty"`
+	PolicyVersion   int64             `json:"policy_version,omitempty"` // 0 without an ACL policy
+	PolicyRules     int               `json:"policy_rules,omitempty"`
+	ExitNode        bool              `json:"exit_node,omitempty"`     // serving as an exit node
+	UseExitNode     string            `json:"use_exit_node,omitempty"` // --use-exit-node
+	ExitPeer        string            `json:"exit_peer,omitempty"`     // pubkey our internet traffic goes through
+}
+
+// EpochStatus describes the current Dandelion++ relay epoch
+type EpochStatus struct {
+	ID         uint64    `json:"id"`
+	RelayPeers []string  `json:"relay_peers"`
+	StartedAt  time.Time `json:"started_at"`
+	Duration   string    `json:"duration"`
+}
+
+// CollisionStatus describes a detected mesh IP collision
+type CollisionStatus struct {
+	MeshIP string `json:"mesh_ip"`
+	Winner string `json:"winner"`
+	Loser  string `json:"loser"`
+}
+
+// PeerStatus is a single entry returned by GET /v1/peers
+type PeerStatus struct {
+	WGPubKey         string    `json:"wg_pubkey"`
+	IdentityKey      string    `json:"identity_key,omitempty"`
+	Name             string    `json:"name,omitempty"`
+	MeshIP           string    `json:"mesh_ip"`
+	MeshIPReserved   bool      `json:"mesh_ip_reserved,omitempty"`
+	MeshIPv6         string    `json:"mesh_ipv6,omitempty"`
+	Endpoint         string    `json:"endpoint"`
+	Endpoints        []string  `json:"endpoints,omitempty"`
+	LatencyMs        float64   `json:"latency_ms,omitempty"` // RTT through the pinned endpoint
+	RoutableNetworks []string  `json:"routable_networks,omitempty"`
+	LastSeen         time.Time `json:"last_seen"`
+	DiscoveredVia    []string  `json:"discovered_via"`
+	Active           bool      `json:"active"`
+	RelayCapable     bool      `json:"relay_capable,omitempty"`
+	RelayedVia       string    `json:"relayed_via,omitempty"` // relay pubkey while unreachable directly
+	Tags             []string  `json:"tags,omitempty"`
+	Blocked          bool      `json:"blocked,omitempty"` // kept apart from us by the ACL policy
+	ExitNode         bool      `json:"exit_node,omitempty"`
+}
+
+// ControlServer serves the local control API over a Unix socket
+type ControlServer struct {
+	daemon   *Daemon
+	path     string
+	listener net.Listener
+	server   *http.Server
+}
+
+// NewControlServer creates a control server for the daemon
+func NewControlServer(d *Daemon, path string) *ControlServer {
+	cs := &ControlServer{
+		daemon: d,
+		path:   path,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/status", cs.handleStatus)
+	mux.HandleFunc("GET /v1/peers", cs.handlePeers)
+	mux.HandleFunc("POST /v1/rotate", cs.handleRotate)
+	mux.HandleFunc("POST /v1/revoke", cs.handleRevoke)
+	mux.HandleFunc("POST /v1/unrevoke", cs.handleUnrevoke)
+	mux.HandleFunc("GET /v1/policy", cs.handleGetPolicy)
+	mux.HandleFunc("POST /v1/policy", cs.handleSetPolicy)
+	cs.server = &http.Server{
+		Handler:     mux,
+		ReadTimeout: controlRequestTimeout,
+	}
+
+	return cs
+}
+
+// Start creates the socket and begins serving
+func (cs *ControlServer) Start() error {
+	if err := os.MkdirAll(filepath.Dir(cs.path), 0755); err != nil {
+		return fmt.Errorf("failed to create socket directory: %w", err)
+	}
+
+	// Remove a stale socket left behind by a previous run
+	if err := os.Remove(cs.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", cs.path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", cs.path, err)
+	}
+
+	// The API exposes mesh topology, restrict it to root
+	if err := os.Chmod(cs.path, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+
+	cs.listener = listener
+
+	go func() {
+		if err := cs.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("[Control] Server error: %v", err)
+		}
+	}()
+
+	log.Printf("[Control] API listening on %s", cs.path)
+	return nil
+}
+
+// Stop shuts down the server and removes the socket
+func (cs *ControlServer) Stop() error {
+	if cs.listener == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), controlRequestTimeout)
+	defer cancel()
+
+	err := cs.server.Shutdown(ctx)
+	os.Remove(cs.path)
+	return err
+}
+
+func (cs *ControlServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, cs.daemon.Status())
+}
+
+func (cs *ControlServer) handlePeers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, cs.daemon.PeerStatuses())
+}
+
+func (cs *ControlServer) handleRotate(w http.ResponseWriter, r *http.Request) {
+	var req RotateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+
+	status, err := cs.daemon.StartRotation(req.Announcement, req.NewSecret)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleRevoke takes a revocation signed with the admin key
+func (cs *ControlServer) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	cs.applyRevocation(w, r, false)
+}
+
+// handleUnrevoke takes a lifted revocation signed with the admin key
+func (cs *ControlServer) handleUnrevoke(w http.ResponseWriter, r *http.Request) {
+	cs.applyRevocation(w, r, true)
+}
+
+func (cs *ControlServer) applyRevocation(w http.ResponseWriter, r *http.Request, lifted bool) {
+	var revocation crypto.Revocation
+	if err := json.NewDecoder(r.Body).Decode(&revocation); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+	if revocation.Lifted != lifted {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("wrong endpoint for this revocation record"))
+		return
+	}
+
+	if err := cs.daemon.Revoke(&revocation); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &revocation)
+}
+
+func (cs *ControlServer) handleGetPolicy(w http.ResponseWriter, r *http.Request) {
+	update := cs.daemon.Policy()
+	if update == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no ACL policy is set"))
+		return
+	}
+	writeJSON(w, http.StatusOK, update)
+}
+
+// handleSetPolicy takes a policy update signed with the admin key
+func (cs *ControlServer) handleSetPolicy(w http.ResponseWriter, r *http.Request) {
+	var update crypto.PolicyUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+
+	if err := cs.daemon.SetPolicy(&update); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &update)
+}
+
+// writeError writes an {"error": ...} response
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// writeJSON writes v as a JSON response body
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[Control] Failed to write response: %v", err)
+	}
+}
+
+// Status returns a snapshot of the daemon state
+func (d *Daemon) Status() *StatusResponse {
+	config := d.currentConfig()
+	status := &StatusResponse{
+		Interface:       config.InterfaceName,
+		WGListenPort:    config.WGListenPort,
+		NetworkID:       hex.EncodeToString(config.Keys.NetworkID[:8]),
+		MeshSubnet:      config.meshSubnet().String(),
+		MeshSubnetV6:    net.IP(append(config.Keys.MeshPrefixV6[:], make([]byte, 8)...)).String() + "/64",
+		GossipPort:      config.Keys.GossipPort,
+		Privacy:         config.Privacy,
+		DiscoveryLayers: config.DiscoveryLayers(),
+		Collisions:      []CollisionStatus{},
+		PeerCount:       d.peerStore.Count(),
+		ActivePeers:     len(d.peerStore.GetActive()),
+		StartedAt:       d.startedAt,
+		Rotation:        d.RotationStatus(),
+	}
+
+	for _, r := range d.peerStore.Revocations() {
+		if !r.Lifted {
+			status.Revoked = append(status.Revoked, r.WGPubKey)
+		}
+	}
+	sort.Strings(status.Revoked)
+
+	d.mu.RLock()
+	if d.dnsServer != nil {
+		status.DNSDomain = config.DNSDomain()
+	}
+	if d.policyUpdate != nil {
+		status.PolicyVersion = d.policyUpdate.Version
+		status.PolicyRules = len(d.policy.Rules)
+	}
+	status.UseExitNode = config.UseExitNode
+	status.ExitPeer = d.exitPeer
+	d.mu.RUnlock()
+
+	if d.localNode != nil {
+		d.mu.RLock()
+		status.WGPubKey = d.localNode.WGPubKey
+		if d.localNode.IdentityKey != nil {
+			status.IdentityKey = base64.StdEncoding.EncodeToString(d.localNode.IdentityKey.Public().(ed25519.PublicKey))
+		}
+		status.Name = d.localNode.Name
+		status.Tags = d.localNode.Tags
+		status.ExitNode = d.localNode.ExitNode
+		status.MeshIP = d.localNode.MeshIP
+		status.MeshIPReserved = d.localNode.MeshIPReserved
+		status.MeshIPv6 = d.localNode.MeshIPv6
+		d.mu.RUnlock()
+	}
+
+	// Discovery layers expose their internals via MarshalJSON
+	if m, ok := d.currentDiscovery().(json.Marshaler); ok {
+		if data, err := m.MarshalJSON(); err == nil {
+			status.Discovery = data
+		}
+	}
+
+	if router := d.currentRouter(); router != nil {
+		if epoch := router.GetEpoch(); epoch != nil {
+			es := &EpochStatus{
+				ID:         epoch.ID,
+				RelayPeers: make([]string, 0, len(epoch.RelayPeers)),
+				StartedAt:  epoch.StartedAt,
+				Duration:   epoch.Duration.String(),
+			}
+			for _, p := range epoch.RelayPeers {
+				es.RelayPeers = append(es.RelayPeers, p.WGPubKey)
+			}
+			status.Epoch = es
+		}
+	}
+
+	for _, c := range d.peerStore.DetectCollisions() {
+		winner, loser := DeterministicWinner(c.Peer1, c.Peer2)
+		status.Collisions = append(status.Collisions, CollisionStatus{
+			MeshIP: c.MeshIP,
+			Winner: winner.WGPubKey,
+			Loser:  loser.WGPubKey,
+		})
+	}
+
+	return status
+}
+
+// PeerStatuses returns all known peers sorted by mesh IP
+func (d *Daemon) PeerStatuses() []PeerStatus {
+	peers := d.peerStore.GetAll()
+	result := make([]PeerStatus, 0, len(peers))
+	for _, p := range peers {
+		var latencyMs float64
+		if p.Latency != nil {
+			latencyMs = float64(*p.Latency) / float64(time.Millisecond)
+		}
+		result = append(result, PeerStatus{
+			WGPubKey:         p.WGPubKey,
+			IdentityKey:      p.IdentityKey,
+			Name:             p.Name,
+			MeshIP:           p.MeshIP,
+			MeshIPReserved:   p.MeshIPReserved,
+			MeshIPv6:         p.MeshIPv6,
+			Endpoint:         p.Endpoint,
+			Endpoints:        p.Endpoints,
+			LatencyMs:        latencyMs,
+			RoutableNetworks: p.RoutableNetworks,
+			LastSeen:         p.LastSeen,
+			DiscoveredVia:    p.DiscoveredVia,
+			Active:           time.Since(p.LastSeen) < PeerDeadTimeout,
+			RelayCapable:     p.RelayCapable,
+			RelayedVia:       d.relayFor(p.WGPubKey),
+			Tags:             p.Tags,
+			Blocked:          !d.peerAllowed(p),
+			ExitNode:         p.ExitNode,
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].MeshIP < result[j].MeshIP
+	})
+	return result
+}
+
+// ControlClient talks to a running daemon over its control socket
+type ControlClient struct {
+	path   string
+	client *http.Client
+}
+
+// NewControlClient creates a client for the daemon listening on the given socket
+func NewControlClient(path string) *ControlClient {
+	return &ControlClient{
+		path: path,
+		client: &http.Client{
+			Timeout: controlRequestTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+// Status fetches the daemon status
+func (c *ControlClient) Status() (*StatusResponse, error) {
+	var status StatusResponse
+	if err := c.Get("/v1/status", &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Peers fetches the daemon's peer list
+func (c *ControlClient) Peers() ([]PeerStatus, error) {
+	var peers []PeerStatus
+	if err := c.Get("/v1/peers", &peers); err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// Get performs a GET request against the API and decodes the JSON response into v
+func (c *ControlClient) Get(path string, v interface{}) error {
+	return c.do(http.MethodGet, path, nil, v)
+}
+
+// Post performs a POST request with a JSON body and decodes the JSON response into v
+func (c *ControlClient) Post(path string, body, v interface{}) error {
+	return c.do(http.MethodPost, path, body, v)
+}
+
+func (c *ControlClient) do(method, path string, body, v interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	// The host part is ignored, the transport always dials the socket
+	req, err := http.NewRequest(method, "http://wgmesh"+path, reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach daemon at %s (is 'wgmesh join' running?): %w", c.path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("daemon returned error: %s", apiErr.Error)
+		}
+		return fmt.Errorf("daemon returned status %s", resp.Status)
+	}
+
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
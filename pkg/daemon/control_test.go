@@ -0,0 +1,75 @@
+package daemon
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func newTestDaemon(t *testing.T) *Daemon {
+	t.Helper()
+
+	cfg, err := NewConfig(DaemonOpts{Secret: "test-secret-that-is-long-enough"})
+	if err != nil {
+		t.Fatalf("NewConfig failed: %v", err)
+	}
+	d, err := NewDaemon(cfg)
+	if err != nil {
+		t.Fatalf("NewDaemon failed: %v", err)
+	}
+	d.localNode = &LocalNode{WGPubKey: "localkey", MeshIP: "10.1.0.1"}
+	return d
+}
+
+func TestControlServerStatusAndPeers(t *testing.T) {
+	d := newTestDaemon(t)
+	d.peerStore.Update(&PeerInfo{WGPubKey: "key2", MeshIP: "10.1.0.3", Endpoint: "1.2.3.4:51820"}, "lan")
+	d.peerStore.Update(&PeerInfo{WGPubKey: "key1", MeshIP: "10.1.0.2"}, "dht")
+	d.peerStore.Update(&PeerInfo{WGPubKey: "key1", Endpoint: "5.6.7.8:51820"}, "gossip")
+
+	path := filepath.Join(t.TempDir(), "wg0.sock")
+	cs := NewControlServer(d, path)
+	if err := cs.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer cs.Stop()
+
+	client := NewControlClient(path)
+
+	status, err := client.Status()
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if status.MeshIP != "10.1.0.1" {
+		t.Errorf("Expected mesh IP 10.1.0.1, got %s", status.MeshIP)
+	}
+	if status.PeerCount != 2 || status.ActivePeers != 2 {
+		t.Errorf("Expected 2 peers (2 active), got %d (%d active)", status.PeerCount, status.ActivePeers)
+	}
+	if status.GossipPort != d.config.Keys.GossipPort {
+		t.Errorf("Expected gossip port %d, got %d", d.config.Keys.GossipPort, status.GossipPort)
+	}
+
+	peers, err := client.Peers()
+	if err != nil {
+		t.Fatalf("Peers failed: %v", err)
+	}
+	if len(peers) != 2 {
+		t.Fatalf("Expected 2 peers, got %d", len(peers))
+	}
+	if peers[0].WGPubKey != "key1" {
+		t.Errorf("Expected peers sorted by mesh IP, got %s first", peers[0].WGPubKey)
+	}
+	if peers[0].Endpoint != "5.6.7.8:51820" {
+		t.Errorf("Expected merged endpoint, got %s", peers[0].Endpoint)
+	}
+	if len(peers[0].DiscoveredVia) != 2 {
+		t.Errorf("Expected 2 discovery methods, got %v", peers[0].DiscoveredVia)
+	}
+}
+
+func TestControlClientDaemonNotRunning(t *testing.T) {
+	client := NewControlClient(filepath.Join(t.TempDir(), "missing.sock"))
+	if _, err := client.Status(); err == nil {
+		t.Error("Expected error when daemon socket does not exist")
+	}
+}
@@ -2,15 +2,20 @@ package daemon
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/atvirokodosprendimai/wgmesh/pkg/acl"
 	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
 	"github.com/atvirokodosprendimai/wgmesh/pkg/privacy"
 	"github.com/atvirokodosprendimai/wgmesh/pkg/wireguard"
@@ -27,8 +32,8 @@ type Daemon struct {
 	localNode *LocalNode
 	peerStore *PeerStore
 
-	// Discovery layer (DHT discovery will be attached)
-	dhtDiscovery DiscoveryLayer
+	// Discovery layer (composite of LAN, DHT and gossip, attached via factory)
+	discovery DiscoveryLayer
 
 	// Epoch manager for Dandelion++ privacy
 	epochManager *EpochManager
@@ -36,6 +41,48 @@ type Daemon struct {
 	// Cache stop channel
 	cacheStopCh chan struct{}
 
+	// Local control API (Unix socket)
+	control   *ControlServer
+	startedAt time.Time
+
+	// Prometheus metrics (optional, see Config.MetricsListen)
+	metrics       daemonMetrics
+	metricsServer *MetricsServer
+
+	// In-progress secret rotation (see rotation.go); mu also guards
+	// config and discovery, which are swapped when a rotation completes
+	rotation *rotation
+	mu       sync.RWMutex
+
+	// Last time the revocation list was gossiped (see revocation.go)
+	lastRevocationBroadcast time.Time
+
+	// Public WireGuard endpoint learned via STUN (see stun.go), empty if unknown
+	publicEndpoint string
+
+	// Hole punching attempts per peer (see punch.go)
+	punches map[string]*punchState
+
+	// Relay used for each peer we cannot reach directly (see relay.go)
+	relays map[string]string
+
+	// Candidate endpoint probing per peer (see probe.go)
+	probes map[string]*endpointProbe
+
+	// Mesh DNS server on our mesh IP (see dns.go), nil if disabled or failed
+	dnsServer *DNSServer
+
+	// ACL policy in force and the firewall rules compiled from it (see policy.go)
+	policyUpdate        *crypto.PolicyUpdate
+	policy              *acl.Policy
+	firewallScript      string
+	lastPolicyBroadcast time.Time
+
+	// Exit node our default route goes through (see exitnode.go), empty if none
+	exitPeer string
+	// Peer last reported for announcing the pinned exit node's name
+	exitConflict string
+
 	ctx    context.Context
 	cancel context.CancelFunc
 }
@@ -44,9 +91,19 @@ type Daemon struct {
 type LocalNode struct {
 	WGPubKey         string
 	WGPrivateKey     string
+	IdentityKey      ed25519.PrivateKey // signs our announcements
+	Name             string             // advertised node name (--name, defaults to the hostname)
 	MeshIP           string
+	MeshIPNonce      int    // collision nonce MeshIP is derived with, persisted in the state file
+	MeshIPReserved   bool   // MeshIP is the static reservation from --mesh-ip
+	MeshIPv6         string // in the ULA prefix derived from the secret
 	WGEndpoint       string
+	Endpoints        []string // candidate endpoints announced next to WGEndpoint
 	RoutableNetworks []string
+	Tags             []string // ACL tags (--tags)
+	RelayCapable     bool     // publicly reachable, forwards traffic for peers that cannot reach each other
+	ExitNode         bool     // routes internet traffic for peers (--advertise-exit-node)
+	ExitPin          *ExitPin // exit node chosen for --use-exit-node, persisted in the state file
 }
 
 // DiscoveryLayer is the interface for discovery implementations
@@ -55,6 +112,18 @@ type DiscoveryLayer interface {
 	Stop() error
 }
 
+// Reannouncer is implemented by discovery layers that can announce the local
+// node right away instead of waiting for their next interval
+type Reannouncer interface {
+	Reannounce()
+}
+
+// MeshIPUpdater is implemented by discovery layers that can take a new local
+// mesh IP without being restarted
+type MeshIPUpdater interface {
+	SetMeshIP(meshIP string, nonce int, reserved bool)
+}
+
 // NewDaemon creates a new mesh daemon
 func NewDaemon(config *Config) (*Daemon, error) {
 	ctx, cancel := context.WithCancel(context.Background())
@@ -62,6 +131,7 @@ func NewDaemon(config *Config) (*Daemon, error) {
 	d := &Daemon{
 		config:    config,
 		peerStore: NewPeerStore(),
+		startedAt: time.Now(),
 		ctx:       ctx,
 		cancel:    cancel,
 	}
@@ -69,9 +139,11 @@ func NewDaemon(config *Config) (*Daemon, error) {
 	return d, nil
 }
 
-// SetDHTDiscovery sets the DHT discovery layer
-func (d *Daemon) SetDHTDiscovery(dht DiscoveryLayer) {
-	d.dhtDiscovery = dht
+// SetDiscovery sets the discovery layer
+func (d *Daemon) SetDiscovery(discovery DiscoveryLayer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.discovery = discovery
 }
 
 // Run starts the daemon and blocks until stopped
@@ -84,7 +156,13 @@ func (d *Daemon) Run() error {
 	}
 
 	log.Printf("Local node: %s", d.localNode.WGPubKey[:16]+"...")
-	log.Printf("Mesh IP: %s", d.localNode.MeshIP)
+	log.Printf("Mesh IP: %s, %s", d.localNode.MeshIP, d.localNode.MeshIPv6)
+	if d.localNode.MeshIPReserved {
+		log.Printf("Mesh IP %s is reserved with --mesh-ip", d.localNode.MeshIP)
+	}
+	if d.localNode.Name != "" {
+		log.Printf("Node name: %s", d.localNode.Name)
+	}
 
 	// Setup WireGuard interface
 	if err := d.setupWireGuard(); err != nil {
@@ -92,12 +170,28 @@ func (d *Daemon) Run() error {
 	}
 	d.setLocalWGEndpoint()
 
-	// Start DHT discovery if configured
-	if d.dhtDiscovery != nil {
-		if err := d.dhtDiscovery.Start(); err != nil {
-			return fmt.Errorf("failed to start DHT discovery: %w", err)
+	// Start discovery if configured
+	if d.discovery != nil {
+		if err := d.discovery.Start(); err != nil {
+			return fmt.Errorf("failed to start discovery: %w", err)
 		}
-		defer d.dhtDiscovery.Stop()
+		defer d.discovery.Stop()
+	}
+
+	// Serve the local control API for 'wgmesh status' and friends
+	d.startControlServer()
+	defer d.stopControlServer()
+
+	// Resolve node names under the mesh domain
+	d.startDNS()
+	defer d.stopDNS()
+
+	if d.config.MetricsListen != "" {
+		d.metricsServer = NewMetricsServer(d, d.config.MetricsListen)
+		if err := d.metricsServer.Start(); err != nil {
+			return fmt.Errorf("failed to start metrics server: %w", err)
+		}
+		defer d.metricsServer.Stop()
 	}
 
 	// Setup signal handling
@@ -110,6 +204,10 @@ func (d *Daemon) Run() error {
 	// Start status printer
 	go d.statusLoop()
 
+	if len(d.config.STUNServers) > 0 {
+		go d.stunLoop()
+	}
+
 	log.Printf("Daemon running. Press Ctrl+C to stop.")
 
 	// Wait for shutdown signal
@@ -127,13 +225,29 @@ func (d *Daemon) Run() error {
 // initLocalNode loads or creates the local WireGuard node
 func (d *Daemon) initLocalNode() error {
 	// Try to load existing key from state file
-	stateFile := fmt.Sprintf("/var/lib/wgmesh/%s.json", d.config.InterfaceName)
+	stateFile := localNodeStatePath(d.config.InterfaceName)
 	node, err := loadLocalNode(stateFile)
 	if err == nil && node != nil {
 		d.localNode = node
-		// Derive mesh IP from pubkey
-		d.localNode.MeshIP = crypto.DeriveMeshIP(d.config.Keys.MeshSubnet, d.localNode.WGPubKey, d.config.Secret)
+		d.localNode.Name = d.config.NodeName
+		d.localNode.Tags = d.config.Tags
+		d.localNode.ExitNode = d.config.AdvertiseExitNode
+		// Use the reserved mesh IP or derive it from the pubkey
+		// A nonce is stored after we lost a mesh IP collision
+		d.localNode.MeshIP, d.localNode.MeshIPReserved = d.config.NodeMeshIP(d.localNode.WGPubKey, d.localNode.MeshIPNonce)
+		d.localNode.MeshIPv6 = crypto.DeriveMeshIPv6(d.config.Keys.MeshPrefixV6, d.localNode.WGPubKey, d.config.Secret)
 		d.localNode.RoutableNetworks = d.config.AdvertiseRoutes
+
+		// Upgrade state files from before node identities
+		if d.localNode.IdentityKey == nil {
+			if d.localNode.IdentityKey, err = generateIdentityKey(); err != nil {
+				return err
+			}
+			log.Printf("Generated node identity key")
+			if err := saveLocalNode(stateFile, d.localNode); err != nil {
+				log.Printf("Warning: failed to save local node state: %v", err)
+			}
+		}
 		return nil
 	}
 
@@ -143,14 +257,25 @@ func (d *Daemon) initLocalNode() error {
 		return fmt.Errorf("failed to generate keypair: %w", err)
 	}
 
-	// Derive mesh IP from public key
-	meshIP := crypto.DeriveMeshIP(d.config.Keys.MeshSubnet, publicKey, d.config.Secret)
+	identityKey, err := generateIdentityKey()
+	if err != nil {
+		return err
+	}
+
+	// Use the reserved mesh IP or derive it from the public key
+	meshIP, reserved := d.config.NodeMeshIP(publicKey, 0)
 
 	d.localNode = &LocalNode{
 		WGPubKey:         publicKey,
 		WGPrivateKey:     privateKey,
+		IdentityKey:      identityKey,
+		Name:             d.config.NodeName,
 		MeshIP:           meshIP,
+		MeshIPReserved:   reserved,
+		MeshIPv6:         crypto.DeriveMeshIPv6(d.config.Keys.MeshPrefixV6, publicKey, d.config.Secret),
 		RoutableNetworks: d.config.AdvertiseRoutes,
+		Tags:             d.config.Tags,
+		ExitNode:         d.config.AdvertiseExitNode,
 	}
 
 	// Save to state file
@@ -161,6 +286,15 @@ func (d *Daemon) initLocalNode() error {
 	return nil
 }
 
+// generateIdentityKey creates a new Ed25519 node identity key
+func generateIdentityKey() (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate identity key: %w", err)
+	}
+	return key, nil
+}
+
 // setupWireGuard creates and configures the WireGuard interface
 func (d *Daemon) setupWireGuard() error {
 	log.Printf("Setting up WireGuard interface %s...", d.config.InterfaceName)
@@ -203,8 +337,8 @@ func (d *Daemon) setupWireGuard() error {
 		return fmt.Errorf("failed to configure interface: %w", err)
 	}
 
-	// Set IP address
-	if err := setInterfaceAddress(d.config.InterfaceName, d.localNode.MeshIP+"/16"); err != nil {
+	// Set IPv4 and IPv6 mesh addresses
+	if err := setMeshAddresses(d.config.InterfaceName, d.localNode.MeshIP, d.config.MeshPrefixLen(), d.localNode.MeshIPv6); err != nil {
 		return fmt.Errorf("failed to set IP address: %w", err)
 	}
 
@@ -234,48 +368,107 @@ func (d *Daemon) reconcileLoop() {
 
 // reconcile updates WireGuard configuration based on discovered peers
 func (d *Daemon) reconcile() {
+	d.metrics.reconcileRuns.Add(1)
+
 	peers := d.peerStore.GetActive()
+	config := d.currentConfig()
+
+	// Route peers we cannot reach directly through a relay, or back
+	d.updateRelays(peers)
+
+	// Move our default route to the exit node once it shows up
+	d.updateExitRoute()
+
 	for _, peer := range peers {
 		// Skip ourselves
 		if peer.WGPubKey == d.localNode.WGPubKey {
 			continue
 		}
 
+		// Never configure a revoked peer, make sure it is gone instead
+		if d.peerStore.IsRevoked(peer.WGPubKey) {
+			d.removePeer(peer.WGPubKey)
+			continue
+		}
+
+		// Peers the ACL policy keeps apart from us get no peering at all
+		if !d.peerAllowed(peer) {
+			d.removePeer(peer.WGPubKey)
+			continue
+		}
+
 		// Add/update peer in WireGuard
-		if err := d.configurePeer(peer); err != nil {
+		if err := d.configurePeer(peer, config.Keys.PSK); err != nil {
+			d.metrics.wgSetFailures.Add(1)
 			log.Printf("Failed to configure peer %s: %v", peer.WGPubKey[:8]+"...", err)
 		}
 	}
 
+	// During a secret rotation, peers that only know the new secret use its PSK
+	rotationPeers, rotationPSK := d.rotationPeers()
+	for _, peer := range rotationPeers {
+		if peer.WGPubKey == d.localNode.WGPubKey || d.peerStore.IsRevoked(peer.WGPubKey) || !d.peerAllowed(peer) {
+			continue
+		}
+		if err := d.configurePeer(peer, rotationPSK); err != nil {
+			d.metrics.wgSetFailures.Add(1)
+			log.Printf("Failed to configure peer %s: %v", peer.WGPubKey[:8]+"...", err)
+		}
+	}
+	peers = append(peers, rotationPeers...)
+
 	if err := d.syncPeerRoutes(peers); err != nil {
 		log.Printf("Failed to sync peer routes: %v", err)
 	}
 
+	// Filter what allowed peers may send us
+	d.updateFirewall(peers)
+
 	// Check for mesh IP collisions
 	d.CheckAndResolveCollisions()
 
 	// Cleanup stale peers
 	removed := d.peerStore.CleanupStale()
+	removed = append(removed, d.cleanupRotationPeers()...)
 	for _, pubKey := range removed {
 		if err := d.removePeer(pubKey); err != nil {
 			log.Printf("Failed to remove stale peer %s: %v", pubKey[:8]+"...", err)
+			continue
 		}
+		d.metrics.peersRemoved.Add(1)
 	}
+
+	// Re-announce or complete a secret rotation
+	d.checkRotation()
+
+	// Keep spreading revocations to nodes that missed them
+	d.checkRevocations()
+
+	// Same for the ACL policy
+	d.checkPolicy()
+
+	// Get peers behind NAT talking to each other
+	d.checkHolePunching()
+
+	// Pin the fastest working endpoint of each peer
+	d.checkEndpointProbes(d.peerStore.GetActive())
 }
 
 // configurePeer adds or updates a peer in the WireGuard configuration
-func (d *Daemon) configurePeer(peer *PeerInfo) error {
-	// Build allowed IPs (mesh IP + routable networks)
-	allowedIPs := peer.MeshIP + "/32"
-	for _, net := range peer.RoutableNetworks {
-		allowedIPs += "," + net
+func (d *Daemon) configurePeer(peer *PeerInfo, psk [32]byte) error {
+	// Build allowed IPs (mesh IP + routable networks, moved to the relay if relayed)
+	d.mu.RLock()
+	allowedIPs := peerAllowedIPs(peer, d.relays, d.peerStore.Get)
+	if allowedIPs != "" && d.exitPeer != "" && (peer.WGPubKey == d.exitPeer || d.relays[d.exitPeer] == peer.WGPubKey) {
+		allowedIPs += "," + strings.Join(exitDefaultRoutes, ",")
 	}
+	d.mu.RUnlock()
 
 	// Use wg set to add/update peer
 	return wireguard.SetPeer(
-		d.config.InterfaceName,
+		d.currentConfig().InterfaceName,
 		peer.WGPubKey,
-		d.config.Keys.PSK,
+		psk,
 		peer.Endpoint,
 		allowedIPs,
 	)
@@ -283,7 +476,7 @@ func (d *Daemon) configurePeer(peer *PeerInfo) error {
 
 // removePeer removes a peer from the WireGuard configuration
 func (d *Daemon) removePeer(pubKey string) error {
-	return wireguard.RemovePeer(d.config.InterfaceName, pubKey)
+	return wireguard.RemovePeer(d.currentConfig().InterfaceName, pubKey)
 }
 
 // statusLoop periodically prints mesh status
@@ -322,13 +515,16 @@ func (d *Daemon) GetPeerStore() *PeerStore {
 
 // GetConfig returns the daemon config
 func (d *Daemon) GetConfig() *Config {
-	return d.config
+	return d.currentConfig()
 }
 
-// RunWithDHTDiscovery runs the daemon with DHT discovery enabled
+// RunWithDiscovery runs the daemon with the discovery layers enabled in the config
 // This is the main entry point for the join command
-func (d *Daemon) RunWithDHTDiscovery() error {
-	log.Printf("Starting wgmesh daemon with DHT discovery...")
+func (d *Daemon) RunWithDiscovery() error {
+	log.Printf("Starting wgmesh daemon with discovery (%s)...", d.config.DiscoveryLayers())
+
+	// Pick up a secret rotation that started or finished before a restart
+	d.resumeRotation()
 
 	// Load or create local node first
 	if err := d.initLocalNode(); err != nil {
@@ -339,11 +535,20 @@ func (d *Daemon) RunWithDHTDiscovery() error {
 	log.Printf("Mesh IP: %s", d.localNode.MeshIP)
 	log.Printf("Network ID: %x (both nodes must show the same ID to find each other)", d.config.Keys.NetworkID[:8])
 
+	// Learn our public endpoint while WireGuard does not own the listen port yet
+	d.discoverPublicEndpoint()
+
 	// Setup WireGuard interface
 	if err := d.setupWireGuard(); err != nil {
 		return fmt.Errorf("failed to setup WireGuard: %w", err)
 	}
 	d.setLocalWGEndpoint()
+	d.updateRelayCapability()
+
+	// NAT for peers using us as their exit node, and our own exit route
+	d.startExitNode()
+	defer d.stopExitNode()
+	defer d.stopExitRoute()
 
 	// Restore peers from cache for faster startup
 	RestoreFromCache(d.config.InterfaceName, d.peerStore)
@@ -360,32 +565,48 @@ func (d *Daemon) RunWithDHTDiscovery() error {
 		}
 	}()
 
-	// Now create DHT discovery with the initialized local node
-	// Import is handled via interface to avoid circular dependency
-	dhtFactory := GetDHTDiscoveryFactory()
-	if dhtFactory != nil {
-		dht, err := dhtFactory(d.config, d.localNode, d.peerStore)
-		if err != nil {
-			return fmt.Errorf("failed to create DHT discovery: %w", err)
-		}
-		d.dhtDiscovery = dht
+	// Now create discovery with the initialized local node
+	if err := d.startDiscovery(); err != nil {
+		return err
+	}
+	defer d.stopDiscovery()
 
-		if err := d.dhtDiscovery.Start(); err != nil {
-			return fmt.Errorf("failed to start DHT discovery: %w", err)
-		}
-		defer d.dhtDiscovery.Stop()
-	} else {
-		log.Printf("Warning: DHT discovery factory not set, running without DHT")
+	// ACL policy from a previous run or --acl-policy, gossiped to peers
+	d.loadPolicy()
+
+	// Resumed rotation: run discovery for the new secret as well
+	d.mu.RLock()
+	resumed := d.rotation
+	d.mu.RUnlock()
+	if resumed != nil {
+		go d.startRotationDiscovery(resumed)
 	}
+	defer d.stopRotation()
 
 	// Start epoch manager for privacy features
 	if d.config.Privacy {
-		d.epochManager = NewEpochManager(d.config.Keys.EpochSeed)
-		d.epochManager.Start(d.getPrivacyPeers)
-		defer d.epochManager.Stop()
+		d.startPrivacy()
+		defer d.stopPrivacy()
+		go d.dandelionLoop()
 		log.Printf("Privacy mode enabled (Dandelion++ relay)")
 	}
 
+	// Serve the local control API for 'wgmesh status' and friends
+	d.startControlServer()
+	defer d.stopControlServer()
+
+	// Resolve node names under the mesh domain
+	d.startDNS()
+	defer d.stopDNS()
+
+	if d.config.MetricsListen != "" {
+		d.metricsServer = NewMetricsServer(d, d.config.MetricsListen)
+		if err := d.metricsServer.Start(); err != nil {
+			return fmt.Errorf("failed to start metrics server: %w", err)
+		}
+		defer d.metricsServer.Stop()
+	}
+
 	// Setup signal handling
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
@@ -410,29 +631,135 @@ func (d *Daemon) RunWithDHTDiscovery() error {
 	return nil
 }
 
-// DHTDiscoveryFactory is a function type for creating DHT discovery instances
-type DHTDiscoveryFactory func(config *Config, localNode *LocalNode, peerStore *PeerStore) (DiscoveryLayer, error)
+// startDiscovery creates and starts discovery for the current config
+// Import is handled via the factory to avoid circular dependency
+func (d *Daemon) startDiscovery() error {
+	factory := GetDiscoveryFactory()
+	if factory == nil {
+		log.Printf("Warning: discovery factory not set, running without discovery")
+		return nil
+	}
+
+	discovery, err := factory(d.currentConfig(), d.localNode, d.peerStore)
+	if err != nil {
+		return fmt.Errorf("failed to create discovery: %w", err)
+	}
+
+	// Rotation announcements, revocations, Dandelion++ stems and hole punches travel over the discovery layer's mesh messaging
+	if m, ok := discovery.(MeshMessenger); ok {
+		m.SetMessageHandler(crypto.MessageTypeRotate, d.handleRotationMessage)
+		m.SetMessageHandler(crypto.MessageTypeRevoke, d.handleRevocationMessage)
+		m.SetMessageHandler(crypto.MessageTypeStem, d.handleStemMessage)
+		m.SetMessageHandler(crypto.MessageTypePunch, d.handlePunchMessage)
+		m.SetMessageHandler(crypto.MessageTypePolicy, d.handlePolicyMessage)
+	}
+
+	if err := discovery.Start(); err != nil {
+		return fmt.Errorf("failed to start discovery: %w", err)
+	}
+
+	d.mu.Lock()
+	d.discovery = discovery
+	d.mu.Unlock()
+	return nil
+}
+
+// stopDiscovery stops the current discovery layer, if any
+func (d *Daemon) stopDiscovery() {
+	if discovery := d.currentDiscovery(); discovery != nil {
+		discovery.Stop()
+	}
+}
+
+// announceLocalNode hands a changed mesh IP to the discovery layers (they
+// work on a copy of the local node) and has it announced right away
+func (d *Daemon) announceLocalNode() {
+	d.mu.RLock()
+	discovery := d.discovery
+	meshIP, nonce, reserved := d.localNode.MeshIP, d.localNode.MeshIPNonce, d.localNode.MeshIPReserved
+	d.mu.RUnlock()
+
+	if u, ok := discovery.(MeshIPUpdater); ok {
+		u.SetMeshIP(meshIP, nonce, reserved)
+	}
+	if r, ok := discovery.(Reannouncer); ok {
+		r.Reannounce()
+	}
+	d.announceViaDandelion()
+}
+
+// currentDiscovery returns the discovery layer (it is replaced when a rotation completes)
+func (d *Daemon) currentDiscovery() DiscoveryLayer {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.discovery
+}
 
-var dhtDiscoveryFactory DHTDiscoveryFactory
+// currentConfig returns the config (it is replaced when a rotation completes)
+func (d *Daemon) currentConfig() *Config {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.config
+}
 
-// SetDHTDiscoveryFactory sets the factory function for creating DHT discovery
+// setConfig replaces the config
+func (d *Daemon) setConfig(config *Config) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.config = config
+}
+
+// DiscoveryFactory is a function type for creating discovery instances
+// The returned layer runs every discovery method enabled in the config
+type DiscoveryFactory func(config *Config, localNode *LocalNode, peerStore *PeerStore) (DiscoveryLayer, error)
+
+var discoveryFactory DiscoveryFactory
+
+// SetDiscoveryFactory sets the factory function for creating discovery
 // This is called by the discovery package to avoid circular imports
-func SetDHTDiscoveryFactory(factory DHTDiscoveryFactory) {
-	dhtDiscoveryFactory = factory
+func SetDiscoveryFactory(factory DiscoveryFactory) {
+	discoveryFactory = factory
 }
 
-// GetDHTDiscoveryFactory returns the current DHT discovery factory
-func GetDHTDiscoveryFactory() DHTDiscoveryFactory {
-	return dhtDiscoveryFactory
+// GetDiscoveryFactory returns the current discovery factory
+func GetDiscoveryFactory() DiscoveryFactory {
+	return discoveryFactory
 }
 
+// setLocalWGEndpoint sets the endpoint we advertise: the public address learned
+// via STUN, or the wildcard address so peers use the address they see us at.
+// Our other addresses are announced as candidate endpoints.
 func (d *Daemon) setLocalWGEndpoint() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
 	if d.localNode == nil {
 		return
 	}
+	d.localNode.Endpoints = localEndpointCandidates(d.config.InterfaceName, d.config.WGListenPort, d.publicEndpoint)
+	if d.publicEndpoint != "" {
+		d.localNode.WGEndpoint = d.publicEndpoint
+		return
+	}
 	d.localNode.WGEndpoint = net.JoinHostPort("0.0.0.0", strconv.Itoa(d.config.WGListenPort))
 }
 
+// startControlServer starts the control API; the daemon keeps running without it
+func (d *Daemon) startControlServer() {
+	d.control = NewControlServer(d, ControlSocketPath(d.config.InterfaceName))
+	if err := d.control.Start(); err != nil {
+		log.Printf("Warning: control API unavailable: %v", err)
+		d.control = nil
+	}
+}
+
+// stopControlServer stops the control API if it is running
+func (d *Daemon) stopControlServer() {
+	if d.control != nil {
+		d.control.Stop()
+	}
+}
+
 // getPrivacyPeers returns current peers formatted for the privacy layer
 func (d *Daemon) getPrivacyPeers() []privacy.PeerInfo {
 	peers := d.peerStore.GetActive()
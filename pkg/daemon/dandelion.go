@@ -0,0 +1,214 @@
+package daemon
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
+	"github.com/atvirokodosprendimai/wgmesh/pkg/privacy"
+)
+
+// DandelionAnnounceInterval is how often a node in privacy mode sends its own
+// announcement through the Dandelion++ stem
+const DandelionAnnounceInterval = 2 * time.Minute
+
+// startPrivacy starts the epoch manager and routes Dandelion++ traffic over
+// the discovery layer's mesh messaging
+func (d *Daemon) startPrivacy() {
+	em := NewEpochManager(d.currentConfig().Keys.EpochSeed)
+	router := em.GetRouter()
+	router.SetStemHandler(d.sendStem)
+	router.SetFluffHandler(d.fluff)
+	em.Start(d.getPrivacyPeers)
+
+	d.mu.Lock()
+	d.epochManager = em
+	d.mu.Unlock()
+}
+
+// stopPrivacy stops the epoch manager, if any
+func (d *Daemon) stopPrivacy() {
+	d.mu.Lock()
+	em := d.epochManager
+	d.epochManager = nil
+	d.mu.Unlock()
+
+	if em != nil {
+		em.Stop()
+	}
+}
+
+// currentRouter returns the Dandelion++ router, or nil when privacy mode is off
+func (d *Daemon) currentRouter() *privacy.DandelionRouter {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.epochManager == nil {
+		return nil
+	}
+	return d.epochManager.GetRouter()
+}
+
+// sendStem relays a stem-phase announcement to one of the epoch's relay peers
+func (d *Daemon) sendStem(msg privacy.DandelionAnnounce, relay privacy.PeerInfo) {
+	messenger, ok := d.currentDiscovery().(MeshMessenger)
+	if !ok {
+		return
+	}
+	if err := messenger.Send(crypto.MessageTypeStem, msg, relay.MeshIP); err != nil {
+		log.Printf("[Dandelion] Failed to relay to %s: %v", safeKeyPrefix(relay.WGPubKey), err)
+	}
+}
+
+// fluff broadcasts the origin's signed announcement to all peers as a normal ANNOUNCE
+func (d *Daemon) fluff(msg privacy.DandelionAnnounce) {
+	messenger, ok := d.currentDiscovery().(MeshMessenger)
+	if !ok || len(msg.Announcement) == 0 {
+		return
+	}
+	if err := messenger.Broadcast(crypto.MessageTypeAnnounce, msg.Announcement); err != nil {
+		log.Printf("[Dandelion] Failed to fluff announcement: %v", err)
+	}
+}
+
+// handleStemMessage processes a stem-phase announcement relayed by a peer
+func (d *Daemon) handleStemMessage(payload []byte) {
+	router := d.currentRouter()
+	if router == nil {
+		// Not in privacy mode, we take no part in relaying
+		return
+	}
+
+	var msg privacy.DandelionAnnounce
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		log.Printf("[Dandelion] Invalid stem message: %v", err)
+		return
+	}
+
+	announcement, err := d.verifyStemAnnouncement(&msg)
+	if err != nil {
+		log.Printf("[Dandelion] Rejected stem message from %s: %v", safeKeyPrefix(msg.OriginPubkey), err)
+		return
+	}
+
+	if announcement.WGPubKey != d.localNode.WGPubKey {
+		peer := &PeerInfo{
+			WGPubKey:         announcement.WGPubKey,
+			IdentityKey:      base64.StdEncoding.EncodeToString(announcement.IdentityKey),
+			MeshIP:           announcement.MeshIP,
+			MeshIPNonce:      announcement.MeshIPNonce,
+			MeshIPReserved:   announcement.MeshIPReserved,
+			MeshIPv6:         announcement.MeshIPv6,
+			Endpoint:         announcement.WGEndpoint,
+			Endpoints:        announcement.Endpoints,
+			RoutableNetworks: announcement.RoutableNetworks,
+			Tags:             announcement.Tags,
+			RelayCapable:     announcement.RelayCapable,
+			ExitNode:         announcement.ExitNode,
+		}
+		if ValidNodeName(announcement.Name) {
+			peer.Name = announcement.Name
+		}
+		if err := d.peerStore.Update(peer, privacy.DandelionMethod); err != nil {
+			log.Printf("[Dandelion] Rejected announcement for %s: %v", safeKeyPrefix(peer.WGPubKey), err)
+			return
+		}
+	}
+
+	router.HandleAnnounce(msg)
+}
+
+// verifyStemAnnouncement checks the origin's embedded announcement the same way
+// the discovery layers check announcements received directly
+func (d *Daemon) verifyStemAnnouncement(msg *privacy.DandelionAnnounce) (*crypto.PeerAnnouncement, error) {
+	if len(msg.Announcement) == 0 {
+		return nil, fmt.Errorf("missing origin announcement")
+	}
+
+	announcement, err := crypto.ParseAnnouncement(&crypto.Envelope{MessageType: crypto.MessageTypeStem}, msg.Announcement)
+	if err != nil {
+		return nil, err
+	}
+	if err := announcement.VerifyMembershipToken(d.currentConfig().Keys.MembershipKey); err != nil {
+		return nil, err
+	}
+	if err := announcement.VerifySignature(); err != nil {
+		return nil, err
+	}
+	if err := d.currentConfig().VerifyMeshIP(announcement.WGPubKey, announcement.MeshIP, announcement.MeshIPv6, announcement.MeshIPNonce, announcement.MeshIPReserved); err != nil {
+		return nil, err
+	}
+	if announcement.WGPubKey != msg.OriginPubkey {
+		return nil, fmt.Errorf("origin %s does not match announcement for %s",
+			safeKeyPrefix(msg.OriginPubkey), safeKeyPrefix(announcement.WGPubKey))
+	}
+
+	return announcement, nil
+}
+
+// dandelionLoop periodically sends our own announcement into the stem
+func (d *Daemon) dandelionLoop() {
+	ticker := time.NewTicker(DandelionAnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			d.announceViaDandelion()
+		}
+	}
+}
+
+// announceViaDandelion originates a Dandelion++ announcement for the local node
+func (d *Daemon) announceViaDandelion() {
+	router := d.currentRouter()
+	if router == nil {
+		return
+	}
+
+	d.mu.RLock()
+	meshIP := d.localNode.MeshIP
+	meshIPNonce := d.localNode.MeshIPNonce
+	meshIPReserved := d.localNode.MeshIPReserved
+	name := d.localNode.Name
+	meshIPv6 := d.localNode.MeshIPv6
+	endpoint := d.localNode.WGEndpoint
+	endpoints := d.localNode.Endpoints
+	relayCapable := d.localNode.RelayCapable
+	exitNode := d.localNode.ExitNode
+	tags := d.localNode.Tags
+	d.mu.RUnlock()
+
+	// Our wildcard listen address is useless to peers and would overwrite the
+	// endpoint they learned directly, so leave it out
+	if host, _, err := net.SplitHostPort(endpoint); err != nil || net.ParseIP(host).IsUnspecified() {
+		endpoint = ""
+	}
+
+	announcement := crypto.CreateAnnouncement(d.localNode.WGPubKey, meshIP, endpoint, d.localNode.RoutableNetworks, nil)
+	announcement.Name = name
+	announcement.MeshIPNonce = meshIPNonce
+	announcement.MeshIPReserved = meshIPReserved
+	announcement.MeshIPv6 = meshIPv6
+	announcement.Endpoints = endpoints
+	announcement.RelayCapable = relayCapable
+	announcement.ExitNode = exitNode
+	announcement.Tags = tags
+	announcement.AttachMembershipToken(d.currentConfig().Keys.MembershipKey)
+	announcement.Sign(d.localNode.IdentityKey)
+
+	data, err := json.Marshal(announcement)
+	if err != nil {
+		log.Printf("[Dandelion] Failed to marshal announcement: %v", err)
+		return
+	}
+
+	msg := privacy.CreateAnnounce(announcement.WGPubKey, meshIP, endpoint, announcement.RoutableNetworks)
+	msg.Announcement = data
+	router.HandleAnnounce(msg)
+}
@@ -0,0 +1,70 @@
+package daemon
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
+	"github.com/atvirokodosprendimai/wgmesh/pkg/privacy"
+)
+
+func newStemMessage(t *testing.T, d *Daemon, pubKey string) privacy.DandelionAnnounce {
+	t.Helper()
+
+	_, identity, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	meshIP := d.config.DeriveMeshIP(pubKey)
+	announcement := crypto.CreateAnnouncement(pubKey, meshIP, "", nil, nil)
+	announcement.AttachMembershipToken(d.config.Keys.MembershipKey)
+	announcement.Sign(identity)
+	data, err := json.Marshal(announcement)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	msg := privacy.CreateAnnounce(pubKey, meshIP, "", nil)
+	msg.Announcement = data
+	return msg
+}
+
+func TestHandleStemMessage(t *testing.T) {
+	d := newTestDaemon(t)
+	d.epochManager = NewEpochManager(d.config.Keys.EpochSeed)
+
+	// Without relay peers the router fluffs right away
+	var fluffed []privacy.DandelionAnnounce
+	d.epochManager.GetRouter().SetFluffHandler(func(msg privacy.DandelionAnnounce) {
+		fluffed = append(fluffed, msg)
+	})
+
+	payload, _ := json.Marshal(newStemMessage(t, d, "originkey"))
+	d.handleStemMessage(payload)
+
+	peer, ok := d.peerStore.Get("originkey")
+	if !ok {
+		t.Fatal("Origin should be added to the peer store")
+	}
+	if len(peer.DiscoveredVia) != 1 || peer.DiscoveredVia[0] != privacy.DandelionMethod {
+		t.Errorf("Expected method %s, got %v", privacy.DandelionMethod, peer.DiscoveredVia)
+	}
+	if len(fluffed) != 1 {
+		t.Fatalf("Expected 1 fluffed message, got %d", len(fluffed))
+	}
+
+	// A relay must not be able to claim another node's announcement as its origin
+	msg := newStemMessage(t, d, "otherkey")
+	msg.OriginPubkey = "spoofed"
+	payload, _ = json.Marshal(msg)
+	d.handleStemMessage(payload)
+
+	if _, ok := d.peerStore.Get("otherkey"); ok {
+		t.Error("Stem message with mismatched origin should be rejected")
+	}
+	if len(fluffed) != 1 {
+		t.Errorf("Rejected stem message should not be relayed, got %d fluffed", len(fluffed))
+	}
+}
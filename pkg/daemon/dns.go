@@ -0,0 +1,433 @@
+package daemon
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DNSPort is the port the mesh DNS server listens on at our mesh IP
+	DNSPort = 53
+	// DNSTTL is the TTL of mesh DNS answers, short since addresses can change on collisions
+	DNSTTL = 60
+	// DNSTopLevelDomain is appended to the mesh name: <node>.<mesh name>.mesh
+	DNSTopLevelDomain = "mesh"
+)
+
+// DNS message fields (RFC 1035, RFC 3596)
+const (
+	dnsHeaderSize     = 12
+	dnsMaxMessageSize = 512
+	dnsFlagQR         = 0x8000
+	dnsFlagAA         = 0x0400
+	dnsFlagRD         = 0x0100
+	dnsOpcodeMask     = 0x7800
+	dnsTypeA          = 1
+	dnsTypePTR        = 12
+	dnsTypeAAAA       = 28
+	dnsClassIN        = 1
+	dnsRcodeSuccess   = 0
+	dnsRcodeFormErr   = 1
+	dnsRcodeNXDomain  = 3
+	dnsRcodeNotImp    = 4
+	dnsRcodeRefused   = 5
+)
+
+var errDNSFormat = errors.New("malformed DNS query")
+
+// dnsZone answers queries for the mesh domain from a lookup of node names and
+// mesh addresses. Names outside the domain are refused, we are no recursive resolver.
+type dnsZone struct {
+	domain string // lowercase, without trailing dot, e.g. "wg0.mesh"
+	byName func(name string) (*PeerInfo, bool)
+	byIP   func(ip net.IP) (*PeerInfo, bool)
+}
+
+// answer builds the response to a query, or returns an error for packets that
+// deserve no response at all
+func (z *dnsZone) answer(query []byte) ([]byte, error) {
+	if len(query) < dnsHeaderSize {
+		return nil, errDNSFormat
+	}
+	flags := binary.BigEndian.Uint16(query[2:4])
+	if flags&dnsFlagQR != 0 {
+		return nil, errDNSFormat
+	}
+
+	if flags&dnsOpcodeMask != 0 {
+		return dnsResponse(query, dnsHeaderSize, dnsRcodeNotImp, nil), nil
+	}
+	if binary.BigEndian.Uint16(query[4:6]) != 1 {
+		return dnsResponse(query, dnsHeaderSize, dnsRcodeFormErr, nil), nil
+	}
+
+	name, end, err := parseDNSName(query, dnsHeaderSize)
+	if err != nil || end+4 > len(query) {
+		return dnsResponse(query, dnsHeaderSize, dnsRcodeFormErr, nil), nil
+	}
+	qtype := binary.BigEndian.Uint16(query[end : end+2])
+	qclass := binary.BigEndian.Uint16(query[end+2 : end+4])
+	questionEnd := end + 4
+
+	if qclass != dnsClassIN {
+		return dnsResponse(query, questionEnd, dnsRcodeRefused, nil), nil
+	}
+
+	var answers [][]byte
+	rcode := dnsRcodeSuccess
+	switch {
+	case name == z.domain:
+		// The zone itself exists but has no records of its own
+	case strings.HasSuffix(name, "."+z.domain):
+		label := strings.TrimSuffix(name, "."+z.domain)
+		peer, ok := z.byName(label)
+		if !ok {
+			rcode = dnsRcodeNXDomain
+			break
+		}
+		if ip := net.ParseIP(peer.MeshIP).To4(); qtype == dnsTypeA && ip != nil {
+			answers = append(answers, dnsRecord(dnsTypeA, ip))
+		}
+		if ip := net.ParseIP(peer.MeshIPv6); qtype == dnsTypeAAAA && ip != nil && ip.To4() == nil {
+			answers = append(answers, dnsRecord(dnsTypeAAAA, ip.To16()))
+		}
+	case strings.HasSuffix(name, ".in-addr.arpa") || strings.HasSuffix(name, ".ip6.arpa"):
+		ip := parseReverseName(name)
+		if ip == nil {
+			return dnsResponse(query, questionEnd, dnsRcodeRefused, nil), nil
+		}
+		peer, ok := z.byIP(ip)
+		if !ok || peer.Name == "" {
+			rcode = dnsRcodeNXDomain
+			break
+		}
+		if qtype == dnsTypePTR {
+			answers = append(answers, dnsRecord(dnsTypePTR, encodeDNSName(peer.Name+"."+z.domain)))
+		}
+	default:
+		rcode = dnsRcodeRefused
+	}
+
+	return dnsResponse(query, questionEnd, rcode, answers), nil
+}
+
+// dnsResponse builds a response echoing the query's header and question.
+// Answers are resource records for the question's name.
+func dnsResponse(query []byte, questionEnd, rcode int, answers [][]byte) []byte {
+	resp := make([]byte, 0, dnsMaxMessageSize)
+	resp = append(resp, query[:questionEnd]...)
+
+	flags := binary.BigEndian.Uint16(query[2:4])
+	flags = dnsFlagQR | dnsFlagAA | flags&(dnsOpcodeMask|dnsFlagRD) | uint16(rcode)
+	binary.BigEndian.PutUint16(resp[2:4], flags)
+
+	qdcount := uint16(0)
+	if questionEnd > dnsHeaderSize {
+		qdcount = 1
+	}
+	binary.BigEndian.PutUint16(resp[4:6], qdcount)
+	binary.BigEndian.PutUint16(resp[6:8], uint16(len(answers)))
+	binary.BigEndian.PutUint16(resp[8:10], 0)
+	binary.BigEndian.PutUint16(resp[10:12], 0)
+
+	for _, answer := range answers {
+		resp = append(resp, answer...)
+	}
+	return resp
+}
+
+// dnsRecord encodes a resource record for the question name (a compression
+// pointer to offset 12) with the given type and data
+func dnsRecord(rtype uint16, data []byte) []byte {
+	record := make([]byte, 12, 12+len(data))
+	binary.BigEndian.PutUint16(record[0:2], 0xC000|dnsHeaderSize)
+	binary.BigEndian.PutUint16(record[2:4], rtype)
+	binary.BigEndian.PutUint16(record[4:6], dnsClassIN)
+	binary.BigEndian.PutUint32(record[6:10], DNSTTL)
+	binary.BigEndian.PutUint16(record[10:12], uint16(len(data)))
+	return append(record, data...)
+}
+
+// parseDNSName reads an uncompressed name starting at offset and returns it in
+// lowercase without trailing dot, and the offset after it
+func parseDNSName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	for {
+		if offset >= len(msg) {
+			return "", 0, errDNSFormat
+		}
+		length := int(msg[offset])
+		offset++
+		if length == 0 {
+			break
+		}
+		// Questions are never compressed, anything above 63 is a pointer or reserved
+		if length > 63 || offset+length > len(msg) {
+			return "", 0, errDNSFormat
+		}
+		labels = append(labels, strings.ToLower(string(msg[offset:offset+length])))
+		offset += length
+	}
+	return strings.Join(labels, "."), offset, nil
+}
+
+// encodeDNSName encodes a dotted name in wire format
+func encodeDNSName(name string) []byte {
+	var out []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		out = append(out, byte(len(label)))
+		out = append(out, label...)
+	}
+	return append(out, 0)
+}
+
+// parseReverseName turns an in-addr.arpa or ip6.arpa name into the address it
+// stands for, nil if it does not name a single address
+func parseReverseName(name string) net.IP {
+	if rest, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		parts := strings.Split(rest, ".")
+		if len(parts) != 4 {
+			return nil
+		}
+		ip := make(net.IP, 4)
+		for i, part := range parts {
+			n, err := strconv.ParseUint(part, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[3-i] = byte(n)
+		}
+		return ip
+	}
+
+	if rest, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		nibbles := strings.Split(rest, ".")
+		if len(nibbles) != 32 {
+			return nil
+		}
+		ip := make(net.IP, 16)
+		for i, nibble := range nibbles {
+			n, err := strconv.ParseUint(nibble, 16, 4)
+			if err != nil || len(nibble) != 1 {
+				return nil
+			}
+			pos := 31 - i
+			if pos%2 == 0 {
+				ip[pos/2] |= byte(n) << 4
+			} else {
+				ip[pos/2] |= byte(n)
+			}
+		}
+		return ip
+	}
+	return nil
+}
+
+// reverseZones returns the reverse lookup zones of the mesh subnets, rounded
+// to whole labels: octets for IPv4, nibbles for the IPv6 /64
+func reverseZones(subnet *net.IPNet, prefixV6 [8]byte) []string {
+	ones, _ := subnet.Mask.Size()
+	ip := subnet.IP.To4()
+	var v4 []string
+	for i := ones/8 - 1; i >= 0; i-- {
+		v4 = append(v4, strconv.Itoa(int(ip[i])))
+	}
+	zones := []string{strings.Join(append(v4, "in-addr.arpa"), ".")}
+
+	var v6 []string
+	for i := 7; i >= 0; i-- {
+		v6 = append(v6, strconv.FormatUint(uint64(prefixV6[i]&0x0f), 16), strconv.FormatUint(uint64(prefixV6[i]>>4), 16))
+	}
+	return append(zones, strings.Join(append(v6, "ip6.arpa"), "."))
+}
+
+// DNSServer serves the mesh DNS zone over UDP on our mesh IP
+type DNSServer struct {
+	zone *dnsZone
+	addr string
+	conn *net.UDPConn
+	wg   sync.WaitGroup
+}
+
+// NewDNSServer creates a DNS server answering from zone on addr
+func NewDNSServer(zone *dnsZone, addr string) *DNSServer {
+	return &DNSServer{zone: zone, addr: addr}
+}
+
+// Start begins serving DNS
+func (s *DNSServer) Start() error {
+	udpAddr, err := net.ResolveUDPAddr("udp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", s.addr, err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.addr, err)
+	}
+	s.conn = conn
+
+	s.wg.Add(1)
+	go s.serve()
+
+	log.Printf("[DNS] Serving %s on %s", s.zone.domain, s.addr)
+	return nil
+}
+
+// Stop shuts down the DNS server
+func (s *DNSServer) Stop() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.wg.Wait()
+	}
+}
+
+func (s *DNSServer) serve() {
+	defer s.wg.Done()
+
+	buf := make([]byte, dnsMaxMessageSize)
+	for {
+		n, remote, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("[DNS] Read error: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		resp, err := s.zone.answer(buf[:n])
+		if err != nil {
+			continue
+		}
+		s.conn.WriteToUDP(resp, remote)
+	}
+}
+
+// meshDNSZone builds the zone for the daemon: our own node plus the peer
+// store's name index
+func (d *Daemon) meshDNSZone() *dnsZone {
+	local := func() *PeerInfo {
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		return &PeerInfo{
+			WGPubKey: d.localNode.WGPubKey,
+			Name:     d.localNode.Name,
+			MeshIP:   d.localNode.MeshIP,
+			MeshIPv6: d.localNode.MeshIPv6,
+		}
+	}
+
+	return &dnsZone{
+		domain: d.currentConfig().DNSDomain(),
+		byName: func(name string) (*PeerInfo, bool) {
+			if self := local(); self.Name == name {
+				return self, true
+			}
+			return d.peerStore.GetByName(name)
+		},
+		byIP: func(ip net.IP) (*PeerInfo, bool) {
+			if self := local(); ip.Equal(net.ParseIP(self.MeshIP)) || ip.Equal(net.ParseIP(self.MeshIPv6)) {
+				return self, true
+			}
+			for _, peer := range d.peerStore.GetAll() {
+				if !ip.Equal(net.ParseIP(peer.MeshIP)) && !ip.Equal(net.ParseIP(peer.MeshIPv6)) {
+					continue
+				}
+				// Only the peer that owns its name in the index answers for it
+				if owner, ok := d.peerStore.GetByName(peer.Name); ok && owner.WGPubKey == peer.WGPubKey {
+					return peer, true
+				}
+				return &PeerInfo{WGPubKey: peer.WGPubKey}, true
+			}
+			return nil, false
+		},
+	}
+}
+
+// startDNS serves the mesh zone on our mesh IP and points systemd-resolved at
+// it for the mesh domain. DNS is optional, failures are only logged.
+func (d *Daemon) startDNS() {
+	config := d.currentConfig()
+	if config.DisableDNS {
+		return
+	}
+
+	d.mu.RLock()
+	meshIP := d.localNode.MeshIP
+	d.mu.RUnlock()
+
+	server := NewDNSServer(d.meshDNSZone(), net.JoinHostPort(meshIP, strconv.Itoa(DNSPort)))
+	if err := server.Start(); err != nil {
+		log.Printf("[DNS] Not serving mesh names: %v", err)
+		return
+	}
+	d.mu.Lock()
+	d.dnsServer = server
+	d.mu.Unlock()
+
+	zones := append([]string{config.DNSDomain()}, reverseZones(config.meshSubnet(), config.Keys.MeshPrefixV6)...)
+	if err := configureResolved(config.InterfaceName, meshIP, zones); err != nil {
+		log.Printf("[DNS] Failed to configure systemd-resolved, query %s directly: %v", meshIP, err)
+	}
+}
+
+// stopDNS stops the mesh DNS server and removes the resolver configuration
+func (d *Daemon) stopDNS() {
+	d.mu.Lock()
+	server := d.dnsServer
+	d.dnsServer = nil
+	d.mu.Unlock()
+
+	if server != nil {
+		server.Stop()
+		revertResolved(d.currentConfig().InterfaceName)
+	}
+}
+
+// restartDNS rebinds the DNS server after our mesh IP changed
+func (d *Daemon) restartDNS() {
+	d.stopDNS()
+	d.startDNS()
+}
+
+// configureResolved sets our DNS server and the mesh zones as per-link DNS
+// for the WireGuard interface, so only mesh names are sent to it
+func configureResolved(iface, server string, zones []string) error {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+	if _, err := exec.LookPath("resolvectl"); err != nil {
+		return fmt.Errorf("resolvectl not found")
+	}
+
+	if output, err := exec.Command("resolvectl", "dns", iface, server).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set DNS server: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+	args := []string{"domain", iface}
+	for _, zone := range zones {
+		args = append(args, "~"+zone)
+	}
+	if output, err := exec.Command("resolvectl", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set DNS domains: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+	// Older versions lack default-route; routing domains alone keep other queries away there
+	exec.Command("resolvectl", "default-route", iface, "false").Run()
+	return nil
+}
+
+// revertResolved drops the per-link DNS settings of the WireGuard interface
+func revertResolved(iface string) {
+	if runtime.GOOS != "linux" {
+		return
+	}
+	exec.Command("resolvectl", "revert", iface).Run()
+}
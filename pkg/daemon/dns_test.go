@@ -0,0 +1,140 @@
+package daemon
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// dnsQuery builds a query for name and qtype
+func dnsQuery(name string, qtype uint16) []byte {
+	query := make([]byte, dnsHeaderSize)
+	binary.BigEndian.PutUint16(query[0:2], 0x1234)
+	binary.BigEndian.PutUint16(query[2:4], dnsFlagRD)
+	binary.BigEndian.PutUint16(query[4:6], 1)
+	query = append(query, encodeDNSName(name)...)
+	query = binary.BigEndian.AppendUint16(query, qtype)
+	return binary.BigEndian.AppendUint16(query, dnsClassIN)
+}
+
+func testDNSZone() *dnsZone {
+	peers := []*PeerInfo{
+		{WGPubKey: "key1", Name: "web", MeshIP: "10.42.0.5", MeshIPv6: "fd00:1:2:3::5"},
+		{WGPubKey: "key2", Name: "db", MeshIP: "10.42.0.6"},
+	}
+	return &dnsZone{
+		domain: "wg0.mesh",
+		byName: func(name string) (*PeerInfo, bool) {
+			for _, p := range peers {
+				if p.Name == name {
+					return p, true
+				}
+			}
+			return nil, false
+		},
+		byIP: func(ip net.IP) (*PeerInfo, bool) {
+			for _, p := range peers {
+				if ip.Equal(net.ParseIP(p.MeshIP)) || ip.Equal(net.ParseIP(p.MeshIPv6)) {
+					return p, true
+				}
+			}
+			return nil, false
+		},
+	}
+}
+
+func TestDNSZoneAnswer(t *testing.T) {
+	zone := testDNSZone()
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers int
+		rdata   string
+	}{
+		{"web.wg0.mesh", dnsTypeA, dnsRcodeSuccess, 1, "10.42.0.5"},
+		{"WEB.wg0.mesh.", dnsTypeA, dnsRcodeSuccess, 1, "10.42.0.5"},
+		{"web.wg0.mesh", dnsTypeAAAA, dnsRcodeSuccess, 1, "fd00:1:2:3::5"},
+		{"db.wg0.mesh", dnsTypeAAAA, dnsRcodeSuccess, 0, ""},
+		{"missing.wg0.mesh", dnsTypeA, dnsRcodeNXDomain, 0, ""},
+		{"wg0.mesh", dnsTypeA, dnsRcodeSuccess, 0, ""},
+		{"example.com", dnsTypeA, dnsRcodeRefused, 0, ""},
+		{"6.0.42.10.in-addr.arpa", dnsTypePTR, dnsRcodeSuccess, 1, "db.wg0.mesh"},
+		{"7.0.42.10.in-addr.arpa", dnsTypePTR, dnsRcodeNXDomain, 0, ""},
+	}
+
+	for _, tt := range tests {
+		resp, err := zone.answer(dnsQuery(tt.name, tt.qtype))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if id := binary.BigEndian.Uint16(resp[0:2]); id != 0x1234 {
+			t.Errorf("%s: expected the query ID, got %x", tt.name, id)
+		}
+		flags := binary.BigEndian.Uint16(resp[2:4])
+		if flags&dnsFlagQR == 0 || flags&dnsFlagRD == 0 {
+			t.Errorf("%s: expected QR and RD set, got flags %x", tt.name, flags)
+		}
+		if rcode := int(flags & 0x000f); rcode != tt.rcode {
+			t.Errorf("%s: expected rcode %d, got %d", tt.name, tt.rcode, rcode)
+		}
+		ancount := int(binary.BigEndian.Uint16(resp[6:8]))
+		if ancount != tt.answers {
+			t.Errorf("%s: expected %d answers, got %d", tt.name, tt.answers, ancount)
+			continue
+		}
+		if tt.answers == 0 {
+			continue
+		}
+
+		// The answer follows the echoed question
+		record := resp[len(dnsQuery(tt.name, tt.qtype)):]
+		rdata := record[12:]
+		var got string
+		switch tt.qtype {
+		case dnsTypePTR:
+			got, _, _ = parseDNSName(rdata, 0)
+		default:
+			got = net.IP(rdata).String()
+		}
+		if got != tt.rdata {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.rdata, got)
+		}
+	}
+}
+
+func TestDNSZoneIgnoresResponses(t *testing.T) {
+	query := dnsQuery("web.wg0.mesh", dnsTypeA)
+	binary.BigEndian.PutUint16(query[2:4], dnsFlagQR)
+	if _, err := testDNSZone().answer(query); err == nil {
+		t.Error("Expected responses to be ignored")
+	}
+	if _, err := testDNSZone().answer(query[:5]); err == nil {
+		t.Error("Expected truncated packets to be ignored")
+	}
+}
+
+func TestParseReverseName(t *testing.T) {
+	if ip := parseReverseName("5.0.42.10.in-addr.arpa"); !ip.Equal(net.ParseIP("10.42.0.5")) {
+		t.Errorf("Expected 10.42.0.5, got %v", ip)
+	}
+	name := "5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.d.f.ip6.arpa"
+	if ip := parseReverseName(name); !ip.Equal(net.ParseIP("fd00:1:2:3::5")) {
+		t.Errorf("Expected fd00:1:2:3::5, got %v", ip)
+	}
+	if ip := parseReverseName("0.42.10.in-addr.arpa"); ip != nil {
+		t.Errorf("Expected no address for a partial name, got %v", ip)
+	}
+}
+
+func TestReverseZones(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.42.0.0/16")
+	zones := reverseZones(subnet, [8]byte{0xfd, 0x00, 0x00, 0x01, 0x00, 0x02, 0x00, 0x03})
+	if zones[0] != "42.10.in-addr.arpa" {
+		t.Errorf("Unexpected IPv4 zone %s", zones[0])
+	}
+	if zones[1] != "3.0.0.0.2.0.0.0.1.0.0.0.0.0.d.f.ip6.arpa" {
+		t.Errorf("Unexpected IPv6 zone %s", zones[1])
+	}
+}
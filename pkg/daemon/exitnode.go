@@ -0,0 +1,302 @@
+package daemon
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/acl"
+)
+
+// ExitRouteTable is the routing table holding the default route through the
+// exit node. WireGuard marks its own packets with the same number, so the
+// encrypted underlay traffic keeps using the main table (like wg-quick).
+const ExitRouteTable = 51820
+
+// exitDefaultRoutes are added to the exit node's AllowedIPs
+var exitDefaultRoutes = []string{"0.0.0.0/0", "::/0"}
+
+// isDefaultRoute reports whether network covers the whole IPv4 or IPv6 space
+func isDefaultRoute(network string) bool {
+	_, ipNet, err := net.ParseCIDR(strings.TrimSpace(network))
+	if err != nil {
+		return false
+	}
+	ones, _ := ipNet.Mask.Size()
+	return ones == 0
+}
+
+// exitTableName returns the nftables table masquerading exit node traffic
+func exitTableName(iface string) string {
+	return acl.TableName(iface) + "_exit"
+}
+
+// exitNATScript masquerades traffic from the mesh that leaves through any
+// other interface
+func exitNATScript(iface string) string {
+	table := exitTableName(iface)
+	var b strings.Builder
+	// Creating the table first makes the delete succeed on the first run
+	fmt.Fprintf(&b, "table inet %s\n", table)
+	fmt.Fprintf(&b, "delete table inet %s\n", table)
+	fmt.Fprintf(&b, "table inet %s {\n", table)
+	b.WriteString("\tchain postrouting {\n")
+	b.WriteString("\t\ttype nat hook postrouting priority srcnat; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tiifname %q oifname != %q masquerade\n", iface, iface)
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// startExitNode enables forwarding and NAT so peers can send their internet
+// traffic through this node
+func (d *Daemon) startExitNode() {
+	config := d.currentConfig()
+	if !config.AdvertiseExitNode {
+		return
+	}
+	if runtime.GOOS != "linux" {
+		log.Printf("[Exit] Serving as an exit node is only supported on Linux")
+		d.mu.Lock()
+		d.localNode.ExitNode = false
+		d.mu.Unlock()
+		return
+	}
+
+	if err := setupExitNAT(config.InterfaceName); err != nil {
+		log.Printf("[Exit] Not offering to be an exit node: %v", err)
+		d.mu.Lock()
+		d.localNode.ExitNode = false
+		d.mu.Unlock()
+		return
+	}
+	log.Printf("[Exit] Offering to route internet traffic for peers")
+}
+
+// stopExitNode removes the NAT rules again
+func (d *Daemon) stopExitNode() {
+	d.mu.RLock()
+	serving := d.localNode.ExitNode
+	d.mu.RUnlock()
+	if !serving {
+		return
+	}
+
+	iface := d.currentConfig().InterfaceName
+	if output, err := exec.Command("nft", "delete", "table", "inet", exitTableName(iface)).CombinedOutput(); err != nil {
+		log.Printf("[Exit] Failed to remove NAT rules: %s: %v", strings.TrimSpace(string(output)), err)
+	}
+}
+
+// setupExitNAT turns on IPv4 and IPv6 forwarding and loads the masquerade rules
+func setupExitNAT(iface string) error {
+	if err := enableForwarding(); err != nil {
+		return err
+	}
+	if output, err := exec.Command("sysctl", "-w", "net.ipv6.conf.all.forwarding=1").CombinedOutput(); err != nil {
+		log.Printf("[Exit] Warning: failed to enable IPv6 forwarding: %s", strings.TrimSpace(string(output)))
+	}
+
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(exitNATScript(iface))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to load NAT rules: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
+// ExitPin records which peer --use-exit-node resolved to the first time.
+// Names are announced by the nodes themselves, so without the pin any member
+// announcing the same name could take over our internet traffic.
+type ExitPin struct {
+	UseExitNode string `json:"use_exit_node"` // the --use-exit-node value the pin is for
+	WGPubKey    string `json:"wg_pubkey"`
+	IdentityKey string `json:"identity_key"`
+}
+
+// selectExitNode resolves --use-exit-node to a peer that offers to be an exit
+// node, nil if there is none (yet). The first peer found is pinned together
+// with its identity key and used from then on, even if another peer
+// announces the name later; only a new --use-exit-node value picks again.
+func (d *Daemon) selectExitNode() *PeerInfo {
+	config := d.currentConfig()
+	want := config.UseExitNode
+
+	d.mu.RLock()
+	pin := d.localNode.ExitPin
+	d.mu.RUnlock()
+	if pin != nil && pin.UseExitNode != want {
+		pin = nil
+	}
+
+	var peer *PeerInfo
+	var ok bool
+	if pin != nil {
+		peer, ok = d.peerStore.Get(pin.WGPubKey)
+		if ok && peer.IdentityKey != pin.IdentityKey {
+			ok = false
+		}
+		if named, found := d.peerStore.GetByName(want); found && named.WGPubKey != pin.WGPubKey {
+			d.reportExitConflict(want, named.WGPubKey, pin.WGPubKey)
+		}
+	} else {
+		peer, ok = d.peerStore.GetByName(want)
+		if !ok {
+			peer, ok = d.peerStore.Get(want)
+		}
+	}
+	if !ok || peer.IdentityKey == "" || !peer.ExitNode || peer.MeshIP == "" || d.peerStore.IsRevoked(peer.WGPubKey) || !d.peerAllowed(peer) {
+		return nil
+	}
+
+	if pin == nil {
+		d.mu.Lock()
+		d.localNode.ExitPin = &ExitPin{UseExitNode: want, WGPubKey: peer.WGPubKey, IdentityKey: peer.IdentityKey}
+		d.mu.Unlock()
+		log.Printf("[Exit] Pinned exit node %s to %s", want, safeKeyPrefix(peer.WGPubKey))
+		if err := saveLocalNode(localNodeStatePath(config.InterfaceName), d.localNode); err != nil {
+			log.Printf("[Exit] Failed to save exit node pin: %v", err)
+		}
+	}
+	return peer
+}
+
+// reportExitConflict logs once per peer that another node announces the name
+// of our pinned exit node
+func (d *Daemon) reportExitConflict(name, other, pinned string) {
+	d.mu.Lock()
+	reported := d.exitConflict == other
+	d.exitConflict = other
+	d.mu.Unlock()
+	if !reported {
+		log.Printf("[Exit] WARNING: %s also announces exit node name %s, staying with pinned %s; use --use-exit-node <pubkey> to switch",
+			safeKeyPrefix(other), name, safeKeyPrefix(pinned))
+	}
+}
+
+// updateExitRoute is called from the reconcile loop. Once the exit node shows
+// up, our default route moves into the tunnel. It stays there while the exit
+// node is unreachable, so traffic never silently leaves through the local
+// uplink, and only moves back if the peer stops offering to be an exit node.
+func (d *Daemon) updateExitRoute() {
+	config := d.currentConfig()
+	if config.UseExitNode == "" || runtime.GOOS != "linux" {
+		return
+	}
+
+	next := ""
+	if peer := d.selectExitNode(); peer != nil {
+		next = peer.WGPubKey
+	}
+
+	d.mu.RLock()
+	current := d.exitPeer
+	d.mu.RUnlock()
+	if next == current {
+		return
+	}
+
+	// The pin keeps next at one peer; only a restart with another
+	// --use-exit-node value can change it
+	switch {
+	case next == "":
+		log.Printf("[Exit] %s is no longer an exit node, using the local default route", config.UseExitNode)
+		teardownExitRouting(config.InterfaceName)
+	case current == "":
+		if err := setupExitRouting(config.InterfaceName, config.Keys.GossipPort); err != nil {
+			log.Printf("[Exit] Failed to route through %s: %v", config.UseExitNode, err)
+			teardownExitRouting(config.InterfaceName)
+			return
+		}
+		log.Printf("[Exit] Routing internet traffic through %s (%s)", config.UseExitNode, safeKeyPrefix(next))
+	}
+
+	d.mu.Lock()
+	d.exitPeer = next
+	d.mu.Unlock()
+}
+
+// stopExitRoute restores the local default route on shutdown
+func (d *Daemon) stopExitRoute() {
+	d.mu.Lock()
+	current := d.exitPeer
+	d.exitPeer = ""
+	d.mu.Unlock()
+
+	if current != "" {
+		teardownExitRouting(d.currentConfig().InterfaceName)
+	}
+}
+
+// usingExitNode reports whether our internet traffic goes through an exit node
+func (d *Daemon) usingExitNode() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.exitPeer != ""
+}
+
+// exitRoutingCommands returns the commands installing policy routing for an
+// exit node: everything not marked by WireGuard looks up ExitRouteTable,
+// except routes more specific than a default route (LAN, mesh) and the
+// discovery sockets talking to the internet from the gossip and DHT ports.
+func exitRoutingCommands(iface string, gossipPort uint16) [][]string {
+	table := strconv.Itoa(ExitRouteTable)
+	sports := fmt.Sprintf("%d-%d", gossipPort, gossipPort+1)
+
+	commands := [][]string{
+		{"wg", "set", iface, "fwmark", table},
+		{"sysctl", "-w", "net.ipv4.conf.all.src_valid_mark=1"},
+	}
+	for _, family := range []string{"-4", "-6"} {
+		commands = append(commands,
+			[]string{"ip", family, "route", "replace", "default", "dev", iface, "table", table},
+			[]string{"ip", family, "rule", "add", "not", "fwmark", table, "table", table},
+			[]string{"ip", family, "rule", "add", "table", "main", "suppress_prefixlength", "0"},
+			[]string{"ip", family, "rule", "add", "ipproto", "udp", "sport", sports, "table", "main"},
+		)
+	}
+	return commands
+}
+
+// setupExitRouting installs the policy routing for an exit node
+func setupExitRouting(iface string, gossipPort uint16) error {
+	// Start from a clean slate in case a previous run did not clean up
+	teardownExitRouting(iface)
+
+	for _, args := range exitRoutingCommands(iface, gossipPort) {
+		if output, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			// Hosts without IPv6 cannot install the IPv6 half
+			if args[0] == "ip" && args[1] == "-6" {
+				continue
+			}
+			return fmt.Errorf("%s: %s: %w", strings.Join(args, " "), strings.TrimSpace(string(output)), err)
+		}
+	}
+	return nil
+}
+
+// teardownExitRouting removes the policy routing for an exit node
+func teardownExitRouting(iface string) {
+	table := strconv.Itoa(ExitRouteTable)
+	for _, family := range []string{"-4", "-6"} {
+		for _, rule := range [][]string{
+			{"not", "fwmark", table, "table", table},
+			{"table", "main", "suppress_prefixlength", "0"},
+			{"ipproto", "udp", "table", "main"},
+		} {
+			// Each del removes one matching rule, repeat until none is left
+			args := append([]string{family, "rule", "del"}, rule...)
+			for i := 0; i < 10; i++ {
+				if exec.Command("ip", args...).Run() != nil {
+					break
+				}
+			}
+		}
+		exec.Command("ip", family, "route", "flush", "table", table).Run()
+	}
+	exec.Command("wg", "set", iface, "fwmark", "0").Run()
+}
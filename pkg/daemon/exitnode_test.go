@@ -0,0 +1,94 @@
+package daemon
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsDefaultRoute(t *testing.T) {
+	for _, network := range []string{"0.0.0.0/0", "::/0", " 0.0.0.0/0 "} {
+		if !isDefaultRoute(network) {
+			t.Errorf("Expected %q to be a default route", network)
+		}
+	}
+	for _, network := range []string{"0.0.0.0/1", "10.0.0.0/8", "::/1", "default", ""} {
+		if isDefaultRoute(network) {
+			t.Errorf("Expected %q not to be a default route", network)
+		}
+	}
+}
+
+func TestExitNodeConfig(t *testing.T) {
+	secret := "test-secret-that-is-long-enough"
+
+	if _, err := NewConfig(DaemonOpts{Secret: secret, AdvertiseRoutes: []string{"192.168.1.0/24", "0.0.0.0/0"}}); err == nil {
+		t.Error("Expected advertising a default route to be rejected")
+	}
+	if _, err := NewConfig(DaemonOpts{Secret: secret, ExitNode: true, UseExitNode: "gw1"}); err == nil {
+		t.Error("Expected advertising and using an exit node to be rejected")
+	}
+	if _, err := NewConfig(DaemonOpts{Secret: secret, UseExitNode: "not a name"}); err == nil {
+		t.Error("Expected an invalid exit node to be rejected")
+	}
+
+	for _, exit := range []string{"gw1", "YWJjZGVmZ2hpamtsbW5vcHFyc3R1dnd4eXoxMjM0NTY="} {
+		cfg, err := NewConfig(DaemonOpts{Secret: secret, UseExitNode: exit})
+		if err != nil {
+			t.Fatalf("NewConfig with exit node %s failed: %v", exit, err)
+		}
+		if cfg.UseExitNode != exit {
+			t.Errorf("Expected exit node %s, got %s", exit, cfg.UseExitNode)
+		}
+	}
+}
+
+func TestExitRoutingCommands(t *testing.T) {
+	var lines []string
+	for _, args := range exitRoutingCommands("wg0", 51900) {
+		lines = append(lines, strings.Join(args, " "))
+	}
+	script := strings.Join(lines, "\n")
+
+	for _, want := range []string{
+		"wg set wg0 fwmark 51820",
+		"ip -4 route replace default dev wg0 table 51820",
+		"ip -4 rule add not fwmark 51820 table 51820",
+		"ip -6 rule add table main suppress_prefixlength 0",
+		"ip -4 rule add ipproto udp sport 51900-51901 table main",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("Expected %q in:\n%s", want, script)
+		}
+	}
+
+	nat := exitNATScript("wg0")
+	if !strings.Contains(nat, `iifname "wg0" oifname != "wg0" masquerade`) {
+		t.Errorf("Expected masquerading of mesh traffic:\n%s", nat)
+	}
+}
+
+func TestSelectExitNodePinned(t *testing.T) {
+	d := newTestDaemon(t)
+	d.config.UseExitNode = "gw1"
+	d.localNode.ExitPin = &ExitPin{UseExitNode: "gw1", WGPubKey: "key2", IdentityKey: "id2"}
+
+	d.peerStore.Update(&PeerInfo{WGPubKey: "key2", IdentityKey: "id2", Name: "gw1", MeshIP: "10.1.0.2", ExitNode: true}, "lan")
+	if peer := d.selectExitNode(); peer == nil || peer.WGPubKey != "key2" {
+		t.Fatalf("Expected the pinned exit node, got %v", peer)
+	}
+
+	// A lower pubkey announcing the same name wins the name, but not our traffic
+	d.peerStore.Update(&PeerInfo{WGPubKey: "key1", IdentityKey: "id1", Name: "gw1", MeshIP: "10.1.0.3", ExitNode: true}, "lan")
+	if got, _ := d.peerStore.GetByName("gw1"); got.WGPubKey != "key1" {
+		t.Fatalf("Expected key1 to own the name, got %s", got.WGPubKey)
+	}
+	if peer := d.selectExitNode(); peer == nil || peer.WGPubKey != "key2" {
+		t.Errorf("Expected to stay with the pinned exit node, got %v", peer)
+	}
+
+	// The pinned peer must keep its identity key
+	d.localNode.ExitPin = &ExitPin{UseExitNode: "gw1", WGPubKey: "key2", IdentityKey: "id-other"}
+	if peer := d.selectExitNode(); peer != nil {
+		t.Errorf("Expected no exit node when the pinned identity changed, got %v", peer)
+	}
+}
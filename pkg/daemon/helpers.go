@@ -1,8 +1,11 @@
 package daemon
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net"
 	"os"
 	"os/exec"
@@ -13,8 +16,16 @@ import (
 
 // localNodeState is the persisted state for a local node
 type localNodeState struct {
-	WGPubKey     string `json:"wg_pubkey"`
-	WGPrivateKey string `json:"wg_private_key"`
+	WGPubKey     string   `json:"wg_pubkey"`
+	WGPrivateKey string   `json:"wg_private_key"`
+	IdentityKey  string   `json:"identity_private_key,omitempty"` // Ed25519, base64
+	MeshIPNonce  int      `json:"mesh_ip_nonce,omitempty"`        // set after losing a mesh IP collision
+	ExitPin      *ExitPin `json:"exit_pin,omitempty"`
+}
+
+// localNodeStatePath returns the state file holding the local node's keys
+func localNodeStatePath(interfaceName string) string {
+	return filepath.Join("/var/lib/wgmesh", fmt.Sprintf("%s.json", interfaceName))
 }
 
 // loadLocalNode loads the local node state from a file
@@ -29,10 +40,24 @@ func loadLocalNode(path string) (*LocalNode, error) {
 		return nil, err
 	}
 
-	return &LocalNode{
+	node := &LocalNode{
 		WGPubKey:     state.WGPubKey,
 		WGPrivateKey: state.WGPrivateKey,
-	}, nil
+		MeshIPNonce:  state.MeshIPNonce,
+		ExitPin:      state.ExitPin,
+	}
+
+	// State files written before node identities existed have no key;
+	// the caller generates one
+	if state.IdentityKey != "" {
+		key, err := base64.StdEncoding.DecodeString(state.IdentityKey)
+		if err != nil || len(key) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("invalid identity key in %s", path)
+		}
+		node.IdentityKey = ed25519.PrivateKey(key)
+	}
+
+	return node, nil
 }
 
 // saveLocalNode saves the local node state to a file
@@ -46,6 +71,11 @@ func saveLocalNode(path string, node *LocalNode) error {
 	state := localNodeState{
 		WGPubKey:     node.WGPubKey,
 		WGPrivateKey: node.WGPrivateKey,
+		MeshIPNonce:  node.MeshIPNonce,
+		ExitPin:      node.ExitPin,
+	}
+	if node.IdentityKey != nil {
+		state.IdentityKey = base64.StdEncoding.EncodeToString(node.IdentityKey)
 	}
 
 	data, err := json.MarshalIndent(state, "", "  ")
@@ -135,6 +165,47 @@ func setInterfaceAddress(name, address string) error {
 	}
 }
 
+// setMeshAddresses replaces the interface addresses with the IPv4 mesh address
+// and adds the IPv6 one. Hosts without IPv6 keep working with IPv4 only.
+func setMeshAddresses(name, meshIP string, prefixLen int, meshIPv6 string) error {
+	if err := setInterfaceAddress(name, fmt.Sprintf("%s/%d", meshIP, prefixLen)); err != nil {
+		return err
+	}
+	if meshIPv6 != "" {
+		if err := addInterfaceAddress(name, meshIPv6+"/64"); err != nil {
+			log.Printf("Warning: failed to set IPv6 mesh address %s: %v", meshIPv6, err)
+		}
+	}
+	return nil
+}
+
+// addInterfaceAddress adds an IP address to an interface, keeping existing ones
+func addInterfaceAddress(name, address string) error {
+	switch runtime.GOOS {
+	case "linux":
+		cmd := exec.Command("ip", "addr", "add", address, "dev", name)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			if !strings.Contains(string(output), "File exists") {
+				return fmt.Errorf("failed to add address: %s: %w", string(output), err)
+			}
+		}
+		return nil
+	case "darwin":
+		ip, prefix, ok := strings.Cut(address, "/")
+		if ok && strings.Contains(ip, ":") {
+			cmd := exec.Command("ifconfig", name, "inet6", ip, "prefixlen", prefix, "alias")
+			if output, err := cmd.CombinedOutput(); err != nil {
+				return fmt.Errorf("failed to add address: %s: %w", string(output), err)
+			}
+			return nil
+		}
+		// ifconfig aliases are additive, same as setInterfaceAddress
+		return setInterfaceAddress(name, address)
+	default:
+		return fmt.Errorf("unsupported OS: %s", runtime.GOOS)
+	}
+}
+
 // setInterfaceUp brings an interface up
 func setInterfaceUp(name string) error {
 	switch runtime.GOOS {
@@ -0,0 +1,241 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/wireguard"
+)
+
+// MetricsNamespace prefixes every exported metric name
+const MetricsNamespace = "wgmesh"
+
+// MetricsCollector is implemented by components that export Prometheus metrics.
+// Discovery layers implement it optionally; the daemon checks via type assertion.
+type MetricsCollector interface {
+	CollectMetrics(m *MetricsWriter)
+}
+
+// MetricsWriter writes metrics in the Prometheus text exposition format
+type MetricsWriter struct {
+	w    io.Writer
+	seen map[string]bool
+}
+
+// NewMetricsWriter creates a writer emitting to w
+func NewMetricsWriter(w io.Writer) *MetricsWriter {
+	return &MetricsWriter{w: w, seen: make(map[string]bool)}
+}
+
+// Gauge writes a gauge sample. Labels are given as alternating name/value pairs.
+func (m *MetricsWriter) Gauge(name, help string, value float64, labels ...string) {
+	m.write(name, "gauge", help, value, labels)
+}
+
+// Counter writes a counter sample. Labels are given as alternating name/value pairs.
+func (m *MetricsWriter) Counter(name, help string, value uint64, labels ...string) {
+	m.write(name, "counter", help, float64(value), labels)
+}
+
+func (m *MetricsWriter) write(name, kind, help string, value float64, labels []string) {
+	name = MetricsNamespace + "_" + name
+
+	// HELP and TYPE are written once per metric family
+	if !m.seen[name] {
+		m.seen[name] = true
+		fmt.Fprintf(m.w, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(m.w, "# TYPE %s %s\n", name, kind)
+	}
+
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) >= 2 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(escapeLabelValue(labels[i+1]))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	fmt.Fprintf(m.w, "%s %s\n", b.String(), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// escapeLabelValue escapes a label value per the text exposition format
+func escapeLabelValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return strings.ReplaceAll(v, `"`, `\"`)
+}
+
+// daemonMetrics holds counters updated by the reconcile loop
+type daemonMetrics struct {
+	reconcileRuns atomic.Uint64
+	wgSetFailures atomic.Uint64
+	routesAdded   atomic.Uint64
+	routesRemoved atomic.Uint64
+	peersRemoved  atomic.Uint64
+}
+
+// CollectMetrics writes peer store gauges
+func (ps *PeerStore) CollectMetrics(m *MetricsWriter) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	var active, dead int
+	byMethod := make(map[string]int)
+	now := time.Now()
+	for _, peer := range ps.peers {
+		if now.Sub(peer.LastSeen) < PeerDeadTimeout {
+			active++
+		} else {
+			dead++
+		}
+		for _, method := range peer.DiscoveredVia {
+			byMethod[method]++
+		}
+	}
+
+	m.Gauge("peers", "Number of known peers by state.", float64(active), "state", "active")
+	m.Gauge("peers", "Number of known peers by state.", float64(dead), "state", "dead")
+	revoked := 0
+	for pubKey := range ps.revoked {
+		if ps.isRevoked(pubKey) {
+			revoked++
+		}
+	}
+	m.Gauge("revoked_peers", "Number of revoked peer pubkeys.", float64(revoked))
+
+	methods := make([]string, 0, len(byMethod))
+	for method := range byMethod {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		m.Gauge("peers_discovered_via", "Number of known peers seen by each discovery method.",
+			float64(byMethod[method]), "method", method)
+	}
+}
+
+// CollectMetrics writes daemon, peer store, discovery and WireGuard metrics
+func (d *Daemon) CollectMetrics(m *MetricsWriter) {
+	m.Gauge("up", "Whether the wgmesh daemon is running.", 1)
+	m.Gauge("start_time_seconds", "Unix time the daemon was started.", float64(d.startedAt.Unix()))
+
+	d.peerStore.CollectMetrics(m)
+
+	m.Counter("reconcile_runs_total", "Number of reconcile passes.", d.metrics.reconcileRuns.Load())
+	m.Counter("wg_set_failures_total", "Number of failed 'wg set' peer updates.", d.metrics.wgSetFailures.Load())
+	m.Counter("route_changes_total", "Number of route diff changes applied.", d.metrics.routesAdded.Load(), "op", "add")
+	m.Counter("route_changes_total", "Number of route diff changes applied.", d.metrics.routesRemoved.Load(), "op", "remove")
+	m.Counter("stale_peers_removed_total", "Number of stale peers removed from WireGuard.", d.metrics.peersRemoved.Load())
+
+	if c, ok := d.currentDiscovery().(MetricsCollector); ok {
+		c.CollectMetrics(m)
+	}
+
+	d.collectWireGuardMetrics(m)
+}
+
+// collectWireGuardMetrics writes per-peer handshake age and transfer counters from 'wg show dump'
+func (d *Daemon) collectWireGuardMetrics(m *MetricsWriter) {
+	stats, err := wireguard.GetPeerStats(d.currentConfig().InterfaceName)
+	if err != nil {
+		log.Printf("[Metrics] Failed to read WireGuard stats: %v", err)
+		return
+	}
+
+	// Label peers with their mesh IP as well, it is easier to read than a pubkey
+	meshIPs := make(map[string]string)
+	for _, p := range d.peerStore.GetAll() {
+		meshIPs[p.WGPubKey] = p.MeshIP
+	}
+
+	labels := func(s wireguard.PeerStats) []string {
+		return []string{"peer", s.PublicKey, "mesh_ip", meshIPs[s.PublicKey]}
+	}
+
+	// Samples of one metric family must be written together, hence one loop per family
+	now := time.Now()
+	for _, s := range stats {
+		// Peers that never completed a handshake are reported with age -1
+		age := -1.0
+		if !s.LatestHandshake.IsZero() {
+			age = now.Sub(s.LatestHandshake).Seconds()
+		}
+		m.Gauge("peer_handshake_age_seconds", "Seconds since the latest WireGuard handshake (-1 if none).", age, labels(s)...)
+	}
+	for _, s := range stats {
+		m.Counter("peer_receive_bytes_total", "Bytes received from the peer.", s.ReceiveBytes, labels(s)...)
+	}
+	for _, s := range stats {
+		m.Counter("peer_transmit_bytes_total", "Bytes sent to the peer.", s.TransmitBytes, labels(s)...)
+	}
+}
+
+// MetricsServer serves the /metrics endpoint over HTTP
+type MetricsServer struct {
+	daemon *Daemon
+	addr   string
+	server *http.Server
+}
+
+// NewMetricsServer creates a metrics server listening on addr
+func NewMetricsServer(d *Daemon, addr string) *MetricsServer {
+	ms := &MetricsServer{daemon: d, addr: addr}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", ms.handleMetrics)
+	ms.server = &http.Server{
+		Handler:     mux,
+		ReadTimeout: 10 * time.Second,
+	}
+
+	return ms
+}
+
+// Start begins serving metrics
+func (ms *MetricsServer) Start() error {
+	listener, err := net.Listen("tcp", ms.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", ms.addr, err)
+	}
+
+	go func() {
+		if err := ms.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("[Metrics] Server error: %v", err)
+		}
+	}()
+
+	log.Printf("[Metrics] Serving Prometheus metrics on http://%s/metrics", listener.Addr())
+	return nil
+}
+
+// Stop shuts down the metrics server
+func (ms *MetricsServer) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return ms.server.Shutdown(ctx)
+}
+
+func (ms *MetricsServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	ms.daemon.CollectMetrics(NewMetricsWriter(&buf))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
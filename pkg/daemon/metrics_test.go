@@ -0,0 +1,61 @@
+package daemon
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetricsWriterFormat(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewMetricsWriter(&buf)
+
+	m.Counter("route_changes_total", "Route changes.", 3, "op", "add")
+	m.Counter("route_changes_total", "Route changes.", 1, "op", "remove")
+	m.Gauge("dht_nodes", "DHT nodes.", 42)
+
+	expected := `# HELP wgmesh_route_changes_total Route changes.
+# TYPE wgmesh_route_changes_total counter
+wgmesh_route_changes_total{op="add"} 3
+wgmesh_route_changes_total{op="remove"} 1
+# HELP wgmesh_dht_nodes DHT nodes.
+# TYPE wgmesh_dht_nodes gauge
+wgmesh_dht_nodes 42
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestMetricsWriterEscapesLabels(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewMetricsWriter(&buf)
+
+	m.Gauge("test", "Test.", 1, "label", "a\"b\\c\nd")
+
+	if !strings.Contains(buf.String(), `wgmesh_test{label="a\"b\\c\nd"} 1`) {
+		t.Errorf("Label value not escaped: %s", buf.String())
+	}
+}
+
+func TestPeerStoreCollectMetrics(t *testing.T) {
+	ps := NewPeerStore()
+	ps.Update(&PeerInfo{WGPubKey: "key1", MeshIP: "10.0.0.1"}, "lan")
+	ps.Update(&PeerInfo{WGPubKey: "key1"}, "dht")
+	ps.Update(&PeerInfo{WGPubKey: "key2", MeshIP: "10.0.0.2"}, "dht")
+
+	var buf bytes.Buffer
+	ps.CollectMetrics(NewMetricsWriter(&buf))
+	out := buf.String()
+
+	for _, line := range []string{
+		`wgmesh_peers{state="active"} 2`,
+		`wgmesh_peers{state="dead"} 0`,
+		`wgmesh_peers_discovered_via{method="dht"} 2`,
+		`wgmesh_peers_discovered_via{method="lan"} 1`,
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("Expected %q in output:\n%s", line, out)
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package daemon
 
 import (
+	"errors"
+	"net/netip"
 	"sync"
 	"time"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
 )
 
 const (
@@ -10,54 +14,114 @@ const (
 	PeerRemoveTimeout  = 10 * time.Minute // Remove peer from WG config after grace period
 )
 
+// ErrIdentityMismatch is returned by PeerStore.Update when an update for a
+// known peer does not carry the identity key the peer was first seen with
+var ErrIdentityMismatch = errors.New("identity key does not match the known peer")
+
+// ErrPeerRevoked is returned by PeerStore.Update for revoked pubkeys
+var ErrPeerRevoked = errors.New("peer has been revoked")
+
 // PeerInfo represents a discovered mesh peer
 type PeerInfo struct {
 	WGPubKey         string
+	IdentityKey      string // Ed25519 public key (base64) from a signed announcement, empty if unverified
+	Name             string // node name advertised by the peer, empty if it has none
 	MeshIP           string
-	Endpoint         string // best known endpoint (ip:port)
+	MeshIPNonce      int  // collision nonce MeshIP was derived with, 0 for the plain derivation
+	MeshIPReserved   bool // MeshIP is a static reservation (--mesh-ip), it wins collisions
+	MeshIPv6         string
+	Endpoint         string   // endpoint in use (ip:port): pinned by probing, else the latest reported
+	Endpoints        []string // all candidate endpoints reported for the peer, newest first
 	RoutableNetworks []string
+	Tags             []string // ACL tags, only taken from the peer's own signed announcements
 	LastSeen         time.Time
+	RelayCapable     bool           // announced by the peer itself
+	ExitNode         bool           // offers to route internet traffic, announced by the peer itself
 	DiscoveredVia    []string       // ["lan", "dht", "gossip"]
-	Latency          *time.Duration // measured via WG handshake
+	Latency          *time.Duration // RTT through the pinned endpoint, nil until probing pins one
 }
 
 // PeerStore is a thread-safe store for discovered peers
 type PeerStore struct {
-	mu    sync.RWMutex
-	peers map[string]*PeerInfo // keyed by WG pubkey
+	mu      sync.RWMutex
+	peers   map[string]*PeerInfo          // keyed by WG pubkey
+	revoked map[string]*crypto.Revocation // keyed by WG pubkey
+	names   map[string]string             // node name -> WG pubkey
 }
 
 // NewPeerStore creates a new peer store
 func NewPeerStore() *PeerStore {
 	return &PeerStore{
-		peers: make(map[string]*PeerInfo),
+		peers:   make(map[string]*PeerInfo),
+		revoked: make(map[string]*crypto.Revocation),
+		names:   make(map[string]string),
 	}
 }
 
 // Update adds or updates a peer in the store
 // Merge logic: newest timestamp wins for mutable fields (endpoint, routable_networks)
-func (ps *PeerStore) Update(info *PeerInfo, discoveryMethod string) {
+// Once a peer is bound to an identity key, only updates signed by that key are
+// accepted; anything else (including unsigned transitive info) returns ErrIdentityMismatch.
+// The binding is trust on first use: nothing proves that the first identity
+// seen for a WireGuard pubkey belongs to the holder of its private key, so it
+// guards a peer against members that show up later, not against one that
+// announced its pubkey first.
+func (ps *PeerStore) Update(info *PeerInfo, discoveryMethod string) error {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 
+	if ps.isRevoked(info.WGPubKey) {
+		return ErrPeerRevoked
+	}
+
 	existing, exists := ps.peers[info.WGPubKey]
 	if !exists {
 		// New peer
 		info.LastSeen = time.Now()
 		info.DiscoveredVia = []string{discoveryMethod}
+		info.Endpoints = mergeEndpoints(info.Endpoint, info.Endpoints, nil)
 		ps.peers[info.WGPubKey] = info
-		return
+		if info.Name != "" {
+			ps.reindexNames()
+		}
+		return nil
 	}
 
-	// Update existing peer - newer info wins
-	if info.Endpoint != "" {
+	if existing.IdentityKey != "" && info.IdentityKey != existing.IdentityKey {
+		return ErrIdentityMismatch
+	}
+	if existing.IdentityKey == "" {
+		existing.IdentityKey = info.IdentityKey
+	}
+
+	// Update existing peer - newer info wins, except that a pinned endpoint is
+	// kept until probing finds a better one or the peer shows up somewhere new
+	if info.Endpoint != "" && (existing.Latency == nil || !containsEndpoint(existing.Endpoints, info.Endpoint)) {
 		existing.Endpoint = info.Endpoint
+		existing.Latency = nil
 	}
+	existing.Endpoints = mergeEndpoints(info.Endpoint, info.Endpoints, existing.Endpoints)
 	if len(info.RoutableNetworks) > 0 {
 		existing.RoutableNetworks = info.RoutableNetworks
 	}
 	if info.MeshIP != "" {
 		existing.MeshIP = info.MeshIP
+		existing.MeshIPNonce = info.MeshIPNonce
+		existing.MeshIPReserved = info.MeshIPReserved
+	}
+	if info.Name != "" && info.Name != existing.Name {
+		existing.Name = info.Name
+		ps.reindexNames()
+	}
+	if info.MeshIPv6 != "" {
+		existing.MeshIPv6 = info.MeshIPv6
+	}
+	// Only the peer's own signed announcement says whether it relays or
+	// serves as an exit node and which ACL tags it carries
+	if info.IdentityKey != "" {
+		existing.RelayCapable = info.RelayCapable
+		existing.ExitNode = info.ExitNode
+		existing.Tags = info.Tags
 	}
 
 	existing.LastSeen = time.Now()
@@ -73,6 +137,7 @@ func (ps *PeerStore) Update(info *PeerInfo, discoveryMethod string) {
 	if !found {
 		existing.DiscoveredVia = append(existing.DiscoveredVia, discoveryMethod)
 	}
+	return nil
 }
 
 // Get returns a peer by public key
@@ -124,6 +189,7 @@ func (ps *PeerStore) Remove(pubKey string) {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 	delete(ps.peers, pubKey)
+	ps.reindexNames()
 }
 
 // CleanupStale removes peers that haven't been seen for too long
@@ -139,9 +205,95 @@ func (ps *PeerStore) CleanupStale() []string {
 			removed = append(removed, pubKey)
 		}
 	}
+	if len(removed) > 0 {
+		ps.reindexNames()
+	}
 	return removed
 }
 
+// SetEndpoint changes the endpoint of a known peer without touching anything
+// else, e.g. to the address a hole punch is attempted on. The endpoint is no
+// longer pinned afterwards. It returns false if the peer is unknown.
+func (ps *PeerStore) SetEndpoint(pubKey, endpoint string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	peer, exists := ps.peers[pubKey]
+	if !exists {
+		return false
+	}
+	peer.Endpoint = endpoint
+	peer.Latency = nil
+	peer.Endpoints = mergeEndpoints(endpoint, nil, peer.Endpoints)
+	return true
+}
+
+// PinEndpoint makes an endpoint with a working handshake the one WireGuard
+// uses and records its RTT. It returns false if the peer is unknown.
+func (ps *PeerStore) PinEndpoint(pubKey, endpoint string, latency time.Duration) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	peer, exists := ps.peers[pubKey]
+	if !exists {
+		return false
+	}
+	peer.Endpoint = endpoint
+	peer.Latency = &latency
+	peer.Endpoints = mergeEndpoints(endpoint, nil, peer.Endpoints)
+	return true
+}
+
+// mergeEndpoints returns a new candidate list with the latest endpoint and the
+// announced candidates in front of the known ones. Unusable addresses are dropped.
+func mergeEndpoints(latest string, announced, known []string) []string {
+	merged := make([]string, 0, MaxEndpointCandidates)
+	for _, list := range [][]string{{latest}, announced, known} {
+		for _, endpoint := range list {
+			if len(merged) == MaxEndpointCandidates {
+				return merged
+			}
+			if !usableEndpoint(endpoint) || containsEndpoint(merged, endpoint) {
+				continue
+			}
+			merged = append(merged, endpoint)
+		}
+	}
+	return merged
+}
+
+// usableEndpoint reports whether endpoint is an ip:port WireGuard can send to,
+// including IPv6 link-local addresses with a zone
+func usableEndpoint(endpoint string) bool {
+	addrPort, err := netip.ParseAddrPort(endpoint)
+	return err == nil && addrPort.Port() != 0 && !addrPort.Addr().IsUnspecified()
+}
+
+func containsEndpoint(endpoints []string, endpoint string) bool {
+	for _, e := range endpoints {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// Replace discards all peers and stores copies of the given ones
+func (ps *PeerStore) Replace(peers []*PeerInfo) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.peers = make(map[string]*PeerInfo, len(peers))
+	for _, peer := range peers {
+		if ps.isRevoked(peer.WGPubKey) {
+			continue
+		}
+		peerCopy := *peer
+		ps.peers[peer.WGPubKey] = &peerCopy
+	}
+	ps.reindexNames()
+}
+
 // Count returns the number of peers
 func (ps *PeerStore) Count() int {
 	ps.mu.RLock()
@@ -160,3 +312,82 @@ func (ps *PeerStore) IsDead(pubKey string) bool {
 	}
 	return time.Since(peer.LastSeen) > PeerDeadTimeout
 }
+
+// Revoke records a revocation, or the lifting of one, and drops a revoked
+// peer. It returns false if the store already holds a newer record for the
+// pubkey.
+func (ps *PeerStore) Revoke(r *crypto.Revocation) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if !r.Newer(ps.revoked[r.WGPubKey]) {
+		return false
+	}
+	ps.revoked[r.WGPubKey] = r
+	if !r.Lifted {
+		delete(ps.peers, r.WGPubKey)
+		ps.reindexNames()
+	}
+	return true
+}
+
+// GetByName returns a copy of the peer advertising the given node name
+func (ps *PeerStore) GetByName(name string) (*PeerInfo, bool) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	pubKey, ok := ps.names[name]
+	if !ok {
+		return nil, false
+	}
+	peer, ok := ps.peers[pubKey]
+	if !ok {
+		return nil, false
+	}
+	peerCopy := *peer
+	return &peerCopy, true
+}
+
+// reindexNames rebuilds the name index. Names are chosen by operators and may
+// clash; the peer with the lowest pubkey keeps the name on every node. Only
+// peers bound to an identity key, i.e. seen in their own signed announcement,
+// can own a name. Caller must hold ps.mu.
+func (ps *PeerStore) reindexNames() {
+	names := make(map[string]string, len(ps.peers))
+	for pubKey, peer := range ps.peers {
+		if peer.Name == "" || peer.IdentityKey == "" {
+			continue
+		}
+		if current, ok := names[peer.Name]; !ok || pubKey < current {
+			names[peer.Name] = pubKey
+		}
+	}
+	ps.names = names
+}
+
+// IsRevoked checks if a pubkey has been revoked and the revocation not lifted
+func (ps *PeerStore) IsRevoked(pubKey string) bool {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.isRevoked(pubKey)
+}
+
+// isRevoked is IsRevoked for callers holding ps.mu
+func (ps *PeerStore) isRevoked(pubKey string) bool {
+	r, ok := ps.revoked[pubKey]
+	return ok && !r.Lifted
+}
+
+// Revocations returns copies of all revocation records, including lifted
+// ones, which have to be gossiped to override the revocation everywhere
+func (ps *PeerStore) Revocations() []*crypto.Revocation {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	result := make([]*crypto.Revocation, 0, len(ps.revoked))
+	for _, r := range ps.revoked {
+		rCopy := *r
+		result = append(result, &rCopy)
+	}
+	return result
+}
@@ -1,8 +1,11 @@
 package daemon
 
 import (
+	"errors"
 	"testing"
 	"time"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
 )
 
 func TestPeerStoreUpdate(t *testing.T) {
@@ -91,6 +94,42 @@ func TestPeerStoreRemove(t *testing.T) {
 	}
 }
 
+func TestPeerStoreGetByName(t *testing.T) {
+	ps := NewPeerStore()
+
+	ps.Update(&PeerInfo{WGPubKey: "key2", IdentityKey: "id2", Name: "web"}, "test")
+	ps.Update(&PeerInfo{WGPubKey: "key3", IdentityKey: "id3", Name: "db"}, "test")
+
+	if got, ok := ps.GetByName("web"); !ok || got.WGPubKey != "key2" {
+		t.Fatalf("Expected web to be key2, got %v", got)
+	}
+
+	// Only peers bound to an identity can own a name
+	ps.Update(&PeerInfo{WGPubKey: "key0", Name: "web"}, "gossip")
+	if got, ok := ps.GetByName("web"); !ok || got.WGPubKey != "key2" {
+		t.Errorf("Expected an unsigned entry not to take the name, got %v", got)
+	}
+
+	// On a clash the lower pubkey keeps the name, whatever the order
+	ps.Update(&PeerInfo{WGPubKey: "key1", IdentityKey: "id1", Name: "web"}, "test")
+	if got, ok := ps.GetByName("web"); !ok || got.WGPubKey != "key1" {
+		t.Errorf("Expected key1 to win the name, got %v", got)
+	}
+	ps.Remove("key1")
+	if got, ok := ps.GetByName("web"); !ok || got.WGPubKey != "key2" {
+		t.Errorf("Expected web to fall back to key2, got %v", got)
+	}
+
+	// Renames move the index
+	ps.Update(&PeerInfo{WGPubKey: "key3", IdentityKey: "id3", Name: "db2"}, "test")
+	if _, ok := ps.GetByName("db"); ok {
+		t.Error("Old name should be gone after a rename")
+	}
+	if _, ok := ps.GetByName("db2"); !ok {
+		t.Error("Expected to find the new name")
+	}
+}
+
 func TestPeerStoreCleanupStale(t *testing.T) {
 	ps := NewPeerStore()
 
@@ -125,3 +164,143 @@ func TestPeerStoreIsDead(t *testing.T) {
 		t.Error("Non-existent peer should be dead")
 	}
 }
+
+func TestPeerStoreIdentityBinding(t *testing.T) {
+	ps := NewPeerStore()
+
+	// Transitive info arrives first without an identity
+	ps.Update(&PeerInfo{WGPubKey: "key1", Endpoint: "9.9.9.9:51820"}, "gossip-transitive")
+
+	// The peer's own signed announcement binds the identity
+	if err := ps.Update(&PeerInfo{WGPubKey: "key1", IdentityKey: "id1", MeshIP: "10.0.0.1", Endpoint: "1.2.3.4:51820"}, "dht"); err != nil {
+		t.Fatalf("First identity should bind, got %v", err)
+	}
+
+	// Another identity must not take over the endpoint or routes
+	err := ps.Update(&PeerInfo{
+		WGPubKey:         "key1",
+		IdentityKey:      "id2",
+		Endpoint:         "6.6.6.6:51820",
+		RoutableNetworks: []string{"0.0.0.0/0"},
+	}, "gossip")
+	if !errors.Is(err, ErrIdentityMismatch) {
+		t.Errorf("Expected ErrIdentityMismatch, got %v", err)
+	}
+
+	// Neither may unsigned transitive info
+	if err := ps.Update(&PeerInfo{WGPubKey: "key1", Endpoint: "6.6.6.6:51820"}, "dht-transitive"); !errors.Is(err, ErrIdentityMismatch) {
+		t.Errorf("Expected ErrIdentityMismatch for unsigned update, got %v", err)
+	}
+
+	got, _ := ps.Get("key1")
+	if got.Endpoint != "1.2.3.4:51820" || len(got.RoutableNetworks) != 0 || got.IdentityKey != "id1" {
+		t.Errorf("Peer was modified by a foreign identity: %+v", got)
+	}
+
+	// The bound identity can still update its own entry
+	if err := ps.Update(&PeerInfo{WGPubKey: "key1", IdentityKey: "id1", Endpoint: "5.6.7.8:51820"}, "lan"); err != nil {
+		t.Errorf("Same identity should update, got %v", err)
+	}
+}
+
+func TestPeerStoreTags(t *testing.T) {
+	ps := NewPeerStore()
+
+	ps.Update(&PeerInfo{WGPubKey: "key1", IdentityKey: "id1", Tags: []string{"app"}}, "dht")
+
+	// Unsigned transitive info must not change the tags the ACL policy matches on
+	ps.Update(&PeerInfo{WGPubKey: "key1", Tags: []string{"db"}}, "gossip-transitive")
+	if got, _ := ps.Get("key1"); len(got.Tags) != 1 || got.Tags[0] != "app" {
+		t.Errorf("Expected tags [app], got %v", got.Tags)
+	}
+
+	// The peer's own announcement may drop them
+	ps.Update(&PeerInfo{WGPubKey: "key1", IdentityKey: "id1"}, "lan")
+	if got, _ := ps.Get("key1"); len(got.Tags) != 0 {
+		t.Errorf("Expected no tags, got %v", got.Tags)
+	}
+}
+
+func TestPeerStoreRevoke(t *testing.T) {
+	ps := NewPeerStore()
+	ps.Update(&PeerInfo{WGPubKey: "key1", MeshIP: "10.0.0.1"}, "dht")
+	ps.Update(&PeerInfo{WGPubKey: "key2", MeshIP: "10.0.0.2"}, "dht")
+
+	_, admin, err := crypto.GenerateAdminKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := crypto.CreateRevocation(admin, "key1", "lost")
+	if !ps.Revoke(r) {
+		t.Fatal("First revocation should be new")
+	}
+	if ps.Revoke(r) {
+		t.Error("Repeated revocation should not be new")
+	}
+
+	if _, ok := ps.Get("key1"); ok {
+		t.Error("Revoked peer should be removed")
+	}
+	if err := ps.Update(&PeerInfo{WGPubKey: "key1", MeshIP: "10.0.0.1"}, "gossip"); !errors.Is(err, ErrPeerRevoked) {
+		t.Errorf("Expected ErrPeerRevoked, got %v", err)
+	}
+	ps.Replace([]*PeerInfo{{WGPubKey: "key1"}, {WGPubKey: "key2"}})
+	if ps.Count() != 1 || !ps.IsRevoked("key1") {
+		t.Errorf("Replace should skip revoked peers, got %d peers", ps.Count())
+	}
+	if len(ps.Revocations()) != 1 {
+		t.Errorf("Expected 1 revocation, got %d", len(ps.Revocations()))
+	}
+
+	// Lifting the revocation lets the peer back in, an older record doesn't revert it
+	lift := crypto.LiftRevocation(admin, "key1", "found")
+	if !ps.Revoke(lift) || ps.IsRevoked("key1") {
+		t.Fatal("Lift should un-revoke the peer")
+	}
+	if ps.Revoke(r) || ps.IsRevoked("key1") {
+		t.Error("Replayed older revocation should not win over the lift")
+	}
+	if err := ps.Update(&PeerInfo{WGPubKey: "key1", MeshIP: "10.0.0.1"}, "gossip"); err != nil {
+		t.Errorf("Un-revoked peer should be accepted, got %v", err)
+	}
+	if len(ps.Revocations()) != 1 {
+		t.Errorf("Lift should replace the revocation record, got %d", len(ps.Revocations()))
+	}
+}
+
+func TestPeerStoreEndpointCandidates(t *testing.T) {
+	ps := NewPeerStore()
+
+	ps.Update(&PeerInfo{
+		WGPubKey:  "key1",
+		Endpoint:  "203.0.113.1:51820",
+		Endpoints: []string{"192.168.1.10:51820", "[2001:db8::1]:51820", "0.0.0.0:51820"},
+	}, "dht")
+	ps.Update(&PeerInfo{WGPubKey: "key1", Endpoint: "192.168.1.10:51820"}, "lan")
+
+	got, _ := ps.Get("key1")
+	if got.Endpoint != "192.168.1.10:51820" {
+		t.Errorf("Unpinned endpoint should follow the latest report, got %s", got.Endpoint)
+	}
+	if len(got.Endpoints) != 3 {
+		t.Fatalf("Expected 3 usable candidates, got %v", got.Endpoints)
+	}
+
+	// A pinned endpoint survives reports of other known candidates
+	ps.PinEndpoint("key1", "[2001:db8::1]:51820", 5*time.Millisecond)
+	ps.Update(&PeerInfo{WGPubKey: "key1", Endpoint: "203.0.113.1:51820"}, "dht")
+	got, _ = ps.Get("key1")
+	if got.Endpoint != "[2001:db8::1]:51820" || got.Latency == nil {
+		t.Errorf("Pinned endpoint should be kept, got %s", got.Endpoint)
+	}
+
+	// An address never seen before means the peer moved
+	ps.Update(&PeerInfo{WGPubKey: "key1", Endpoint: "198.51.100.7:51820"}, "dht")
+	got, _ = ps.Get("key1")
+	if got.Endpoint != "198.51.100.7:51820" || got.Latency != nil {
+		t.Errorf("New address should unpin the endpoint, got %s", got.Endpoint)
+	}
+	if got.Endpoints[0] != "198.51.100.7:51820" {
+		t.Errorf("Newest candidate should come first, got %v", got.Endpoints)
+	}
+}
@@ -0,0 +1,290 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/acl"
+	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
+)
+
+// PolicyRebroadcastInterval is how often the ACL policy is re-sent so that
+// nodes which were offline or joined later learn about it
+const PolicyRebroadcastInterval = 10 * time.Minute
+
+// MaxPolicyClockSkew is how far in the future a policy version may lie. A
+// version far ahead would otherwise win over every later policy.
+const MaxPolicyClockSkew = time.Hour
+
+// noFirewall marks that no ACL table is installed, as opposed to "" which
+// means we don't know yet (e.g. one left behind by a previous run)
+const noFirewall = "-"
+
+// PolicyPath returns the path of the persisted ACL policy for an interface
+func PolicyPath(interfaceName string) string {
+	return filepath.Join("/var/lib/wgmesh", fmt.Sprintf("%s-policy.json", interfaceName))
+}
+
+// loadPolicyUpdate loads a persisted policy update (nil if there is none)
+func loadPolicyUpdate(path string) (*crypto.PolicyUpdate, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var update crypto.PolicyUpdate
+	if err := json.Unmarshal(data, &update); err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %w", err)
+	}
+	return &update, nil
+}
+
+// savePolicyUpdate persists a policy update
+func savePolicyUpdate(path string, update *crypto.PolicyUpdate) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(update, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// loadPolicy restores the persisted policy on startup and distributes the
+// signed --acl-policy file if the mesh doesn't run it or a newer one already
+func (d *Daemon) loadPolicy() {
+	config := d.currentConfig()
+	update, err := loadPolicyUpdate(PolicyPath(config.InterfaceName))
+	if err != nil {
+		log.Printf("[ACL] Ignoring persisted policy: %v", err)
+	} else if update != nil {
+		// Checked again, the admin key may have changed since it was stored
+		if err := d.checkPolicyUpdate(update); err != nil {
+			log.Printf("[ACL] Ignoring persisted policy: %v", err)
+		} else {
+			d.applyPolicyUpdate(update)
+		}
+	}
+
+	if config.ACLPolicyFile == "" {
+		return
+	}
+	update, err = loadPolicyUpdate(config.ACLPolicyFile)
+	if err != nil || update == nil {
+		log.Printf("[ACL] Failed to read policy from %s: %v", config.ACLPolicyFile, err)
+		return
+	}
+	if err := d.SetPolicy(update); err != nil && !errors.Is(err, errPolicyNotNewer) {
+		log.Printf("[ACL] Failed to set policy from %s: %v", config.ACLPolicyFile, err)
+	}
+}
+
+// errPolicyNotNewer is returned by SetPolicy for a policy that is already in
+// force or older than the one in force
+var errPolicyNotNewer = errors.New("the same or a newer policy is already in force")
+
+// SetPolicy puts a policy update signed with the admin key into force and
+// gossips it to all peers
+func (d *Daemon) SetPolicy(update *crypto.PolicyUpdate) error {
+	if err := d.checkPolicyUpdate(update); err != nil {
+		return err
+	}
+	if _, err := acl.Parse(update.Policy); err != nil {
+		return err
+	}
+	if !d.applyPolicyUpdate(update) {
+		return errPolicyNotNewer
+	}
+	d.broadcastPolicy()
+	return nil
+}
+
+// checkPolicyUpdate checks that an update is signed with the admin key and
+// its version doesn't lie too far in the future
+func (d *Daemon) checkPolicyUpdate(update *crypto.PolicyUpdate) error {
+	adminKey := d.currentConfig().AdminKey
+	if adminKey == nil {
+		return fmt.Errorf("no admin key configured, start the daemon with --admin-key or an admin secret URI")
+	}
+	if !update.Verify(adminKey) {
+		return fmt.Errorf("policy version %d is not signed with the mesh admin key", update.Version)
+	}
+	if time.Unix(0, update.Version).After(time.Now().Add(MaxPolicyClockSkew)) {
+		return fmt.Errorf("policy version %d lies in the future", update.Version)
+	}
+	return nil
+}
+
+// Policy returns the policy update in force, nil if there is none
+func (d *Daemon) Policy() *crypto.PolicyUpdate {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.policyUpdate
+}
+
+// handlePolicyMessage processes a POLICY message gossiped by a peer
+func (d *Daemon) handlePolicyMessage(payload []byte) {
+	var update crypto.PolicyUpdate
+	if err := json.Unmarshal(payload, &update); err != nil {
+		log.Printf("[ACL] Invalid policy message: %v", err)
+		return
+	}
+
+	// Without a pinned admin key nobody may set a policy
+	if d.currentConfig().AdminKey == nil {
+		return
+	}
+	if err := d.checkPolicyUpdate(&update); err != nil {
+		log.Printf("[ACL] Ignoring policy: %v", err)
+		return
+	}
+
+	// Flood a new policy right away instead of waiting for the next rebroadcast
+	if d.applyPolicyUpdate(&update) {
+		d.broadcastPolicy()
+	}
+}
+
+// applyPolicyUpdate puts a policy into force if it is newer than the current
+// one. It returns true if the policy was applied.
+func (d *Daemon) applyPolicyUpdate(update *crypto.PolicyUpdate) bool {
+	policy, err := acl.Parse(update.Policy)
+	if err != nil {
+		log.Printf("[ACL] Ignoring policy version %d: %v", update.Version, err)
+		return false
+	}
+
+	d.mu.Lock()
+	if d.policyUpdate != nil && update.Version <= d.policyUpdate.Version {
+		d.mu.Unlock()
+		return false
+	}
+	d.policyUpdate = update
+	d.policy = policy
+	d.mu.Unlock()
+
+	log.Printf("[ACL] Policy version %d in force (%d rules)", update.Version, len(policy.Rules))
+	if runtime.GOOS != "linux" {
+		log.Printf("[ACL] Warning: firewall rules need nftables, only peerings are restricted on %s", runtime.GOOS)
+	}
+
+	if err := savePolicyUpdate(PolicyPath(d.currentConfig().InterfaceName), update); err != nil {
+		log.Printf("[ACL] Failed to persist policy: %v", err)
+	}
+	return true
+}
+
+// broadcastPolicy sends the policy in force to all peers. It carries the
+// admin signature, so it stays valid across secret rotations as is.
+func (d *Daemon) broadcastPolicy() {
+	d.mu.Lock()
+	d.lastPolicyBroadcast = time.Now()
+	update := d.policyUpdate
+	d.mu.Unlock()
+
+	messenger, ok := d.currentDiscovery().(MeshMessenger)
+	if update == nil || !ok {
+		return
+	}
+
+	if err := messenger.Broadcast(crypto.MessageTypePolicy, update); err != nil {
+		log.Printf("[ACL] Failed to broadcast policy: %v", err)
+	}
+}
+
+// checkPolicy is called from the reconcile loop to periodically re-send the policy
+func (d *Daemon) checkPolicy() {
+	d.mu.RLock()
+	last := d.lastPolicyBroadcast
+	d.mu.RUnlock()
+
+	if time.Since(last) >= PolicyRebroadcastInterval {
+		d.broadcastPolicy()
+	}
+}
+
+// peerAllowed reports whether the policy lets us and peer talk at all
+func (d *Daemon) peerAllowed(peer *PeerInfo) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.policy == nil || d.localNode == nil {
+		return true
+	}
+	local := d.policy.NodeTags(d.localNode.WGPubKey, d.localNode.Tags)
+	return d.policy.Connected(local, d.policy.NodeTags(peer.WGPubKey, peer.Tags))
+}
+
+// updateFirewall compiles the policy into nftables rules for the mesh
+// interface and loads them if they changed
+func (d *Daemon) updateFirewall(peers []*PeerInfo) {
+	if runtime.GOOS != "linux" {
+		return
+	}
+	config := d.currentConfig()
+
+	d.mu.RLock()
+	policy := d.policy
+	var local acl.Node
+	if d.localNode != nil {
+		local = acl.Node{Name: d.localNode.Name, Tags: policy.NodeTags(d.localNode.WGPubKey, d.localNode.Tags)}
+	}
+	current := d.firewallScript
+	d.mu.RUnlock()
+
+	if policy == nil {
+		if current == noFirewall {
+			return
+		}
+		// Clean up once, also if nft is missing on nodes never running a policy
+		if err := acl.Remove(config.InterfaceName); err != nil && current != "" {
+			log.Printf("[ACL] %v", err)
+		}
+		d.mu.Lock()
+		d.firewallScript = noFirewall
+		d.mu.Unlock()
+		return
+	}
+
+	fw := acl.Firewall{
+		Interface:    config.InterfaceName,
+		Local:        local,
+		ControlPorts: []int{int(config.Keys.GossipPort), DNSPort},
+	}
+	for _, peer := range peers {
+		if d.peerStore.IsRevoked(peer.WGPubKey) {
+			continue
+		}
+		node := acl.Node{Name: peer.Name, Tags: policy.NodeTags(peer.WGPubKey, peer.Tags)}
+		for _, addr := range []string{peer.MeshIP, peer.MeshIPv6} {
+			if addr != "" {
+				node.Addrs = append(node.Addrs, addr)
+			}
+		}
+		fw.Peers = append(fw.Peers, node)
+	}
+
+	script := acl.Compile(policy, fw)
+	if script == current {
+		return
+	}
+	if err := acl.Apply(script); err != nil {
+		log.Printf("[ACL] %v", err)
+		return
+	}
+
+	d.mu.Lock()
+	d.firewallScript = script
+	d.mu.Unlock()
+	log.Printf("[ACL] Firewall rules updated on %s", config.InterfaceName)
+}
@@ -0,0 +1,41 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
+)
+
+func TestCheckPolicyUpdate(t *testing.T) {
+	d := newTestDaemon(t)
+	adminPub, admin, err := crypto.GenerateAdminKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	update := crypto.CreatePolicyUpdate(admin, []byte(`{"rules":[]}`))
+	if err := d.checkPolicyUpdate(update); err == nil {
+		t.Error("Expected policies to be refused without an admin key")
+	}
+
+	d.config.AdminKey = adminPub
+	if err := d.checkPolicyUpdate(update); err != nil {
+		t.Errorf("Expected the admin's policy to be accepted, got %v", err)
+	}
+
+	_, other, err := crypto.GenerateAdminKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.checkPolicyUpdate(crypto.CreatePolicyUpdate(other, []byte(`{"rules":[]}`))); err == nil {
+		t.Error("Expected a policy signed by another key to be refused")
+	}
+
+	// A version far ahead would win over every later policy
+	future := &crypto.PolicyUpdate{Version: time.Now().Add(2 * MaxPolicyClockSkew).UnixNano(), Policy: update.Policy}
+	future.Sign(admin)
+	if err := d.checkPolicyUpdate(future); err == nil {
+		t.Error("Expected a policy version in the future to be refused")
+	}
+}
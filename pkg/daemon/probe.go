@@ -0,0 +1,243 @@
+package daemon
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/wireguard"
+)
+
+const (
+	// MaxEndpointCandidates limits how many candidate endpoints are kept per peer
+	MaxEndpointCandidates = 8
+	// EndpointProbeInterval is how often the candidate endpoints of a peer are probed
+	EndpointProbeInterval = 10 * time.Minute
+)
+
+// endpointProbe tracks probing of a peer's candidate endpoints
+type endpointProbe struct {
+	last    time.Time
+	running bool
+}
+
+// localEndpointCandidates lists the endpoints peers may reach our WireGuard
+// port at: the public address learned via STUN first, then the addresses of
+// our other interfaces (LAN and global IPv6)
+func localEndpointCandidates(wgInterface string, listenPort int, publicEndpoint string) []string {
+	var candidates []string
+	if publicEndpoint != "" {
+		candidates = append(candidates, publicEndpoint)
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return candidates
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || iface.Name == wgInterface {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() || ipNet.IP.IsLoopback() {
+				continue
+			}
+			candidates = append(candidates, net.JoinHostPort(ipNet.IP.String(), strconv.Itoa(listenPort)))
+		}
+	}
+
+	return mergeEndpoints("", candidates, nil)
+}
+
+// checkEndpointProbes is called from the reconcile loop and starts probing
+// the candidate endpoints of peers that are due
+func (d *Daemon) checkEndpointProbes(peers []*PeerInfo) {
+	// Probes ping through the tunnel, like routes this is Linux only
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	now := time.Now()
+	var due []*PeerInfo
+
+	d.mu.Lock()
+	if d.probes == nil {
+		d.probes = make(map[string]*endpointProbe)
+	}
+	active := make(map[string]bool)
+	for _, peer := range peers {
+		active[peer.WGPubKey] = true
+		// Traffic to relayed peers goes through the relay, probing would measure the relay
+		if peer.WGPubKey == d.localNode.WGPubKey || peer.MeshIP == "" || len(peer.Endpoints) == 0 || d.relays[peer.WGPubKey] != "" {
+			continue
+		}
+		probe, ok := d.probes[peer.WGPubKey]
+		if !ok {
+			probe = &endpointProbe{}
+			d.probes[peer.WGPubKey] = probe
+		}
+		if probe.running || now.Sub(probe.last) < EndpointProbeInterval {
+			continue
+		}
+		probe.running = true
+		probe.last = now
+		due = append(due, peer)
+	}
+	for pubKey, probe := range d.probes {
+		if !active[pubKey] && !probe.running {
+			delete(d.probes, pubKey)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, peer := range due {
+		go d.probeEndpoints(peer)
+	}
+}
+
+// probeEndpoints looks for a working endpoint of a peer whose handshake went
+// stale. It tries the candidates in order, starting with the endpoint in use,
+// and pins the first one that completes a handshake. A peer with a fresh
+// handshake is left alone; only its round trip time is measured.
+func (d *Daemon) probeEndpoints(peer *PeerInfo) {
+	defer func() {
+		d.mu.Lock()
+		if probe, ok := d.probes[peer.WGPubKey]; ok {
+			probe.running = false
+		}
+		d.mu.Unlock()
+	}()
+
+	if stats, err := d.peerStats(peer.WGPubKey); err == nil && handshakeFresh(stats.LatestHandshake, time.Now()) {
+		if rtt, err := pingRTT(peer.MeshIP); err == nil {
+			d.peerStore.PinEndpoint(peer.WGPubKey, stats.Endpoint, rtt)
+		}
+		return
+	}
+
+	for _, candidate := range mergeEndpoints(peer.Endpoint, peer.Endpoints, nil) {
+		if d.ctx.Err() != nil {
+			return
+		}
+		endpoint, rtt, err := d.probeEndpoint(peer, candidate)
+		if err != nil {
+			continue
+		}
+		if !d.peerStore.PinEndpoint(peer.WGPubKey, endpoint, rtt) {
+			return
+		}
+		d.applyEndpoint(peer.WGPubKey)
+		if endpoint != peer.Endpoint {
+			log.Printf("[Probe] Pinned %s to %s (rtt %v, was %s)",
+				safeKeyPrefix(peer.WGPubKey), endpoint, rtt.Round(time.Microsecond), peer.Endpoint)
+		}
+		return
+	}
+
+	// Nothing answered, go back to what we had
+	if peer.Endpoint != "" && d.peerStore.SetEndpoint(peer.WGPubKey, peer.Endpoint) {
+		d.applyEndpoint(peer.WGPubKey)
+	}
+}
+
+// probeEndpoint points WireGuard at candidate and pings the peer's mesh IP
+// through the tunnel. Only a handshake completed after the switch counts, an
+// older one may have been made over another endpoint. It returns the endpoint
+// WireGuard ended up using, which differs from the candidate when the peer's
+// replies come from another address.
+func (d *Daemon) probeEndpoint(peer *PeerInfo, candidate string) (string, time.Duration, error) {
+	if !d.peerStore.SetEndpoint(peer.WGPubKey, candidate) {
+		return "", 0, fmt.Errorf("peer %s is gone", safeKeyPrefix(peer.WGPubKey))
+	}
+	switched := time.Now()
+	if err := d.applyEndpoint(peer.WGPubKey); err != nil {
+		return "", 0, err
+	}
+
+	rtt, err := pingRTT(peer.MeshIP)
+	if err != nil {
+		return "", 0, err
+	}
+
+	stats, err := d.peerStats(peer.WGPubKey)
+	if err != nil {
+		return "", 0, err
+	}
+	if !stats.LatestHandshake.After(switched) {
+		return "", 0, fmt.Errorf("no handshake via %s", candidate)
+	}
+	return stats.Endpoint, rtt, nil
+}
+
+// peerStats returns the WireGuard statistics of one peer
+func (d *Daemon) peerStats(pubKey string) (wireguard.PeerStats, error) {
+	stats, err := wireguard.GetPeerStats(d.currentConfig().InterfaceName)
+	if err != nil {
+		return wireguard.PeerStats{}, err
+	}
+	for _, s := range stats {
+		if s.PublicKey == pubKey {
+			return s, nil
+		}
+	}
+	return wireguard.PeerStats{}, fmt.Errorf("peer %s is not configured", safeKeyPrefix(pubKey))
+}
+
+// handshakeFresh reports whether a handshake is recent enough for the peer
+// to count as connected
+func handshakeFresh(handshake, now time.Time) bool {
+	return !handshake.IsZero() && now.Sub(handshake) < HandshakeTimeout
+}
+
+// applyEndpoint configures WireGuard with the stored endpoint of a peer
+func (d *Daemon) applyEndpoint(pubKey string) error {
+	peer, ok := d.peerStore.Get(pubKey)
+	if !ok {
+		return fmt.Errorf("peer %s is gone", safeKeyPrefix(pubKey))
+	}
+	if err := d.configurePeer(peer, d.currentConfig().Keys.PSK); err != nil {
+		log.Printf("[Probe] Failed to configure peer %s: %v", safeKeyPrefix(pubKey), err)
+		return err
+	}
+	return nil
+}
+
+// pingRTT pings ip a few times and returns the average round trip time
+func pingRTT(ip string) (time.Duration, error) {
+	output, err := exec.Command("ping", "-c", "3", "-i", "0.2", "-W", "1", "-q", ip).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("no reply from %s: %w", ip, err)
+	}
+	return parsePingRTT(string(output))
+}
+
+// parsePingRTT extracts the average from the summary line of ping,
+// e.g. "rtt min/avg/max/mdev = 0.042/0.051/0.063/0.008 ms"
+func parsePingRTT(output string) (time.Duration, error) {
+	for _, line := range strings.Split(output, "\n") {
+		_, values, ok := strings.Cut(line, " = ")
+		if !ok || !strings.Contains(line, "min/avg/max") {
+			continue
+		}
+		fields := strings.Split(strings.TrimSuffix(strings.TrimSpace(values), " ms"), "/")
+		if len(fields) < 2 {
+			break
+		}
+		avg, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			break
+		}
+		return time.Duration(avg * float64(time.Millisecond)), nil
+	}
+	return 0, fmt.Errorf("no round trip time in ping output")
+}
@@ -0,0 +1,50 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePingRTT(t *testing.T) {
+	output := `PING 10.42.0.2 (10.42.0.2) 56(84) bytes of data.
+
+--- 10.42.0.2 ping statistics ---
+3 packets transmitted, 3 received, 0% packet loss, time 402ms
+rtt min/avg/max/mdev = 11.210/12.500/13.902/1.100 ms
+`
+	rtt, err := parsePingRTT(output)
+	if err != nil {
+		t.Fatalf("parsePingRTT failed: %v", err)
+	}
+	if rtt != 12500*time.Microsecond {
+		t.Errorf("Expected 12.5ms, got %v", rtt)
+	}
+
+	// BusyBox and macOS label the line differently
+	rtt, err = parsePingRTT("round-trip min/avg/max = 0.100/0.200/0.300 ms\n")
+	if err != nil || rtt != 200*time.Microsecond {
+		t.Errorf("Expected 200µs, got %v (%v)", rtt, err)
+	}
+
+	if _, err := parsePingRTT("3 packets transmitted, 0 received, 100% packet loss\n"); err == nil {
+		t.Error("Expected an error without a summary line")
+	}
+}
+
+func TestHandshakeFresh(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		handshake time.Time
+		want      bool
+	}{
+		{"never", time.Time{}, false},
+		{"recent", now.Add(-30 * time.Second), true},
+		{"stale", now.Add(-HandshakeTimeout), false},
+	}
+	for _, tt := range tests {
+		if got := handshakeFresh(tt.handshake, now); got != tt.want {
+			t.Errorf("%s: handshakeFresh() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package daemon
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
+	"github.com/atvirokodosprendimai/wgmesh/pkg/wireguard"
+)
+
+const (
+	// HandshakeTimeout is how old the latest handshake may be for a peer to
+	// count as connected (WireGuard re-handshakes every 2 minutes)
+	HandshakeTimeout = 3 * time.Minute
+	// PunchAfter is how long a peer must stay without a handshake before a
+	// hole punch is attempted
+	PunchAfter = 30 * time.Second
+	// PunchRetryInterval is the minimum time between punches to the same peer
+	PunchRetryInterval = 2 * time.Minute
+	// PunchDelay gives both sides time to receive the go message before they
+	// start sending at the same moment
+	PunchDelay = 2 * time.Second
+	// PunchPackets is how many packets each side sends to open its NAT
+	PunchPackets = 5
+	// punchPort receives the punch packets on the peer; they only need to
+	// trigger a handshake, so they go to the discard port
+	punchPort = 9
+)
+
+// PunchMessage coordinates a simultaneous-open hole punch. The initiator
+// sends it without StartAt to an introducer, a peer both sides have a working
+// handshake with. The introducer fills in the endpoints it sees both sides at
+// (the NAT mappings of their WireGuard ports), signs it with its identity key
+// and sends it to both of them.
+type PunchMessage struct {
+	Initiator         string `json:"initiator"`
+	Target            string `json:"target"`
+	InitiatorEndpoint string `json:"initiator_endpoint,omitempty"`
+	TargetEndpoint    string `json:"target_endpoint,omitempty"`
+	StartAt           int64  `json:"start_at,omitempty"`   // unix milliseconds, zero in requests
+	Introducer        string `json:"introducer,omitempty"` // WG pubkey of the introducer
+	Signature         []byte `json:"signature,omitempty"`  // introducer's Ed25519 signature
+}
+
+// signedBytes returns the message without its signature
+func (m *PunchMessage) signedBytes() []byte {
+	unsigned := *m
+	unsigned.Signature = nil
+	data, _ := json.Marshal(&unsigned)
+	return data
+}
+
+// Sign signs the message with the introducer's identity key
+func (m *PunchMessage) Sign(identity ed25519.PrivateKey) {
+	m.Signature = ed25519.Sign(identity, m.signedBytes())
+}
+
+// Verify checks the signature against an identity key (base64, as in PeerInfo)
+func (m *PunchMessage) Verify(identityKey string) bool {
+	key, err := base64.StdEncoding.DecodeString(identityKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(key), m.signedBytes(), m.Signature)
+}
+
+// punchTimeValid reports whether a go message's start time is about
+// PunchDelay ahead of now, as set by an introducer moments ago. Old or
+// far-future messages are replays or forgeries.
+func punchTimeValid(startAt, now time.Time) bool {
+	return !startAt.Before(now.Add(-PunchDelay)) && !startAt.After(now.Add(2*PunchDelay))
+}
+
+// punchState tracks hole punching for a peer without a handshake
+type punchState struct {
+	since       time.Time // first seen without a handshake
+	lastPunch   time.Time
+	introducer  string // peer we asked to coordinate the last punch
+	lastStartAt int64  // StartAt of the last go message accepted, to drop replays
+}
+
+// checkHolePunching is called from the reconcile loop. For peers that have
+// not completed a handshake, it asks a mutually reachable peer to coordinate a punch.
+func (d *Daemon) checkHolePunching() {
+	messenger, ok := d.currentDiscovery().(MeshMessenger)
+	if !ok {
+		return
+	}
+
+	stats, err := wireguard.GetPeerStats(d.currentConfig().InterfaceName)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	connected := make(map[string]time.Time)
+	for _, s := range stats {
+		if !s.LatestHandshake.IsZero() && now.Sub(s.LatestHandshake) < HandshakeTimeout {
+			connected[s.PublicKey] = s.LatestHandshake
+		}
+	}
+
+	d.mu.Lock()
+	if d.punches == nil {
+		d.punches = make(map[string]*punchState)
+	}
+	var targets []string
+	configured := make(map[string]bool)
+	for _, s := range stats {
+		configured[s.PublicKey] = true
+		if _, ok := connected[s.PublicKey]; ok {
+			delete(d.punches, s.PublicKey)
+			continue
+		}
+		state, ok := d.punches[s.PublicKey]
+		if !ok {
+			d.punches[s.PublicKey] = &punchState{since: now}
+			continue
+		}
+		if now.Sub(state.since) >= PunchAfter && now.Sub(state.lastPunch) >= PunchRetryInterval {
+			state.lastPunch = now
+			targets = append(targets, s.PublicKey)
+		}
+	}
+	for pubKey := range d.punches {
+		if !configured[pubKey] {
+			delete(d.punches, pubKey)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, target := range targets {
+		introducer := d.pickIntroducer(connected, target)
+		if introducer == nil {
+			continue
+		}
+		d.mu.Lock()
+		if state, ok := d.punches[target]; ok {
+			state.introducer = introducer.WGPubKey
+		}
+		d.mu.Unlock()
+		log.Printf("[Punch] No handshake with %s, asking %s to coordinate a hole punch",
+			safeKeyPrefix(target), safeKeyPrefix(introducer.WGPubKey))
+		msg := &PunchMessage{Initiator: d.localNode.WGPubKey, Target: target}
+		if err := messenger.Send(crypto.MessageTypePunch, msg, introducer.MeshIP); err != nil {
+			log.Printf("[Punch] Failed to send punch request: %v", err)
+		}
+	}
+}
+
+// pickIntroducer returns the connected peer with the most recent handshake, other than target
+func (d *Daemon) pickIntroducer(connected map[string]time.Time, target string) *PeerInfo {
+	var best *PeerInfo
+	var bestHandshake time.Time
+	for pubKey, handshake := range connected {
+		if pubKey == target || !handshake.After(bestHandshake) {
+			continue
+		}
+		if peer, ok := d.peerStore.Get(pubKey); ok && peer.MeshIP != "" {
+			best, bestHandshake = peer, handshake
+		}
+	}
+	return best
+}
+
+// handlePunchMessage processes a PUNCH message from a peer
+func (d *Daemon) handlePunchMessage(payload []byte) {
+	var msg PunchMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		log.Printf("[Punch] Invalid punch message: %v", err)
+		return
+	}
+
+	if msg.StartAt == 0 {
+		d.introducePunch(&msg)
+		return
+	}
+
+	peer, endpoint, ok := punchPeer(&msg, d.localNode.WGPubKey)
+	if !ok || endpoint == "" {
+		return
+	}
+	if err := d.checkPunchMessage(&msg, peer); err != nil {
+		log.Printf("[Punch] Ignoring punch for %s: %s", safeKeyPrefix(peer), err)
+		return
+	}
+	d.punch(peer, endpoint, time.UnixMilli(msg.StartAt))
+}
+
+// checkPunchMessage accepts a go message only if it is fresh, signed by the
+// bound identity of its introducer and about a peer we are punching. The
+// initiator also requires the introducer it asked.
+func (d *Daemon) checkPunchMessage(msg *PunchMessage, peer string) error {
+	if !punchTimeValid(time.UnixMilli(msg.StartAt), time.Now()) {
+		return fmt.Errorf("start time out of range")
+	}
+
+	introducer, ok := d.peerStore.Get(msg.Introducer)
+	if !ok || introducer.IdentityKey == "" {
+		return fmt.Errorf("unknown introducer %s", safeKeyPrefix(msg.Introducer))
+	}
+	if !msg.Verify(introducer.IdentityKey) {
+		return fmt.Errorf("invalid signature from %s", safeKeyPrefix(msg.Introducer))
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	state, ok := d.punches[peer]
+	switch {
+	case !ok:
+		return fmt.Errorf("not punching this peer")
+	case msg.Initiator == d.localNode.WGPubKey && state.introducer != msg.Introducer:
+		return fmt.Errorf("%s is not the introducer we asked", safeKeyPrefix(msg.Introducer))
+	case msg.StartAt <= state.lastStartAt:
+		return fmt.Errorf("replayed message")
+	}
+	state.lastStartAt = msg.StartAt
+	return nil
+}
+
+// introducePunch answers a punch request if we have a working handshake with both sides
+func (d *Daemon) introducePunch(msg *PunchMessage) {
+	messenger, ok := d.currentDiscovery().(MeshMessenger)
+	if !ok {
+		return
+	}
+
+	if d.localNode.IdentityKey == nil {
+		return
+	}
+
+	stats, err := wireguard.GetPeerStats(d.currentConfig().InterfaceName)
+	if err != nil {
+		log.Printf("[Punch] Failed to read WireGuard stats: %v", err)
+		return
+	}
+
+	now := time.Now()
+	endpoints := make(map[string]string)
+	for _, s := range stats {
+		if s.Endpoint != "" && !s.LatestHandshake.IsZero() && now.Sub(s.LatestHandshake) < HandshakeTimeout {
+			endpoints[s.PublicKey] = s.Endpoint
+		}
+	}
+
+	msg.InitiatorEndpoint = endpoints[msg.Initiator]
+	msg.TargetEndpoint = endpoints[msg.Target]
+	if msg.InitiatorEndpoint == "" || msg.TargetEndpoint == "" {
+		log.Printf("[Punch] Cannot introduce %s to %s: no working handshake with both",
+			safeKeyPrefix(msg.Initiator), safeKeyPrefix(msg.Target))
+		return
+	}
+	msg.StartAt = now.Add(PunchDelay).UnixMilli()
+	msg.Introducer = d.localNode.WGPubKey
+	msg.Sign(d.localNode.IdentityKey)
+
+	for _, pubKey := range []string{msg.Initiator, msg.Target} {
+		peer, ok := d.peerStore.Get(pubKey)
+		if !ok || peer.MeshIP == "" {
+			return
+		}
+		if err := messenger.Send(crypto.MessageTypePunch, msg, peer.MeshIP); err != nil {
+			log.Printf("[Punch] Failed to send punch to %s: %v", safeKeyPrefix(pubKey), err)
+		}
+	}
+	log.Printf("[Punch] Introduced %s (%s) to %s (%s)",
+		safeKeyPrefix(msg.Initiator), msg.InitiatorEndpoint, safeKeyPrefix(msg.Target), msg.TargetEndpoint)
+}
+
+// punchPeer returns the other side of a punch go message and the endpoint to punch towards
+func punchPeer(msg *PunchMessage, localPubKey string) (peer, endpoint string, ok bool) {
+	switch localPubKey {
+	case msg.Initiator:
+		return msg.Target, msg.TargetEndpoint, true
+	case msg.Target:
+		return msg.Initiator, msg.InitiatorEndpoint, true
+	default:
+		return "", "", false
+	}
+}
+
+// punch points WireGuard at the endpoint and sends traffic to the peer at
+// startAt, so both NATs open a mapping towards each other at the same time
+func (d *Daemon) punch(pubKey, endpoint string, startAt time.Time) {
+	if _, _, err := net.SplitHostPort(endpoint); err != nil {
+		return
+	}
+	if !d.peerStore.SetEndpoint(pubKey, endpoint) {
+		return
+	}
+	peer, _ := d.peerStore.Get(pubKey)
+	if err := d.configurePeer(peer, d.currentConfig().Keys.PSK); err != nil {
+		log.Printf("[Punch] Failed to configure peer %s: %v", safeKeyPrefix(pubKey), err)
+		return
+	}
+
+	log.Printf("[Punch] Punching to %s at %s", safeKeyPrefix(pubKey), endpoint)
+	go func() {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(time.Until(startAt)):
+		}
+
+		// Any packet routed to the peer's mesh IP makes WireGuard send a
+		// handshake initiation to the endpoint
+		addr := net.JoinHostPort(peer.MeshIP, strconv.Itoa(punchPort))
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			log.Printf("[Punch] Failed to send punch packets: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		for i := 0; i < PunchPackets; i++ {
+			conn.Write([]byte("wgmesh-punch"))
+			time.Sleep(200 * time.Millisecond)
+		}
+	}()
+}
@@ -0,0 +1,61 @@
+package daemon
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestPunchMessageSignature(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := base64.StdEncoding.EncodeToString(public)
+
+	msg := &PunchMessage{
+		Initiator:         "initiator",
+		Target:            "target",
+		InitiatorEndpoint: "203.0.113.1:51820",
+		TargetEndpoint:    "203.0.113.2:51820",
+		StartAt:           time.Now().UnixMilli(),
+		Introducer:        "introducer",
+	}
+	msg.Sign(private)
+	if !msg.Verify(identity) {
+		t.Fatal("Expected the signature to verify")
+	}
+
+	msg.TargetEndpoint = "198.51.100.7:51820"
+	if msg.Verify(identity) {
+		t.Error("Expected a modified endpoint to invalidate the signature")
+	}
+
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	msg.TargetEndpoint = "203.0.113.2:51820"
+	if msg.Verify(base64.StdEncoding.EncodeToString(other)) {
+		t.Error("Expected another identity key to be rejected")
+	}
+}
+
+func TestPunchTimeValid(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		startAt time.Time
+		valid   bool
+	}{
+		{now.Add(PunchDelay), true},
+		{now, true},
+		{now.Add(-PunchDelay / 2), true},
+		{now.Add(-2 * PunchDelay), false},
+		{now.Add(-time.Hour), false},
+		{now.Add(3 * PunchDelay), false},
+	}
+	for _, tt := range tests {
+		if got := punchTimeValid(tt.startAt, now); got != tt.valid {
+			t.Errorf("start %v from now: expected %v, got %v", tt.startAt.Sub(now), tt.valid, got)
+		}
+	}
+}
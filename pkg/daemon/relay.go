@@ -0,0 +1,216 @@
+package daemon
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/wireguard"
+)
+
+// RelayAfter is how long a peer must stay without a handshake before its
+// traffic is sent through a relay. It leaves time for hole punching first.
+const RelayAfter = 2 * time.Minute
+
+// updateRelayCapability decides whether we offer to relay for other peers.
+// We do if the public endpoint learned via STUN is an address of this host,
+// i.e. we are not behind NAT, and IP forwarding can be enabled.
+func (d *Daemon) updateRelayCapability() {
+	config := d.currentConfig()
+
+	d.mu.RLock()
+	endpoint := d.publicEndpoint
+	wasCapable := d.localNode.RelayCapable
+	d.mu.RUnlock()
+
+	capable := !config.DisableRelay && runtime.GOOS == "linux" && isLocalEndpoint(endpoint)
+	if capable && !wasCapable {
+		if err := enableForwarding(); err != nil {
+			log.Printf("[Relay] Not offering to relay: %v", err)
+			capable = false
+		} else {
+			log.Printf("[Relay] Reachable at %s, offering to relay for peers that cannot reach each other", endpoint)
+		}
+	}
+
+	d.mu.Lock()
+	d.localNode.RelayCapable = capable
+	d.mu.Unlock()
+}
+
+// isLocalEndpoint reports whether the endpoint's IP is assigned to a local interface
+func isLocalEndpoint(endpoint string) bool {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// enableForwarding lets the kernel forward packets between relayed peers
+func enableForwarding() error {
+	cmd := exec.Command("sysctl", "-w", "net.ipv4.ip_forward=1")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to enable IP forwarding: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
+// updateRelays is called from the reconcile loop. Peers that have had no
+// handshake for RelayAfter are routed through a relay-capable peer we have a
+// working handshake with. As soon as a direct handshake succeeds (WireGuard
+// keeps trying thanks to the persistent keepalive), the direct path is used again.
+func (d *Daemon) updateRelays(peers []*PeerInfo) {
+	stats, err := wireguard.GetPeerStats(d.currentConfig().InterfaceName)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	connected := make(map[string]bool)
+	for _, s := range stats {
+		if !s.LatestHandshake.IsZero() && now.Sub(s.LatestHandshake) < HandshakeTimeout {
+			connected[s.PublicKey] = true
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.relays == nil {
+		d.relays = make(map[string]string)
+	}
+
+	known := make(map[string]bool)
+	for _, peer := range peers {
+		if peer.WGPubKey == d.localNode.WGPubKey {
+			continue
+		}
+		known[peer.WGPubKey] = true
+		current := d.relays[peer.WGPubKey]
+
+		if connected[peer.WGPubKey] {
+			if current != "" {
+				log.Printf("[Relay] Direct handshake with %s, no longer relaying via %s",
+					safeKeyPrefix(peer.WGPubKey), safeKeyPrefix(current))
+				delete(d.relays, peer.WGPubKey)
+			}
+			continue
+		}
+
+		// The hole punching state records since when the peer has had no handshake
+		state, ok := d.punches[peer.WGPubKey]
+		if !ok || now.Sub(state.since) < RelayAfter {
+			continue
+		}
+
+		relay := selectRelay(peer.WGPubKey, peers, connected, current)
+		if relay == current {
+			continue
+		}
+		if relay == "" {
+			log.Printf("[Relay] Lost relay %s for %s, no other relay available",
+				safeKeyPrefix(current), safeKeyPrefix(peer.WGPubKey))
+			delete(d.relays, peer.WGPubKey)
+			continue
+		}
+		log.Printf("[Relay] No handshake with %s for %v, relaying via %s",
+			safeKeyPrefix(peer.WGPubKey), now.Sub(state.since).Round(time.Second), safeKeyPrefix(relay))
+		d.relays[peer.WGPubKey] = relay
+	}
+
+	for pubKey := range d.relays {
+		if !known[pubKey] {
+			delete(d.relays, pubKey)
+		}
+	}
+}
+
+// selectRelay picks the relay for target: the current one while it is still
+// usable, otherwise the relay-capable connected peer with the lowest pubkey,
+// so both sides of a broken link tend to pick the same relay
+func selectRelay(target string, peers []*PeerInfo, connected map[string]bool, current string) string {
+	var candidates []string
+	for _, peer := range peers {
+		if peer.WGPubKey != target && peer.RelayCapable && connected[peer.WGPubKey] {
+			candidates = append(candidates, peer.WGPubKey)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	sort.Strings(candidates)
+	for _, c := range candidates {
+		if c == current {
+			return current
+		}
+	}
+	return candidates[0]
+}
+
+// relayFor returns the relay used for a peer, empty if we reach it directly
+func (d *Daemon) relayFor(pubKey string) string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.relays[pubKey]
+}
+
+// peerAllowedIPs builds a peer's WireGuard allowed IPs: its mesh IP and routable
+// networks plus those of the peers relayed through it. A relayed peer gets
+// none, its addresses are routed to the relay instead.
+func peerAllowedIPs(peer *PeerInfo, relays map[string]string, lookup func(string) (*PeerInfo, bool)) string {
+	if relays[peer.WGPubKey] != "" {
+		return ""
+	}
+
+	ips := meshAllowedIPs(peer)
+
+	var relayed []string
+	for pubKey, relay := range relays {
+		if relay == peer.WGPubKey {
+			relayed = append(relayed, pubKey)
+		}
+	}
+	sort.Strings(relayed)
+	for _, pubKey := range relayed {
+		if p, ok := lookup(pubKey); ok && p.MeshIP != "" {
+			ips = append(ips, meshAllowedIPs(p)...)
+		}
+	}
+
+	return strings.Join(ips, ",")
+}
+
+// meshAllowedIPs returns a peer's own mesh addresses and routable networks
+func meshAllowedIPs(peer *PeerInfo) []string {
+	ips := []string{peer.MeshIP + "/32"}
+	if peer.MeshIPv6 != "" {
+		ips = append(ips, peer.MeshIPv6+"/128")
+	}
+	for _, network := range peer.RoutableNetworks {
+		if !isDefaultRoute(network) {
+			ips = append(ips, network)
+		}
+	}
+	return ips
+}
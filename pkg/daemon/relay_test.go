@@ -0,0 +1,67 @@
+package daemon
+
+import "testing"
+
+func TestSelectRelay(t *testing.T) {
+	peers := []*PeerInfo{
+		{WGPubKey: "target"},
+		{WGPubKey: "relay-b", RelayCapable: true},
+		{WGPubKey: "relay-a", RelayCapable: true},
+		{WGPubKey: "relay-c", RelayCapable: true},
+		{WGPubKey: "plain"},
+	}
+	connected := map[string]bool{"relay-b": true, "relay-c": true, "plain": true}
+
+	// relay-a has the lowest key but no handshake with us
+	if relay := selectRelay("target", peers, connected, ""); relay != "relay-b" {
+		t.Errorf("Expected relay-b, got %q", relay)
+	}
+
+	// A working relay is kept
+	if relay := selectRelay("target", peers, connected, "relay-c"); relay != "relay-c" {
+		t.Errorf("Expected current relay-c to be kept, got %q", relay)
+	}
+
+	// A relay without a handshake is replaced
+	if relay := selectRelay("target", peers, connected, "relay-a"); relay != "relay-b" {
+		t.Errorf("Expected relay-a to be replaced by relay-b, got %q", relay)
+	}
+
+	if relay := selectRelay("target", peers, map[string]bool{"plain": true}, ""); relay != "" {
+		t.Errorf("Expected no relay without relay-capable peers, got %q", relay)
+	}
+}
+
+func TestPeerAllowedIPs(t *testing.T) {
+	peers := map[string]*PeerInfo{
+		"relay":  {WGPubKey: "relay", MeshIP: "10.1.0.1"},
+		"far":    {WGPubKey: "far", MeshIP: "10.1.0.2", RoutableNetworks: []string{"192.168.10.0/24"}},
+		"direct": {WGPubKey: "direct", MeshIP: "10.1.0.3", MeshIPv6: "fd12:3456:789a::3"},
+	}
+	lookup := func(pubKey string) (*PeerInfo, bool) {
+		p, ok := peers[pubKey]
+		return p, ok
+	}
+	relays := map[string]string{"far": "relay"}
+
+	if got := peerAllowedIPs(peers["relay"], relays, lookup); got != "10.1.0.1/32,10.1.0.2/32,192.168.10.0/24" {
+		t.Errorf("Relay should carry the relayed peer's addresses, got %q", got)
+	}
+	if got := peerAllowedIPs(peers["far"], relays, lookup); got != "" {
+		t.Errorf("Relayed peer should have no allowed IPs, got %q", got)
+	}
+	if got := peerAllowedIPs(peers["direct"], relays, lookup); got != "10.1.0.3/32,fd12:3456:789a::3/128" {
+		t.Errorf("Expected both mesh addresses, got %q", got)
+	}
+
+	// Back to direct once the relay entry is gone
+	if got := peerAllowedIPs(peers["far"], nil, lookup); got != "10.1.0.2/32,192.168.10.0/24" {
+		t.Errorf("Expected direct allowed IPs, got %q", got)
+	}
+
+	// An announced default route must not take over our internet traffic
+	rogue := &PeerInfo{WGPubKey: "rogue", MeshIP: "10.1.0.4", RoutableNetworks: []string{"0.0.0.0/0", "::/0", "192.168.20.0/24"}}
+	if got := peerAllowedIPs(rogue, nil, lookup); got != "10.1.0.4/32,192.168.20.0/24" {
+		t.Errorf("Expected default routes to be dropped, got %q", got)
+	}
+}
@@ -0,0 +1,142 @@
+package daemon
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
+)
+
+// RevocationRebroadcastInterval is how often the revocation list is re-sent so
+// that nodes which were offline or joined later learn about it
+const RevocationRebroadcastInterval = 10 * time.Minute
+
+// Revoke applies a revocation, or the lifting of one, signed with the mesh
+// admin key (POST /v1/revoke and /v1/unrevoke) and gossips it to all peers
+func (d *Daemon) Revoke(r *crypto.Revocation) error {
+	if !validWGKey(r.WGPubKey) {
+		return fmt.Errorf("invalid WireGuard public key: %q", r.WGPubKey)
+	}
+	adminKey := d.currentConfig().AdminKey
+	if adminKey == nil {
+		return fmt.Errorf("no admin key configured, start the daemon with --admin-key or an admin secret URI")
+	}
+	if !r.Verify(adminKey) {
+		return fmt.Errorf("revocation is not signed with the mesh admin key")
+	}
+	if d.localNode != nil && r.WGPubKey == d.localNode.WGPubKey {
+		return fmt.Errorf("refusing to revoke this node's own key")
+	}
+	if !d.applyRevocation(r) {
+		return fmt.Errorf("a newer revocation record for %s exists", r.WGPubKey)
+	}
+	d.broadcastRevocations()
+	return nil
+}
+
+// validWGKey reports whether key is a base64 WireGuard public key
+func validWGKey(key string) bool {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(raw) == 32
+}
+
+// handleRevocationMessage processes a REVOKE message gossiped by a peer
+func (d *Daemon) handleRevocationMessage(payload []byte) {
+	var revocations []*crypto.Revocation
+	if err := json.Unmarshal(payload, &revocations); err != nil {
+		log.Printf("[Revoke] Invalid revocation message: %v", err)
+		return
+	}
+
+	// Without a pinned admin key nobody may revoke nodes
+	adminKey := d.currentConfig().AdminKey
+	if adminKey == nil {
+		return
+	}
+
+	learned := false
+	for _, r := range revocations {
+		if !r.Verify(adminKey) {
+			log.Printf("[Revoke] Ignoring revocation of %s: invalid signature", safeKeyPrefix(r.WGPubKey))
+			continue
+		}
+		if d.applyRevocation(r) {
+			learned = true
+		}
+	}
+
+	// Flood new revocations right away instead of waiting for the next rebroadcast
+	if learned {
+		d.broadcastRevocations()
+	}
+}
+
+// applyRevocation records a revocation and removes the peer from WireGuard,
+// or records that a revocation was lifted. It returns true if the record was new.
+func (d *Daemon) applyRevocation(r *crypto.Revocation) bool {
+	if d.localNode != nil && r.WGPubKey == d.localNode.WGPubKey {
+		if !r.Lifted {
+			log.Printf("[Revoke] WARNING: this node has been revoked from the mesh (%s); peers will refuse it", r.Reason)
+		}
+		return false
+	}
+
+	if !d.peerStore.Revoke(r) {
+		return false
+	}
+
+	d.mu.RLock()
+	if d.rotation != nil {
+		d.rotation.peerStore.Revoke(r)
+	}
+	d.mu.RUnlock()
+
+	if r.Lifted {
+		// The peer is configured again once discovery sees it
+		log.Printf("[Revoke] Lifted revocation of peer %s (%s)", safeKeyPrefix(r.WGPubKey), r.Reason)
+	} else {
+		log.Printf("[Revoke] Revoked peer %s (%s)", safeKeyPrefix(r.WGPubKey), r.Reason)
+		if err := d.removePeer(r.WGPubKey); err != nil {
+			log.Printf("[Revoke] Failed to remove peer from WireGuard: %v", err)
+		}
+	}
+
+	// Persist right away, a revocation must survive a crash
+	if err := SavePeerCache(d.currentConfig().InterfaceName, d.peerStore); err != nil {
+		log.Printf("[Revoke] Failed to persist revocation: %v", err)
+	}
+	return true
+}
+
+// broadcastRevocations sends the full revocation list to all peers. The
+// records carry the admin signature, so they stay valid across secret
+// rotations without being re-signed.
+func (d *Daemon) broadcastRevocations() {
+	d.mu.Lock()
+	d.lastRevocationBroadcast = time.Now()
+	d.mu.Unlock()
+
+	revocations := d.peerStore.Revocations()
+	messenger, ok := d.currentDiscovery().(MeshMessenger)
+	if len(revocations) == 0 || !ok {
+		return
+	}
+
+	if err := messenger.Broadcast(crypto.MessageTypeRevoke, revocations); err != nil {
+		log.Printf("[Revoke] Failed to broadcast revocations: %v", err)
+	}
+}
+
+// checkRevocations is called from the reconcile loop to periodically re-send revocations
+func (d *Daemon) checkRevocations() {
+	d.mu.RLock()
+	last := d.lastRevocationBroadcast
+	d.mu.RUnlock()
+
+	if time.Since(last) >= RevocationRebroadcastInterval {
+		d.broadcastRevocations()
+	}
+}
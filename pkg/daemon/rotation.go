@@ -0,0 +1,501 @@
+package daemon
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
+)
+
+// DefaultRotationGracePeriod is how long both secrets are accepted by default
+const DefaultRotationGracePeriod = 24 * time.Hour
+
+// RotationRebroadcastInterval is how often a rotation is re-announced during
+// the grace period so that peers that were offline still learn about it
+const RotationRebroadcastInterval = 5 * time.Minute
+
+// MeshMessenger is implemented by discovery layers that can exchange control
+// messages with peers over the mesh (see discovery.CompositeDiscovery)
+type MeshMessenger interface {
+	Broadcast(messageType string, payload interface{}) error
+	Send(messageType string, payload interface{}, meshIP string) error
+	SetMessageHandler(messageType string, handler func(payload []byte))
+}
+
+// RotationStatus describes an in-progress secret rotation (no secrets)
+type RotationStatus struct {
+	NewNetworkID       string    `json:"new_network_id"`
+	StartedAt          time.Time `json:"started_at"`
+	CompletesAt        time.Time `json:"completes_at"`
+	NewSecretOnlyPeers int       `json:"new_secret_only_peers"`
+}
+
+// RotateRequest is the body of POST /v1/rotate
+type RotateRequest struct {
+	NewSecret    string                       `json:"new_secret"`
+	Announcement *crypto.RotationAnnouncement `json:"announcement"` // signed with the admin key
+}
+
+// rotation holds the runtime state of an in-progress secret rotation.
+// During the grace period a second discovery stack runs with the new secret
+// and feeds its own peer store, so peers that only know the new secret can be
+// configured with the new PSK while everyone else keeps the old one.
+type rotation struct {
+	state         *crypto.RotationState
+	newConfig     *Config
+	peerStore     *PeerStore
+	discovery     DiscoveryLayer
+	lastBroadcast time.Time
+}
+
+// RotationStatePath returns the path of the persisted rotation state for an interface
+func RotationStatePath(interfaceName string) string {
+	return filepath.Join("/var/lib/wgmesh", fmt.Sprintf("%s-rotation.json", interfaceName))
+}
+
+// loadRotationState loads persisted rotation state (nil if there is none)
+func loadRotationState(path string) (*crypto.RotationState, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state crypto.RotationState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse rotation state: %w", err)
+	}
+	return &state, nil
+}
+
+// saveRotationState persists rotation state; it contains both secrets
+func saveRotationState(path string, state *crypto.RotationState) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// StartRotation begins rotating the mesh to newSecret and announces it to all
+// peers. The announcement must be signed with the mesh admin key.
+func (d *Daemon) StartRotation(announcement *crypto.RotationAnnouncement, newSecret string) (*RotationStatus, error) {
+	config := d.currentConfig()
+	newSecret = parseSecret(newSecret)
+	if newSecret == "" {
+		return nil, fmt.Errorf("new secret is required")
+	}
+	if newSecret == config.Secret {
+		return nil, fmt.Errorf("new secret is the same as the current secret")
+	}
+	if err := checkRotationAnnouncement(config, announcement); err != nil {
+		return nil, err
+	}
+	if !crypto.VerifyNewSecret(newSecret, announcement) {
+		return nil, fmt.Errorf("new secret does not match the signed announcement")
+	}
+
+	if err := d.beginRotation(announcement, newSecret); err != nil {
+		return nil, err
+	}
+
+	d.broadcastRotation()
+	return d.RotationStatus(), nil
+}
+
+// checkRotationAnnouncement verifies that a rotation was ordered by the mesh admin
+func checkRotationAnnouncement(config *Config, announcement *crypto.RotationAnnouncement) error {
+	if announcement == nil {
+		return fmt.Errorf("a rotation announcement signed with the admin key is required")
+	}
+	if config.AdminKey == nil {
+		return fmt.Errorf("no mesh admin key configured: pass --admin-key or add admin=<pubkey> to the secret URI")
+	}
+	if !announcement.Verify(config.AdminKey) {
+		return fmt.Errorf("rotation is not signed with the mesh admin key or its grace period is over")
+	}
+	return nil
+}
+
+// handleRotationMessage processes a ROTATE message gossiped by a peer
+func (d *Daemon) handleRotationMessage(payload []byte) {
+	var announcement crypto.RotationAnnouncement
+	if err := json.Unmarshal(payload, &announcement); err != nil {
+		log.Printf("[Rotation] Invalid rotation message: %v", err)
+		return
+	}
+
+	d.mu.RLock()
+	current := d.rotation
+	localNode := d.localNode
+	d.mu.RUnlock()
+	if current != nil {
+		if crypto.VerifyNewSecret(current.state.NewSecret, &announcement) {
+			return // already rotating to this secret
+		}
+		log.Printf("[Rotation] Ignoring rotation to a different secret while a rotation is in progress")
+		return
+	}
+
+	if err := checkRotationAnnouncement(d.currentConfig(), &announcement); err != nil {
+		log.Printf("[Rotation] Rejected rotation announcement: %v", err)
+		return
+	}
+	// Peers that know us seal the secret to our key, we catch up on the
+	// next re-announcement otherwise
+	newSecret, err := announcement.OpenSecret(localNode.WGPubKey, localNode.WGPrivateKey)
+	if err != nil {
+		log.Printf("[Rotation] Cannot use rotation announcement yet: %v", err)
+		return
+	}
+
+	if err := d.beginRotation(&announcement, newSecret); err != nil {
+		log.Printf("[Rotation] Failed to start rotation: %v", err)
+		return
+	}
+
+	// Flood the announcement so it reaches peers we can reach but the sender can't
+	d.broadcastRotation()
+}
+
+// beginRotation enters dual-secret mode for a validated announcement
+func (d *Daemon) beginRotation(announcement *crypto.RotationAnnouncement, newSecret string) error {
+	config := d.currentConfig()
+	newConfig, err := config.WithSecret(newSecret)
+	if err != nil {
+		return err
+	}
+
+	// All nodes complete at the same absolute time: the announcement's
+	// timestamp plus its grace period
+	signed := *announcement
+	signed.SealedSecrets = nil
+	state := &crypto.RotationState{
+		OldSecret:    config.Secret,
+		NewSecret:    newConfig.Secret,
+		GracePeriod:  time.Duration(announcement.GracePeriod) * time.Second,
+		StartedAt:    time.Unix(announcement.Timestamp, 0),
+		Announcement: &signed,
+	}
+
+	d.mu.Lock()
+	if d.rotation != nil {
+		d.mu.Unlock()
+		return fmt.Errorf("a rotation is already in progress")
+	}
+	r := &rotation{
+		state:     state,
+		newConfig: newConfig,
+		peerStore: NewPeerStore(),
+	}
+	d.rotation = r
+	d.mu.Unlock()
+
+	if err := saveRotationState(RotationStatePath(config.InterfaceName), state); err != nil {
+		log.Printf("[Rotation] Warning: failed to persist rotation state: %v", err)
+	}
+
+	log.Printf("[Rotation] Rotating to network %x, completing at %s",
+		newConfig.Keys.NetworkID[:8], state.CompletesAt().Format(time.RFC3339))
+
+	go d.startRotationDiscovery(r)
+	return nil
+}
+
+// startRotationDiscovery runs a second discovery stack with the new secret.
+// We announce ourselves there with the mesh IP derived from the new secret
+// and add that address to the interface so new-only peers are routable.
+func (d *Daemon) startRotationDiscovery(r *rotation) {
+	factory := GetDiscoveryFactory()
+	if factory == nil {
+		return
+	}
+
+	node := *d.localNode
+	node.MeshIP, node.MeshIPReserved = r.newConfig.NodeMeshIP(node.WGPubKey, 0)
+	node.MeshIPNonce = 0
+	node.MeshIPv6 = crypto.DeriveMeshIPv6(r.newConfig.Keys.MeshPrefixV6, node.WGPubKey, r.newConfig.Secret)
+	if err := addInterfaceAddress(r.newConfig.InterfaceName, fmt.Sprintf("%s/%d", node.MeshIP, r.newConfig.MeshPrefixLen())); err != nil {
+		log.Printf("[Rotation] Failed to add new mesh IP %s: %v", node.MeshIP, err)
+	}
+	if err := addInterfaceAddress(r.newConfig.InterfaceName, node.MeshIPv6+"/64"); err != nil {
+		log.Printf("[Rotation] Failed to add new IPv6 mesh IP %s: %v", node.MeshIPv6, err)
+	}
+
+	discovery, err := factory(r.newConfig, &node, r.peerStore)
+	if err != nil {
+		log.Printf("[Rotation] Failed to create discovery for new secret: %v", err)
+		return
+	}
+	if err := discovery.Start(); err != nil {
+		log.Printf("[Rotation] Failed to start discovery for new secret: %v", err)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.rotation != r {
+		// Rotation completed while we were starting up
+		discovery.Stop()
+		return
+	}
+	r.discovery = discovery
+}
+
+// broadcastRotation (re-)announces the current rotation, with the new secret
+// sealed to the WireGuard key of every peer we know. Revoked nodes are not in
+// the peer store and get no copy.
+func (d *Daemon) broadcastRotation() {
+	d.mu.Lock()
+	r := d.rotation
+	if r != nil {
+		r.lastBroadcast = time.Now()
+	}
+	d.mu.Unlock()
+
+	messenger, ok := d.currentDiscovery().(MeshMessenger)
+	if r == nil || !ok {
+		return
+	}
+
+	if r.state.Announcement == nil || !time.Now().Before(r.state.CompletesAt()) {
+		return
+	}
+
+	announcement := *r.state.Announcement
+	announcement.SealedSecrets = nil
+	for _, peer := range d.peerStore.GetAll() {
+		if err := announcement.SealSecret(r.state.NewSecret, peer.WGPubKey); err != nil {
+			log.Printf("[Rotation] Cannot seal the new secret for %s: %v", safeKeyPrefix(peer.WGPubKey), err)
+		}
+	}
+
+	if err := messenger.Broadcast(crypto.MessageTypeRotate, announcement); err != nil {
+		log.Printf("[Rotation] Failed to broadcast rotation: %v", err)
+	}
+}
+
+// checkRotation is called from the reconcile loop to re-announce or complete a rotation
+func (d *Daemon) checkRotation() {
+	d.mu.RLock()
+	r := d.rotation
+	d.mu.RUnlock()
+	if r == nil {
+		return
+	}
+
+	if r.state.ShouldComplete() {
+		d.completeRotation(r)
+		return
+	}
+
+	if time.Since(r.lastBroadcast) >= RotationRebroadcastInterval {
+		d.broadcastRotation()
+	}
+}
+
+// completeRotation switches the daemon to the new secret alone
+func (d *Daemon) completeRotation(r *rotation) {
+	log.Printf("[Rotation] Grace period over, switching to the new secret")
+
+	d.mu.Lock()
+	d.rotation = nil
+	pending := r.discovery
+	d.mu.Unlock()
+
+	if pending != nil {
+		pending.Stop()
+	}
+	d.stopDiscovery()
+
+	// Peers that never showed up with the new secret are no longer members
+	newPeers := r.peerStore.GetAll()
+	known := make(map[string]bool, len(newPeers))
+	for _, p := range newPeers {
+		known[p.WGPubKey] = true
+	}
+	for _, p := range d.peerStore.GetAll() {
+		if !known[p.WGPubKey] {
+			log.Printf("[Rotation] Removing peer %s (did not switch to the new secret)", safeKeyPrefix(p.WGPubKey))
+			if err := d.removePeer(p.WGPubKey); err != nil {
+				log.Printf("[Rotation] Failed to remove peer: %v", err)
+			}
+		}
+	}
+	d.peerStore.Replace(newPeers)
+
+	d.setConfig(r.newConfig)
+
+	// The mesh subnet is derived from the secret, so our address changes too
+	// (unless it is reserved)
+	newIP, reserved := d.config.NodeMeshIP(d.localNode.WGPubKey, 0)
+	newIPv6 := crypto.DeriveMeshIPv6(d.config.Keys.MeshPrefixV6, d.localNode.WGPubKey, d.config.Secret)
+	log.Printf("[Rotation] Mesh IP: %s -> %s, %s -> %s", d.localNode.MeshIP, newIP, d.localNode.MeshIPv6, newIPv6)
+	d.mu.Lock()
+	d.localNode.MeshIP = newIP
+	d.localNode.MeshIPNonce = 0
+	d.localNode.MeshIPReserved = reserved
+	d.localNode.MeshIPv6 = newIPv6
+	d.mu.Unlock()
+	if err := saveLocalNode(localNodeStatePath(d.config.InterfaceName), d.localNode); err != nil {
+		log.Printf("[Rotation] Failed to save local node state: %v", err)
+	}
+	if err := setMeshAddresses(d.config.InterfaceName, newIP, d.config.MeshPrefixLen(), newIPv6); err != nil {
+		log.Printf("[Rotation] Failed to update interface address: %v", err)
+	}
+	d.restartDNS()
+
+	if d.currentRouter() != nil {
+		d.stopPrivacy()
+		d.startPrivacy()
+	}
+
+	if err := d.startDiscovery(); err != nil {
+		log.Printf("[Rotation] Failed to restart discovery with the new secret: %v", err)
+	}
+
+	r.state.Completed = true
+	if err := saveRotationState(RotationStatePath(d.config.InterfaceName), r.state); err != nil {
+		log.Printf("[Rotation] Warning: failed to persist rotation state: %v", err)
+	}
+
+	// Keep the systemd service on the new secret across restarts
+	if _, err := os.Stat(SecretEnvPath); err == nil {
+		if err := WriteSecretEnv(d.config.Secret); err != nil {
+			log.Printf("[Rotation] Warning: failed to update %s: %v", SecretEnvPath, err)
+		}
+	}
+
+	log.Printf("[Rotation] Rotation complete, now on network %x", d.config.Keys.NetworkID[:8])
+}
+
+// stopRotation stops the new-secret discovery stack on shutdown; the persisted
+// state lets the rotation resume on the next start
+func (d *Daemon) stopRotation() {
+	d.mu.Lock()
+	var discovery DiscoveryLayer
+	if d.rotation != nil {
+		discovery = d.rotation.discovery
+	}
+	d.mu.Unlock()
+
+	if discovery != nil {
+		discovery.Stop()
+	}
+}
+
+// resumeRotation restores persisted rotation state on startup. A rotation that
+// completed while the daemon was started with the old secret switches to the
+// new one; an unfinished rotation re-enters dual-secret mode.
+func (d *Daemon) resumeRotation() {
+	path := RotationStatePath(d.config.InterfaceName)
+	state, err := loadRotationState(path)
+	if err != nil {
+		log.Printf("[Rotation] Ignoring rotation state: %v", err)
+		return
+	}
+	if state == nil || state.OldSecret != d.config.Secret {
+		return
+	}
+
+	newConfig, err := d.config.WithSecret(state.NewSecret)
+	if err != nil {
+		log.Printf("[Rotation] Ignoring rotation state: %v", err)
+		return
+	}
+
+	if state.Completed || state.ShouldComplete() {
+		log.Printf("[Rotation] The mesh secret was rotated, using the new secret (network %x)", newConfig.Keys.NetworkID[:8])
+		d.setConfig(newConfig)
+		if !state.Completed {
+			state.Completed = true
+			if err := saveRotationState(path, state); err != nil {
+				log.Printf("[Rotation] Warning: failed to persist rotation state: %v", err)
+			}
+		}
+		return
+	}
+
+	log.Printf("[Rotation] Resuming rotation to network %x, completing at %s",
+		newConfig.Keys.NetworkID[:8], state.CompletesAt().Format(time.RFC3339))
+
+	d.mu.Lock()
+	d.rotation = &rotation{
+		state:     state,
+		newConfig: newConfig,
+		peerStore: NewPeerStore(),
+	}
+	d.mu.Unlock()
+}
+
+// RotationStatus returns the state of the current rotation (nil if none)
+func (d *Daemon) RotationStatus() *RotationStatus {
+	d.mu.RLock()
+	r := d.rotation
+	d.mu.RUnlock()
+	if r == nil {
+		return nil
+	}
+
+	newOnly := 0
+	for _, p := range r.peerStore.GetActive() {
+		if _, ok := d.peerStore.Get(p.WGPubKey); !ok {
+			newOnly++
+		}
+	}
+
+	return &RotationStatus{
+		NewNetworkID:       hex.EncodeToString(r.newConfig.Keys.NetworkID[:8]),
+		StartedAt:          r.state.StartedAt,
+		CompletesAt:        r.state.CompletesAt(),
+		NewSecretOnlyPeers: newOnly,
+	}
+}
+
+// rotationPeers returns active peers known only under the new secret, with the PSK to use for them
+func (d *Daemon) rotationPeers() ([]*PeerInfo, [32]byte) {
+	d.mu.RLock()
+	r := d.rotation
+	d.mu.RUnlock()
+	if r == nil {
+		return nil, [32]byte{}
+	}
+
+	var peers []*PeerInfo
+	for _, p := range r.peerStore.GetActive() {
+		if _, ok := d.peerStore.Get(p.WGPubKey); !ok {
+			peers = append(peers, p)
+		}
+	}
+	return peers, r.newConfig.Keys.PSK
+}
+
+// cleanupRotationPeers expires stale peers in the new-secret store and returns
+// those that must also be removed from WireGuard (not known under the old secret)
+func (d *Daemon) cleanupRotationPeers() []string {
+	d.mu.RLock()
+	r := d.rotation
+	d.mu.RUnlock()
+	if r == nil {
+		return nil
+	}
+
+	var removed []string
+	for _, pubKey := range r.peerStore.CleanupStale() {
+		if _, ok := d.peerStore.Get(pubKey); !ok {
+			removed = append(removed, pubKey)
+		}
+	}
+	return removed
+}
@@ -0,0 +1,149 @@
+package daemon
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
+)
+
+func TestRotationStatePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wg0-rotation.json")
+
+	state, err := loadRotationState(path)
+	if err != nil || state != nil {
+		t.Fatalf("Expected no state for missing file, got %v, %v", state, err)
+	}
+
+	want := &crypto.RotationState{
+		OldSecret:   "old-secret-that-is-long-enough",
+		NewSecret:   "new-secret-that-is-long-enough",
+		GracePeriod: time.Hour,
+		StartedAt:   time.Unix(1700000000, 0),
+	}
+	if err := saveRotationState(path, want); err != nil {
+		t.Fatalf("saveRotationState failed: %v", err)
+	}
+
+	got, err := loadRotationState(path)
+	if err != nil {
+		t.Fatalf("loadRotationState failed: %v", err)
+	}
+	if got.NewSecret != want.NewSecret || got.GracePeriod != want.GracePeriod || !got.CompletesAt().Equal(want.CompletesAt()) {
+		t.Errorf("Round trip mismatch: got %+v, want %+v", got, want)
+	}
+}
+
+func TestRotationPeersUseNewPSK(t *testing.T) {
+	d := newTestDaemon(t)
+	d.peerStore.Update(&PeerInfo{WGPubKey: "both", MeshIP: "10.1.0.2"}, "dht")
+
+	newConfig, err := d.config.WithSecret("new-secret-that-is-long-enough")
+	if err != nil {
+		t.Fatalf("WithSecret failed: %v", err)
+	}
+	r := &rotation{
+		state: &crypto.RotationState{
+			OldSecret:   d.config.Secret,
+			NewSecret:   newConfig.Secret,
+			GracePeriod: time.Hour,
+			StartedAt:   time.Now(),
+		},
+		newConfig: newConfig,
+		peerStore: NewPeerStore(),
+	}
+	r.peerStore.Update(&PeerInfo{WGPubKey: "both", MeshIP: "10.2.0.2"}, "dht")
+	r.peerStore.Update(&PeerInfo{WGPubKey: "newonly", MeshIP: "10.2.0.3"}, "dht")
+	d.rotation = r
+
+	peers, psk := d.rotationPeers()
+	if len(peers) != 1 || peers[0].WGPubKey != "newonly" {
+		t.Fatalf("Expected only the new-secret-only peer, got %v", peers)
+	}
+	if psk != newConfig.Keys.PSK {
+		t.Error("Expected the PSK derived from the new secret")
+	}
+
+	status := d.Status()
+	if status.Rotation == nil || status.Rotation.NewSecretOnlyPeers != 1 {
+		t.Errorf("Expected rotation status with 1 new-only peer, got %+v", status.Rotation)
+	}
+	data, _ := json.Marshal(status)
+	if strings.Contains(string(data), newConfig.Secret) {
+		t.Error("Status must not expose the new secret")
+	}
+}
+
+func TestRotationMessageRejected(t *testing.T) {
+	d := newTestDaemon(t)
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := base64.StdEncoding.EncodeToString(key.PublicKey().Bytes())
+	d.localNode.WGPubKey = pub
+	d.localNode.WGPrivateKey = base64.StdEncoding.EncodeToString(key.Bytes())
+	adminPub, admin, err := crypto.GenerateAdminKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSecret := "new-secret-that-is-long-enough"
+
+	deliver := func(ann *crypto.RotationAnnouncement) {
+		payload, _ := json.Marshal(ann)
+		d.handleRotationMessage(payload)
+	}
+	sealed := func(signer ed25519.PrivateKey, secret string) *crypto.RotationAnnouncement {
+		ann := crypto.CreateRotationAnnouncement(signer, newSecret, time.Hour)
+		if err := ann.SealSecret(secret, pub); err != nil {
+			t.Fatal(err)
+		}
+		return ann
+	}
+
+	// Holding the mesh secret is not enough without an admin key
+	deliver(sealed(admin, newSecret))
+	if d.rotation != nil {
+		t.Error("Rotation must be rejected without an admin key")
+	}
+
+	d.config.AdminKey = adminPub
+	_, other, err := crypto.GenerateAdminKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliver(sealed(other, newSecret))
+	if d.rotation != nil {
+		t.Error("Rotation signed with another key must be rejected")
+	}
+
+	// Valid signature, but the sealed secret does not match the signed hash
+	deliver(sealed(admin, "a-different-secret-entirely-xx"))
+	if d.rotation != nil {
+		t.Error("Rotation with a mismatching new secret must be rejected")
+	}
+
+	// Valid signature, but not sealed to us
+	deliver(crypto.CreateRotationAnnouncement(admin, newSecret, time.Hour))
+	if d.rotation != nil {
+		t.Error("Rotation without a secret sealed to us must be ignored")
+	}
+
+	ann := crypto.CreateRotationAnnouncement(admin, d.config.Secret, time.Hour)
+	if _, err := d.StartRotation(ann, d.config.Secret); err == nil {
+		t.Error("Expected error when rotating to the current secret")
+	}
+	if _, err := d.StartRotation(crypto.CreateRotationAnnouncement(admin, newSecret, time.Hour), "another-secret-that-is-long-enough"); err == nil {
+		t.Error("Expected error when the secret does not match the announcement")
+	}
+	if _, err := d.StartRotation(nil, newSecret); err == nil {
+		t.Error("Expected error for an unsigned rotation")
+	}
+}
@@ -24,20 +24,36 @@ func (d *Daemon) syncPeerRoutes(peers []*PeerInfo) error {
 		}
 		for _, network := range peer.RoutableNetworks {
 			network = strings.TrimSpace(network)
-			if network == "" {
+			// Default routes only go through exit nodes we chose (see exitnode.go)
+			if network == "" || isDefaultRoute(network) {
 				continue
 			}
-			desired = append(desired, routeEntry{Network: network, Gateway: peer.MeshIP})
+			// IPv6 networks are routed via the peer's IPv6 mesh address
+			gateway := peer.MeshIP
+			if strings.Contains(network, ":") {
+				gateway = peer.MeshIPv6
+			}
+			if gateway == "" {
+				continue
+			}
+			desired = append(desired, routeEntry{Network: network, Gateway: gateway})
 		}
 	}
 
-	current, err := getCurrentRoutes(d.config.InterfaceName)
+	iface := d.currentConfig().InterfaceName
+	current, err := getCurrentRoutes(iface)
 	if err != nil {
 		return err
 	}
 
 	toAdd, toRemove := calculateRouteDiff(current, desired)
-	return applyRouteDiff(d.config.InterfaceName, toAdd, toRemove)
+	if err := applyRouteDiff(iface, toAdd, toRemove); err != nil {
+		return err
+	}
+
+	d.metrics.routesAdded.Add(uint64(len(toAdd)))
+	d.metrics.routesRemoved.Add(uint64(len(toRemove)))
+	return nil
 }
 
 func getCurrentRoutes(iface string) ([]routeEntry, error) {
@@ -47,6 +63,11 @@ func getCurrentRoutes(iface string) ([]routeEntry, error) {
 		return nil, fmt.Errorf("failed to read routes: %w", err)
 	}
 
+	// IPv6 routes are listed separately; hosts without IPv6 have none
+	if output6, err := exec.Command("ip", "-6", "route", "show", "dev", iface).Output(); err == nil {
+		output = append(append(output, '\n'), output6...)
+	}
+
 	routes := make([]routeEntry, 0)
 	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
 		line = strings.TrimSpace(line)
@@ -0,0 +1,357 @@
+package daemon
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// STUNTimeout is how long to wait for a STUN server to answer
+	STUNTimeout = 3 * time.Second
+	// STUNRefreshInterval is how often the public endpoint is re-checked
+	STUNRefreshInterval = 5 * time.Minute
+)
+
+// DefaultSTUNServers are queried to learn the public address of the WireGuard port
+var DefaultSTUNServers = []string{
+	"stun.l.google.com:19302",
+	"stun.cloudflare.com:3478",
+}
+
+// STUN message fields (RFC 5389)
+const (
+	stunHeaderSize           = 20
+	stunMagicCookie          = 0x2112A442
+	stunBindingRequest       = 0x0001
+	stunBindingSuccess       = 0x0101
+	stunAttrMappedAddress    = 0x0001
+	stunAttrXorMappedAddress = 0x0020
+	stunFamilyIPv4           = 0x01
+	stunFamilyIPv6           = 0x02
+)
+
+// STUNQuery sends a binding request from conn and returns our address as seen by the server
+func STUNQuery(conn net.PacketConn, server string, timeout time.Duration) (*net.UDPAddr, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve STUN server %s: %w", server, err)
+	}
+
+	var txID [12]byte
+	if _, err := rand.Read(txID[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate transaction ID: %w", err)
+	}
+
+	req := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(req[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:8], stunMagicCookie)
+	copy(req[8:20], txID[:])
+
+	if _, err := conn.WriteTo(req, serverAddr); err != nil {
+		return nil, fmt.Errorf("failed to send STUN request: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil, fmt.Errorf("failed to set read deadline: %w", err)
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, fmt.Errorf("no STUN response from %s: %w", server, err)
+		}
+		// Skip unrelated packets that arrive on the same socket
+		if addr, err := parseSTUNResponse(buf[:n], txID); err == nil {
+			return addr, nil
+		}
+	}
+}
+
+// parseSTUNResponse extracts the mapped address from a binding success response
+func parseSTUNResponse(data []byte, txID [12]byte) (*net.UDPAddr, error) {
+	if len(data) < stunHeaderSize {
+		return nil, fmt.Errorf("STUN response too short")
+	}
+	if binary.BigEndian.Uint16(data[0:2]) != stunBindingSuccess {
+		return nil, fmt.Errorf("not a STUN binding success response")
+	}
+	if binary.BigEndian.Uint32(data[4:8]) != stunMagicCookie || string(data[8:20]) != string(txID[:]) {
+		return nil, fmt.Errorf("STUN transaction mismatch")
+	}
+
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if stunHeaderSize+length > len(data) {
+		return nil, fmt.Errorf("truncated STUN response")
+	}
+
+	var mapped *net.UDPAddr
+	attrs := data[stunHeaderSize : stunHeaderSize+length]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if 4+attrLen > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+attrLen]
+
+		switch attrType {
+		case stunAttrXorMappedAddress:
+			// Preferred: not rewritten by NATs that mangle addresses in payloads
+			if addr := decodeSTUNAddress(value, data[4:20]); addr != nil {
+				return addr, nil
+			}
+		case stunAttrMappedAddress:
+			mapped = decodeSTUNAddress(value, nil)
+		}
+
+		// Attributes are padded to a multiple of 4 bytes
+		attrs = attrs[4+(attrLen+3)&^3:]
+	}
+
+	if mapped == nil {
+		return nil, fmt.Errorf("STUN response carries no mapped address")
+	}
+	return mapped, nil
+}
+
+// decodeSTUNAddress decodes a (XOR-)MAPPED-ADDRESS value. xorKey is the magic
+// cookie followed by the transaction ID, or nil for a plain MAPPED-ADDRESS.
+func decodeSTUNAddress(value, xorKey []byte) *net.UDPAddr {
+	if len(value) < 8 {
+		return nil
+	}
+
+	var ipLen int
+	switch value[1] {
+	case stunFamilyIPv4:
+		ipLen = net.IPv4len
+	case stunFamilyIPv6:
+		ipLen = net.IPv6len
+	default:
+		return nil
+	}
+	if len(value) < 4+ipLen {
+		return nil
+	}
+
+	port := binary.BigEndian.Uint16(value[2:4])
+	ip := make(net.IP, ipLen)
+	copy(ip, value[4:4+ipLen])
+	if xorKey != nil {
+		port ^= uint16(stunMagicCookie >> 16)
+		for i := range ip {
+			ip[i] ^= xorKey[i]
+		}
+	}
+
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
+
+// encodeSTUNBindingResponse builds a binding success response for a request,
+// reporting addr as the XOR-MAPPED-ADDRESS
+func encodeSTUNBindingResponse(req []byte, addr *net.UDPAddr) ([]byte, error) {
+	if len(req) < stunHeaderSize || binary.BigEndian.Uint16(req[0:2]) != stunBindingRequest ||
+		binary.BigEndian.Uint32(req[4:8]) != stunMagicCookie {
+		return nil, fmt.Errorf("not a STUN binding request")
+	}
+
+	ip := addr.IP.To4()
+	family := byte(stunFamilyIPv4)
+	if ip == nil {
+		ip = addr.IP.To16()
+		family = stunFamilyIPv6
+	}
+
+	value := make([]byte, 4+len(ip))
+	value[1] = family
+	binary.BigEndian.PutUint16(value[2:4], uint16(addr.Port)^uint16(stunMagicCookie>>16))
+	for i := range ip {
+		value[4+i] = ip[i] ^ req[4+i]
+	}
+
+	resp := make([]byte, stunHeaderSize+4+len(value))
+	binary.BigEndian.PutUint16(resp[0:2], stunBindingSuccess)
+	binary.BigEndian.PutUint16(resp[2:4], uint16(4+len(value)))
+	copy(resp[4:20], req[4:20])
+	binary.BigEndian.PutUint16(resp[20:22], stunAttrXorMappedAddress)
+	binary.BigEndian.PutUint16(resp[22:24], uint16(len(value)))
+	copy(resp[24:], value)
+	return resp, nil
+}
+
+// STUNServer is a minimal STUN server answering binding requests. It stands in
+// for public STUN servers on offline networks and in tests.
+type STUNServer struct {
+	conn *net.UDPConn
+}
+
+// NewSTUNServer starts a STUN server on addr (e.g. ":3478")
+func NewSTUNServer(addr string) (*STUNServer, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", addr, err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	s := &STUNServer{conn: conn}
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address the server listens on
+func (s *STUNServer) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Close stops the server
+func (s *STUNServer) Close() error {
+	return s.conn.Close()
+}
+
+func (s *STUNServer) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, remote, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		resp, err := encodeSTUNBindingResponse(buf[:n], remote)
+		if err != nil {
+			continue
+		}
+		s.conn.WriteToUDP(resp, remote)
+	}
+}
+
+// DiscoverPublicEndpoint asks the STUN servers for the public address of the
+// WireGuard listen port. The port can only be queried directly while WireGuard
+// is not bound to it yet. Otherwise the query is sent from another port and
+// exact is false: only the IP of the result is known, it is paired with the
+// listen port.
+func DiscoverPublicEndpoint(listenPort int, servers []string) (endpoint string, exact bool, err error) {
+	if len(servers) == 0 {
+		return "", false, fmt.Errorf("no STUN servers configured")
+	}
+
+	exact = true
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: listenPort})
+	if err != nil {
+		exact = false
+		conn, err = net.ListenUDP("udp4", &net.UDPAddr{})
+		if err != nil {
+			return "", false, fmt.Errorf("failed to open STUN socket: %w", err)
+		}
+	}
+	defer conn.Close()
+
+	var lastErr error
+	for _, server := range servers {
+		addr, err := STUNQuery(conn, server, STUNTimeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		port := addr.Port
+		if !exact {
+			port = listenPort
+		}
+		return net.JoinHostPort(addr.IP.String(), strconv.Itoa(port)), exact, nil
+	}
+
+	return "", false, lastErr
+}
+
+// nextPublicEndpoint decides which endpoint to announce after a STUN check.
+// An exact result, or one whose IP belongs to this host, is announced as is.
+// Otherwise the public port is unknown, since a NAT need not keep the port of
+// the WireGuard socket: the previous endpoint stays while the IP is the same,
+// and once the IP changes nothing is announced, so peers use the address they
+// see us at.
+func nextPublicEndpoint(previous, endpoint string, exact, local bool) string {
+	if exact || local {
+		return endpoint
+	}
+	previousHost, _, err := net.SplitHostPort(previous)
+	if err != nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil || host != previousHost {
+		return ""
+	}
+	return previous
+}
+
+// discoverPublicEndpoint learns our public WireGuard endpoint via STUN and
+// returns true if it changed
+func (d *Daemon) discoverPublicEndpoint() bool {
+	config := d.currentConfig()
+	if len(config.STUNServers) == 0 {
+		return false
+	}
+
+	// STUN requests would leave through the exit node and learn its address
+	if d.usingExitNode() {
+		return false
+	}
+
+	d.mu.RLock()
+	previous := d.publicEndpoint
+	d.mu.RUnlock()
+
+	discovered, exact, err := DiscoverPublicEndpoint(config.WGListenPort, config.STUNServers)
+	if err != nil {
+		log.Printf("[STUN] Failed to learn public endpoint: %v", err)
+		return false
+	}
+	endpoint := nextPublicEndpoint(previous, discovered, exact, isLocalEndpoint(discovered))
+	if endpoint == previous {
+		return false
+	}
+
+	if endpoint == "" {
+		host, _, _ := net.SplitHostPort(discovered)
+		log.Printf("[STUN] Public IP is now %s but the WireGuard port behind the NAT is unknown, not announcing a public endpoint until restart", host)
+	} else {
+		log.Printf("[STUN] Public WireGuard endpoint: %s", endpoint)
+	}
+	d.mu.Lock()
+	d.publicEndpoint = endpoint
+	d.mu.Unlock()
+	return true
+}
+
+// stunLoop re-checks the public endpoint and restarts discovery when it
+// changes (e.g. a new IP from the ISP), so announcements carry the new address
+func (d *Daemon) stunLoop() {
+	ticker := time.NewTicker(STUNRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			if !d.discoverPublicEndpoint() {
+				continue
+			}
+			d.setLocalWGEndpoint()
+			d.updateRelayCapability()
+			d.stopDiscovery()
+			if err := d.startDiscovery(); err != nil {
+				log.Printf("[STUN] Failed to restart discovery with the new endpoint: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package daemon
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSTUNQuery(t *testing.T) {
+	server, err := NewSTUNServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewSTUNServer failed: %v", err)
+	}
+	defer server.Close()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP failed: %v", err)
+	}
+	defer conn.Close()
+
+	addr, err := STUNQuery(conn, server.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("STUNQuery failed: %v", err)
+	}
+
+	local := conn.LocalAddr().(*net.UDPAddr)
+	if !addr.IP.Equal(local.IP) || addr.Port != local.Port {
+		t.Errorf("Expected mapped address %s, got %s", local, addr)
+	}
+}
+
+func TestParseSTUNResponseRejectsOtherTransaction(t *testing.T) {
+	req := make([]byte, stunHeaderSize)
+	req[1] = stunBindingRequest
+	req[4], req[5], req[6], req[7] = 0x21, 0x12, 0xA4, 0x42
+	copy(req[8:], "transaction1")
+
+	resp, err := encodeSTUNBindingResponse(req, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51820})
+	if err != nil {
+		t.Fatalf("encodeSTUNBindingResponse failed: %v", err)
+	}
+
+	var txID [12]byte
+	copy(txID[:], "transaction1")
+	addr, err := parseSTUNResponse(resp, txID)
+	if err != nil {
+		t.Fatalf("parseSTUNResponse failed: %v", err)
+	}
+	if addr.String() != "192.0.2.1:51820" {
+		t.Errorf("Expected 192.0.2.1:51820, got %s", addr)
+	}
+
+	copy(txID[:], "transaction2")
+	if _, err := parseSTUNResponse(resp, txID); err == nil {
+		t.Error("Response for another transaction should be rejected")
+	}
+}
+
+func TestPunchPeer(t *testing.T) {
+	msg := &PunchMessage{
+		Initiator:         "alice",
+		Target:            "bob",
+		InitiatorEndpoint: "198.51.100.1:40000",
+		TargetEndpoint:    "203.0.113.2:50000",
+	}
+
+	if peer, endpoint, ok := punchPeer(msg, "alice"); !ok || peer != "bob" || endpoint != "203.0.113.2:50000" {
+		t.Errorf("Initiator should punch bob at 203.0.113.2:50000, got %s %s", peer, endpoint)
+	}
+	if peer, endpoint, ok := punchPeer(msg, "bob"); !ok || peer != "alice" || endpoint != "198.51.100.1:40000" {
+		t.Errorf("Target should punch alice at 198.51.100.1:40000, got %s %s", peer, endpoint)
+	}
+	if _, _, ok := punchPeer(msg, "carol"); ok {
+		t.Error("Uninvolved node should not punch")
+	}
+}
+
+func TestNextPublicEndpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous string
+		endpoint string
+		exact    bool
+		local    bool
+		want     string
+	}{
+		{"exact", "", "203.0.113.1:40000", true, false, "203.0.113.1:40000"},
+		{"exact replaces previous", "203.0.113.1:40000", "198.51.100.1:41000", true, false, "198.51.100.1:41000"},
+		{"own address", "", "203.0.113.1:51820", false, true, "203.0.113.1:51820"},
+		{"same IP keeps the learned port", "203.0.113.1:40000", "203.0.113.1:51820", false, false, "203.0.113.1:40000"},
+		{"new IP behind NAT", "203.0.113.1:40000", "198.51.100.1:51820", false, false, ""},
+		{"nothing learned yet", "", "198.51.100.1:51820", false, false, ""},
+	}
+	for _, tt := range tests {
+		if got := nextPublicEndpoint(tt.previous, tt.endpoint, tt.exact, tt.local); got != tt.want {
+			t.Errorf("%s: nextPublicEndpoint() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
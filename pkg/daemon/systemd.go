@@ -26,7 +26,7 @@ LimitNOFILE=65535
 NoNewPrivileges=yes
 ProtectSystem=full
 ProtectHome=true
-ReadWritePaths=/var/lib/wgmesh
+ReadWritePaths=/var/lib/wgmesh /etc/wgmesh
 
 [Install]
 WantedBy=multi-user.target
@@ -39,6 +39,24 @@ type SystemdServiceConfig struct {
 	ListenPort      int
 	AdvertiseRoutes []string
 	Privacy         bool
+	MeshSubnet      string
+	MeshIP          string
+	NodeName        string
+	MeshName        string
+	NoDNS           bool
+	Tags            string // comma-separated
+	ACLPolicy       string // policy file path
+	AdminKey        string // admin public key
+	ExitNode        bool   // --advertise-exit-node
+	UseExitNode     string
+	NoLAN           bool
+	NoDHT           bool
+	NoGossip        bool
+	DHTStaticID     bool
+	Registry        string
+	STUNServers     string // passed through as-is, empty keeps the default
+	NoRelay         bool
+	MetricsListen   string
 	BinaryPath      string
 }
 
@@ -71,6 +89,60 @@ func GenerateSystemdUnit(cfg SystemdServiceConfig) (string, error) {
 	if cfg.Privacy {
 		args = append(args, "--privacy")
 	}
+	if cfg.MeshSubnet != "" {
+		args = append(args, "--mesh-subnet", cfg.MeshSubnet)
+	}
+	if cfg.MeshIP != "" {
+		args = append(args, "--mesh-ip", cfg.MeshIP)
+	}
+	if cfg.NodeName != "" {
+		args = append(args, "--name", cfg.NodeName)
+	}
+	if cfg.MeshName != "" {
+		args = append(args, "--mesh-name", cfg.MeshName)
+	}
+	if cfg.NoDNS {
+		args = append(args, "--no-dns")
+	}
+	if cfg.Tags != "" {
+		args = append(args, "--tags", cfg.Tags)
+	}
+	if cfg.ACLPolicy != "" {
+		args = append(args, "--acl-policy", cfg.ACLPolicy)
+	}
+	if cfg.AdminKey != "" {
+		args = append(args, "--admin-key", cfg.AdminKey)
+	}
+	if cfg.ExitNode {
+		args = append(args, "--advertise-exit-node")
+	}
+	if cfg.UseExitNode != "" {
+		args = append(args, "--use-exit-node", cfg.UseExitNode)
+	}
+	if cfg.NoLAN {
+		args = append(args, "--no-lan")
+	}
+	if cfg.NoDHT {
+		args = append(args, "--no-dht")
+	}
+	if cfg.NoGossip {
+		args = append(args, "--no-gossip")
+	}
+	if cfg.DHTStaticID {
+		args = append(args, "--dht-static-id")
+	}
+	if cfg.Registry != "" {
+		args = append(args, "--registry", cfg.Registry)
+	}
+	if cfg.STUNServers != "" {
+		args = append(args, "--stun-servers", cfg.STUNServers)
+	}
+	if cfg.NoRelay {
+		args = append(args, "--no-relay")
+	}
+	if cfg.MetricsListen != "" {
+		args = append(args, "--metrics-listen", cfg.MetricsListen)
+	}
 
 	data := struct {
 		ExecStart string
@@ -99,18 +171,8 @@ func InstallSystemdService(cfg SystemdServiceConfig) error {
 	}
 
 	// Write secret to environment file with restricted permissions
-	secretDir := "/etc/wgmesh"
-	if err := os.MkdirAll(secretDir, 0700); err != nil {
-		return fmt.Errorf("failed to create secret directory (run as root?): %w", err)
-	}
-
-	// Quote the secret value for safe systemd environment file parsing
-	escapedSecret := strings.ReplaceAll(cfg.Secret, `\`, `\\`)
-	escapedSecret = strings.ReplaceAll(escapedSecret, `"`, `\"`)
-	secretEnv := fmt.Sprintf("WGMESH_SECRET=\"%s\"\n", escapedSecret)
-	secretPath := filepath.Join(secretDir, "secret.env")
-	if err := os.WriteFile(secretPath, []byte(secretEnv), 0600); err != nil {
-		return fmt.Errorf("failed to write secret file (run as root?): %w", err)
+	if err := WriteSecretEnv(cfg.Secret); err != nil {
+		return err
 	}
 
 	// Write unit file
@@ -137,6 +199,25 @@ func InstallSystemdService(cfg SystemdServiceConfig) error {
 	return nil
 }
 
+// SecretEnvPath is the environment file holding the secret for the systemd service
+const SecretEnvPath = "/etc/wgmesh/secret.env"
+
+// WriteSecretEnv writes the mesh secret to the systemd environment file
+func WriteSecretEnv(secret string) error {
+	if err := os.MkdirAll(filepath.Dir(SecretEnvPath), 0700); err != nil {
+		return fmt.Errorf("failed to create secret directory (run as root?): %w", err)
+	}
+
+	// Quote the secret value for safe systemd environment file parsing
+	escapedSecret := strings.ReplaceAll(secret, `\`, `\\`)
+	escapedSecret = strings.ReplaceAll(escapedSecret, `"`, `\"`)
+	secretEnv := fmt.Sprintf("WGMESH_SECRET=\"%s\"\n", escapedSecret)
+	if err := os.WriteFile(SecretEnvPath, []byte(secretEnv), 0600); err != nil {
+		return fmt.Errorf("failed to write secret file (run as root?): %w", err)
+	}
+	return nil
+}
+
 // UninstallSystemdService stops and removes the wgmesh systemd service
 func UninstallSystemdService() error {
 	// Stop service
@@ -152,9 +233,8 @@ func UninstallSystemdService() error {
 	}
 
 	// Remove secret environment file
-	secretDir := "/etc/wgmesh"
-	secretPath := filepath.Join(secretDir, "secret.env")
-	if err := os.Remove(secretPath); err != nil && !os.IsNotExist(err) {
+	secretDir := filepath.Dir(SecretEnvPath)
+	if err := os.Remove(SecretEnvPath); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed to remove secret file: %w", err)
 	}
 
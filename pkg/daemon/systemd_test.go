@@ -119,3 +119,24 @@ func TestGenerateSystemdUnitWithoutPrivacy(t *testing.T) {
 		t.Error("Unit should not contain --privacy flag when Privacy is false")
 	}
 }
+
+func TestGenerateSystemdUnitWithDisabledLayers(t *testing.T) {
+	cfg := SystemdServiceConfig{
+		Secret:     "test-secret-that-is-long-enough",
+		BinaryPath: "/usr/local/bin/wgmesh",
+		NoDHT:      true,
+		NoGossip:   true,
+	}
+
+	unit, err := GenerateSystemdUnit(cfg)
+	if err != nil {
+		t.Fatalf("GenerateSystemdUnit failed: %v", err)
+	}
+
+	if !strings.Contains(unit, "--no-dht") || !strings.Contains(unit, "--no-gossip") {
+		t.Error("Unit should contain --no-dht and --no-gossip flags")
+	}
+	if strings.Contains(unit, "--no-lan") {
+		t.Error("Unit should not contain --no-lan flag when LAN is enabled")
+	}
+}
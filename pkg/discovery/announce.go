@@ -0,0 +1,231 @@
+package discovery
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
+	"github.com/atvirokodosprendimai/wgmesh/pkg/daemon"
+)
+
+// RejectWarningInterval limits how often a rejected sender is logged
+const RejectWarningInterval = 10 * time.Minute
+
+// newAnnouncement creates an announcement for the local node carrying our membership token
+func newAnnouncement(config *daemon.Config, localNode *LocalNode, knownPeers []crypto.KnownPeer) *crypto.PeerAnnouncement {
+	meshIP, nonce, reserved := localNode.meshAddress()
+	announcement := crypto.CreateAnnouncement(
+		localNode.WGPubKey,
+		meshIP,
+		localNode.WGEndpoint,
+		localNode.RoutableNetworks,
+		knownPeers,
+	)
+	announcement.Name = localNode.Name
+	announcement.MeshIPNonce = nonce
+	announcement.MeshIPReserved = reserved
+	announcement.MeshIPv6 = localNode.MeshIPv6
+	announcement.Endpoints = localNode.Endpoints
+	announcement.RelayCapable = localNode.RelayCapable
+	announcement.ExitNode = localNode.ExitNode
+	announcement.Tags = localNode.Tags
+	announcement.AttachMembershipToken(config.Keys.MembershipKey)
+	if localNode.IdentityKey != nil {
+		announcement.Sign(localNode.IdentityKey)
+	}
+	return announcement
+}
+
+// openAnnouncement decrypts a message and verifies the sender's membership token.
+// Errors wrap crypto.ProtocolVersionError or crypto.ErrInvalidMembershipToken when
+// the message came from a node with the same secret, so callers can report them.
+func openAnnouncement(data []byte, config *daemon.Config) (*crypto.Envelope, *crypto.PeerAnnouncement, error) {
+	envelope, plaintext, err := crypto.OpenEnvelopeRaw(data, config.Keys.GossipKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	announcement, err := parseAnnouncement(config, envelope, plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return envelope, announcement, nil
+}
+
+// parseAnnouncement parses a decrypted payload and verifies the sender's
+// membership token, identity signature and mesh addresses
+func parseAnnouncement(config *daemon.Config, envelope *crypto.Envelope, plaintext []byte) (*crypto.PeerAnnouncement, error) {
+	announcement, err := crypto.ParseAnnouncement(envelope, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := announcement.VerifyMembershipToken(config.Keys.MembershipKey); err != nil {
+		return nil, err
+	}
+	if err := announcement.VerifySignature(); err != nil {
+		return nil, err
+	}
+	if err := config.VerifyMeshIP(announcement.WGPubKey, announcement.MeshIP, announcement.MeshIPv6, announcement.MeshIPNonce, announcement.MeshIPReserved); err != nil {
+		return nil, err
+	}
+
+	return announcement, nil
+}
+
+// peerFromAnnouncement builds peer store info for the sender of a verified announcement
+func peerFromAnnouncement(announcement *crypto.PeerAnnouncement, endpoint string) *daemon.PeerInfo {
+	return &daemon.PeerInfo{
+		WGPubKey:         announcement.WGPubKey,
+		IdentityKey:      base64.StdEncoding.EncodeToString(announcement.IdentityKey),
+		Name:             nodeName(announcement.Name),
+		MeshIP:           announcement.MeshIP,
+		MeshIPNonce:      announcement.MeshIPNonce,
+		MeshIPReserved:   announcement.MeshIPReserved,
+		MeshIPv6:         announcement.MeshIPv6,
+		Endpoint:         endpoint,
+		Endpoints:        announcement.Endpoints,
+		RoutableNetworks: announcement.RoutableNetworks,
+		Tags:             announcement.Tags,
+		RelayCapable:     announcement.RelayCapable,
+		ExitNode:         announcement.ExitNode,
+	}
+}
+
+// peerFromKnownPeer builds peer store info for a transitive peer. It returns
+// nil if the mesh addresses are not the ones derived from the peer's pubkey.
+// The entry is not signed by the peer, so its name and reservation flag are
+// dropped: a reserved address can't be verified and would win collisions,
+// and a name could be taken from its owner. Peers with a reservation are
+// learned from their own announcements only.
+func peerFromKnownPeer(config *daemon.Config, kp crypto.KnownPeer, endpoint string) *daemon.PeerInfo {
+	if config.VerifyMeshIP(kp.WGPubKey, kp.MeshIP, kp.MeshIPv6, kp.MeshIPNonce, false) != nil {
+		return nil
+	}
+	return &daemon.PeerInfo{
+		WGPubKey:    kp.WGPubKey,
+		MeshIP:      kp.MeshIP,
+		MeshIPNonce: kp.MeshIPNonce,
+		MeshIPv6:    kp.MeshIPv6,
+		Endpoint:    endpoint,
+	}
+}
+
+// knownPeer describes a peer store entry for transitive discovery
+func knownPeer(p *daemon.PeerInfo) crypto.KnownPeer {
+	return crypto.KnownPeer{
+		WGPubKey:       p.WGPubKey,
+		Name:           p.Name,
+		MeshIP:         p.MeshIP,
+		MeshIPNonce:    p.MeshIPNonce,
+		MeshIPReserved: p.MeshIPReserved,
+		MeshIPv6:       p.MeshIPv6,
+		WGEndpoint:     p.Endpoint,
+	}
+}
+
+// nodeName returns an announced node name, or "" if it is not a valid one
+func nodeName(name string) string {
+	if !daemon.ValidNodeName(name) {
+		return ""
+	}
+	return name
+}
+
+// updatePeer stores a peer learned from its own signed announcement and
+// reports attempts to take over a pubkey bound to another identity
+func updatePeer(peerStore *daemon.PeerStore, peer *daemon.PeerInfo, method, layer, remote string) {
+	if err := peerStore.Update(peer, method); err != nil {
+		reportRejected(layer, remote, fmt.Errorf("announcement for %s: %w", safeTruncate(peer.WGPubKey, 8), err))
+	}
+}
+
+// reportRejected logs why a message from a mesh member was rejected.
+// It returns false if the error is not a protocol or membership error
+// (e.g. wrong secret or not a wgmesh packet), which callers handle themselves.
+func reportRejected(layer, remote string, err error) bool {
+	var versionErr *crypto.ProtocolVersionError
+	switch {
+	case errors.As(err, &versionErr):
+		if rejectWarnings.allow(layer + "|" + remote) {
+			if versionErr.MessageType == crypto.MessageTypeReject {
+				log.Printf("[%s] Peer at %s rejected our message: it speaks %s, we speak %s. Upgrade wgmesh so all nodes run the same protocol version.",
+					layer, remote, versionErr.Version, crypto.ProtocolVersion)
+			} else {
+				log.Printf("[%s] Ignoring %s from %s: peer speaks %s, we speak %s. Upgrade wgmesh so all nodes run the same protocol version.",
+					layer, versionErr.MessageType, remote, versionErr.Version, crypto.ProtocolVersion)
+			}
+		}
+		return true
+	case errors.Is(err, crypto.ErrInvalidMembershipToken),
+		errors.Is(err, crypto.ErrInvalidSignature),
+		errors.Is(err, daemon.ErrIdentityMismatch),
+		errors.Is(err, daemon.ErrMeshIPMismatch),
+		errors.Is(err, daemon.ErrPeerRevoked):
+		if rejectWarnings.allow(layer + "|" + remote) {
+			log.Printf("[%s] Rejected message from %s: %v", layer, remote, err)
+		}
+		return true
+	}
+	return false
+}
+
+// warningLimiter rate limits repeated log messages per key
+type warningLimiter struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+var rejectWarnings = &warningLimiter{last: make(map[string]time.Time)}
+
+// allow reports whether a warning for key may be logged now
+func (w *warningLimiter) allow(key string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	if last, ok := w.last[key]; ok && now.Sub(last) < RejectWarningInterval {
+		return false
+	}
+
+	// Keep the map bounded when many different senders show up
+	if len(w.last) > 1024 {
+		for k, t := range w.last {
+			if now.Sub(t) >= RejectWarningInterval {
+				delete(w.last, k)
+			}
+		}
+	}
+	w.last[key] = now
+	return true
+}
+
+// MessageHandler handles a decrypted control message payload (see daemon.MeshMessenger)
+type MessageHandler func(payload []byte, remoteAddr *net.UDPAddr)
+
+// messageHandlers maps message types to handlers for payloads that are not announcements
+type messageHandlers struct {
+	mu       sync.RWMutex
+	handlers map[string]MessageHandler
+}
+
+func (h *messageHandlers) set(messageType string, handler MessageHandler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.handlers == nil {
+		h.handlers = make(map[string]MessageHandler)
+	}
+	h.handlers[messageType] = handler
+}
+
+func (h *messageHandlers) get(messageType string) MessageHandler {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.handlers[messageType]
+}
@@ -0,0 +1,338 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
+	"github.com/atvirokodosprendimai/wgmesh/pkg/daemon"
+)
+
+// CompositeDiscovery runs the LAN, DHT, in-mesh gossip and registry layers together.
+// Every layer feeds the shared PeerStore under its own method label, and a
+// layer that fails to start does not prevent the others from running (e.g. a
+// LAN-only office network without internet access has no DHT).
+type CompositeDiscovery struct {
+	config    *daemon.Config
+	localNode *LocalNode // shared by every layer
+	peerStore *daemon.PeerStore
+
+	lan      *LANDiscovery
+	dht      *DHTDiscovery
+	gossip   *MeshGossip
+	registry *RegistryDiscovery
+
+	mu       sync.Mutex
+	running  []daemon.DiscoveryLayer
+	handlers map[string]MessageHandler
+}
+
+// NewCompositeDiscovery creates the discovery layers enabled in the config
+func NewCompositeDiscovery(config *daemon.Config, localNode *LocalNode, peerStore *daemon.PeerStore) (*CompositeDiscovery, error) {
+	c := &CompositeDiscovery{
+		config:    config,
+		localNode: localNode,
+		peerStore: peerStore,
+		handlers:  make(map[string]MessageHandler),
+	}
+
+	if !config.DisableLAN {
+		lan, err := NewLANDiscovery(config, localNode, peerStore)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create LAN discovery: %w", err)
+		}
+		c.lan = lan
+	}
+
+	if !config.DisableDHT {
+		dht, err := NewDHTDiscovery(config, localNode, peerStore)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create DHT discovery: %w", err)
+		}
+		c.dht = dht
+	}
+
+	if !config.DisableGossip {
+		gossip, err := NewMeshGossip(config, localNode, peerStore)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gossip: %w", err)
+		}
+		c.gossip = gossip
+	}
+
+	if config.Registry != "" {
+		registry, err := NewRegistryDiscovery(config, localNode, peerStore)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create registry discovery: %w", err)
+		}
+		c.registry = registry
+	}
+
+	return c, nil
+}
+
+// Start starts every configured layer. It only fails if no layer could be started.
+func (c *CompositeDiscovery) Start() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.running) > 0 {
+		return fmt.Errorf("discovery already running")
+	}
+
+	configured := 0
+
+	if c.dht != nil {
+		configured++
+		if err := c.dht.Start(); err != nil {
+			log.Printf("[Discovery] DHT layer unavailable: %v", err)
+		} else {
+			c.running = append(c.running, c.dht)
+		}
+	}
+
+	if c.gossip != nil {
+		configured++
+		// Gossip shares the exchange socket when the DHT layer is up, since both
+		// use the gossip port derived from the secret
+		if c.dht != nil {
+			if exchange := c.dht.Exchange(); exchange != nil {
+				c.gossip.UseExchange(exchange)
+			}
+		}
+		if err := c.gossip.Start(); err != nil {
+			log.Printf("[Discovery] Gossip layer unavailable: %v", err)
+		} else {
+			c.running = append(c.running, c.gossip)
+		}
+	}
+
+	if c.lan != nil {
+		configured++
+		if err := c.lan.Start(); err != nil {
+			log.Printf("[Discovery] LAN layer unavailable: %v", err)
+		} else {
+			c.running = append(c.running, c.lan)
+		}
+	}
+
+	if c.registry != nil {
+		configured++
+		// Listed peers are verified through the DHT layer's peer exchange
+		if c.dht != nil {
+			if exchange := c.dht.Exchange(); exchange != nil {
+				c.registry.UseExchange(exchange)
+			}
+		}
+		if err := c.registry.Start(); err != nil {
+			log.Printf("[Discovery] Registry layer unavailable: %v", err)
+		} else {
+			c.running = append(c.running, c.registry)
+		}
+	}
+
+	if configured == 0 {
+		return fmt.Errorf("all discovery layers are disabled")
+	}
+	if len(c.running) == 0 {
+		return fmt.Errorf("none of the %d configured discovery layers could be started", configured)
+	}
+
+	for messageType, handler := range c.handlers {
+		c.registerHandler(messageType, handler)
+	}
+
+	log.Printf("[Discovery] Running %d of %d discovery layers", len(c.running), configured)
+	return nil
+}
+
+// SetMessageHandler registers a handler for control messages arriving on the
+// exchange or gossip socket. It implements daemon.MeshMessenger.
+func (c *CompositeDiscovery) SetMessageHandler(messageType string, handler func(payload []byte)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wrapped := func(payload []byte, _ *net.UDPAddr) { handler(payload) }
+	c.handlers[messageType] = wrapped
+	if len(c.running) > 0 {
+		c.registerHandler(messageType, wrapped)
+	}
+}
+
+// registerHandler installs a handler on the layers that own a receiving socket
+func (c *CompositeDiscovery) registerHandler(messageType string, handler MessageHandler) {
+	if c.dht != nil {
+		if exchange := c.dht.Exchange(); exchange != nil {
+			exchange.SetMessageHandler(messageType, handler)
+		}
+	}
+	if c.gossip != nil {
+		c.gossip.SetMessageHandler(messageType, handler)
+	}
+}
+
+// Broadcast seals a control message with the gossip key and sends it to every
+// active peer's mesh IP on the gossip port. It implements daemon.MeshMessenger.
+func (c *CompositeDiscovery) Broadcast(messageType string, payload interface{}) error {
+	data, err := crypto.SealEnvelope(messageType, payload, c.config.Keys.GossipKey)
+	if err != nil {
+		return fmt.Errorf("failed to seal %s: %w", messageType, err)
+	}
+
+	send, err := c.sender()
+	if err != nil {
+		return err
+	}
+
+	var sent int
+	for _, peer := range c.peerStore.GetActive() {
+		if peer.MeshIP == "" {
+			continue
+		}
+		addr := &net.UDPAddr{IP: net.ParseIP(peer.MeshIP), Port: int(c.config.Keys.GossipPort)}
+		if err := send(data, addr); err != nil {
+			log.Printf("[Discovery] Failed to send %s to %s: %v", messageType, peer.MeshIP, err)
+			continue
+		}
+		sent++
+	}
+
+	log.Printf("[Discovery] Broadcast %s to %d peers", messageType, sent)
+	return nil
+}
+
+// Send seals a control message with the gossip key and sends it to a single
+// peer's mesh IP on the gossip port. It implements daemon.MeshMessenger.
+func (c *CompositeDiscovery) Send(messageType string, payload interface{}, meshIP string) error {
+	ip := net.ParseIP(meshIP)
+	if ip == nil {
+		return fmt.Errorf("invalid mesh IP %q", meshIP)
+	}
+
+	data, err := crypto.SealEnvelope(messageType, payload, c.config.Keys.GossipKey)
+	if err != nil {
+		return fmt.Errorf("failed to seal %s: %w", messageType, err)
+	}
+
+	send, err := c.sender()
+	if err != nil {
+		return err
+	}
+	return send(data, &net.UDPAddr{IP: ip, Port: int(c.config.Keys.GossipPort)})
+}
+
+// sender returns a function writing to peers from whichever socket is running
+func (c *CompositeDiscovery) sender() (func([]byte, *net.UDPAddr) error, error) {
+	if c.dht != nil {
+		if exchange := c.dht.Exchange(); exchange != nil {
+			return exchange.WriteTo, nil
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, layer := range c.running {
+		if layer == daemon.DiscoveryLayer(c.gossip) {
+			return c.gossip.send, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no running discovery layer can reach peers (DHT exchange and gossip are down)")
+}
+
+// Reannounce has every running layer that supports it announce the local node
+// right away. It implements daemon.Reannouncer.
+func (c *CompositeDiscovery) Reannounce() {
+	c.mu.Lock()
+	running := append([]daemon.DiscoveryLayer(nil), c.running...)
+	c.mu.Unlock()
+
+	for _, layer := range running {
+		if r, ok := layer.(daemon.Reannouncer); ok {
+			r.Reannounce()
+		}
+	}
+}
+
+// SetMeshIP hands a new local mesh IP to the running layers, which announce
+// it from then on. It implements daemon.MeshIPUpdater.
+func (c *CompositeDiscovery) SetMeshIP(meshIP string, nonce int, reserved bool) {
+	c.localNode.setMeshAddress(meshIP, nonce, reserved)
+
+	if c.gossip != nil {
+		if err := c.gossip.rebind(meshIP); err != nil {
+			log.Printf("[Gossip] Failed to move to new mesh IP %s: %v", meshIP, err)
+		}
+	}
+}
+
+// Stop stops all running layers in reverse start order
+func (c *CompositeDiscovery) Stop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := len(c.running) - 1; i >= 0; i-- {
+		if err := c.running[i].Stop(); err != nil {
+			log.Printf("[Discovery] Failed to stop layer: %v", err)
+		}
+	}
+	c.running = nil
+	return nil
+}
+
+// CollectMetrics writes the running state of each layer and forwards to layers exporting metrics
+func (c *CompositeDiscovery) CollectMetrics(m *daemon.MetricsWriter) {
+	c.mu.Lock()
+	running := append([]daemon.DiscoveryLayer(nil), c.running...)
+	c.mu.Unlock()
+
+	isRunning := func(layer daemon.DiscoveryLayer) float64 {
+		for _, r := range running {
+			if r == layer {
+				return 1
+			}
+		}
+		return 0
+	}
+
+	const help = "Whether a discovery layer is running."
+	if c.lan != nil {
+		m.Gauge("discovery_layer_up", help, isRunning(c.lan), "layer", LANMethod)
+	}
+	if c.dht != nil {
+		m.Gauge("discovery_layer_up", help, isRunning(c.dht), "layer", DHTMethod)
+	}
+	if c.gossip != nil {
+		m.Gauge("discovery_layer_up", help, isRunning(c.gossip), "layer", GossipMethod)
+	}
+	if c.registry != nil {
+		m.Gauge("discovery_layer_up", help, isRunning(c.registry), "layer", RegistryMethod)
+	}
+
+	for _, layer := range running {
+		if mc, ok := layer.(daemon.MetricsCollector); ok {
+			mc.CollectMetrics(m)
+		}
+	}
+}
+
+// MarshalJSON implements json.Marshaler for debugging
+func (c *CompositeDiscovery) MarshalJSON() ([]byte, error) {
+	layers := make(map[string]interface{})
+	if c.lan != nil {
+		layers[LANMethod] = c.lan
+	}
+	if c.dht != nil {
+		layers[DHTMethod] = c.dht
+	}
+	if c.gossip != nil {
+		layers[GossipMethod] = c.gossip
+	}
+	if c.registry != nil {
+		layers[RegistryMethod] = c.registry
+	}
+	return json.Marshal(layers)
+}
@@ -2,6 +2,8 @@ package discovery
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
@@ -24,6 +26,10 @@ const (
 	DHTBootstrapTimeout    = 30 * time.Second
 	DHTPersistInterval     = 2 * time.Minute
 	DHTMethod              = "dht"
+
+	// DHTClockSkew is how far apart node clocks may be around the hourly
+	// network ID rollover while still finding each other
+	DHTClockSkew = 5 * time.Minute
 )
 
 // Well-known BitTorrent DHT bootstrap nodes
@@ -57,9 +63,35 @@ type DHTDiscovery struct {
 type LocalNode struct {
 	WGPubKey         string
 	WGPrivateKey     string
+	IdentityKey      ed25519.PrivateKey
+	Name             string
 	MeshIP           string
+	MeshIPNonce      int
+	MeshIPReserved   bool
+	MeshIPv6         string
 	WGEndpoint       string
+	Endpoints        []string
 	RoutableNetworks []string
+	Tags             []string
+	RelayCapable     bool
+	ExitNode         bool
+
+	// mu guards the mesh IP fields, which change when we lose a collision
+	mu sync.RWMutex
+}
+
+// meshAddress returns the mesh IP and how it was derived
+func (n *LocalNode) meshAddress() (meshIP string, nonce int, reserved bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.MeshIP, n.MeshIPNonce, n.MeshIPReserved
+}
+
+// setMeshAddress replaces the mesh IP while the layers are running
+func (n *LocalNode) setMeshAddress(meshIP string, nonce int, reserved bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.MeshIP, n.MeshIPNonce, n.MeshIPReserved = meshIP, nonce, reserved
 }
 
 // NewDHTDiscovery creates a new DHT discovery instance
@@ -93,12 +125,14 @@ func (d *DHTDiscovery) Start() error {
 
 	// Start the peer exchange server (listens for incoming connections)
 	if err := d.exchange.Start(); err != nil {
+		d.setRunning(false)
 		return fmt.Errorf("failed to start peer exchange: %w", err)
 	}
 
 	// Initialize DHT server
 	if err := d.initDHTServer(); err != nil {
 		d.exchange.Stop()
+		d.setRunning(false)
 		return fmt.Errorf("failed to initialize DHT server: %w", err)
 	}
 
@@ -136,6 +170,22 @@ func (d *DHTDiscovery) Stop() error {
 	return nil
 }
 
+func (d *DHTDiscovery) setRunning(running bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.running = running
+}
+
+// Exchange returns the peer exchange handler if DHT discovery is running, nil otherwise
+func (d *DHTDiscovery) Exchange() *PeerExchange {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if !d.running {
+		return nil
+	}
+	return d.exchange
+}
+
 // initDHTServer initializes the BitTorrent DHT server
 func (d *DHTDiscovery) initDHTServer() error {
 	// Use a separate port for DHT (exchange port + 1)
@@ -195,12 +245,16 @@ func (d *DHTDiscovery) initDHTServer() error {
 		ctx, cancel := context.WithTimeout(d.ctx, 30*time.Second)
 		defer cancel()
 
-		// Do a self-lookup to bootstrap
-		var randomID [20]byte
-		copy(randomID[:], d.config.Keys.NetworkID[:])
+		// Look up our current network ID to bootstrap, so the static ID never
+		// shows up on the DHT unless it is in use
+		ids, err := d.infohashes()
+		if err != nil {
+			log.Printf("[DHT] Failed to derive network IDs: %v", err)
+			return
+		}
 
 		// Use Announce with port 0 to do a get_peers which bootstraps the routing table
-		a, err := d.server.Announce(randomID, 0, false)
+		a, err := d.server.Announce(ids[0], 0, false)
 		if err != nil {
 			log.Printf("[DHT] Bootstrap lookup failed: %v", err)
 			return
@@ -303,20 +357,48 @@ func (d *DHTDiscovery) announceLoop() {
 	ticker := time.NewTicker(DHTAnnounceInterval)
 	defer ticker.Stop()
 
+	// Announce under the next hour's ID as soon as it comes into use instead
+	// of waiting up to DHTAnnounceInterval after the rollover
+	rollover := time.NewTimer(untilRollover(time.Now()))
+	defer rollover.Stop()
+
 	for {
 		select {
 		case <-d.ctx.Done():
 			return
 		case <-ticker.C:
 			d.announce()
+		case <-rollover.C:
+			d.announce()
+			rollover.Reset(untilRollover(time.Now()))
 		}
 	}
 }
 
-// announce publishes our presence to the DHT under the network ID
+// untilRollover returns the time until the next hour's network ID is added,
+// which is DHTClockSkew before the hour starts
+func untilRollover(now time.Time) time.Duration {
+	next := now.Truncate(time.Hour).Add(time.Hour - DHTClockSkew)
+	if !next.After(now) {
+		next = next.Add(time.Hour)
+	}
+	return next.Sub(now)
+}
+
+// infohashes returns the network IDs to announce and query: the hourly
+// rotating IDs around now, or the static ID with --dht-static-id
+func (d *DHTDiscovery) infohashes() ([][20]byte, error) {
+	if d.config.DHTStaticID {
+		var id [20]byte
+		copy(id[:], d.config.Keys.NetworkID[:])
+		return [][20]byte{id}, nil
+	}
+	return crypto.GetDHTNetworkIDs(d.config.Secret, time.Now(), DHTClockSkew)
+}
+
+// announce publishes our presence to the DHT under the network IDs
 func (d *DHTDiscovery) announce() {
-	// Get current and previous network IDs (for hourly rotation)
-	current, previous, err := crypto.GetCurrentAndPreviousNetworkIDs(d.config.Secret)
+	ids, err := d.infohashes()
 	if err != nil {
 		log.Printf("[DHT] Failed to derive network IDs: %v", err)
 		return
@@ -324,15 +406,14 @@ func (d *DHTDiscovery) announce() {
 
 	port := d.exchange.Port()
 
-	log.Printf("[DHT] Announcing to network ID %x on exchange port %d (DHT port %d)", current[:8], port, d.dhtPort)
+	log.Printf("[DHT] Announcing to network ID %x on exchange port %d (DHT port %d)", ids[0][:8], port, d.dhtPort)
 
-	// Announce to current network ID
-	d.announceToInfohash(current, port)
-
-	// Also announce to previous hour's ID during transition
-	if current != previous {
-		log.Printf("[DHT] Also announcing to previous network ID %x", previous[:8])
-		d.announceToInfohash(previous, port)
+	// The first ID is the current one, the others cover the hourly rollover
+	for i, id := range ids {
+		if i > 0 {
+			log.Printf("[DHT] Also announcing to network ID %x", id[:8])
+		}
+		d.announceToInfohash(id, port)
 	}
 }
 
@@ -395,21 +476,17 @@ func (d *DHTDiscovery) queryLoop() {
 
 // queryPeers queries the DHT for other peers in our mesh
 func (d *DHTDiscovery) queryPeers() {
-	// Get current and previous network IDs
-	current, previous, err := crypto.GetCurrentAndPreviousNetworkIDs(d.config.Secret)
+	ids, err := d.infohashes()
 	if err != nil {
 		log.Printf("[DHT] Failed to derive network IDs: %v", err)
 		return
 	}
 
-	log.Printf("[DHT] Querying network ID %x (DHT has %d nodes)", current[:8], d.server.NumNodes())
-
-	// Query current network ID
-	d.queryInfohash(current)
+	log.Printf("[DHT] Querying network ID %x (DHT has %d nodes)", ids[0][:8], d.server.NumNodes())
 
-	// Also query previous hour's ID during transition
-	if current != previous {
-		d.queryInfohash(previous)
+	// Query the current ID and those of the neighbouring hours around the rollover
+	for _, id := range ids {
+		d.queryInfohash(id)
 	}
 }
 
@@ -483,7 +560,7 @@ func (d *DHTDiscovery) contactPeer(addr krpc.NodeAddr) {
 	log.Printf("[DHT] SUCCESS! Found wgmesh peer %s (%s) at %s", peerInfo.WGPubKey[:8]+"...", peerInfo.MeshIP, peerInfo.Endpoint)
 
 	// Add to peer store
-	d.peerStore.Update(peerInfo, DHTMethod)
+	updatePeer(d.peerStore, peerInfo, DHTMethod, "DHT", addrStr)
 
 	// Process transitive peers (known_peers from the exchange)
 	// This is handled inside ExchangeWithPeer
@@ -493,3 +570,39 @@ func (d *DHTDiscovery) contactPeer(addr krpc.NodeAddr) {
 func (d *DHTDiscovery) SetOnPeerDiscovered(callback func(addr net.Addr)) {
 	d.onPeerDiscovered = callback
 }
+
+// CollectMetrics writes the DHT routing table size and exchange counters
+func (d *DHTDiscovery) CollectMetrics(m *daemon.MetricsWriter) {
+	d.mu.RLock()
+	server := d.server
+	exchange := d.exchange
+	d.mu.RUnlock()
+
+	nodes := 0
+	if server != nil {
+		nodes = server.NumNodes()
+	}
+	m.Gauge("dht_nodes", "Number of nodes in the DHT routing table.", float64(nodes))
+
+	if exchange != nil {
+		exchange.CollectMetrics(m)
+	}
+}
+
+// MarshalJSON implements json.Marshaler for debugging
+func (d *DHTDiscovery) MarshalJSON() ([]byte, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	nodes := 0
+	if d.server != nil {
+		nodes = d.server.NumNodes()
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"dht_port": d.dhtPort,
+		"nodes":    nodes,
+		"exchange": d.exchange,
+		"running":  d.running,
+	})
+}
@@ -2,11 +2,13 @@ package discovery
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
@@ -34,6 +36,26 @@ type PeerExchange struct {
 
 	pendingMu      sync.Mutex
 	pendingReplies map[string]chan *daemon.PeerInfo
+
+	// onAnnounce receives ANNOUNCE messages arriving on the shared socket (in-mesh gossip)
+	onAnnounce func(announcement *crypto.PeerAnnouncement, remoteAddr *net.UDPAddr)
+
+	// handlers receive control messages that do not carry an announcement (e.g. ROTATE)
+	handlers messageHandlers
+
+	stats exchangeStats
+}
+
+// exchangeStats counts exchange protocol messages for metrics
+type exchangeStats struct {
+	helloSent        atomic.Uint64
+	helloReceived    atomic.Uint64
+	replySent        atomic.Uint64
+	replyReceived    atomic.Uint64
+	announceReceived atomic.Uint64
+	rejectSent       atomic.Uint64
+	decryptFailures  atomic.Uint64
+	rejected         atomic.Uint64
 }
 
 // NewPeerExchange creates a new peer exchange handler
@@ -108,6 +130,31 @@ func (pe *PeerExchange) UDPConn() net.PacketConn {
 	return pe.conn
 }
 
+// SetAnnounceHandler sets the callback for ANNOUNCE messages received on the exchange socket
+func (pe *PeerExchange) SetAnnounceHandler(handler func(*crypto.PeerAnnouncement, *net.UDPAddr)) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.onAnnounce = handler
+}
+
+// SetMessageHandler sets the callback for a control message type received on the exchange socket
+func (pe *PeerExchange) SetMessageHandler(messageType string, handler MessageHandler) {
+	pe.handlers.set(messageType, handler)
+}
+
+// WriteTo sends raw data from the exchange socket
+func (pe *PeerExchange) WriteTo(data []byte, remoteAddr *net.UDPAddr) error {
+	pe.mu.RLock()
+	conn := pe.conn
+	pe.mu.RUnlock()
+
+	if conn == nil {
+		return fmt.Errorf("peer exchange not running")
+	}
+	_, err := conn.WriteToUDP(data, remoteAddr)
+	return err
+}
+
 // listenLoop handles incoming peer exchange requests
 func (pe *PeerExchange) listenLoop() {
 	buf := make([]byte, MaxExchangeSize)
@@ -141,20 +188,62 @@ func (pe *PeerExchange) listenLoop() {
 // handleMessage processes an incoming peer exchange message
 func (pe *PeerExchange) handleMessage(data []byte, remoteAddr *net.UDPAddr) {
 	// Try to decrypt the message
-	envelope, announcement, err := crypto.OpenEnvelope(data, pe.config.Keys.GossipKey)
+	envelope, plaintext, err := crypto.OpenEnvelopeRaw(data, pe.config.Keys.GossipKey)
 	if err != nil {
+		pe.stats.decryptFailures.Add(1)
 		// Could be a DHT message or wrong key - log for debugging
 		log.Printf("[Exchange] Received non-wgmesh packet from %s (len=%d, possibly DHT or wrong secret)", remoteAddr.String(), len(data))
 		return
 	}
 
+	if handler := pe.handlers.get(envelope.MessageType); handler != nil {
+		handler(plaintext, remoteAddr)
+		return
+	}
+
+	// Verify the announcement and the sender's membership token
+	announcement, err := parseAnnouncement(pe.config, envelope, plaintext)
+	if err != nil {
+		if reportRejected("Exchange", remoteAddr.String(), err) {
+			pe.stats.rejected.Add(1)
+
+			// Tell nodes on another protocol version why they get no REPLY
+			var versionErr *crypto.ProtocolVersionError
+			if errors.As(err, &versionErr) && versionErr.MessageType == crypto.MessageTypeHello {
+				if err := pe.sendReject(remoteAddr, versionErr.Version); err != nil {
+					log.Printf("[Exchange] Failed to send reject to %s: %v", remoteAddr.String(), err)
+				}
+			}
+			return
+		}
+
+		log.Printf("[Exchange] Invalid %s from %s: %v", envelope.MessageType, remoteAddr.String(), err)
+		return
+	}
+
 	log.Printf("[Exchange] SUCCESS! Received valid %s from wgmesh peer at %s", envelope.MessageType, remoteAddr.String())
 
 	switch envelope.MessageType {
 	case crypto.MessageTypeHello:
+		pe.stats.helloReceived.Add(1)
 		pe.handleHello(announcement, remoteAddr)
 	case crypto.MessageTypeReply:
+		pe.stats.replyReceived.Add(1)
 		pe.handleReply(announcement, remoteAddr)
+	case crypto.MessageTypeAnnounce:
+		pe.stats.announceReceived.Add(1)
+		pe.mu.RLock()
+		onAnnounce := pe.onAnnounce
+		pe.mu.RUnlock()
+		if onAnnounce != nil {
+			onAnnounce(announcement, remoteAddr)
+		}
+	case crypto.MessageTypeReject:
+		// Sent in our protocol version by a node that speaks another one
+		if rejectWarnings.allow("Exchange|" + remoteAddr.String()) {
+			log.Printf("[Exchange] Peer at %s rejected our message: it speaks another protocol version than %s. Upgrade wgmesh so all nodes run the same protocol version.",
+				remoteAddr.String(), crypto.ProtocolVersion)
+		}
 	default:
 		log.Printf("[Exchange] Unknown message type: %s", envelope.MessageType)
 	}
@@ -167,15 +256,15 @@ func (pe *PeerExchange) handleHello(announcement *crypto.PeerAnnouncement, remot
 		return
 	}
 
-	// Update peer store with the sender's info
-	peerInfo := &daemon.PeerInfo{
-		WGPubKey:         announcement.WGPubKey,
-		MeshIP:           announcement.MeshIP,
-		Endpoint:         resolvePeerEndpoint(announcement.WGEndpoint, remoteAddr),
-		RoutableNetworks: announcement.RoutableNetworks,
+	// Revoked nodes get no reply, so they learn nothing about the mesh
+	if pe.peerStore.IsRevoked(announcement.WGPubKey) {
+		reportRejected("Exchange", remoteAddr.String(), fmt.Errorf("HELLO from %s: %w", safeTruncate(announcement.WGPubKey, 8), daemon.ErrPeerRevoked))
+		return
 	}
 
-	pe.peerStore.Update(peerInfo, DHTMethod)
+	// Update peer store with the sender's info
+	peerInfo := peerFromAnnouncement(announcement, resolvePeerEndpoint(announcement.WGEndpoint, remoteAddr))
+	updatePeer(pe.peerStore, peerInfo, DHTMethod, "Exchange", remoteAddr.String())
 
 	pe.updateTransitivePeers(announcement.KnownPeers)
 
@@ -187,12 +276,7 @@ func (pe *PeerExchange) handleHello(announcement *crypto.PeerAnnouncement, remot
 
 // handleReply routes a REPLY back to an in-flight exchange request.
 func (pe *PeerExchange) handleReply(reply *crypto.PeerAnnouncement, remoteAddr *net.UDPAddr) {
-	peerInfo := &daemon.PeerInfo{
-		WGPubKey:         reply.WGPubKey,
-		MeshIP:           reply.MeshIP,
-		Endpoint:         resolvePeerEndpoint(reply.WGEndpoint, remoteAddr),
-		RoutableNetworks: reply.RoutableNetworks,
-	}
+	peerInfo := peerFromAnnouncement(reply, resolvePeerEndpoint(reply.WGEndpoint, remoteAddr))
 
 	pe.updateTransitivePeers(reply.KnownPeers)
 
@@ -205,7 +289,7 @@ func (pe *PeerExchange) handleReply(reply *crypto.PeerAnnouncement, remoteAddr *
 	}
 
 	log.Printf("[Exchange] Received unsolicited REPLY from %s", remoteAddr.String())
-	pe.peerStore.Update(peerInfo, DHTMethod)
+	updatePeer(pe.peerStore, peerInfo, DHTMethod, "Exchange", remoteAddr.String())
 }
 
 // sendReply sends a REPLY message to a peer
@@ -213,21 +297,48 @@ func (pe *PeerExchange) sendReply(remoteAddr *net.UDPAddr) error {
 	// Build list of known peers for transitive discovery
 	knownPeers := pe.getKnownPeers()
 
-	announcement := crypto.CreateAnnouncement(
-		pe.localNode.WGPubKey,
-		pe.localNode.MeshIP,
-		pe.localNode.WGEndpoint,
-		pe.localNode.RoutableNetworks,
-		knownPeers,
-	)
+	announcement := newAnnouncement(pe.config, pe.localNode, knownPeers)
 
 	data, err := crypto.SealEnvelope(crypto.MessageTypeReply, announcement, pe.config.Keys.GossipKey)
 	if err != nil {
 		return fmt.Errorf("failed to seal reply: %w", err)
 	}
 
-	_, err = pe.conn.WriteToUDP(data, remoteAddr)
-	return err
+	if _, err := pe.conn.WriteToUDP(data, remoteAddr); err != nil {
+		return err
+	}
+	pe.stats.replySent.Add(1)
+	return nil
+}
+
+// sendReject tells a node speaking another protocol version that we ignored its HELLO
+func (pe *PeerExchange) sendReject(remoteAddr *net.UDPAddr, version string) error {
+	announcement := newRejectAnnouncement(pe.config, pe.localNode, version)
+
+	data, err := crypto.SealEnvelope(crypto.MessageTypeReject, announcement, pe.config.Keys.GossipKey)
+	if err != nil {
+		return fmt.Errorf("failed to seal reject: %w", err)
+	}
+
+	if _, err := pe.conn.WriteToUDP(data, remoteAddr); err != nil {
+		return err
+	}
+	pe.stats.rejectSent.Add(1)
+	return nil
+}
+
+// newRejectAnnouncement builds the payload of a REJECT in the protocol
+// version the rejected node speaks. Nodes only read messages in their own
+// version, so a REJECT in ours would be dropped by exactly the nodes it is
+// meant for. Nodes that predate REJECT still only log it as an unknown
+// message type.
+func newRejectAnnouncement(config *daemon.Config, localNode *LocalNode, version string) *crypto.PeerAnnouncement {
+	announcement := newAnnouncement(config, localNode, nil)
+	announcement.Protocol = version
+	if localNode.IdentityKey != nil {
+		announcement.Sign(localNode.IdentityKey)
+	}
+	return announcement
 }
 
 // ExchangeWithPeer initiates a peer exchange with a remote address
@@ -245,13 +356,7 @@ func (pe *PeerExchange) ExchangeWithPeer(addrStr string) (*daemon.PeerInfo, erro
 	knownPeers := pe.getKnownPeers()
 
 	// Create HELLO message
-	announcement := crypto.CreateAnnouncement(
-		pe.localNode.WGPubKey,
-		pe.localNode.MeshIP,
-		pe.localNode.WGEndpoint,
-		pe.localNode.RoutableNetworks,
-		knownPeers,
-	)
+	announcement := newAnnouncement(pe.config, pe.localNode, knownPeers)
 
 	data, err := crypto.SealEnvelope(crypto.MessageTypeHello, announcement, pe.config.Keys.GossipKey)
 	if err != nil {
@@ -265,6 +370,7 @@ func (pe *PeerExchange) ExchangeWithPeer(addrStr string) (*daemon.PeerInfo, erro
 	if err != nil {
 		return nil, fmt.Errorf("failed to send hello: %w", err)
 	}
+	pe.stats.helloSent.Add(1)
 
 	select {
 	case peerInfo := <-replyCh:
@@ -279,11 +385,12 @@ func (pe *PeerExchange) updateTransitivePeers(knownPeers []crypto.KnownPeer) {
 		if kp.WGPubKey == pe.localNode.WGPubKey {
 			continue
 		}
-		transitivePeer := &daemon.PeerInfo{
-			WGPubKey: kp.WGPubKey,
-			MeshIP:   kp.MeshIP,
-			Endpoint: normalizeKnownPeerEndpoint(kp.WGEndpoint),
+		transitivePeer := peerFromKnownPeer(pe.config, kp, normalizeKnownPeerEndpoint(kp.WGEndpoint))
+		if transitivePeer == nil {
+			continue
 		}
+		// Transitive info is not signed by the peer it describes, so it
+		// cannot change a peer bound to an identity (ErrIdentityMismatch)
 		pe.peerStore.Update(transitivePeer, DHTMethod+"-transitive")
 	}
 }
@@ -343,11 +450,7 @@ func (pe *PeerExchange) getKnownPeers() []crypto.KnownPeer {
 	knownPeers := make([]crypto.KnownPeer, 0, len(peers))
 
 	for _, p := range peers {
-		knownPeers = append(knownPeers, crypto.KnownPeer{
-			WGPubKey:   p.WGPubKey,
-			MeshIP:     p.MeshIP,
-			WGEndpoint: p.Endpoint,
-		})
+		knownPeers = append(knownPeers, knownPeer(p))
 	}
 
 	return knownPeers
@@ -357,13 +460,7 @@ func (pe *PeerExchange) getKnownPeers() []crypto.KnownPeer {
 func (pe *PeerExchange) SendAnnounce(remoteAddr *net.UDPAddr) error {
 	knownPeers := pe.getKnownPeers()
 
-	announcement := crypto.CreateAnnouncement(
-		pe.localNode.WGPubKey,
-		pe.localNode.MeshIP,
-		pe.localNode.WGEndpoint,
-		pe.localNode.RoutableNetworks,
-		knownPeers,
-	)
+	announcement := newAnnouncement(pe.config, pe.localNode, knownPeers)
 
 	data, err := crypto.SealEnvelope(crypto.MessageTypeAnnounce, announcement, pe.config.Keys.GossipKey)
 	if err != nil {
@@ -374,6 +471,19 @@ func (pe *PeerExchange) SendAnnounce(remoteAddr *net.UDPAddr) error {
 	return err
 }
 
+// CollectMetrics writes exchange message counters
+func (pe *PeerExchange) CollectMetrics(m *daemon.MetricsWriter) {
+	const help = "Number of peer exchange messages by type and direction."
+	m.Counter("exchange_messages_total", help, pe.stats.helloSent.Load(), "type", crypto.MessageTypeHello, "direction", "sent")
+	m.Counter("exchange_messages_total", help, pe.stats.helloReceived.Load(), "type", crypto.MessageTypeHello, "direction", "received")
+	m.Counter("exchange_messages_total", help, pe.stats.replySent.Load(), "type", crypto.MessageTypeReply, "direction", "sent")
+	m.Counter("exchange_messages_total", help, pe.stats.replyReceived.Load(), "type", crypto.MessageTypeReply, "direction", "received")
+	m.Counter("exchange_messages_total", help, pe.stats.announceReceived.Load(), "type", crypto.MessageTypeAnnounce, "direction", "received")
+	m.Counter("exchange_messages_total", help, pe.stats.rejectSent.Load(), "type", crypto.MessageTypeReject, "direction", "sent")
+	m.Counter("exchange_decrypt_failures_total", "Number of packets that could not be decrypted with the mesh key.", pe.stats.decryptFailures.Load())
+	m.Counter("exchange_rejected_total", "Number of messages from mesh members rejected for protocol version or membership token.", pe.stats.rejected.Load())
+}
+
 // MarshalJSON implements json.Marshaler for debugging
 func (pe *PeerExchange) MarshalJSON() ([]byte, error) {
 	pe.mu.RLock()
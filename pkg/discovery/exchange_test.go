@@ -0,0 +1,31 @@
+package discovery
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
+	"github.com/atvirokodosprendimai/wgmesh/pkg/daemon"
+)
+
+func TestNewRejectAnnouncement(t *testing.T) {
+	keys, _ := crypto.DeriveKeys("test-secret-that-is-long-enough")
+	_, identity, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	localNode := &LocalNode{WGPubKey: "key1", MeshIP: "10.1.0.1", IdentityKey: identity}
+
+	reject := newRejectAnnouncement(&daemon.Config{Keys: keys}, localNode, "wgmesh-v2")
+	if reject.Protocol != "wgmesh-v2" {
+		t.Errorf("Reject should use the rejected node's protocol version, got %q", reject.Protocol)
+	}
+	// Nodes on that version still check the membership token and signature
+	if err := reject.VerifyMembershipToken(keys.MembershipKey); err != nil {
+		t.Errorf("Reject should carry a valid membership token: %v", err)
+	}
+	if err := reject.VerifySignature(); err != nil {
+		t.Errorf("Reject should be signed after changing the version: %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package discovery
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
@@ -29,6 +30,12 @@ type MeshGossip struct {
 
 	conn *net.UDPConn
 
+	// exchange is set when gossip shares the peer exchange socket
+	exchange *PeerExchange
+
+	// handlers receive control messages on our own socket (e.g. ROTATE)
+	handlers messageHandlers
+
 	mu      sync.RWMutex
 	running bool
 	stopCh  chan struct{}
@@ -46,6 +53,19 @@ func NewMeshGossip(config *daemon.Config, localNode *LocalNode, peerStore *daemo
 	}, nil
 }
 
+// UseExchange makes gossip send and receive through the peer exchange socket
+// instead of binding its own. Must be called before Start.
+func (g *MeshGossip) UseExchange(exchange *PeerExchange) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.exchange = exchange
+}
+
+// SetMessageHandler sets the callback for a control message type received on the gossip socket
+func (g *MeshGossip) SetMessageHandler(messageType string, handler MessageHandler) {
+	g.handlers.set(messageType, handler)
+}
+
 // Start begins in-mesh gossip
 func (g *MeshGossip) Start() error {
 	g.mu.Lock()
@@ -55,9 +75,25 @@ func (g *MeshGossip) Start() error {
 		return fmt.Errorf("gossip already running")
 	}
 
+	// The exchange already listens on the gossip port on all interfaces,
+	// including the WireGuard interface
+	if g.exchange != nil {
+		g.port = uint16(g.exchange.Port())
+		g.exchange.SetAnnounceHandler(func(announcement *crypto.PeerAnnouncement, _ *net.UDPAddr) {
+			g.handleAnnouncement(announcement)
+		})
+		g.running = true
+
+		go g.gossipLoop()
+
+		log.Printf("[Gossip] In-mesh gossip started on shared exchange port %d", g.port)
+		return nil
+	}
+
 	// Bind to mesh IP on gossip port
+	meshIP, _, _ := g.localNode.meshAddress()
 	addr := &net.UDPAddr{
-		IP:   net.ParseIP(g.localNode.MeshIP),
+		IP:   net.ParseIP(meshIP),
 		Port: int(g.port),
 	}
 
@@ -77,7 +113,7 @@ func (g *MeshGossip) Start() error {
 	g.conn = conn
 	g.running = true
 
-	go g.listenLoop()
+	go g.listenLoop(conn)
 	go g.gossipLoop()
 
 	log.Printf("[Gossip] In-mesh gossip started on %s", addr.String())
@@ -96,6 +132,9 @@ func (g *MeshGossip) Stop() error {
 	g.running = false
 	close(g.stopCh)
 
+	if g.exchange != nil {
+		g.exchange.SetAnnounceHandler(nil)
+	}
 	if g.conn != nil {
 		g.conn.Close()
 	}
@@ -141,27 +180,7 @@ func (g *MeshGossip) exchangeWithRandomPeer() {
 	// Pick a random peer
 	target := candidates[rand.Intn(len(candidates))]
 
-	// Build known peers list
-	var knownPeers []crypto.KnownPeer
-	for _, p := range peers {
-		if p.WGPubKey != target.WGPubKey {
-			knownPeers = append(knownPeers, crypto.KnownPeer{
-				WGPubKey:   p.WGPubKey,
-				MeshIP:     p.MeshIP,
-				WGEndpoint: p.Endpoint,
-			})
-		}
-	}
-
-	announcement := crypto.CreateAnnouncement(
-		g.localNode.WGPubKey,
-		g.localNode.MeshIP,
-		g.localNode.WGEndpoint,
-		g.localNode.RoutableNetworks,
-		knownPeers,
-	)
-
-	data, err := crypto.SealEnvelope(crypto.MessageTypeAnnounce, announcement, g.gossipKey)
+	data, err := g.sealAnnouncement(target, peers)
 	if err != nil {
 		log.Printf("[Gossip] Failed to seal gossip message: %v", err)
 		return
@@ -173,13 +192,97 @@ func (g *MeshGossip) exchangeWithRandomPeer() {
 		Port: int(g.port),
 	}
 
-	if _, err := g.conn.WriteToUDP(data, targetAddr); err != nil {
+	if err := g.send(data, targetAddr); err != nil {
 		log.Printf("[Gossip] Failed to send to %s: %v", target.MeshIP, err)
 	}
 }
 
-// listenLoop listens for gossip messages
-func (g *MeshGossip) listenLoop() {
+// Reannounce sends our announcement to every peer at once. After our mesh IP
+// changed, peers drop tunnel traffic from the new address until they learn
+// it, so the announcement also goes to the gossip port on the peer's endpoint.
+func (g *MeshGossip) Reannounce() {
+	peers := g.peerStore.GetActive()
+
+	var sent int
+	for _, target := range peers {
+		if target.WGPubKey == g.localNode.WGPubKey || target.MeshIP == "" {
+			continue
+		}
+
+		data, err := g.sealAnnouncement(target, peers)
+		if err != nil {
+			log.Printf("[Gossip] Failed to seal gossip message: %v", err)
+			return
+		}
+
+		addrs := []*net.UDPAddr{{IP: net.ParseIP(target.MeshIP), Port: int(g.port)}}
+		if host, _, err := net.SplitHostPort(target.Endpoint); err == nil {
+			if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+				addrs = append(addrs, &net.UDPAddr{IP: ip, Port: int(g.port)})
+			}
+		}
+		for _, addr := range addrs {
+			if err := g.send(data, addr); err == nil {
+				sent++
+			}
+		}
+	}
+
+	log.Printf("[Gossip] Re-announced to %d addresses", sent)
+}
+
+// sealAnnouncement builds our announcement for target, carrying the other peers
+func (g *MeshGossip) sealAnnouncement(target *daemon.PeerInfo, peers []*daemon.PeerInfo) ([]byte, error) {
+	var knownPeers []crypto.KnownPeer
+	for _, p := range peers {
+		if p.WGPubKey != target.WGPubKey {
+			knownPeers = append(knownPeers, knownPeer(p))
+		}
+	}
+
+	announcement := newAnnouncement(g.config, g.localNode, knownPeers)
+	return crypto.SealEnvelope(crypto.MessageTypeAnnounce, announcement, g.gossipKey)
+}
+
+// send writes a sealed message either through the shared exchange socket or our own
+func (g *MeshGossip) send(data []byte, addr *net.UDPAddr) error {
+	if g.exchange != nil {
+		return g.exchange.WriteTo(data, addr)
+	}
+	g.mu.RLock()
+	conn := g.conn
+	g.mu.RUnlock()
+	_, err := conn.WriteToUDP(data, addr)
+	return err
+}
+
+// rebind moves our own socket to a new mesh IP. The old address is removed
+// from the interface, so a socket bound to it stops receiving. Nothing to do
+// when gossip shares the exchange socket or listens on all interfaces.
+func (g *MeshGossip) rebind(meshIP string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.running || g.conn == nil || g.conn.LocalAddr().(*net.UDPAddr).IP.IsUnspecified() {
+		return nil
+	}
+
+	addr := &net.UDPAddr{IP: net.ParseIP(meshIP), Port: int(g.port)}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to bind gossip port: %w", err)
+	}
+
+	g.conn.Close()
+	g.conn = conn
+	go g.listenLoop(conn)
+
+	log.Printf("[Gossip] In-mesh gossip moved to %s", addr.String())
+	return nil
+}
+
+// listenLoop listens for gossip messages on conn until it is closed
+func (g *MeshGossip) listenLoop(conn *net.UDPConn) {
 	buf := make([]byte, GossipMaxMessageSize)
 
 	for {
@@ -189,12 +292,16 @@ func (g *MeshGossip) listenLoop() {
 		default:
 		}
 
-		g.conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-		n, _, err := g.conn.ReadFromUDP(buf)
+		conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, remoteAddr, err := conn.ReadFromUDP(buf)
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				continue
 			}
+			if errors.Is(err, net.ErrClosed) {
+				// Stopped, or replaced by rebind
+				return
+			}
 			g.mu.RLock()
 			running := g.running
 			g.mu.RUnlock()
@@ -204,36 +311,47 @@ func (g *MeshGossip) listenLoop() {
 			continue
 		}
 
-		_, announcement, err := crypto.OpenEnvelope(buf[:n], g.gossipKey)
+		envelope, plaintext, err := crypto.OpenEnvelopeRaw(buf[:n], g.gossipKey)
 		if err != nil {
 			continue
 		}
 
-		if announcement.WGPubKey == g.localNode.WGPubKey {
+		if handler := g.handlers.get(envelope.MessageType); handler != nil {
+			handler(plaintext, remoteAddr)
 			continue
 		}
 
-		// Update the sender's info
-		peer := &daemon.PeerInfo{
-			WGPubKey:         announcement.WGPubKey,
-			MeshIP:           announcement.MeshIP,
-			Endpoint:         announcement.WGEndpoint,
-			RoutableNetworks: announcement.RoutableNetworks,
+		announcement, err := parseAnnouncement(g.config, envelope, plaintext)
+		if err != nil {
+			reportRejected("Gossip", remoteAddr.String(), err)
+			continue
 		}
-		g.peerStore.Update(peer, GossipMethod)
 
-		// Process transitive peers
-		for _, kp := range announcement.KnownPeers {
-			if kp.WGPubKey == g.localNode.WGPubKey {
-				continue
-			}
-			transitivePeer := &daemon.PeerInfo{
-				WGPubKey: kp.WGPubKey,
-				MeshIP:   kp.MeshIP,
-				Endpoint: kp.WGEndpoint,
-			}
-			g.peerStore.Update(transitivePeer, GossipMethod+"-transitive")
+		g.handleAnnouncement(announcement)
+	}
+}
+
+// handleAnnouncement merges a gossip announcement and its known peers into the peer store
+func (g *MeshGossip) handleAnnouncement(announcement *crypto.PeerAnnouncement) {
+	if announcement.WGPubKey == g.localNode.WGPubKey {
+		return
+	}
+
+	// Update the sender's info
+	peer := peerFromAnnouncement(announcement, announcement.WGEndpoint)
+	updatePeer(g.peerStore, peer, GossipMethod, "Gossip", announcement.MeshIP)
+
+	// Process transitive peers
+	for _, kp := range announcement.KnownPeers {
+		if kp.WGPubKey == g.localNode.WGPubKey {
+			continue
+		}
+		transitivePeer := peerFromKnownPeer(g.config, kp, kp.WGEndpoint)
+		if transitivePeer == nil {
+			continue
 		}
+		// Ignored for peers bound to another identity, see PeerExchange.updateTransitivePeers
+		g.peerStore.Update(transitivePeer, GossipMethod+"-transitive")
 	}
 }
 
@@ -5,21 +5,30 @@ import (
 )
 
 func init() {
-	// Register the DHT discovery factory with the daemon package
-	daemon.SetDHTDiscoveryFactory(createDHTDiscovery)
+	// Register the discovery factory with the daemon package
+	daemon.SetDiscoveryFactory(createDiscovery)
 }
 
-// createDHTDiscovery creates a new DHT discovery instance
-// This is called by the daemon when starting with DHT discovery enabled
-func createDHTDiscovery(config *daemon.Config, localNode *daemon.LocalNode, peerStore *daemon.PeerStore) (daemon.DiscoveryLayer, error) {
+// createDiscovery creates the composite discovery layer (LAN, DHT, gossip and registry)
+// This is called by the daemon when starting with discovery enabled
+func createDiscovery(config *daemon.Config, localNode *daemon.LocalNode, peerStore *daemon.PeerStore) (daemon.DiscoveryLayer, error) {
 	// Convert daemon.LocalNode to discovery.LocalNode
 	discoveryLocalNode := &LocalNode{
 		WGPubKey:         localNode.WGPubKey,
 		WGPrivateKey:     localNode.WGPrivateKey,
+		IdentityKey:      localNode.IdentityKey,
+		Name:             localNode.Name,
 		MeshIP:           localNode.MeshIP,
+		MeshIPNonce:      localNode.MeshIPNonce,
+		MeshIPReserved:   localNode.MeshIPReserved,
+		MeshIPv6:         localNode.MeshIPv6,
 		WGEndpoint:       localNode.WGEndpoint,
+		Endpoints:        localNode.Endpoints,
 		RoutableNetworks: localNode.RoutableNetworks,
+		Tags:             localNode.Tags,
+		RelayCapable:     localNode.RelayCapable,
+		ExitNode:         localNode.ExitNode,
 	}
 
-	return NewDHTDiscovery(config, discoveryLocalNode, peerStore)
+	return NewCompositeDiscovery(config, discoveryLocalNode, peerStore)
 }
@@ -30,6 +30,10 @@ type LANDiscovery struct {
 	multicastAddr *net.UDPAddr
 	conn          *net.UDPConn
 
+	// IPv6 link-local multicast, one socket per interface
+	multicastAddr6 *net.UDPAddr
+	conns6         map[string]*net.UDPConn
+
 	mu      sync.RWMutex
 	running bool
 	stopCh  chan struct{}
@@ -48,13 +52,19 @@ func NewLANDiscovery(config *daemon.Config, localNode *LocalNode, peerStore *dae
 		Port: LANMulticastPort,
 	}
 
+	// The IPv6 group is ff02::X:Y with X:Y from the same MulticastID
+	multicastIP6 := net.ParseIP("ff02::")
+	copy(multicastIP6[12:], config.Keys.MulticastID[:])
+
 	return &LANDiscovery{
-		config:        config,
-		localNode:     localNode,
-		peerStore:     peerStore,
-		gossipKey:     config.Keys.GossipKey,
-		multicastAddr: multicastAddr,
-		stopCh:        make(chan struct{}),
+		config:         config,
+		localNode:      localNode,
+		peerStore:      peerStore,
+		gossipKey:      config.Keys.GossipKey,
+		multicastAddr:  multicastAddr,
+		multicastAddr6: &net.UDPAddr{IP: multicastIP6, Port: LANMulticastPort},
+		conns6:         make(map[string]*net.UDPConn),
+		stopCh:         make(chan struct{}),
 	}, nil
 }
 
@@ -79,14 +89,42 @@ func (l *LANDiscovery) Start() error {
 	l.conn = conn
 	l.running = true
 
-	// Start listener and announcer
-	go l.listenLoop()
+	// Join the IPv6 group on every interface that supports it
+	l.joinIPv6()
+
+	// Start listeners and announcer
+	go l.listenLoop(l.conn, "")
+	for name, conn6 := range l.conns6 {
+		go l.listenLoop(conn6, name)
+	}
 	go l.announceLoop()
 
-	log.Printf("[LAN] Multicast discovery started on %s", l.multicastAddr.String())
+	log.Printf("[LAN] Multicast discovery started on %s and %s on %d interfaces",
+		l.multicastAddr.String(), l.multicastAddr6.IP, len(l.conns6))
 	return nil
 }
 
+// joinIPv6 joins the IPv6 link-local multicast group on each multicast-capable
+// interface. IPv6 is optional, interfaces where joining fails are skipped.
+func (l *LANDiscovery) joinIPv6() {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 ||
+			iface.Flags&net.FlagLoopback != 0 || iface.Name == l.config.InterfaceName {
+			continue
+		}
+		conn, err := net.ListenMulticastUDP("udp6", &iface, l.multicastAddr6)
+		if err != nil {
+			continue
+		}
+		conn.SetReadBuffer(LANMaxMessageSize)
+		l.conns6[iface.Name] = conn
+	}
+}
+
 // Stop stops LAN multicast discovery
 func (l *LANDiscovery) Stop() error {
 	l.mu.Lock()
@@ -102,6 +140,9 @@ func (l *LANDiscovery) Stop() error {
 	if l.conn != nil {
 		l.conn.Close()
 	}
+	for _, conn6 := range l.conns6 {
+		conn6.Close()
+	}
 
 	log.Printf("[LAN] Multicast discovery stopped")
 	return nil
@@ -128,13 +169,7 @@ func (l *LANDiscovery) announceLoop() {
 // announce sends a multicast announcement
 func (l *LANDiscovery) announce() {
 	// Create announcement
-	announcement := crypto.CreateAnnouncement(
-		l.localNode.WGPubKey,
-		l.localNode.MeshIP,
-		l.localNode.WGEndpoint,
-		l.localNode.RoutableNetworks,
-		nil, // No known peers in LAN announce (keep small)
-	)
+	announcement := newAnnouncement(l.config, l.localNode, nil) // No known peers in LAN announce (keep small)
 
 	data, err := crypto.SealEnvelope(crypto.MessageTypeAnnounce, announcement, l.gossipKey)
 	if err != nil {
@@ -153,10 +188,28 @@ func (l *LANDiscovery) announce() {
 	if _, err := sendConn.Write(data); err != nil {
 		log.Printf("[LAN] Failed to send announcement: %v", err)
 	}
+
+	// Link-local multicast has to be sent out of each interface
+	for name := range l.conns6 {
+		addr := *l.multicastAddr6
+		addr.Zone = name
+		sendConn6, err := net.DialUDP("udp6", nil, &addr)
+		if err != nil {
+			continue
+		}
+		sendConn6.Write(data)
+		sendConn6.Close()
+	}
+}
+
+// Reannounce sends a multicast announcement right away
+func (l *LANDiscovery) Reannounce() {
+	l.announce()
 }
 
-// listenLoop listens for multicast announcements
-func (l *LANDiscovery) listenLoop() {
+// listenLoop listens for multicast announcements on conn. For IPv6 sockets,
+// zone is the interface the socket joined the group on.
+func (l *LANDiscovery) listenLoop(conn *net.UDPConn, zone string) {
 	buf := make([]byte, LANMaxMessageSize)
 
 	for {
@@ -166,8 +219,8 @@ func (l *LANDiscovery) listenLoop() {
 		default:
 		}
 
-		l.conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-		n, remoteAddr, err := l.conn.ReadFromUDP(buf)
+		conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, remoteAddr, err := conn.ReadFromUDP(buf)
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				continue
@@ -181,10 +234,18 @@ func (l *LANDiscovery) listenLoop() {
 			continue
 		}
 
+		// Every IPv6 socket receives the group's traffic from all interfaces,
+		// only handle what arrived on our own
+		if zone != "" && remoteAddr.Zone != "" && remoteAddr.Zone != zone {
+			continue
+		}
+
 		// Try to decrypt
-		_, announcement, err := crypto.OpenEnvelope(buf[:n], l.gossipKey)
+		_, announcement, err := openAnnouncement(buf[:n], l.config)
 		if err != nil {
-			// Not a wgmesh packet or wrong secret - silently ignore
+			// Version or membership problems are reported, anything else
+			// (not a wgmesh packet or wrong secret) is silently ignored
+			reportRejected("LAN", remoteAddr.String(), err)
 			continue
 		}
 
@@ -196,15 +257,10 @@ func (l *LANDiscovery) listenLoop() {
 		// Resolve endpoint from the sender's address if the announced one is 0.0.0.0
 		endpoint := resolveEndpoint(announcement.WGEndpoint, remoteAddr)
 
-		peer := &daemon.PeerInfo{
-			WGPubKey:         announcement.WGPubKey,
-			MeshIP:           announcement.MeshIP,
-			Endpoint:         endpoint,
-			RoutableNetworks: announcement.RoutableNetworks,
-		}
+		peer := peerFromAnnouncement(announcement, endpoint)
 
 		log.Printf("[LAN] Discovered peer %s (%s) at %s", safeTruncate(peer.WGPubKey, 8), peer.MeshIP, peer.Endpoint)
-		l.peerStore.Update(peer, LANMethod)
+		updatePeer(l.peerStore, peer, LANMethod, "LAN", remoteAddr.String())
 	}
 }
 
@@ -213,25 +269,35 @@ func resolveEndpoint(advertised string, sender *net.UDPAddr) string {
 	if host, port, err := net.SplitHostPort(advertised); err == nil {
 		if host == "" || host == "0.0.0.0" || host == "::" {
 			if sender != nil && sender.IP != nil {
-				return net.JoinHostPort(sender.IP.String(), port)
+				return net.JoinHostPort(senderHost(sender), port)
 			}
 		}
 		return advertised
 	}
 	if sender != nil && sender.IP != nil {
-		return net.JoinHostPort(sender.IP.String(), fmt.Sprintf("%d", daemon.DefaultWGPort))
+		return net.JoinHostPort(senderHost(sender), fmt.Sprintf("%d", daemon.DefaultWGPort))
 	}
 	return ""
 }
 
+// senderHost returns the sender's IP, with the zone for IPv6 link-local senders
+func senderHost(sender *net.UDPAddr) string {
+	if sender.Zone != "" {
+		return sender.IP.String() + "%" + sender.Zone
+	}
+	return sender.IP.String()
+}
+
 // MarshalJSON implements json.Marshaler for debugging
 func (l *LANDiscovery) MarshalJSON() ([]byte, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
 	return json.Marshal(map[string]interface{}{
-		"multicast_addr": l.multicastAddr.String(),
-		"running":        l.running,
+		"multicast_addr":    l.multicastAddr.String(),
+		"multicast_addr_v6": l.multicastAddr6.IP.String(),
+		"ipv6_interfaces":   len(l.conns6),
+		"running":           l.running,
 	})
 }
 
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strings"
@@ -25,8 +26,41 @@ const (
 	RegistryRetryDelay  = 5 * time.Second
 	RegistryMaxRetries  = 3
 	RegistryHTTPTimeout = 15 * time.Second
+	RegistryInterval    = 10 * time.Minute
 )
 
+// Registry is a rendezvous point where nodes publish the mesh's encrypted peer
+// list, so new nodes can bootstrap when LAN and DHT discovery cannot find peers
+type Registry interface {
+	// FindOrCreate returns the peers published for the mesh and adds myInfo to the list
+	FindOrCreate(myInfo *daemon.PeerInfo) ([]*daemon.PeerInfo, error)
+}
+
+// NewRegistry creates the registry backend selected by url: "github" or
+// "github://owner/repo" for GitHub Issues, or an http(s) URL of a server
+// started with 'wgmesh registry-server'
+func NewRegistry(url string, keys *crypto.DerivedKeys) (Registry, error) {
+	switch {
+	case url == "github":
+		return NewGitHubRegistry(keys, RegistryRepo), nil
+	case strings.HasPrefix(url, "github://"):
+		repo := strings.TrimPrefix(url, "github://")
+		if strings.Count(repo, "/") != 1 {
+			return nil, fmt.Errorf("invalid GitHub registry %q, expected github://owner/repo", url)
+		}
+		return NewGitHubRegistry(keys, repo), nil
+	case strings.HasPrefix(url, "http://"), strings.HasPrefix(url, "https://"):
+		return NewHTTPRegistry(keys, url), nil
+	default:
+		return nil, fmt.Errorf("unsupported registry %q, use github, github://owner/repo or an http(s) URL", url)
+	}
+}
+
+// registrySearchTerm returns the rendezvous name the mesh's peer list is stored under
+func registrySearchTerm(keys *crypto.DerivedKeys) string {
+	return fmt.Sprintf("wgmesh-%x", keys.RendezvousID)
+}
+
 // RegistryPeerEntry represents a peer entry stored in the registry
 type RegistryPeerEntry struct {
 	WGPubKey         string   `json:"wg_pubkey"`
@@ -36,10 +70,11 @@ type RegistryPeerEntry struct {
 	Timestamp        int64    `json:"timestamp"`
 }
 
-// RendezvousRegistry implements GitHub Issue-based peer discovery
-type RendezvousRegistry struct {
+// GitHubRegistry implements GitHub Issue-based peer discovery
+type GitHubRegistry struct {
 	SearchTerm string
 	GossipKey  [32]byte
+	Repo       string
 	IssueURL   string // Cached after first find/create
 	issueNum   int
 
@@ -47,11 +82,12 @@ type RendezvousRegistry struct {
 	mu     sync.Mutex
 }
 
-// NewRendezvousRegistry creates a new registry discovery instance
-func NewRendezvousRegistry(keys *crypto.DerivedKeys) *RendezvousRegistry {
-	return &RendezvousRegistry{
-		SearchTerm: fmt.Sprintf("wgmesh-%x", keys.RendezvousID),
+// NewGitHubRegistry creates a registry backed by issues in the given repository
+func NewGitHubRegistry(keys *crypto.DerivedKeys, repo string) *GitHubRegistry {
+	return &GitHubRegistry{
+		SearchTerm: registrySearchTerm(keys),
 		GossipKey:  keys.GossipKey,
+		Repo:       repo,
 		client: &http.Client{
 			Timeout: RegistryHTTPTimeout,
 		},
@@ -59,7 +95,7 @@ func NewRendezvousRegistry(keys *crypto.DerivedKeys) *RendezvousRegistry {
 }
 
 // FindOrCreate searches for an existing registry entry or creates one
-func (r *RendezvousRegistry) FindOrCreate(myInfo *daemon.PeerInfo) ([]*daemon.PeerInfo, error) {
+func (r *GitHubRegistry) FindOrCreate(myInfo *daemon.PeerInfo) ([]*daemon.PeerInfo, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -93,9 +129,9 @@ func (r *RendezvousRegistry) FindOrCreate(myInfo *daemon.PeerInfo) ([]*daemon.Pe
 }
 
 // searchRegistry searches GitHub Issues for the rendezvous point
-func (r *RendezvousRegistry) searchRegistry() ([]*daemon.PeerInfo, error) {
+func (r *GitHubRegistry) searchRegistry() ([]*daemon.PeerInfo, error) {
 	searchURL := fmt.Sprintf("%s/search/issues?q=%s+repo:%s+in:title",
-		RegistryAPI, r.SearchTerm, RegistryRepo)
+		RegistryAPI, r.SearchTerm, r.Repo)
 
 	req, err := http.NewRequest("GET", searchURL, nil)
 	if err != nil {
@@ -139,7 +175,7 @@ func (r *RendezvousRegistry) searchRegistry() ([]*daemon.PeerInfo, error) {
 	// Use the first matching issue
 	issue := result.Items[0]
 	r.issueNum = issue.Number
-	r.IssueURL = fmt.Sprintf("%s/repos/%s/issues/%d", RegistryAPI, RegistryRepo, issue.Number)
+	r.IssueURL = fmt.Sprintf("%s/repos/%s/issues/%d", RegistryAPI, r.Repo, issue.Number)
 
 	log.Printf("[Registry] Found registry entry: issue #%d", issue.Number)
 
@@ -148,7 +184,7 @@ func (r *RendezvousRegistry) searchRegistry() ([]*daemon.PeerInfo, error) {
 }
 
 // decryptPeerList decrypts the peer list from the issue body
-func (r *RendezvousRegistry) decryptPeerList(body string) []*daemon.PeerInfo {
+func (r *GitHubRegistry) decryptPeerList(body string) []*daemon.PeerInfo {
 	// The body contains the encrypted peer list between markers
 	const startMarker = "<!-- PEERS:"
 	const endMarker = ":PEERS -->"
@@ -164,40 +200,11 @@ func (r *RendezvousRegistry) decryptPeerList(body string) []*daemon.PeerInfo {
 		return nil
 	}
 
-	// Decrypt using gossip key
-	_, announcement, err := crypto.OpenEnvelope([]byte(encryptedData), r.GossipKey)
-	if err != nil {
-		log.Printf("[Registry] Failed to decrypt peer list: %v", err)
-		return nil
-	}
-
-	var peers []*daemon.PeerInfo
-
-	// The announcement itself is a peer
-	if announcement.WGPubKey != "" {
-		peers = append(peers, &daemon.PeerInfo{
-			WGPubKey:         announcement.WGPubKey,
-			MeshIP:           announcement.MeshIP,
-			Endpoint:         announcement.WGEndpoint,
-			RoutableNetworks: announcement.RoutableNetworks,
-		})
-	}
-
-	// Known peers from the announcement
-	for _, kp := range announcement.KnownPeers {
-		peers = append(peers, &daemon.PeerInfo{
-			WGPubKey: kp.WGPubKey,
-			MeshIP:   kp.MeshIP,
-			Endpoint: kp.WGEndpoint,
-		})
-	}
-
-	log.Printf("[Registry] Decrypted %d peers from registry", len(peers))
-	return peers
+	return openPeerList([]byte(encryptedData), r.GossipKey)
 }
 
 // createIssue creates a new registry issue
-func (r *RendezvousRegistry) createIssue(myInfo *daemon.PeerInfo, token string) error {
+func (r *GitHubRegistry) createIssue(myInfo *daemon.PeerInfo, token string) error {
 	// Create encrypted body
 	body, err := r.buildIssueBody([]*daemon.PeerInfo{myInfo})
 	if err != nil {
@@ -214,7 +221,7 @@ func (r *RendezvousRegistry) createIssue(myInfo *daemon.PeerInfo, token string)
 		return fmt.Errorf("failed to marshal issue: %w", err)
 	}
 
-	url := fmt.Sprintf("%s/repos/%s/issues", RegistryAPI, RegistryRepo)
+	url := fmt.Sprintf("%s/repos/%s/issues", RegistryAPI, r.Repo)
 	req, err := http.NewRequest("POST", url, bytes.NewReader(jsonData))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
@@ -243,33 +250,19 @@ func (r *RendezvousRegistry) createIssue(myInfo *daemon.PeerInfo, token string)
 	}
 
 	r.issueNum = result.Number
-	r.IssueURL = fmt.Sprintf("%s/repos/%s/issues/%d", RegistryAPI, RegistryRepo, result.Number)
+	r.IssueURL = fmt.Sprintf("%s/repos/%s/issues/%d", RegistryAPI, r.Repo, result.Number)
 
 	log.Printf("[Registry] Created registry entry: issue #%d", result.Number)
 	return nil
 }
 
 // updatePeerListMerged updates the registry, merging myInfo with existing peers
-func (r *RendezvousRegistry) updatePeerListMerged(myInfo *daemon.PeerInfo, existingPeers []*daemon.PeerInfo, token string) error {
+func (r *GitHubRegistry) updatePeerListMerged(myInfo *daemon.PeerInfo, existingPeers []*daemon.PeerInfo, token string) error {
 	if r.issueNum == 0 {
 		return fmt.Errorf("no issue number set")
 	}
 
-	// Merge: start with myInfo, then add existing peers (deduplicate by pubkey)
-	merged := []*daemon.PeerInfo{myInfo}
-	seen := map[string]bool{myInfo.WGPubKey: true}
-	for _, p := range existingPeers {
-		if p.WGPubKey == "" || seen[p.WGPubKey] {
-			continue
-		}
-		seen[p.WGPubKey] = true
-		merged = append(merged, p)
-		if len(merged) >= RegistryMaxPeers {
-			break
-		}
-	}
-
-	body, err := r.buildIssueBody(merged)
+	body, err := r.buildIssueBody(mergePeerList(myInfo, existingPeers))
 	if err != nil {
 		return fmt.Errorf("failed to build issue body: %w", err)
 	}
@@ -283,7 +276,7 @@ func (r *RendezvousRegistry) updatePeerListMerged(myInfo *daemon.PeerInfo, exist
 		return fmt.Errorf("failed to marshal update: %w", err)
 	}
 
-	url := fmt.Sprintf("%s/repos/%s/issues/%d", RegistryAPI, RegistryRepo, r.issueNum)
+	url := fmt.Sprintf("%s/repos/%s/issues/%d", RegistryAPI, r.Repo, r.issueNum)
 	req, err := http.NewRequest("PATCH", url, bytes.NewReader(jsonData))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
@@ -309,19 +302,45 @@ func (r *RendezvousRegistry) updatePeerListMerged(myInfo *daemon.PeerInfo, exist
 }
 
 // buildIssueBody creates the encrypted issue body
-func (r *RendezvousRegistry) buildIssueBody(peers []*daemon.PeerInfo) (string, error) {
+func (r *GitHubRegistry) buildIssueBody(peers []*daemon.PeerInfo) (string, error) {
+	encrypted, err := sealPeerList(peers, r.GossipKey)
+	if err != nil {
+		return "", err
+	}
+
+	body := fmt.Sprintf("wgmesh registry rendezvous point\n\n<!-- PEERS:\n%s\n:PEERS -->", string(encrypted))
+	return body, nil
+}
+
+// mergePeerList puts myInfo first and adds the existing peers, deduplicated by
+// pubkey and capped at RegistryMaxPeers
+func mergePeerList(myInfo *daemon.PeerInfo, existingPeers []*daemon.PeerInfo) []*daemon.PeerInfo {
+	merged := []*daemon.PeerInfo{myInfo}
+	seen := map[string]bool{myInfo.WGPubKey: true}
+	for _, p := range existingPeers {
+		if p.WGPubKey == "" || seen[p.WGPubKey] {
+			continue
+		}
+		seen[p.WGPubKey] = true
+		merged = append(merged, p)
+		if len(merged) >= RegistryMaxPeers {
+			break
+		}
+	}
+	return merged
+}
+
+// sealPeerList encrypts a peer list as an announcement from the first peer
+// carrying the others as known peers. The registry only sees the sealed blob.
+func sealPeerList(peers []*daemon.PeerInfo, gossipKey [32]byte) ([]byte, error) {
 	if len(peers) == 0 {
-		return "", fmt.Errorf("no peers to publish")
+		return nil, fmt.Errorf("no peers to publish")
 	}
 
 	// Build known peers list (all but first)
 	var knownPeers []crypto.KnownPeer
 	for _, p := range peers[1:] {
-		knownPeers = append(knownPeers, crypto.KnownPeer{
-			WGPubKey:   p.WGPubKey,
-			MeshIP:     p.MeshIP,
-			WGEndpoint: p.Endpoint,
-		})
+		knownPeers = append(knownPeers, knownPeer(p))
 	}
 
 	// Create announcement from the first peer
@@ -333,64 +352,227 @@ func (r *RendezvousRegistry) buildIssueBody(peers []*daemon.PeerInfo) (string, e
 		first.RoutableNetworks,
 		knownPeers,
 	)
+	announcement.Name = first.Name
+	announcement.MeshIPNonce = first.MeshIPNonce
+	announcement.MeshIPReserved = first.MeshIPReserved
+	announcement.MeshIPv6 = first.MeshIPv6
 
-	encrypted, err := crypto.SealEnvelope(crypto.MessageTypeAnnounce, announcement, r.GossipKey)
+	encrypted, err := crypto.SealEnvelope(crypto.MessageTypeAnnounce, announcement, gossipKey)
 	if err != nil {
-		return "", fmt.Errorf("failed to encrypt peer list: %w", err)
+		return nil, fmt.Errorf("failed to encrypt peer list: %w", err)
 	}
-
-	body := fmt.Sprintf("wgmesh registry rendezvous point\n\n<!-- PEERS:\n%s\n:PEERS -->", string(encrypted))
-	return body, nil
+	return encrypted, nil
 }
 
-// UpdatePeerListWithAll updates the registry with all known peers
-func (r *RendezvousRegistry) UpdatePeerListWithAll(peers []*daemon.PeerInfo) error {
-	token := os.Getenv("GITHUB_TOKEN")
-	if token == "" {
-		return fmt.Errorf("GITHUB_TOKEN not set")
+// openPeerList decrypts a peer list sealed by sealPeerList. Lists are only
+// rewritten every RegistryInterval, so they may be up to RegistryUpdateAge
+// old instead of the usual MaxMessageAge.
+func openPeerList(data []byte, gossipKey [32]byte) []*daemon.PeerInfo {
+	_, plaintext, err := crypto.OpenEnvelopeRaw(data, gossipKey)
+	if err != nil {
+		log.Printf("[Registry] Failed to decrypt peer list: %v", err)
+		return nil
 	}
 
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	var announcement crypto.PeerAnnouncement
+	if err := json.Unmarshal(plaintext, &announcement); err != nil {
+		log.Printf("[Registry] Invalid peer list: %v", err)
+		return nil
+	}
+	if announcement.Protocol != crypto.ProtocolVersion {
+		log.Printf("[Registry] Ignoring peer list written by protocol %s, we speak %s", announcement.Protocol, crypto.ProtocolVersion)
+		return nil
+	}
+	if age := time.Since(time.Unix(announcement.Timestamp, 0)); age > RegistryUpdateAge {
+		log.Printf("[Registry] Ignoring stale peer list (%v old)", age.Round(time.Minute))
+		return nil
+	}
 
-	if r.issueNum == 0 {
-		return fmt.Errorf("no registry issue found")
+	var peers []*daemon.PeerInfo
+
+	// The announcement itself is a peer
+	if announcement.WGPubKey != "" {
+		peers = append(peers, &daemon.PeerInfo{
+			WGPubKey:         announcement.WGPubKey,
+			Name:             nodeName(announcement.Name),
+			MeshIP:           announcement.MeshIP,
+			MeshIPNonce:      announcement.MeshIPNonce,
+			MeshIPReserved:   announcement.MeshIPReserved,
+			MeshIPv6:         announcement.MeshIPv6,
+			Endpoint:         announcement.WGEndpoint,
+			RoutableNetworks: announcement.RoutableNetworks,
+		})
+	}
+
+	// Known peers from the announcement
+	for _, kp := range announcement.KnownPeers {
+		peers = append(peers, &daemon.PeerInfo{
+			WGPubKey:       kp.WGPubKey,
+			Name:           nodeName(kp.Name),
+			MeshIP:         kp.MeshIP,
+			MeshIPNonce:    kp.MeshIPNonce,
+			MeshIPReserved: kp.MeshIPReserved,
+			MeshIPv6:       kp.MeshIPv6,
+			Endpoint:       kp.WGEndpoint,
+		})
 	}
 
-	body, err := r.buildIssueBody(peers)
+	log.Printf("[Registry] Decrypted %d peers from registry", len(peers))
+	return peers
+}
+
+// RegistryDiscovery periodically publishes the local node to a registry and
+// contacts the peers listed there. Registry entries are not signed, so they
+// only seed the peer store, without names or reserved addresses, until the
+// peers are verified by a peer exchange.
+type RegistryDiscovery struct {
+	config    *daemon.Config
+	localNode *LocalNode
+	peerStore *daemon.PeerStore
+	registry  Registry
+	exchange  *PeerExchange
+
+	mu      sync.Mutex
+	running bool
+	stopCh  chan struct{}
+}
+
+// NewRegistryDiscovery creates a registry discovery layer for the registry in the config
+func NewRegistryDiscovery(config *daemon.Config, localNode *LocalNode, peerStore *daemon.PeerStore) (*RegistryDiscovery, error) {
+	registry, err := NewRegistry(config.Registry, config.Keys)
 	if err != nil {
-		return fmt.Errorf("failed to build issue body: %w", err)
+		return nil, err
 	}
 
-	update := map[string]string{
-		"body": body,
+	return &RegistryDiscovery{
+		config:    config,
+		localNode: localNode,
+		peerStore: peerStore,
+		registry:  registry,
+	}, nil
+}
+
+// UseExchange lets the registry layer verify listed peers through the DHT layer's peer exchange
+func (rd *RegistryDiscovery) UseExchange(exchange *PeerExchange) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	rd.exchange = exchange
+}
+
+// Start begins polling the registry
+func (rd *RegistryDiscovery) Start() error {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	if rd.running {
+		return fmt.Errorf("registry discovery already running")
 	}
+	rd.running = true
+	rd.stopCh = make(chan struct{})
 
-	jsonData, err := json.Marshal(update)
-	if err != nil {
-		return err
+	go rd.pollLoop(rd.stopCh)
+
+	log.Printf("[Registry] Registry discovery started (%s)", rd.config.Registry)
+	return nil
+}
+
+// Stop stops polling the registry
+func (rd *RegistryDiscovery) Stop() error {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	if !rd.running {
+		return nil
 	}
+	rd.running = false
+	close(rd.stopCh)
 
-	url := fmt.Sprintf("%s/repos/%s/issues/%d", RegistryAPI, RegistryRepo, r.issueNum)
-	req, err := http.NewRequest("PATCH", url, bytes.NewReader(jsonData))
-	if err != nil {
-		return err
+	log.Printf("[Registry] Registry discovery stopped")
+	return nil
+}
+
+func (rd *RegistryDiscovery) pollLoop(stopCh chan struct{}) {
+	rd.poll()
+
+	ticker := time.NewTicker(RegistryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			rd.poll()
+		}
 	}
-	req.Header.Set("Accept", "application/vnd.github.v3+json")
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", "wgmesh")
+}
 
-	resp, err := r.client.Do(req)
+// poll publishes our info and processes the peers listed in the registry
+func (rd *RegistryDiscovery) poll() {
+	myInfo := &daemon.PeerInfo{
+		WGPubKey:         rd.localNode.WGPubKey,
+		Name:             rd.localNode.Name,
+		MeshIP:           rd.localNode.MeshIP,
+		MeshIPNonce:      rd.localNode.MeshIPNonce,
+		MeshIPReserved:   rd.localNode.MeshIPReserved,
+		MeshIPv6:         rd.localNode.MeshIPv6,
+		Endpoint:         rd.localNode.WGEndpoint,
+		RoutableNetworks: rd.localNode.RoutableNetworks,
+	}
+
+	peers, err := rd.registry.FindOrCreate(myInfo)
 	if err != nil {
-		return err
+		log.Printf("[Registry] %v", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("update returned status %d: %s", resp.StatusCode, string(respBody))
+	rd.mu.Lock()
+	exchange := rd.exchange
+	rd.mu.Unlock()
+
+	for _, peer := range peers {
+		if peer.WGPubKey == rd.localNode.WGPubKey {
+			continue
+		}
+
+		// Anyone with the secret can write the list, so like transitive peers
+		// only take addresses derived from the listed pubkey. Names and
+		// reservations come from the peer's own signed announcement, which the
+		// exchange below fetches.
+		if info := peerFromKnownPeer(rd.config, knownPeer(peer), peer.Endpoint); info != nil {
+			// Ignored for peers bound to an identity, see PeerExchange.updateTransitivePeers
+			rd.peerStore.Update(info, RegistryMethod)
+		} else {
+			log.Printf("[Registry] Not storing listed peer %s until verified: mesh IP %s is not derived from its pubkey",
+				safeTruncate(peer.WGPubKey, 8), peer.MeshIP)
+		}
+
+		// Every node listens for peer exchange on the gossip port derived from the secret
+		host, _, err := net.SplitHostPort(peer.Endpoint)
+		if exchange == nil || err != nil || host == "" || net.ParseIP(host).IsUnspecified() {
+			continue
+		}
+		go rd.contactPeer(exchange, net.JoinHostPort(host, fmt.Sprintf("%d", rd.config.Keys.GossipPort)))
 	}
+}
 
-	return nil
+// contactPeer verifies a listed peer with a signed peer exchange
+func (rd *RegistryDiscovery) contactPeer(exchange *PeerExchange, addr string) {
+	peerInfo, err := exchange.ExchangeWithPeer(addr)
+	if err != nil || peerInfo == nil {
+		return
+	}
+
+	log.Printf("[Registry] Found wgmesh peer %s (%s) at %s", safeTruncate(peerInfo.WGPubKey, 8), peerInfo.MeshIP, peerInfo.Endpoint)
+	updatePeer(rd.peerStore, peerInfo, RegistryMethod, "Registry", addr)
+}
+
+// MarshalJSON implements json.Marshaler for debugging
+func (rd *RegistryDiscovery) MarshalJSON() ([]byte, error) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	return json.Marshal(map[string]interface{}{
+		"registry": rd.config.Registry,
+		"running":  rd.running,
+	})
 }
@@ -0,0 +1,174 @@
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
+	"github.com/atvirokodosprendimai/wgmesh/pkg/daemon"
+)
+
+// RegistryTokenEnv optionally holds a bearer token for a self-hosted registry
+const RegistryTokenEnv = "WGMESH_REGISTRY_TOKEN"
+
+// registryEntry is a peer list stored by the registry server
+type registryEntry struct {
+	Blob      string    `json:"blob"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Version   int64     `json:"version,omitempty"` // bumped on every write, sent as the ETag
+}
+
+// errRegistryConflict means the peer list changed between reading and writing it
+var errRegistryConflict = errors.New("peer list was changed by another node")
+
+// registryResponse is the body of GET /v1/registry/{name}
+type registryResponse struct {
+	Blob       string    `json:"blob,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at,omitempty"`
+	ObservedIP string    `json:"observed_ip"` // the client's address as seen by the server
+}
+
+// HTTPRegistry implements peer discovery against a self-hosted registry server
+type HTTPRegistry struct {
+	URL        string
+	SearchTerm string
+	GossipKey  [32]byte
+
+	client *http.Client
+	mu     sync.Mutex
+}
+
+// NewHTTPRegistry creates a registry client for a server started with 'wgmesh registry-server'
+func NewHTTPRegistry(keys *crypto.DerivedKeys, url string) *HTTPRegistry {
+	return &HTTPRegistry{
+		URL:        strings.TrimSuffix(url, "/"),
+		SearchTerm: registrySearchTerm(keys),
+		GossipKey:  keys.GossipKey,
+		client: &http.Client{
+			Timeout: RegistryHTTPTimeout,
+		},
+	}
+}
+
+// FindOrCreate fetches the mesh's peer list and publishes it again with myInfo
+// merged in. If myInfo has no usable endpoint host, the address the server saw
+// us connect from is used instead. The list is only written if nobody changed
+// it since it was read, otherwise it is read and merged again.
+func (r *HTTPRegistry) FindOrCreate(myInfo *daemon.PeerInfo) ([]*daemon.PeerInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var peers []*daemon.PeerInfo
+	for attempt := 1; ; attempt++ {
+		var resp registryResponse
+		etag, err := r.do("GET", nil, nil, &resp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch peer list: %w", err)
+		}
+
+		peers = nil
+		if resp.Blob != "" {
+			peers = openPeerList([]byte(resp.Blob), r.GossipKey)
+		}
+
+		info := *myInfo
+		info.Endpoint = withObservedIP(info.Endpoint, resp.ObservedIP)
+		err = r.put(mergePeerList(&info, peers), etag)
+		if err == nil {
+			return peers, nil
+		}
+		if !errors.Is(err, errRegistryConflict) || attempt >= RegistryMaxRetries {
+			return peers, fmt.Errorf("failed to publish peer list: %w", err)
+		}
+	}
+}
+
+// put seals a peer list and stores it on the server. The write fails with
+// errRegistryConflict if the list changed since the GET that returned etag;
+// an etag of "*" only creates a new list.
+func (r *HTTPRegistry) put(peers []*daemon.PeerInfo, etag string) error {
+	blob, err := sealPeerList(peers, r.GossipKey)
+	if err != nil {
+		return err
+	}
+	header := map[string]string{"If-Match": etag}
+	if etag == "*" {
+		header = map[string]string{"If-None-Match": "*"}
+	}
+	_, err = r.do("PUT", header, &registryEntry{Blob: string(blob)}, nil)
+	return err
+}
+
+// do sends a request for our rendezvous name and decodes the JSON response
+// into out. It returns the ETag of the response, or "*" if the server has no
+// list for us yet.
+func (r *HTTPRegistry) do(method string, header map[string]string, in, out interface{}) (string, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal request: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, r.URL+"/v1/registry/"+r.SearchTerm, body)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "wgmesh")
+	if token := os.Getenv(RegistryTokenEnv); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%s request failed: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return "", errRegistryConflict
+	}
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("%s returned status %d: %s", method, resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return "", fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		etag = "*"
+	}
+	return etag, nil
+}
+
+// withObservedIP replaces a missing or wildcard endpoint host with observedIP
+func withObservedIP(endpoint, observedIP string) string {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil || observedIP == "" {
+		return endpoint
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return endpoint
+	}
+	return net.JoinHostPort(observedIP, port)
+}
@@ -0,0 +1,237 @@
+package discovery
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// RegistryEntryTTL is how long the server keeps a peer list nobody refreshes
+	RegistryEntryTTL = 7 * 24 * time.Hour
+	// RegistryMaxBlobSize limits the size of a stored peer list
+	RegistryMaxBlobSize = 64 * 1024
+)
+
+// registryNamePattern matches the rendezvous names derived from mesh secrets
+var registryNamePattern = regexp.MustCompile(`^wgmesh-[0-9a-f]{16}$`)
+
+// RegistryServer is a self-hosted alternative to the GitHub registry. It
+// stores the encrypted peer lists by rendezvous name in a local JSON file and
+// never sees mesh secrets or plaintext peer information. As it cannot merge
+// lists itself, every entry carries an ETag and writes with If-Match or
+// If-None-Match fail with 412 if another node wrote in between.
+type RegistryServer struct {
+	addr   string
+	path   string
+	token  string
+	server *http.Server
+
+	mu      sync.Mutex
+	entries map[string]*registryEntry
+}
+
+// NewRegistryServer creates a registry server listening on addr and storing
+// entries in path. If token is set, clients must send it as a bearer token.
+func NewRegistryServer(addr, path, token string) (*RegistryServer, error) {
+	rs := &RegistryServer{
+		addr:    addr,
+		path:    path,
+		token:   token,
+		entries: make(map[string]*registryEntry),
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read registry store: %w", err)
+	default:
+		if err := json.Unmarshal(data, &rs.entries); err != nil {
+			return nil, fmt.Errorf("failed to parse registry store %s: %w", path, err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/registry/{name}", rs.handleGet)
+	mux.HandleFunc("PUT /v1/registry/{name}", rs.handlePut)
+	rs.server = &http.Server{
+		Handler:     rs.authenticate(mux),
+		ReadTimeout: 10 * time.Second,
+	}
+
+	return rs, nil
+}
+
+// Start begins serving the registry API
+func (rs *RegistryServer) Start() error {
+	listener, err := net.Listen("tcp", rs.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", rs.addr, err)
+	}
+
+	go func() {
+		if err := rs.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("[Registry] Server error: %v", err)
+		}
+	}()
+
+	log.Printf("[Registry] Serving registry on http://%s (%d entries in %s)", listener.Addr(), rs.count(), rs.path)
+	return nil
+}
+
+// Stop shuts down the registry server
+func (rs *RegistryServer) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return rs.server.Shutdown(ctx)
+}
+
+// Handler returns the HTTP handler, e.g. for tests
+func (rs *RegistryServer) Handler() http.Handler {
+	return rs.server.Handler
+}
+
+// authenticate rejects requests without the configured bearer token
+func (rs *RegistryServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rs.token != "" {
+			want := []byte("Bearer " + rs.token)
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (rs *RegistryServer) handleGet(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !registryNamePattern.MatchString(name) {
+		http.Error(w, "invalid rendezvous name", http.StatusBadRequest)
+		return
+	}
+
+	resp := registryResponse{ObservedIP: remoteIP(r)}
+	rs.mu.Lock()
+	if entry, ok := rs.entries[name]; ok {
+		resp.Blob = entry.Blob
+		resp.UpdatedAt = entry.UpdatedAt
+		w.Header().Set("ETag", entryETag(entry))
+	}
+	rs.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("[Registry] Failed to write response: %v", err)
+	}
+}
+
+func (rs *RegistryServer) handlePut(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !registryNamePattern.MatchString(name) {
+		http.Error(w, "invalid rendezvous name", http.StatusBadRequest)
+		return
+	}
+
+	var entry registryEntry
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, RegistryMaxBlobSize)).Decode(&entry); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if entry.Blob == "" {
+		http.Error(w, "blob is required", http.StatusBadRequest)
+		return
+	}
+	entry.UpdatedAt = time.Now().UTC()
+
+	rs.mu.Lock()
+	current, exists := rs.entries[name]
+	if !preconditionsMet(r, current, exists) {
+		rs.mu.Unlock()
+		http.Error(w, "peer list was changed by another node", http.StatusPreconditionFailed)
+		return
+	}
+	entry.Version = 1
+	if exists {
+		entry.Version = current.Version + 1
+	}
+	rs.entries[name] = &entry
+	err := rs.save()
+	rs.mu.Unlock()
+
+	if err != nil {
+		log.Printf("[Registry] Failed to persist registry: %v", err)
+		http.Error(w, "failed to persist entry", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", entryETag(&entry))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// preconditionsMet checks the If-Match and If-None-Match headers of a write
+// against the stored entry. Requests without them always overwrite.
+func preconditionsMet(r *http.Request, current *registryEntry, exists bool) bool {
+	if match := r.Header.Get("If-Match"); match != "" {
+		return exists && (match == "*" || match == entryETag(current))
+	}
+	if r.Header.Get("If-None-Match") == "*" {
+		return !exists
+	}
+	return true
+}
+
+// entryETag returns the ETag of a stored entry
+func entryETag(entry *registryEntry) string {
+	return strconv.Quote(strconv.FormatInt(entry.Version, 10))
+}
+
+// save drops expired entries and writes the store atomically. Caller must hold rs.mu.
+func (rs *RegistryServer) save() error {
+	for name, entry := range rs.entries {
+		if time.Since(entry.UpdatedAt) > RegistryEntryTTL {
+			delete(rs.entries, name)
+		}
+	}
+
+	data, err := json.MarshalIndent(rs.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal registry: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(rs.path), 0700); err != nil {
+		return fmt.Errorf("failed to create registry directory: %w", err)
+	}
+
+	tmpPath := rs.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write registry: %w", err)
+	}
+	return os.Rename(tmpPath, rs.path)
+}
+
+func (rs *RegistryServer) count() int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return len(rs.entries)
+}
+
+// remoteIP returns the IP address a request came from
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
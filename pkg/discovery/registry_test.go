@@ -0,0 +1,200 @@
+package discovery
+
+import (
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/crypto"
+	"github.com/atvirokodosprendimai/wgmesh/pkg/daemon"
+)
+
+func TestHTTPRegistryRoundTrip(t *testing.T) {
+	store := filepath.Join(t.TempDir(), "registry.json")
+	rs, err := NewRegistryServer("", store, "")
+	if err != nil {
+		t.Fatalf("NewRegistryServer failed: %v", err)
+	}
+	server := httptest.NewServer(rs.Handler())
+	defer server.Close()
+
+	keys, _ := crypto.DeriveKeys("test-secret-that-is-long-enough")
+
+	first := NewHTTPRegistry(keys, server.URL)
+	peers, err := first.FindOrCreate(&daemon.PeerInfo{WGPubKey: "key1", MeshIP: "10.1.0.1", Endpoint: "0.0.0.0:51820"})
+	if err != nil {
+		t.Fatalf("FindOrCreate failed: %v", err)
+	}
+	if len(peers) != 0 {
+		t.Errorf("Expected empty registry, got %d peers", len(peers))
+	}
+
+	// A second node finds the first one, with the wildcard endpoint replaced
+	// by the address the server saw
+	second := NewHTTPRegistry(keys, server.URL)
+	peers, err = second.FindOrCreate(&daemon.PeerInfo{WGPubKey: "key2", MeshIP: "10.1.0.2", Endpoint: "192.0.2.2:51820"})
+	if err != nil {
+		t.Fatalf("FindOrCreate failed: %v", err)
+	}
+	if len(peers) != 1 || peers[0].WGPubKey != "key1" || peers[0].Endpoint != "127.0.0.1:51820" {
+		t.Fatalf("Expected key1 at 127.0.0.1:51820, got %+v", peers)
+	}
+
+	// Entries survive a server restart
+	rs2, err := NewRegistryServer("", store, "")
+	if err != nil {
+		t.Fatalf("NewRegistryServer failed: %v", err)
+	}
+	server2 := httptest.NewServer(rs2.Handler())
+	defer server2.Close()
+
+	peers, err = NewHTTPRegistry(keys, server2.URL).FindOrCreate(&daemon.PeerInfo{WGPubKey: "key3"})
+	if err != nil {
+		t.Fatalf("FindOrCreate failed: %v", err)
+	}
+	if len(peers) != 2 {
+		t.Errorf("Expected 2 peers after restart, got %d", len(peers))
+	}
+
+	// Another mesh cannot read the list
+	otherKeys, _ := crypto.DeriveKeys("another-secret-that-is-long-enough")
+	peers, _ = NewHTTPRegistry(otherKeys, server2.URL).FindOrCreate(&daemon.PeerInfo{WGPubKey: "other"})
+	if len(peers) != 0 {
+		t.Errorf("Another mesh should not see our peers, got %d", len(peers))
+	}
+}
+
+func TestHTTPRegistryConflict(t *testing.T) {
+	rs, err := NewRegistryServer("", filepath.Join(t.TempDir(), "registry.json"), "")
+	if err != nil {
+		t.Fatalf("NewRegistryServer failed: %v", err)
+	}
+	server := httptest.NewServer(rs.Handler())
+	defer server.Close()
+
+	keys, _ := crypto.DeriveKeys("test-secret-that-is-long-enough")
+	first := NewHTTPRegistry(keys, server.URL)
+	second := NewHTTPRegistry(keys, server.URL)
+
+	// Both nodes read the empty registry, only the first create wins
+	etag, err := first.do("GET", nil, nil, &registryResponse{})
+	if err != nil || etag != "*" {
+		t.Fatalf("Expected no ETag for an empty registry, got %q (%v)", etag, err)
+	}
+	if err := first.put([]*daemon.PeerInfo{{WGPubKey: "key1"}}, etag); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	if err := second.put([]*daemon.PeerInfo{{WGPubKey: "key2"}}, etag); !errors.Is(err, errRegistryConflict) {
+		t.Fatalf("Expected a conflict when creating an existing list, got %v", err)
+	}
+
+	// A write based on an old version is refused
+	etag, err = first.do("GET", nil, nil, &registryResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.FindOrCreate(&daemon.PeerInfo{WGPubKey: "key2"}); err != nil {
+		t.Fatalf("FindOrCreate failed: %v", err)
+	}
+	if err := first.put([]*daemon.PeerInfo{{WGPubKey: "key1"}}, etag); !errors.Is(err, errRegistryConflict) {
+		t.Fatalf("Expected a conflict for a stale ETag, got %v", err)
+	}
+
+	// Neither node's entry was lost
+	peers, err := NewHTTPRegistry(keys, server.URL).FindOrCreate(&daemon.PeerInfo{WGPubKey: "key3"})
+	if err != nil {
+		t.Fatalf("FindOrCreate failed: %v", err)
+	}
+	if len(peers) != 2 {
+		t.Errorf("Expected key1 and key2, got %d peers", len(peers))
+	}
+}
+
+func TestRegistryServerToken(t *testing.T) {
+	rs, err := NewRegistryServer("", filepath.Join(t.TempDir(), "registry.json"), "s3cret")
+	if err != nil {
+		t.Fatalf("NewRegistryServer failed: %v", err)
+	}
+	server := httptest.NewServer(rs.Handler())
+	defer server.Close()
+
+	keys, _ := crypto.DeriveKeys("test-secret-that-is-long-enough")
+	myInfo := &daemon.PeerInfo{WGPubKey: "key1", MeshIP: "10.1.0.1"}
+
+	if _, err := NewHTTPRegistry(keys, server.URL).FindOrCreate(myInfo); err == nil {
+		t.Error("Request without token should be rejected")
+	}
+
+	t.Setenv(RegistryTokenEnv, "s3cret")
+	if _, err := NewHTTPRegistry(keys, server.URL).FindOrCreate(myInfo); err != nil {
+		t.Errorf("Request with token failed: %v", err)
+	}
+}
+
+func TestNewRegistry(t *testing.T) {
+	keys, _ := crypto.DeriveKeys("test-secret-that-is-long-enough")
+
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"github", false},
+		{"github://example/registry", false},
+		{"github://example", true},
+		{"https://registry.example.com", false},
+		{"ftp://registry.example.com", true},
+	}
+	for _, tt := range tests {
+		_, err := NewRegistry(tt.url, keys)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NewRegistry(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+		}
+	}
+}
+
+// staticRegistry returns a fixed peer list, as if written by another node
+type staticRegistry struct {
+	peers []*daemon.PeerInfo
+}
+
+func (r *staticRegistry) FindOrCreate(*daemon.PeerInfo) ([]*daemon.PeerInfo, error) {
+	return r.peers, nil
+}
+
+func TestRegistryDiscoveryIgnoresForgedEntries(t *testing.T) {
+	config, err := daemon.NewConfig(daemon.DaemonOpts{Secret: daemon.FormatSecretURI("test-secret-that-is-long-enough")})
+	if err != nil {
+		t.Fatalf("NewConfig failed: %v", err)
+	}
+
+	victim := config.DeriveMeshIP("victim-key")
+	honest := config.DeriveMeshIP("honest-key")
+	peerStore := daemon.NewPeerStore()
+	rd := &RegistryDiscovery{
+		config:    config,
+		localNode: &LocalNode{WGPubKey: "local-key"},
+		peerStore: peerStore,
+		registry: &staticRegistry{peers: []*daemon.PeerInfo{
+			// Claims the victim's address as a reservation
+			{WGPubKey: "forged-key", Name: "victim", MeshIP: victim, MeshIPReserved: true, Endpoint: "192.0.2.1:51820"},
+			// Claims a name on a derived address
+			{WGPubKey: "honest-key", Name: "victim", MeshIP: honest, MeshIPReserved: true, Endpoint: "192.0.2.2:51820"},
+		}},
+	}
+	rd.poll()
+
+	if _, ok := peerStore.Get("forged-key"); ok {
+		t.Error("Entry with a reserved address that is not derived from its pubkey should not be stored")
+	}
+	peer, ok := peerStore.Get("honest-key")
+	if !ok {
+		t.Fatal("Entry with a derived address should be stored")
+	}
+	if peer.Name != "" || peer.MeshIPReserved {
+		t.Errorf("Name and reservation should only come from signed announcements, got %q reserved=%v", peer.Name, peer.MeshIPReserved)
+	}
+	if _, ok := peerStore.GetByName("victim"); ok {
+		t.Error("Unsigned entry should not claim a name")
+	}
+}
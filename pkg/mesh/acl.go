@@ -0,0 +1,104 @@
+package mesh
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/acl"
+	"github.com/atvirokodosprendimai/wgmesh/pkg/ssh"
+)
+
+// SetACLPolicy loads the policy deployed to all nodes; an empty path removes it
+func (m *Mesh) SetACLPolicy(path string) error {
+	if path == "" {
+		m.ACLPolicy = nil
+		fmt.Println("ACL policy removed")
+		return nil
+	}
+
+	policy, err := acl.Load(path)
+	if err != nil {
+		return err
+	}
+	m.ACLPolicy = policy
+	fmt.Printf("ACL policy set: %d rules\n", len(policy.Rules))
+	return nil
+}
+
+// SetNodeTags sets the ACL tags of a node from a "hostname=tag1,tag2" spec
+func (m *Mesh) SetNodeTags(spec string) error {
+	hostname, value, ok := strings.Cut(spec, "=")
+	if !ok {
+		return fmt.Errorf("invalid tags spec, expected hostname=tag1,tag2")
+	}
+
+	node, exists := m.Nodes[hostname]
+	if !exists {
+		return fmt.Errorf("node %s not found", hostname)
+	}
+
+	tags, err := acl.ParseTags(value)
+	if err != nil {
+		return err
+	}
+	node.Tags = tags
+	fmt.Printf("Tags of %s: %s\n", hostname, strings.Join(tags, ", "))
+	return nil
+}
+
+// connected reports whether the ACL policy lets two nodes peer at all
+func (m *Mesh) connected(a, b *Node) bool {
+	return m.ACLPolicy.Connected(m.ACLPolicy.NodeTags(a.PublicKey, a.Tags), m.ACLPolicy.NodeTags(b.PublicKey, b.Tags))
+}
+
+// aclScriptPath is where the compiled rules are kept on a node
+func (m *Mesh) aclScriptPath() string {
+	return fmt.Sprintf("/etc/wireguard/%s-acl.nft", m.InterfaceName)
+}
+
+// syncFirewallForNode loads the nftables rules compiled from the ACL policy on
+// a node, or removes them when the mesh has no policy. It reports whether the
+// rules changed; they are reloaded either way in case the node rebooted.
+func (m *Mesh) syncFirewallForNode(client *ssh.Client, node *Node) (bool, error) {
+	path := m.aclScriptPath()
+
+	if m.ACLPolicy == nil {
+		if client.RunQuiet("test -f "+path) != nil {
+			return false, nil
+		}
+		client.RunQuiet(fmt.Sprintf("nft delete table inet %s 2>/dev/null; rm -f %s", acl.TableName(m.InterfaceName), path))
+		client.Printf("  Removed ACL rules\n")
+		return true, nil
+	}
+
+	script := m.firewallScript(node)
+	current, err := client.Run("cat " + path)
+	changed := err != nil || current != script
+	if changed {
+		if err := client.WriteFile(path, []byte(script), 0600); err != nil {
+			return false, fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	}
+	if _, err := client.Run("nft -f " + path); err != nil {
+		return false, fmt.Errorf("failed to load %s (is nftables installed?): %w", path, err)
+	}
+	if changed {
+		client.Printf("  Applied ACL rules from %s\n", path)
+	}
+	return changed, nil
+}
+
+// firewallScript compiles the ACL policy into the nftables rules for a node
+func (m *Mesh) firewallScript(node *Node) string {
+	fw := acl.Firewall{
+		Interface: m.InterfaceName,
+		Local:     acl.Node{Name: node.Hostname, Tags: m.ACLPolicy.NodeTags(node.PublicKey, node.Tags)},
+	}
+	for hostname, peer := range m.Nodes {
+		if hostname == node.Hostname {
+			continue
+		}
+		fw.Peers = append(fw.Peers, acl.Node{Name: hostname, Tags: m.ACLPolicy.NodeTags(peer.PublicKey, peer.Tags), Addrs: []string{peer.MeshIP.String()}})
+	}
+	return acl.Compile(m.ACLPolicy, fw)
+}
@@ -1,7 +1,12 @@
 package mesh
 
 import (
+	"bytes"
 	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
 
 	"github.com/atvirokodosprendimai/wgmesh/pkg/ssh"
 	"github.com/atvirokodosprendimai/wgmesh/pkg/wireguard"
@@ -11,81 +16,264 @@ type WireGuardConfig = wireguard.FullConfig
 type WGInterface = wireguard.WGInterface
 type WGPeer = wireguard.WGPeer
 
-func (m *Mesh) Deploy() error {
-	if err := m.detectEndpoints(); err != nil {
-		return fmt.Errorf("failed to detect endpoints: %w", err)
+// DefaultDeployParallel is how many nodes are deployed at the same time
+const DefaultDeployParallel = 8
+
+// DeployOptions controls a deployment
+type DeployOptions struct {
+	// Parallel is the number of nodes deployed at once (DefaultDeployParallel if < 1)
+	Parallel int
+
+	// Plan, if set, makes Deploy refuse to change anything when the live
+	// state or the mesh state no longer lead to the planned changes
+	Plan *Plan
+}
+
+// Deploy outcomes of a single node
+const (
+	DeployUnchanged = "unchanged"
+	DeployUpdated   = "updated"
+	DeployFailed    = "failed"
+)
+
+// DeployResult is the outcome of deploying one node
+type DeployResult struct {
+	Hostname string
+	Status   string
+	Err      error
+}
+
+// Deploy pushes the configuration to all nodes. A failing node does not stop
+// the others; the error reports how many nodes failed after the summary.
+func (m *Mesh) Deploy(opts DeployOptions) error {
+	parallel := opts.Parallel
+	if parallel < 1 {
+		parallel = DefaultDeployParallel
 	}
 
-	for hostname, node := range m.Nodes {
-		fmt.Printf("Deploying to %s...\n", hostname)
+	clients, connErrs := m.connectAll(parallel)
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
 
-		client, err := ssh.NewClient(node.SSHHost, node.SSHPort)
-		if err != nil {
-			return fmt.Errorf("failed to connect to %s: %w", hostname, err)
+	m.detectEndpoints(clients, parallel)
+	if opts.Plan != nil {
+		if err := m.checkPlan(opts.Plan, clients, connErrs, parallel); err != nil {
+			return err
 		}
-		defer client.Close()
+		fmt.Println("Live state matches the plan")
+	}
+
+	results := m.deployAll(clients, connErrs, parallel)
+	printDeploySummary(results)
+	return deployError(results)
+}
 
-		if err := ssh.EnsureWireGuardInstalled(client); err != nil {
-			return fmt.Errorf("failed to ensure WireGuard on %s: %w", hostname, err)
+// deployError reports how many nodes failed, or nil if none did
+func deployError(results []DeployResult) error {
+	failed := 0
+	for _, r := range results {
+		if r.Status == DeployFailed {
+			failed++
 		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d nodes failed", failed, len(results))
+	}
+	return nil
+}
 
-		config := m.generateConfigForNode(node)
-		desiredRoutes := m.collectAllRoutesForNode(node)
+// sortedHostnames returns the node hostnames in a stable order
+func (m *Mesh) sortedHostnames() []string {
+	hostnames := make([]string, 0, len(m.Nodes))
+	for hostname := range m.Nodes {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	return hostnames
+}
+
+// forEachNode runs fn for every hostname with at most parallel calls at a time
+func forEachNode(hostnames []string, parallel int, fn func(i int, hostname string)) {
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, hostname := range hostnames {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, hostname string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i, hostname)
+		}(i, hostname)
+	}
+	wg.Wait()
+}
+
+// connectAll opens one SSH connection per node, used for the whole deployment
+func (m *Mesh) connectAll(parallel int) (map[string]*ssh.Client, map[string]error) {
+	var mu sync.Mutex
+	clients := make(map[string]*ssh.Client)
+	errs := make(map[string]error)
 
-		currentConfig, err := wireguard.GetCurrentConfig(client, m.InterfaceName)
+	forEachNode(m.sortedHostnames(), parallel, func(_ int, hostname string) {
+		node := m.Nodes[hostname]
+		client, err := m.connect(node)
+
+		mu.Lock()
+		defer mu.Unlock()
 		if err != nil {
-			fmt.Printf("  No existing config, applying fresh persistent configuration\n")
-			if err := wireguard.ApplyPersistentConfig(client, m.InterfaceName, config, desiredRoutes); err != nil {
-				return fmt.Errorf("failed to apply config to %s: %w", hostname, err)
+			fmt.Printf("Warning: failed to connect to %s: %v\n", hostname, err)
+			errs[hostname] = fmt.Errorf("failed to connect: %w", err)
+			return
+		}
+		clients[hostname] = client
+	})
+
+	return clients, errs
+}
+
+// deployAll deploys every node. With more than one node at a time, each
+// node's progress is buffered and printed in one piece when it is done.
+func (m *Mesh) deployAll(clients map[string]*ssh.Client, connErrs map[string]error, parallel int) []DeployResult {
+	var mu sync.Mutex
+	hostnames := m.sortedHostnames()
+	results := make([]DeployResult, len(hostnames))
+
+	forEachNode(hostnames, parallel, func(i int, hostname string) {
+		results[i] = DeployResult{Hostname: hostname}
+		client := clients[hostname]
+		if client == nil {
+			results[i].Status = DeployFailed
+			results[i].Err = connErrs[hostname]
+			return
+		}
+
+		var buf bytes.Buffer
+		if parallel > 1 {
+			client.SetOutput(&buf)
+			defer client.SetOutput(nil)
+		}
+
+		client.Printf("Deploying to %s...\n", hostname)
+		changed, err := m.deployNode(client, m.Nodes[hostname])
+		switch {
+		case err != nil:
+			results[i].Status = DeployFailed
+			results[i].Err = err
+			client.Printf("  ✗ Failed: %v\n\n", err)
+		case changed:
+			results[i].Status = DeployUpdated
+			client.Printf("  ✓ Deployed successfully\n\n")
+		default:
+			results[i].Status = DeployUnchanged
+			client.Printf("  ✓ Already up to date\n\n")
+		}
+
+		if parallel > 1 {
+			mu.Lock()
+			os.Stdout.Write(buf.Bytes())
+			mu.Unlock()
+		}
+	})
+
+	return results
+}
+
+// deployNode brings one node up to date and reports whether anything changed
+func (m *Mesh) deployNode(client *ssh.Client, node *Node) (bool, error) {
+	if err := ssh.EnsureWireGuardInstalled(client); err != nil {
+		return false, fmt.Errorf("failed to ensure WireGuard: %w", err)
+	}
+
+	config := m.generateConfigForNode(node)
+	desiredRoutes := m.collectAllRoutesForNode(node)
+	changed := false
+
+	currentConfig, err := wireguard.GetCurrentConfig(client, m.InterfaceName)
+	if err != nil {
+		client.Printf("  No existing config, applying fresh persistent configuration\n")
+		if err := wireguard.ApplyPersistentConfig(client, m.InterfaceName, config, desiredRoutes); err != nil {
+			return false, fmt.Errorf("failed to apply config: %w", err)
+		}
+		changed = true
+	} else {
+		diff := wireguard.CalculateDiff(currentConfig, wireguard.FullConfigToConfig(config))
+		if diff.HasChanges() {
+			client.Printf("  Applying changes with persistent configuration\n")
+			if err := wireguard.UpdatePersistentConfig(client, m.InterfaceName, config, desiredRoutes, diff); err != nil {
+				return false, fmt.Errorf("failed to update config: %w", err)
 			}
+			changed = true
 		} else {
-			diff := wireguard.CalculateDiff(currentConfig, wireguard.FullConfigToConfig(config))
-			if diff.HasChanges() {
-				fmt.Printf("  Applying changes with persistent configuration\n")
-				if err := wireguard.UpdatePersistentConfig(client, m.InterfaceName, config, desiredRoutes, diff); err != nil {
-					return fmt.Errorf("failed to update config on %s: %w", hostname, err)
-				}
-			} else {
-				fmt.Printf("  No WireGuard peer changes needed\n")
-			}
+			client.Printf("  No WireGuard peer changes needed\n")
+		}
 
-			// Always check and sync routes
-			if err := m.syncRoutesForNode(client, node, desiredRoutes); err != nil {
-				return fmt.Errorf("failed to sync routes on %s: %w", hostname, err)
-			}
+		// Always check and sync routes
+		routesChanged, err := m.syncRoutesForNode(client, node, desiredRoutes)
+		if err != nil {
+			return changed, fmt.Errorf("failed to sync routes: %w", err)
+		}
+		changed = changed || routesChanged
 
-			// Always ensure config file is up to date
-			configContent := wireguard.GenerateWgQuickConfig(config, desiredRoutes)
-			configPath := fmt.Sprintf("/etc/wireguard/%s.conf", m.InterfaceName)
+		// Always ensure config file is up to date
+		configContent := wireguard.GenerateWgQuickConfig(config, desiredRoutes)
+		configPath := fmt.Sprintf("/etc/wireguard/%s.conf", m.InterfaceName)
+		if current, err := client.Run("cat " + configPath); err != nil || current != configContent {
 			if err := client.WriteFile(configPath, []byte(configContent), 0600); err != nil {
-				fmt.Printf("  Warning: failed to update config file: %v\n", err)
+				client.Printf("  Warning: failed to update config file: %v\n", err)
+			} else {
+				changed = true
 			}
 		}
+	}
 
-		fmt.Printf("  ✓ Deployed successfully\n\n")
+	hostsChanged, err := m.syncHostsForNode(client)
+	if err != nil {
+		client.Printf("  Warning: failed to update hosts entries: %v\n", err)
 	}
+	changed = changed || hostsChanged
 
-	return nil
+	firewallChanged, err := m.syncFirewallForNode(client, node)
+	if err != nil {
+		return changed, fmt.Errorf("failed to apply ACL rules: %w", err)
+	}
+	return changed || firewallChanged, nil
 }
 
-func (m *Mesh) detectEndpoints() error {
-	for hostname, node := range m.Nodes {
-		if node.IsLocal {
-			continue
+// printDeploySummary prints one line per node and the totals
+func printDeploySummary(results []DeployResult) {
+	counts := make(map[string]int)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tRESULT\tERROR")
+	for _, r := range results {
+		counts[r.Status]++
+		errText := ""
+		if r.Err != nil {
+			errText = r.Err.Error()
 		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.Hostname, r.Status, errText)
+	}
+	w.Flush()
+	fmt.Printf("\n%d updated, %d unchanged, %d failed\n", counts[DeployUpdated], counts[DeployUnchanged], counts[DeployFailed])
+}
 
-		client, err := ssh.NewClient(node.SSHHost, node.SSHPort)
-		if err != nil {
-			return fmt.Errorf("failed to connect to %s: %w", hostname, err)
+// detectEndpoints checks over the open connections which nodes are reachable
+// on their SSH address and which are behind NAT
+func (m *Mesh) detectEndpoints(clients map[string]*ssh.Client, parallel int) {
+	forEachNode(m.sortedHostnames(), parallel, func(_ int, hostname string) {
+		node := m.Nodes[hostname]
+		client := clients[hostname]
+		if node.IsLocal || client == nil {
+			return
 		}
 
 		publicIP, err := ssh.DetectPublicIP(client)
-		client.Close()
-
 		if err != nil {
 			fmt.Printf("Warning: failed to detect public IP for %s: %v\n", hostname, err)
 			node.BehindNAT = true
-			continue
+			return
 		}
 
 		if publicIP != "" && publicIP != node.SSHHost {
@@ -95,16 +283,14 @@ func (m *Mesh) detectEndpoints() error {
 			node.PublicEndpoint = fmt.Sprintf("%s:%d", node.SSHHost, node.ListenPort)
 			fmt.Printf("Detected %s has public endpoint: %s\n", hostname, node.PublicEndpoint)
 		}
-	}
-
-	return nil
+	})
 }
 
 func (m *Mesh) collectRoutesForNode(node *Node) []ssh.RouteEntry {
 	routes := make([]ssh.RouteEntry, 0)
 
 	for peerHostname, peer := range m.Nodes {
-		if peerHostname == node.Hostname {
+		if peerHostname == node.Hostname || !m.connected(node, peer) {
 			continue
 		}
 
@@ -132,7 +318,7 @@ func (m *Mesh) collectAllRoutesForNode(node *Node) []ssh.RouteEntry {
 
 	// Add routes to other nodes' networks (via their mesh IPs)
 	for peerHostname, peer := range m.Nodes {
-		if peerHostname == node.Hostname {
+		if peerHostname == node.Hostname || !m.connected(node, peer) {
 			continue
 		}
 
@@ -147,10 +333,11 @@ func (m *Mesh) collectAllRoutesForNode(node *Node) []ssh.RouteEntry {
 	return routes
 }
 
-func (m *Mesh) syncRoutesForNode(client *ssh.Client, node *Node, desiredRoutes []ssh.RouteEntry) error {
+// syncRoutesForNode applies the route changes and reports whether there were any
+func (m *Mesh) syncRoutesForNode(client *ssh.Client, node *Node, desiredRoutes []ssh.RouteEntry) (bool, error) {
 	currentRoutes, err := ssh.GetCurrentRoutes(client, m.InterfaceName)
 	if err != nil {
-		fmt.Printf("  Warning: could not get current routes, will try to add all: %v\n", err)
+		client.Printf("  Warning: could not get current routes, will try to add all: %v\n", err)
 		// If we can't get current routes, just try to add desired ones
 		for _, route := range desiredRoutes {
 			var cmd string
@@ -163,11 +350,14 @@ func (m *Mesh) syncRoutesForNode(client *ssh.Client, node *Node, desiredRoutes [
 			}
 			client.RunQuiet(cmd)
 		}
-		return nil
+		return len(desiredRoutes) > 0, nil
 	}
 
 	toAdd, toRemove := ssh.CalculateRouteDiff(currentRoutes, desiredRoutes)
-	return ssh.ApplyRouteDiff(client, m.InterfaceName, toAdd, toRemove)
+	if err := ssh.ApplyRouteDiff(client, m.InterfaceName, toAdd, toRemove); err != nil {
+		return false, err
+	}
+	return len(toAdd) > 0 || len(toRemove) > 0, nil
 }
 
 func (m *Mesh) generateConfigForNode(node *Node) *WireGuardConfig {
@@ -181,7 +371,7 @@ func (m *Mesh) generateConfigForNode(node *Node) *WireGuardConfig {
 	}
 
 	for peerHostname, peer := range m.Nodes {
-		if peerHostname == node.Hostname {
+		if peerHostname == node.Hostname || !m.connected(node, peer) {
 			continue
 		}
 
@@ -0,0 +1,104 @@
+package mesh
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForEachNodeParallel(t *testing.T) {
+	hostnames := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+
+	for _, parallel := range []int{1, 3, len(hostnames) + 5} {
+		var running, peak int32
+		var mu sync.Mutex
+		seen := make(map[int]string)
+
+		forEachNode(hostnames, parallel, func(i int, hostname string) {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+
+			mu.Lock()
+			seen[i] = hostname
+			mu.Unlock()
+		})
+
+		want := parallel
+		if want > len(hostnames) {
+			want = len(hostnames)
+		}
+		if int(peak) > want {
+			t.Errorf("parallel %d: %d calls ran at once", parallel, peak)
+		}
+		if parallel == 1 && peak != 1 {
+			t.Errorf("parallel 1: peak = %d, want 1", peak)
+		}
+		if len(seen) != len(hostnames) {
+			t.Fatalf("parallel %d: fn ran for %d hostnames, want %d", parallel, len(seen), len(hostnames))
+		}
+		for i, hostname := range hostnames {
+			if seen[i] != hostname {
+				t.Errorf("parallel %d: index %d got %q, want %q", parallel, i, seen[i], hostname)
+			}
+		}
+	}
+}
+
+func TestDeployAllResults(t *testing.T) {
+	m := &Mesh{Nodes: map[string]*Node{
+		"node-c": {Hostname: "node-c"},
+		"node-a": {Hostname: "node-a"},
+		"node-b": {Hostname: "node-b"},
+	}}
+	connErrs := map[string]error{
+		"node-a": errors.New("failed to connect: timeout"),
+		"node-b": errors.New("failed to connect: connection refused"),
+		"node-c": errors.New("failed to connect: no route to host"),
+	}
+
+	results := m.deployAll(nil, connErrs, 2)
+
+	var hostnames []string
+	for _, r := range results {
+		hostnames = append(hostnames, r.Hostname)
+		if r.Status != DeployFailed {
+			t.Errorf("%s: status = %s, want %s", r.Hostname, r.Status, DeployFailed)
+		}
+		if r.Err != connErrs[r.Hostname] {
+			t.Errorf("%s: err = %v, want the connection error", r.Hostname, r.Err)
+		}
+	}
+	if want := []string{"node-a", "node-b", "node-c"}; !reflect.DeepEqual(hostnames, want) {
+		t.Errorf("Results in order %v, want %v", hostnames, want)
+	}
+}
+
+func TestDeployError(t *testing.T) {
+	results := []DeployResult{
+		{Hostname: "node-a", Status: DeployUpdated},
+		{Hostname: "node-b", Status: DeployFailed, Err: errors.New("failed to apply config")},
+		{Hostname: "node-c", Status: DeployUnchanged},
+		{Hostname: "node-d", Status: DeployFailed, Err: errors.New("failed to connect")},
+	}
+	err := deployError(results)
+	if err == nil || err.Error() != "2 of 4 nodes failed" {
+		t.Errorf("deployError() = %v, want \"2 of 4 nodes failed\"", err)
+	}
+
+	if err := deployError(results[:1]); err != nil {
+		t.Errorf("deployError() without failures = %v, want nil", err)
+	}
+	if err := deployError(nil); err != nil {
+		t.Errorf("deployError() without nodes = %v, want nil", err)
+	}
+}
@@ -0,0 +1,126 @@
+package mesh
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/ssh"
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+var knownHostsFile string
+
+// SetKnownHostsFile adds a known_hosts file checked besides ~/.ssh/known_hosts
+func SetKnownHostsFile(path string) {
+	knownHostsFile = path
+}
+
+func knownHostsFiles() []string {
+	files := []string{ssh.DefaultKnownHostsFile()}
+	if knownHostsFile != "" {
+		files = append(files, knownHostsFile)
+	}
+	return files
+}
+
+// connect opens an SSH connection to a node. The host key must match the
+// key pinned in the state or, for nodes without one, a known_hosts entry.
+// Hosts known to neither are trusted on first use and their key is pinned.
+func (m *Mesh) connect(node *Node) (*ssh.Client, error) {
+	policy := ssh.HostKeyPolicy{
+		KnownHostsFiles: knownHostsFiles(),
+		Pinned:          node.SSHHostKey,
+		TrustNew: func(key cryptossh.PublicKey) {
+			fmt.Printf("Trusting new host key for %s: %s\n", node.Hostname, ssh.Fingerprint(key))
+			m.mu.Lock()
+			node.SSHHostKey = ssh.FormatHostKey(key)
+			m.pinnedHosts = append(m.pinnedHosts, node.Hostname)
+			m.mu.Unlock()
+		},
+	}
+
+	client, err := ssh.NewClient(node.SSHHost, node.SSHPort, sshOptions(node, policy))
+	var changed *ssh.HostKeyChangedError
+	if errors.As(err, &changed) {
+		return nil, fmt.Errorf("%w; refusing to connect, if the host was reinstalled run: wgmesh -trust-host %s", err, node.Hostname)
+	}
+	return client, err
+}
+
+// sshOptions returns the connection settings of a node
+func sshOptions(node *Node, policy ssh.HostKeyPolicy) ssh.ClientOptions {
+	opts := ssh.ClientOptions{
+		HostKeys:  policy,
+		User:      node.SSHUser,
+		ProxyJump: node.SSHProxyJump,
+	}
+	if node.SSHIdentity != "" {
+		opts.IdentityFiles = []string{node.SSHIdentity}
+	}
+	return opts
+}
+
+// SetNodeSSH sets how a node is reached over SSH. Empty values are left
+// unchanged, "-" clears a value so that ~/.ssh/config applies again.
+func (m *Mesh) SetNodeSSH(hostname, user, identity, proxyJump string) error {
+	node, ok := m.Nodes[hostname]
+	if !ok {
+		return fmt.Errorf("node %s not found", hostname)
+	}
+
+	for _, field := range []struct {
+		value  string
+		target *string
+	}{
+		{user, &node.SSHUser},
+		{identity, &node.SSHIdentity},
+		{proxyJump, &node.SSHProxyJump},
+	} {
+		switch field.value {
+		case "":
+		case "-":
+			*field.target = ""
+		default:
+			*field.target = field.value
+		}
+	}
+	return nil
+}
+
+// PinnedHosts returns the nodes whose host key was pinned since the state was
+// loaded, i.e. whether the state needs saving
+func (m *Mesh) PinnedHosts() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string{}, m.pinnedHosts...)
+}
+
+// TrustHost connects to a node accepting whatever host key it presents and
+// pins that key, replacing the previous one
+func (m *Mesh) TrustHost(hostname string) error {
+	node, ok := m.Nodes[hostname]
+	if !ok {
+		return fmt.Errorf("node %s not found", hostname)
+	}
+
+	var presented cryptossh.PublicKey
+	client, err := ssh.NewClient(node.SSHHost, node.SSHPort, sshOptions(node, ssh.HostKeyPolicy{
+		// Jump hosts are still checked against known_hosts
+		KnownHostsFiles: knownHostsFiles(),
+		TrustAny:        true,
+		TrustNew:        func(key cryptossh.PublicKey) { presented = key },
+	}))
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	client.Close()
+
+	previous := "none"
+	if old, _, _, _, err := cryptossh.ParseAuthorizedKey([]byte(node.SSHHostKey)); err == nil {
+		previous = ssh.Fingerprint(old)
+	}
+
+	node.SSHHostKey = ssh.FormatHostKey(presented)
+	fmt.Printf("Pinned host key for %s: %s (was %s)\n", hostname, ssh.Fingerprint(presented), previous)
+	return nil
+}
@@ -0,0 +1,73 @@
+package mesh
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/ssh"
+)
+
+const hostsFile = "/etc/hosts"
+
+// hostsEntries lists every node as <mesh ip> <hostname>.<interface>.mesh <hostname>,
+// the same names the daemon's mesh DNS answers for
+func (m *Mesh) hostsEntries() []string {
+	hostnames := make([]string, 0, len(m.Nodes))
+	for hostname := range m.Nodes {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+
+	domain := strings.ToLower(m.InterfaceName) + ".mesh"
+	entries := make([]string, 0, len(hostnames))
+	for _, hostname := range hostnames {
+		name := strings.ToLower(hostname)
+		entries = append(entries, fmt.Sprintf("%s\t%s.%s %s", m.Nodes[hostname].MeshIP, name, domain, name))
+	}
+	return entries
+}
+
+// replaceHostsBlock replaces the wgmesh block of a hosts file, appending it if
+// there is none yet. Lines outside the block are left alone.
+func replaceHostsBlock(content, iface string, entries []string) string {
+	begin := fmt.Sprintf("# BEGIN wgmesh %s", iface)
+	end := fmt.Sprintf("# END wgmesh %s", iface)
+
+	var kept []string
+	inBlock := false
+	for _, line := range strings.Split(strings.TrimRight(content, "\n"), "\n") {
+		switch {
+		case line == begin:
+			inBlock = true
+		case line == end:
+			inBlock = false
+		case !inBlock:
+			kept = append(kept, line)
+		}
+	}
+
+	kept = append(kept, begin)
+	kept = append(kept, entries...)
+	kept = append(kept, end)
+	return strings.Join(kept, "\n") + "\n"
+}
+
+// syncHostsForNode updates the mesh block of the node's hosts file and
+// reports whether it changed
+func (m *Mesh) syncHostsForNode(client *ssh.Client) (bool, error) {
+	current, err := client.Run("cat " + hostsFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", hostsFile, err)
+	}
+
+	updated := replaceHostsBlock(current, m.InterfaceName, m.hostsEntries())
+	if updated == current {
+		return false, nil
+	}
+	if err := client.WriteFile(hostsFile, []byte(updated), 0644); err != nil {
+		return false, fmt.Errorf("failed to write %s: %w", hostsFile, err)
+	}
+	client.Printf("  Updated mesh hosts entries in %s\n", hostsFile)
+	return true, nil
+}
@@ -93,7 +93,7 @@ func (m *Mesh) AddNode(nodeSpec string) error {
 	}
 
 	sshHost := parts[2]
-	sshPort := 22
+	sshPort := 0 // from ~/.ssh/config, or 22
 	if len(parts) >= 4 {
 		if _, err := fmt.Sscanf(parts[3], "%d", &sshPort); err != nil {
 			return fmt.Errorf("invalid SSH port: %s", parts[3])
@@ -156,7 +156,17 @@ func (m *Mesh) List() {
 
 		fmt.Printf("  %s%s%s:\n", hostname, localMarker, natMarker)
 		fmt.Printf("    Mesh IP: %s\n", node.MeshIP)
-		fmt.Printf("    SSH: %s:%d\n", node.SSHHost, node.SSHPort)
+		if node.SSHPort != 0 {
+			fmt.Printf("    SSH: %s:%d\n", node.SSHHost, node.SSHPort)
+		} else {
+			fmt.Printf("    SSH: %s\n", node.SSHHost)
+		}
+		if node.SSHUser != "" {
+			fmt.Printf("    SSH User: %s\n", node.SSHUser)
+		}
+		if node.SSHProxyJump != "" {
+			fmt.Printf("    SSH Jump: %s\n", node.SSHProxyJump)
+		}
 		fmt.Printf("    Public Key: %s\n", node.PublicKey)
 		if node.PublicEndpoint != "" {
 			fmt.Printf("    Endpoint: %s\n", node.PublicEndpoint)
@@ -164,6 +174,13 @@ func (m *Mesh) List() {
 		if len(node.RoutableNetworks) > 0 {
 			fmt.Printf("    Routable Networks: %v\n", node.RoutableNetworks)
 		}
+		if len(node.Tags) > 0 {
+			fmt.Printf("    Tags: %s\n", strings.Join(node.Tags, ", "))
+		}
 		fmt.Println()
 	}
+
+	if m.ACLPolicy != nil {
+		fmt.Printf("ACL Policy: %d rules\n", len(m.ACLPolicy.Rules))
+	}
 }
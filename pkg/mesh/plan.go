@@ -0,0 +1,392 @@
+package mesh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/ssh"
+	"github.com/atvirokodosprendimai/wgmesh/pkg/wireguard"
+)
+
+// Plan lists the WireGuard, route and file changes a deployment would make
+type Plan struct {
+	CreatedAt time.Time  `json:"created_at"`
+	Interface string     `json:"interface"`
+	Nodes     []NodePlan `json:"nodes"`
+}
+
+// NodePlan lists the changes for one node
+type NodePlan struct {
+	Hostname string `json:"hostname"`
+	Error    string `json:"error,omitempty"`
+
+	// NewInterface means the interface doesn't exist yet and wg-quick brings it up
+	NewInterface bool `json:"new_interface,omitempty"`
+	// FullRestart means wg-quick is restarted instead of updating peers online
+	FullRestart bool `json:"full_restart"`
+
+	PeersAdded    []PeerChange `json:"peers_added,omitempty"`
+	PeersRemoved  []PeerChange `json:"peers_removed,omitempty"`
+	PeersModified []PeerChange `json:"peers_modified,omitempty"`
+	RoutesAdded   []string     `json:"routes_added,omitempty"`
+	RoutesRemoved []string     `json:"routes_removed,omitempty"`
+
+	// Files are the wg-quick config, hosts file and ACL rules that would be
+	// written or removed
+	Files []FileChange `json:"files,omitempty"`
+}
+
+// FileChange is a file written or removed on a node
+type FileChange struct {
+	Path string `json:"path"`
+	// SHA256 is the hash of the new content, so applying a plan notices
+	// when the content changed since; empty if the file is removed
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// PeerChange is a peer added, removed or modified on a node
+type PeerChange struct {
+	PublicKey string   `json:"public_key"`
+	Hostname  string   `json:"hostname,omitempty"` // empty for peers unknown to the mesh state
+	Changes   []string `json:"changes,omitempty"`  // "field: old -> new" for modified peers
+}
+
+// HasChanges reports whether deploying the node would change anything
+func (p *NodePlan) HasChanges() bool {
+	return p.NewInterface || p.FullRestart || len(p.PeersAdded) > 0 || len(p.PeersRemoved) > 0 ||
+		len(p.PeersModified) > 0 || len(p.RoutesAdded) > 0 || len(p.RoutesRemoved) > 0 || len(p.Files) > 0
+}
+
+// Plan connects to all nodes and computes what Deploy would change, without
+// applying anything
+func (m *Mesh) Plan(opts DeployOptions) *Plan {
+	parallel := opts.Parallel
+	if parallel < 1 {
+		parallel = DefaultDeployParallel
+	}
+
+	clients, connErrs := m.connectAll(parallel)
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
+
+	m.detectEndpoints(clients, parallel)
+	return m.planAll(clients, connErrs, parallel)
+}
+
+// LoadPlan reads a plan saved with Save
+func LoadPlan(path string) (*Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plan: %w", err)
+	}
+
+	var plan Plan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("failed to parse plan: %w", err)
+	}
+	return &plan, nil
+}
+
+// Save writes the plan as JSON
+func (p *Plan) Save(path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal plan: %w", err)
+	}
+	return os.WriteFile(path, append(data, '\n'), 0600)
+}
+
+// Print writes the plan in human-readable form
+func (p *Plan) Print(w io.Writer) {
+	changed, unchanged, failed := 0, 0, 0
+	for _, node := range p.Nodes {
+		fmt.Fprintf(w, "%s:\n", node.Hostname)
+		switch {
+		case node.Error != "":
+			failed++
+			fmt.Fprintf(w, "  ✗ Could not plan: %s\n\n", node.Error)
+			continue
+		case !node.HasChanges():
+			unchanged++
+			fmt.Fprintf(w, "  No changes\n\n")
+			continue
+		}
+		changed++
+
+		switch {
+		case node.NewInterface:
+			fmt.Fprintf(w, "  WireGuard: new interface, wg-quick will bring up %s\n", p.Interface)
+		case node.FullRestart:
+			fmt.Fprintf(w, "  WireGuard: full wg-quick restart of %s\n", p.Interface)
+		case len(node.PeersAdded) > 0 || len(node.PeersRemoved) > 0 || len(node.PeersModified) > 0:
+			fmt.Fprintf(w, "  WireGuard: online update, no restart\n")
+		}
+		for _, peer := range node.PeersAdded {
+			fmt.Fprintf(w, "  + peer %s\n", peer.label())
+		}
+		for _, peer := range node.PeersRemoved {
+			fmt.Fprintf(w, "  - peer %s\n", peer.label())
+		}
+		for _, peer := range node.PeersModified {
+			fmt.Fprintf(w, "  ~ peer %s\n", peer.label())
+			for _, change := range peer.Changes {
+				fmt.Fprintf(w, "      %s\n", change)
+			}
+		}
+		for _, route := range node.RoutesAdded {
+			fmt.Fprintf(w, "  + route %s\n", route)
+		}
+		for _, route := range node.RoutesRemoved {
+			fmt.Fprintf(w, "  - route %s\n", route)
+		}
+		for _, file := range node.Files {
+			if file.SHA256 == "" {
+				fmt.Fprintf(w, "  - file %s\n", file.Path)
+			} else {
+				fmt.Fprintf(w, "  ~ file %s\n", file.Path)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "%d to change, %d unchanged, %d could not be planned\n", changed, unchanged, failed)
+}
+
+func (c PeerChange) label() string {
+	if c.Hostname == "" {
+		return c.PublicKey
+	}
+	return fmt.Sprintf("%s (%s)", c.Hostname, c.PublicKey)
+}
+
+// checkPlan recomputes the plan over the open connections and returns an
+// error naming the nodes whose changes differ from the saved plan
+func (m *Mesh) checkPlan(plan *Plan, clients map[string]*ssh.Client, connErrs map[string]error, parallel int) error {
+	if plan.Interface != m.InterfaceName {
+		return fmt.Errorf("plan is for interface %s, the mesh uses %s", plan.Interface, m.InterfaceName)
+	}
+
+	current := m.planAll(clients, connErrs, parallel)
+	if drifted := planDrift(plan, current); len(drifted) > 0 {
+		return fmt.Errorf("state changed since the plan was made on %s: %s", plan.CreatedAt.Format(time.RFC3339), strings.Join(drifted, ", "))
+	}
+	return nil
+}
+
+// planDrift returns the sorted hostnames whose changes differ between the
+// saved plan and the current one. A node that could not be planned only
+// counts as changed if it now can be, or the other way round: the error text
+// (e.g. a connection timeout) may differ from run to run.
+func planDrift(plan, current *Plan) []string {
+	planned := make(map[string]NodePlan, len(plan.Nodes))
+	for _, node := range plan.Nodes {
+		planned[node.Hostname] = node
+	}
+
+	var drifted []string
+	for _, node := range current.Nodes {
+		old, ok := planned[node.Hostname]
+		if !ok {
+			drifted = append(drifted, node.Hostname+" (not in plan)")
+			continue
+		}
+		delete(planned, node.Hostname)
+		if (old.Error != "") != (node.Error != "") {
+			drifted = append(drifted, node.Hostname)
+			continue
+		}
+		old.Error, node.Error = "", ""
+		if !reflect.DeepEqual(old, node) {
+			drifted = append(drifted, node.Hostname)
+		}
+	}
+	for hostname := range planned {
+		drifted = append(drifted, hostname+" (no longer in mesh)")
+	}
+
+	sort.Strings(drifted)
+	return drifted
+}
+
+// planAll plans every node over the open connections
+func (m *Mesh) planAll(clients map[string]*ssh.Client, connErrs map[string]error, parallel int) *Plan {
+	hostnames := m.sortedHostnames()
+	plan := &Plan{
+		CreatedAt: time.Now().UTC(),
+		Interface: m.InterfaceName,
+		Nodes:     make([]NodePlan, len(hostnames)),
+	}
+
+	forEachNode(hostnames, parallel, func(i int, hostname string) {
+		client := clients[hostname]
+		if client == nil {
+			plan.Nodes[i] = NodePlan{Hostname: hostname, Error: connErrs[hostname].Error()}
+			return
+		}
+		plan.Nodes[i] = m.planNode(client, m.Nodes[hostname])
+	})
+
+	return plan
+}
+
+// planNode computes the changes deployNode would make on one node
+func (m *Mesh) planNode(client *ssh.Client, node *Node) NodePlan {
+	plan := NodePlan{Hostname: node.Hostname}
+	fullConfig := m.generateConfigForNode(node)
+	desired := wireguard.FullConfigToConfig(fullConfig)
+	desiredRoutes := m.collectAllRoutesForNode(node)
+	configPath := fmt.Sprintf("/etc/wireguard/%s.conf", m.InterfaceName)
+	configContent := wireguard.GenerateWgQuickConfig(fullConfig, desiredRoutes)
+
+	hostnames := make(map[string]string)
+	for hostname, n := range m.Nodes {
+		hostnames[n.PublicKey] = hostname
+	}
+
+	currentConfig, err := wireguard.GetCurrentConfig(client, m.InterfaceName)
+	if err != nil {
+		// Same as deployNode: a fresh persistent config is applied
+		plan.NewInterface = true
+		plan.FullRestart = true
+		for key := range desired.Peers {
+			plan.PeersAdded = append(plan.PeersAdded, PeerChange{PublicKey: key, Hostname: hostnames[key]})
+		}
+		for _, route := range desiredRoutes {
+			plan.RoutesAdded = append(plan.RoutesAdded, formatRoute(route))
+		}
+		plan.Files = append(plan.Files, fileChange(configPath, configContent))
+		if err := m.planFiles(client, node, &plan); err != nil {
+			plan.Error = err.Error()
+		}
+		sortPlan(&plan)
+		return plan
+	}
+
+	diff := wireguard.CalculateDiff(currentConfig, desired)
+	if diff.HasChanges() {
+		plan.FullRestart = diff.NeedsRestart()
+	}
+	for key := range diff.AddedPeers {
+		plan.PeersAdded = append(plan.PeersAdded, PeerChange{PublicKey: key, Hostname: hostnames[key]})
+	}
+	for _, key := range diff.RemovedPeers {
+		plan.PeersRemoved = append(plan.PeersRemoved, PeerChange{PublicKey: key, Hostname: hostnames[key]})
+	}
+	for key, peer := range diff.ModifiedPeers {
+		plan.PeersModified = append(plan.PeersModified, PeerChange{
+			PublicKey: key,
+			Hostname:  hostnames[key],
+			Changes:   peerChanges(currentConfig.Peers[key], peer),
+		})
+	}
+
+	currentRoutes, err := ssh.GetCurrentRoutes(client, m.InterfaceName)
+	if err != nil {
+		plan.Error = fmt.Sprintf("failed to get current routes: %v", err)
+		sortPlan(&plan)
+		return plan
+	}
+	toAdd, toRemove := ssh.CalculateRouteDiff(currentRoutes, desiredRoutes)
+	for _, route := range toAdd {
+		plan.RoutesAdded = append(plan.RoutesAdded, formatRoute(route))
+	}
+	for _, route := range toRemove {
+		plan.RoutesRemoved = append(plan.RoutesRemoved, formatRoute(route))
+	}
+
+	// Same as deployNode: the config file is rewritten if it differs
+	if current, err := client.Run("cat " + configPath); err != nil || current != configContent {
+		plan.Files = append(plan.Files, fileChange(configPath, configContent))
+	}
+	if err := m.planFiles(client, node, &plan); err != nil {
+		plan.Error = err.Error()
+	}
+
+	sortPlan(&plan)
+	return plan
+}
+
+// planFiles adds the hosts file and ACL rules deployNode would rewrite
+func (m *Mesh) planFiles(client *ssh.Client, node *Node, plan *NodePlan) error {
+	current, err := client.Run("cat " + hostsFile)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", hostsFile, err)
+	}
+	if updated := replaceHostsBlock(current, m.InterfaceName, m.hostsEntries()); updated != current {
+		plan.Files = append(plan.Files, fileChange(hostsFile, updated))
+	}
+
+	path := m.aclScriptPath()
+	if m.ACLPolicy == nil {
+		if client.RunQuiet("test -f "+path) == nil {
+			plan.Files = append(plan.Files, FileChange{Path: path})
+		}
+		return nil
+	}
+	script := m.firewallScript(node)
+	if current, err := client.Run("cat " + path); err != nil || current != script {
+		plan.Files = append(plan.Files, fileChange(path, script))
+	}
+	return nil
+}
+
+func fileChange(path, content string) FileChange {
+	sum := sha256.Sum256([]byte(content))
+	return FileChange{Path: path, SHA256: hex.EncodeToString(sum[:])}
+}
+
+// peerChanges describes the fields that differ between two versions of a peer
+func peerChanges(current, desired wireguard.Peer) []string {
+	var changes []string
+	if current.Endpoint != desired.Endpoint {
+		changes = append(changes, fmt.Sprintf("endpoint: %s -> %s", orNone(current.Endpoint), orNone(desired.Endpoint)))
+	}
+	if current.PersistentKeepalive != desired.PersistentKeepalive {
+		changes = append(changes, fmt.Sprintf("keepalive: %d -> %d", current.PersistentKeepalive, desired.PersistentKeepalive))
+	}
+	currentIPs := sortedCopy(current.AllowedIPs)
+	desiredIPs := sortedCopy(desired.AllowedIPs)
+	if !reflect.DeepEqual(currentIPs, desiredIPs) {
+		changes = append(changes, fmt.Sprintf("allowed-ips: %s -> %s", orNone(strings.Join(currentIPs, ",")), orNone(strings.Join(desiredIPs, ","))))
+	}
+	return changes
+}
+
+func formatRoute(route ssh.RouteEntry) string {
+	if route.Gateway == "" {
+		return route.Network
+	}
+	return fmt.Sprintf("%s via %s", route.Network, route.Gateway)
+}
+
+func sortPlan(plan *NodePlan) {
+	for _, peers := range [][]PeerChange{plan.PeersAdded, plan.PeersRemoved, plan.PeersModified} {
+		sort.Slice(peers, func(i, j int) bool { return peers[i].PublicKey < peers[j].PublicKey })
+	}
+	sort.Strings(plan.RoutesAdded)
+	sort.Strings(plan.RoutesRemoved)
+	sort.Slice(plan.Files, func(i, j int) bool { return plan.Files[i].Path < plan.Files[j].Path })
+}
+
+func sortedCopy(values []string) []string {
+	sorted := append([]string{}, values...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "(none)"
+	}
+	return value
+}
@@ -0,0 +1,113 @@
+package mesh
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testPlan() *Plan {
+	return &Plan{
+		CreatedAt: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC),
+		Interface: "wg0",
+		Nodes: []NodePlan{
+			{
+				Hostname:   "node-a",
+				PeersAdded: []PeerChange{{PublicKey: "key-b", Hostname: "node-b"}},
+				PeersModified: []PeerChange{{
+					PublicKey: "key-c",
+					Hostname:  "node-c",
+					Changes:   []string{"endpoint: (none) -> 192.0.2.3:51820"},
+				}},
+				RoutesAdded: []string{"192.168.2.0/24 via 10.99.0.2"},
+				Files:       []FileChange{fileChange("/etc/wireguard/wg0.conf", "[Interface]\n")},
+			},
+			{Hostname: "node-b"},
+			{Hostname: "node-c", Error: "failed to connect: timeout"},
+		},
+	}
+}
+
+// savedPlan writes the plan to disk and loads it back, as plan and apply do
+func savedPlan(t *testing.T, plan *Plan) *Plan {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "plan.json")
+	if err := plan.Save(path); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	loaded, err := LoadPlan(path)
+	if err != nil {
+		t.Fatalf("LoadPlan failed: %v", err)
+	}
+	return loaded
+}
+
+func TestPlanDriftRoundTrip(t *testing.T) {
+	loaded := savedPlan(t, testPlan())
+	if drifted := planDrift(loaded, testPlan()); len(drifted) > 0 {
+		t.Errorf("Unchanged plan drifted after save and load: %v", drifted)
+	}
+
+	// Only the presence of an error matters, not its text
+	current := testPlan()
+	current.Nodes[2].Error = "failed to connect: connection refused"
+	if drifted := planDrift(loaded, current); len(drifted) > 0 {
+		t.Errorf("Different error text counted as drift: %v", drifted)
+	}
+
+	current.Nodes[2].Error = ""
+	if drifted := planDrift(loaded, current); !reflect.DeepEqual(drifted, []string{"node-c"}) {
+		t.Errorf("Node that can now be planned: drifted = %v, want [node-c]", drifted)
+	}
+}
+
+func TestPlanDriftChanges(t *testing.T) {
+	loaded := savedPlan(t, testPlan())
+
+	current := testPlan()
+	current.Nodes[0].PeersModified[0].Changes = []string{"endpoint: (none) -> 192.0.2.4:51820"}
+	if drifted := planDrift(loaded, current); !reflect.DeepEqual(drifted, []string{"node-a"}) {
+		t.Errorf("Changed peer: drifted = %v, want [node-a]", drifted)
+	}
+
+	current = testPlan()
+	current.Nodes[0].Files[0] = fileChange("/etc/wireguard/wg0.conf", "[Interface]\nListenPort = 51821\n")
+	if drifted := planDrift(loaded, current); !reflect.DeepEqual(drifted, []string{"node-a"}) {
+		t.Errorf("Changed file hash: drifted = %v, want [node-a]", drifted)
+	}
+
+	current = testPlan()
+	current.Nodes[1].Hostname = "node-d"
+	want := []string{"node-b (no longer in mesh)", "node-d (not in plan)"}
+	if drifted := planDrift(loaded, current); !reflect.DeepEqual(drifted, want) {
+		t.Errorf("Changed nodes: drifted = %v, want %v", drifted, want)
+	}
+}
+
+func TestCheckPlanUnreachableNodes(t *testing.T) {
+	m := &Mesh{InterfaceName: "wg0", Nodes: map[string]*Node{
+		"node-a": {Hostname: "node-a"},
+		"node-b": {Hostname: "node-b"},
+	}}
+	plan := m.planAll(nil, map[string]error{
+		"node-a": errors.New("failed to connect: timeout"),
+		"node-b": errors.New("failed to connect: timeout"),
+	}, 2)
+	loaded := savedPlan(t, plan)
+
+	connErrs := map[string]error{
+		"node-a": errors.New("failed to connect: connection refused"),
+		"node-b": errors.New("failed to connect: no route to host"),
+	}
+	if err := m.checkPlan(loaded, nil, connErrs, 2); err != nil {
+		t.Errorf("checkPlan() = %v, want no drift", err)
+	}
+
+	m.InterfaceName = "wg1"
+	if err := m.checkPlan(loaded, nil, connErrs, 2); err == nil || !strings.Contains(err.Error(), "plan is for interface wg0") {
+		t.Errorf("checkPlan() with another interface = %v", err)
+	}
+}
@@ -2,6 +2,9 @@ package mesh
 
 import (
 	"net"
+	"sync"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/acl"
 )
 
 type Node struct {
@@ -10,8 +13,14 @@ type Node struct {
 	PublicKey  string `json:"public_key"`
 	PrivateKey string `json:"private_key,omitempty"`
 
-	SSHHost string `json:"ssh_host"`
-	SSHPort int    `json:"ssh_port"`
+	SSHHost    string `json:"ssh_host"`
+	SSHPort    int    `json:"ssh_port"` // 0 uses ~/.ssh/config, then 22
+	SSHHostKey string `json:"ssh_host_key,omitempty"` // pinned on first connect
+
+	// Empty values fall back to ~/.ssh/config, then root with the default keys
+	SSHUser      string `json:"ssh_user,omitempty"`
+	SSHIdentity  string `json:"ssh_identity,omitempty"`
+	SSHProxyJump string `json:"ssh_proxy_jump,omitempty"` // [user@]host[:port],... as in ssh -J
 
 	PublicEndpoint string `json:"public_endpoint,omitempty"`
 	ListenPort     int    `json:"listen_port"`
@@ -20,6 +29,8 @@ type Node struct {
 
 	RoutableNetworks []string `json:"routable_networks,omitempty"`
 
+	Tags []string `json:"tags,omitempty"`
+
 	IsLocal bool `json:"is_local"`
 }
 
@@ -29,4 +40,8 @@ type Mesh struct {
 	ListenPort    int              `json:"listen_port"`
 	Nodes         map[string]*Node `json:"nodes"`
 	LocalHostname string           `json:"local_hostname"`
+	ACLPolicy     *acl.Policy      `json:"acl_policy,omitempty"`
+
+	mu          sync.Mutex
+	pinnedHosts []string // nodes whose host key was pinned in this run
 }
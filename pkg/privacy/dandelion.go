@@ -5,6 +5,7 @@ import (
 	cryptorand "crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"log"
 	"math/big"
@@ -34,6 +35,10 @@ type DandelionAnnounce struct {
 	HopCount         uint8    `json:"hop_count"`
 	Timestamp        int64    `json:"timestamp"`
 	Nonce            []byte   `json:"nonce"`
+
+	// Announcement is the origin's own signed announcement. Relays cannot sign
+	// for the origin, so it is rebroadcast unchanged when the message fluffs.
+	Announcement json.RawMessage `json:"announcement,omitempty"`
 }
 
 // PeerInfo represents a minimal peer info for relay selection
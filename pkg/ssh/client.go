@@ -6,6 +6,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,18 +15,128 @@ import (
 )
 
 type Client struct {
-	conn *ssh.Client
+	conn  *ssh.Client
+	jumps []*ssh.Client // jump host connections, closed with the client
+	sudo  bool          // not logged in as root, commands run with sudo
+	out   io.Writer     // progress messages, os.Stdout if nil
 }
 
-func NewClient(host string, port int) (*Client, error) {
-	var authMethods []ssh.AuthMethod
+// ClientOptions controls how a client connects. Empty fields fall back to
+// ~/.ssh/config and then to root with the default keys over a direct connection.
+type ClientOptions struct {
+	HostKeys HostKeyPolicy
+
+	// User to log in as. Users other than root run all commands with sudo.
+	User string
+	// IdentityFiles are the private keys to try instead of the default ones
+	IdentityFiles []string
+	// ProxyJump lists jump hosts as in ssh -J: [user@]host[:port],...
+	// "none" connects directly even if ~/.ssh/config sets a jump host.
+	ProxyJump string
+}
+
+// jumpHost is one hop of a ProxyJump chain
+type jumpHost struct {
+	user string
+	host string
+	port int
+}
 
+// NewClient connects to host. A port of 0 uses the Port from ~/.ssh/config,
+// or 22.
+func NewClient(host string, port int, opts ClientOptions) (*Client, error) {
+	target := UserConfig().Lookup(host)
+	if port == 0 {
+		port = target.Port
+	}
+	if port == 0 {
+		port = 22
+	}
+	user := firstNonEmpty(opts.User, target.User, "root")
+	identities := opts.IdentityFiles
+	if len(identities) == 0 {
+		identities = target.IdentityFiles
+	}
+	hostname := firstNonEmpty(target.HostName, host)
+
+	jumps, err := parseProxyJump(firstNonEmpty(opts.ProxyJump, target.ProxyJump))
+	if err != nil {
+		return nil, err
+	}
+
+	var agentSigners func() ([]ssh.Signer, error)
 	if sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK")); err == nil {
-		authMethods = append(authMethods, ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers))
+		agentSigners = agent.NewClient(sshAgent).Signers
 	}
 
-	homeDir, err := os.UserHomeDir()
-	if err == nil {
+	client := &Client{sudo: user != "root"}
+	var via *ssh.Client
+	for _, jump := range jumps {
+		jumpConfig := UserConfig().Lookup(jump.host)
+		jumpPort := jump.port
+		if jumpPort == 0 {
+			jumpPort = jumpConfig.Port
+		}
+		if jumpPort == 0 {
+			jumpPort = 22
+		}
+		jumpHostname := firstNonEmpty(jumpConfig.HostName, jump.host)
+
+		// Jump hosts are not pinned in the mesh state, they must be in known_hosts
+		policy := HostKeyPolicy{KnownHostsFiles: opts.HostKeys.KnownHostsFiles}
+		config, err := clientConfig(firstNonEmpty(jump.user, jumpConfig.User, user), jumpConfig.IdentityFiles, agentSigners, policy, jumpHostname, jumpPort)
+		if err != nil {
+			client.closeJumps()
+			return nil, fmt.Errorf("jump host %s: %w", jump.host, err)
+		}
+
+		conn, err := dial(via, jumpHostname, jumpPort, config)
+		if err != nil {
+			client.closeJumps()
+			return nil, fmt.Errorf("failed to connect to jump host %s: %w", jump.host, err)
+		}
+		client.jumps = append(client.jumps, conn)
+		via = conn
+	}
+
+	config, err := clientConfig(user, identities, agentSigners, opts.HostKeys, hostname, port)
+	if err != nil {
+		client.closeJumps()
+		return nil, err
+	}
+
+	conn, err := dial(via, hostname, port, config)
+	if err != nil {
+		client.closeJumps()
+		return nil, fmt.Errorf("failed to dial SSH: %w", err)
+	}
+	client.conn = conn
+
+	return client, nil
+}
+
+// clientConfig builds the SSH config for one hop. Without identity files the
+// default keys in ~/.ssh are tried.
+func clientConfig(user string, identities []string, agentSigners func() ([]ssh.Signer, error), policy HostKeyPolicy, host string, port int) (*ssh.ClientConfig, error) {
+	var authMethods []ssh.AuthMethod
+
+	if agentSigners != nil {
+		authMethods = append(authMethods, ssh.PublicKeysCallback(agentSigners))
+	}
+
+	if len(identities) > 0 {
+		for _, keyPath := range identities {
+			key, err := os.ReadFile(expandPath(keyPath))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read identity file: %w", err)
+			}
+			signer, err := ssh.ParsePrivateKey(key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse identity file %s: %w", keyPath, err)
+			}
+			authMethods = append(authMethods, ssh.PublicKeys(signer))
+		}
+	} else if homeDir, err := os.UserHomeDir(); err == nil {
 		keyPaths := []string{
 			filepath.Join(homeDir, ".ssh", "id_rsa"),
 			filepath.Join(homeDir, ".ssh", "id_ed25519"),
@@ -41,24 +152,125 @@ func NewClient(host string, port int) (*Client, error) {
 		}
 	}
 
-	config := &ssh.ClientConfig{
-		User:            "root",
-		Auth:            authMethods,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         10 * time.Second,
+	hostKeyCallback, hostKeyAlgorithms, err := policy.callback(host, port)
+	if err != nil {
+		return nil, err
 	}
 
-	addr := fmt.Sprintf("%s:%d", host, port)
-	conn, err := ssh.Dial("tcp", addr, config)
+	return &ssh.ClientConfig{
+		User:              user,
+		Auth:              authMethods,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms,
+		Timeout:           10 * time.Second,
+	}, nil
+}
+
+// dial connects to host:port directly, or through via if it is set
+func dial(via *ssh.Client, host string, port int, config *ssh.ClientConfig) (*ssh.Client, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	if via == nil {
+		return ssh.Dial("tcp", addr, config)
+	}
+
+	conn, err := via.Dial("tcp", addr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to dial SSH: %w", err)
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// parseProxyJump parses a comma-separated list of [user@]host[:port]
+func parseProxyJump(value string) ([]jumpHost, error) {
+	if value == "" || value == "none" {
+		return nil, nil
+	}
+
+	var jumps []jumpHost
+	for _, hop := range strings.Split(value, ",") {
+		hop = strings.TrimPrefix(strings.TrimSpace(hop), "ssh://")
+		var jump jumpHost
+		if user, rest, ok := strings.Cut(hop, "@"); ok {
+			jump.user = user
+			hop = rest
+		}
+		jump.host = hop
+		if host, port, err := net.SplitHostPort(hop); err == nil {
+			jump.host = host
+			if jump.port, err = strconv.Atoi(port); err != nil {
+				return nil, fmt.Errorf("invalid jump host port in %q", hop)
+			}
+		}
+		if jump.host == "" {
+			return nil, fmt.Errorf("invalid jump host %q", value)
+		}
+		jumps = append(jumps, jump)
+	}
+	return jumps, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
 	}
+	return ""
+}
+
+// SetOutput redirects the progress messages printed for this host, e.g. to
+// buffer them while several nodes are deployed at once
+func (c *Client) SetOutput(w io.Writer) {
+	c.out = w
+}
+
+// Printf prints a progress message for this host
+func (c *Client) Printf(format string, args ...interface{}) {
+	fmt.Fprintf(c.output(), format, args...)
+}
+
+// Println prints a progress message line for this host
+func (c *Client) Println(args ...interface{}) {
+	fmt.Fprintln(c.output(), args...)
+}
 
-	return &Client{conn: conn}, nil
+func (c *Client) output() io.Writer {
+	if c.out == nil {
+		return os.Stdout
+	}
+	return c.out
 }
 
 func (c *Client) Close() error {
-	return c.conn.Close()
+	err := c.conn.Close()
+	c.closeJumps()
+	return err
+}
+
+// closeJumps closes the jump host connections, the last hop first
+func (c *Client) closeJumps() {
+	for i := len(c.jumps) - 1; i >= 0; i-- {
+		c.jumps[i].Close()
+	}
+}
+
+// command wraps cmd with sudo when not logged in as root. The whole command
+// line runs in one shell, so pipes and redirections are privileged too.
+func (c *Client) command(cmd string) string {
+	if !c.sudo {
+		return cmd
+	}
+	return "sudo -n sh -c " + shellQuote(cmd)
+}
+
+// shellQuote quotes s as a single sh word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
 }
 
 func (c *Client) Run(cmd string) (string, error) {
@@ -68,7 +280,7 @@ func (c *Client) Run(cmd string) (string, error) {
 	}
 	defer session.Close()
 
-	output, err := session.CombinedOutput(cmd)
+	output, err := session.CombinedOutput(c.command(cmd))
 	if err != nil {
 		return string(output), fmt.Errorf("command failed: %w", err)
 	}
@@ -83,7 +295,7 @@ func (c *Client) RunQuiet(cmd string) error {
 	}
 	defer session.Close()
 
-	return session.Run(cmd)
+	return session.Run(c.command(cmd))
 }
 
 func (c *Client) WriteFile(path string, content []byte, mode os.FileMode) error {
@@ -98,7 +310,7 @@ func (c *Client) WriteFile(path string, content []byte, mode os.FileMode) error
 		return fmt.Errorf("failed to get stdin: %w", err)
 	}
 
-	if err := session.Start(fmt.Sprintf("cat > %s && chmod %o %s", path, mode, path)); err != nil {
+	if err := session.Start(c.command(fmt.Sprintf("cat > %s && chmod %o %s", path, mode, path))); err != nil {
 		return fmt.Errorf("failed to start command: %w", err)
 	}
 
@@ -0,0 +1,65 @@
+package ssh
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseProxyJump(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []jumpHost
+		wantErr bool
+	}{
+		{value: "", want: nil},
+		{value: "none", want: nil},
+		{value: "bastion", want: []jumpHost{{host: "bastion"}}},
+		{value: "admin@bastion:2222", want: []jumpHost{{user: "admin", host: "bastion", port: 2222}}},
+		{value: "ssh://admin@bastion", want: []jumpHost{{user: "admin", host: "bastion"}}},
+		{value: "[2001:db8::1]:2222", want: []jumpHost{{host: "2001:db8::1", port: 2222}}},
+		{
+			value: "a@first, second:22",
+			want:  []jumpHost{{user: "a", host: "first"}, {host: "second", port: 22}},
+		},
+		{value: "bastion:ssh", wantErr: true},
+		{value: "admin@", wantErr: true},
+		{value: "first,,second", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseProxyJump(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseProxyJump failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseProxyJump(%q) = %+v, want %+v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", `''`},
+		{"plain", `'plain'`},
+		{"with space", `'with space'`},
+		{"$(rm -rf /); `id`", "'$(rm -rf /); `id`'"},
+		{"it's", `'it'\''s'`},
+	}
+
+	for _, tt := range tests {
+		if got := shellQuote(tt.in); got != tt.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package ssh
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// HostConfig holds the settings of ~/.ssh/config that apply to one host
+type HostConfig struct {
+	HostName      string
+	User          string
+	Port          int
+	IdentityFiles []string
+	ProxyJump     string
+}
+
+// Config is a parsed OpenSSH client config. Only Host blocks and the
+// HostName, User, Port, IdentityFile and ProxyJump keywords are supported;
+// Match blocks never apply.
+type Config struct {
+	blocks []configBlock
+}
+
+type configBlock struct {
+	patterns []string // nil for settings before the first Host line
+	match    bool     // Match block, not supported
+	settings [][2]string
+}
+
+var (
+	userConfigOnce sync.Once
+	userConfig     *Config
+)
+
+// UserConfig returns ~/.ssh/config, or an empty config if it is missing or
+// cannot be parsed
+func UserConfig() *Config {
+	userConfigOnce.Do(func() {
+		userConfig = &Config{}
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return
+		}
+		config, err := LoadConfig(filepath.Join(homeDir, ".ssh", "config"))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				fmt.Printf("Warning: ignoring ~/.ssh/config: %v\n", err)
+			}
+			return
+		}
+		userConfig = config
+	})
+	return userConfig
+}
+
+// LoadConfig parses an OpenSSH client config file
+func LoadConfig(file string) (*Config, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config := &Config{blocks: []configBlock{{}}}
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := splitConfigLine(line)
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: invalid line %q", file, lineNum, line)
+		}
+
+		switch key {
+		case "host":
+			config.blocks = append(config.blocks, configBlock{patterns: strings.Fields(value)})
+		case "match":
+			config.blocks = append(config.blocks, configBlock{match: true})
+		default:
+			block := &config.blocks[len(config.blocks)-1]
+			block.settings = append(block.settings, [2]string{key, value})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// splitConfigLine splits "Keyword value" or "Keyword=value", lowercasing the
+// keyword and removing quotes around the value
+func splitConfigLine(line string) (string, string, bool) {
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return "", "", false
+	}
+	key := strings.ToLower(line[:i])
+	value := strings.TrimSpace(line[i:])
+	value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	return key, value, value != ""
+}
+
+// Lookup returns the settings for a host alias. As in ssh, the first value
+// found for a keyword wins, except IdentityFile which accumulates.
+func (c *Config) Lookup(alias string) HostConfig {
+	var hc HostConfig
+	for _, block := range c.blocks {
+		if !block.matches(alias) {
+			continue
+		}
+		for _, setting := range block.settings {
+			key, value := setting[0], setting[1]
+			switch key {
+			case "hostname":
+				if hc.HostName == "" {
+					hc.HostName = strings.ReplaceAll(value, "%h", alias)
+				}
+			case "user":
+				if hc.User == "" {
+					hc.User = value
+				}
+			case "port":
+				if hc.Port == 0 {
+					fmt.Sscanf(value, "%d", &hc.Port)
+				}
+			case "identityfile":
+				hc.IdentityFiles = append(hc.IdentityFiles, expandPath(value))
+			case "proxyjump":
+				if hc.ProxyJump == "" {
+					hc.ProxyJump = value
+				}
+			}
+		}
+	}
+	return hc
+}
+
+// matches reports whether a block applies to alias: one pattern must match
+// and no negated pattern may match
+func (b configBlock) matches(alias string) bool {
+	if b.match {
+		return false
+	}
+	if b.patterns == nil {
+		return true
+	}
+
+	alias = strings.ToLower(alias)
+	matched := false
+	for _, pattern := range b.patterns {
+		negate := strings.HasPrefix(pattern, "!")
+		pattern = strings.ToLower(strings.TrimPrefix(pattern, "!"))
+		if ok, _ := path.Match(pattern, alias); ok {
+			if negate {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// expandPath expands a leading ~ and %d to the home directory
+func expandPath(p string) string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		p = homeDir + p[1:]
+	}
+	return strings.ReplaceAll(p, "%d", homeDir)
+}
@@ -0,0 +1,130 @@
+package ssh
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadConfig(t *testing.T) {
+	file := writeConfig(t, `# global settings
+User admin
+
+Host web-*
+    HostName %h.example.com
+    Port=2222
+    IdentityFile "/keys/web"
+
+Match host db
+    User nobody
+`)
+
+	config, err := LoadConfig(file)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if len(config.blocks) != 3 {
+		t.Fatalf("Expected 3 blocks, got %d", len(config.blocks))
+	}
+	if config.blocks[0].patterns != nil {
+		t.Error("Settings before the first Host line should apply to all hosts")
+	}
+	if got := config.blocks[1].settings; !reflect.DeepEqual(got, [][2]string{
+		{"hostname", "%h.example.com"},
+		{"port", "2222"},
+		{"identityfile", "/keys/web"},
+	}) {
+		t.Errorf("Unexpected Host block settings: %v", got)
+	}
+	if !config.blocks[2].match {
+		t.Error("Match block should be marked")
+	}
+
+	if _, err := LoadConfig(writeConfig(t, "Host\n")); err == nil {
+		t.Error("Keyword without a value should fail")
+	}
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("Missing file should return a not-exist error, got %v", err)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, `Host web-* !web-internal
+    HostName %h.example.com
+    User deploy
+    Port 2222
+    IdentityFile /keys/web
+
+Host web-1
+    User other
+    Port 22
+    IdentityFile /keys/web-1
+    ProxyJump bastion
+
+Host db
+    HostName 10.0.0.5
+
+Match all
+    User ignored
+
+Host *
+    User root
+    IdentityFile /keys/default
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		alias string
+		want  HostConfig
+	}{
+		{
+			// First value wins, IdentityFile accumulates
+			alias: "web-1",
+			want: HostConfig{
+				HostName:      "web-1.example.com",
+				User:          "deploy",
+				Port:          2222,
+				IdentityFiles: []string{"/keys/web", "/keys/web-1", "/keys/default"},
+				ProxyJump:     "bastion",
+			},
+		},
+		{
+			alias: "WEB-2",
+			want: HostConfig{
+				HostName:      "WEB-2.example.com",
+				User:          "deploy",
+				Port:          2222,
+				IdentityFiles: []string{"/keys/web", "/keys/default"},
+			},
+		},
+		{
+			// Negated pattern excludes the host from the block
+			alias: "web-internal",
+			want:  HostConfig{User: "root", IdentityFiles: []string{"/keys/default"}},
+		},
+		{
+			alias: "db",
+			want:  HostConfig{HostName: "10.0.0.5", User: "root", IdentityFiles: []string{"/keys/default"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.alias, func(t *testing.T) {
+			if got := config.Lookup(tt.alias); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Lookup(%q) = %+v, want %+v", tt.alias, got, tt.want)
+			}
+		})
+	}
+}
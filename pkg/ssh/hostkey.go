@@ -0,0 +1,159 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyPolicy decides which host keys a client accepts
+type HostKeyPolicy struct {
+	// KnownHostsFiles are OpenSSH known_hosts files, missing ones are skipped
+	KnownHostsFiles []string
+
+	// Pinned is the key recorded for the host in authorized_keys format. If
+	// set, it is the only key accepted and known_hosts is not consulted.
+	Pinned string
+
+	// TrustNew is called with the key of a host that is neither pinned nor in
+	// a known_hosts file, and the key is accepted (trust on first use).
+	// Without it such hosts are rejected.
+	TrustNew func(key ssh.PublicKey)
+
+	// TrustAny passes any key to TrustNew and accepts it, ignoring Pinned
+	// and known_hosts. It is meant for deliberately re-pinning a host.
+	TrustAny bool
+}
+
+// HostKeyChangedError means a host presented a different key than the one
+// pinned or listed in known_hosts, e.g. because it was reinstalled or
+// because someone intercepts the connection
+type HostKeyChangedError struct {
+	Host     string
+	Got      string   // fingerprint of the presented key
+	Expected []string // fingerprints of the accepted keys and where they came from
+}
+
+func (e *HostKeyChangedError) Error() string {
+	return fmt.Sprintf("host key for %s changed: got %s, expected %s", e.Host, e.Got, strings.Join(e.Expected, ", "))
+}
+
+// DefaultKnownHostsFile returns ~/.ssh/known_hosts
+func DefaultKnownHostsFile() string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(homeDir, ".ssh", "known_hosts")
+}
+
+// FormatHostKey returns a key in authorized_keys format, as stored in Pinned
+func FormatHostKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// Fingerprint returns the SHA256 fingerprint of a key as shown by ssh-keygen
+func Fingerprint(key ssh.PublicKey) string {
+	return ssh.FingerprintSHA256(key)
+}
+
+// callback builds the host key callback for host:port. It also returns the
+// host key algorithms to negotiate, so a host with a known key of one type
+// isn't asked for a key of another type and then reported as changed.
+func (p HostKeyPolicy) callback(host string, port int) (ssh.HostKeyCallback, []string, error) {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+
+	if p.TrustAny {
+		callback := func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			if p.TrustNew != nil {
+				p.TrustNew(key)
+			}
+			return nil
+		}
+		return callback, nil, nil
+	}
+
+	if p.Pinned != "" {
+		pinned, _, _, _, err := ssh.ParseAuthorizedKey([]byte(p.Pinned))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid pinned host key: %w", err)
+		}
+		callback := func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			if keyEqual(key, pinned) {
+				return nil
+			}
+			return &HostKeyChangedError{
+				Host:     address,
+				Got:      Fingerprint(key),
+				Expected: []string{Fingerprint(pinned) + " (pinned in mesh state)"},
+			}
+		}
+		return callback, keyAlgorithms(pinned.Type()), nil
+	}
+
+	var files []string
+	for _, file := range p.KnownHostsFiles {
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+	known, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read known hosts: %w", err)
+	}
+
+	callback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := known(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		switch {
+		case err == nil:
+			return nil
+		case !errors.As(err, &keyErr):
+			return err
+		case len(keyErr.Want) > 0:
+			changed := &HostKeyChangedError{Host: address, Got: Fingerprint(key)}
+			for _, want := range keyErr.Want {
+				changed.Expected = append(changed.Expected, fmt.Sprintf("%s (%s:%d)", Fingerprint(want.Key), want.Filename, want.Line))
+			}
+			return changed
+		case p.TrustNew == nil:
+			return fmt.Errorf("unknown host key %s for %s", Fingerprint(key), address)
+		default:
+			p.TrustNew(key)
+			return nil
+		}
+	}
+
+	// Ask known_hosts which key types it has for the host by checking a key
+	// it can't contain
+	var algorithms []string
+	probe, _ := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	var keyErr *knownhosts.KeyError
+	if err := known(address, &net.TCPAddr{}, probe); errors.As(err, &keyErr) {
+		for _, want := range keyErr.Want {
+			algorithms = append(algorithms, keyAlgorithms(want.Key.Type())...)
+		}
+	}
+
+	return callback, algorithms, nil
+}
+
+// keyAlgorithms returns the host key algorithms that yield a key of keyType
+func keyAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+func keyEqual(a, b ssh.PublicKey) bool {
+	return string(a.Marshal()) == string(b.Marshal())
+}
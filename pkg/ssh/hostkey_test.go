@@ -0,0 +1,164 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func generateHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func writeKnownHosts(t *testing.T, lines ...string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// checkHostKey runs the policy's callback as the SSH handshake would
+func checkHostKey(t *testing.T, policy HostKeyPolicy, key ssh.PublicKey) error {
+	t.Helper()
+	callback, _, err := policy.callback("node1.example.com", 22)
+	if err != nil {
+		t.Fatalf("callback failed: %v", err)
+	}
+	return callback("node1.example.com:22", &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 22}, key)
+}
+
+func TestHostKeyPinned(t *testing.T) {
+	pinned := generateHostKey(t)
+	other := generateHostKey(t)
+	policy := HostKeyPolicy{Pinned: FormatHostKey(pinned)}
+
+	if err := checkHostKey(t, policy, pinned); err != nil {
+		t.Errorf("Pinned key should be accepted, got %v", err)
+	}
+
+	err := checkHostKey(t, policy, other)
+	var changed *HostKeyChangedError
+	if !errors.As(err, &changed) {
+		t.Fatalf("Expected HostKeyChangedError, got %v", err)
+	}
+	if changed.Got != Fingerprint(other) {
+		t.Errorf("Got = %s, want %s", changed.Got, Fingerprint(other))
+	}
+	if len(changed.Expected) != 1 || !strings.HasPrefix(changed.Expected[0], Fingerprint(pinned)) {
+		t.Errorf("Expected should name the pinned key, got %v", changed.Expected)
+	}
+
+	// The pinned key wins over known_hosts
+	policy.KnownHostsFiles = []string{writeKnownHosts(t, knownhosts.Line([]string{"node1.example.com"}, other))}
+	if err := checkHostKey(t, policy, other); !errors.As(err, &changed) {
+		t.Errorf("known_hosts should not override the pinned key, got %v", err)
+	}
+
+	if _, _, err := (HostKeyPolicy{Pinned: "not a key"}).callback("node1.example.com", 22); err == nil {
+		t.Error("Invalid pinned key should fail")
+	}
+}
+
+func TestHostKeyKnownHosts(t *testing.T) {
+	known := generateHostKey(t)
+	other := generateHostKey(t)
+	file := writeKnownHosts(t, knownhosts.Line([]string{"node1.example.com"}, known))
+	policy := HostKeyPolicy{KnownHostsFiles: []string{filepath.Join(t.TempDir(), "missing"), file}}
+
+	if err := checkHostKey(t, policy, known); err != nil {
+		t.Errorf("Key in known_hosts should be accepted, got %v", err)
+	}
+
+	trusted := false
+	policy.TrustNew = func(ssh.PublicKey) { trusted = true }
+	err := checkHostKey(t, policy, other)
+	var changed *HostKeyChangedError
+	if !errors.As(err, &changed) {
+		t.Fatalf("Expected HostKeyChangedError, got %v", err)
+	}
+	if len(changed.Expected) != 1 || !strings.Contains(changed.Expected[0], file+":1") {
+		t.Errorf("Expected should name the known_hosts line, got %v", changed.Expected)
+	}
+	if trusted {
+		t.Error("A changed key must not be trusted on first use")
+	}
+
+	_, algorithms, err := policy.callback("node1.example.com", 22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(algorithms, []string{ssh.KeyAlgoED25519}) {
+		t.Errorf("Algorithms = %v, want the type of the known key", algorithms)
+	}
+}
+
+func TestHostKeyTrustOnFirstUse(t *testing.T) {
+	key := generateHostKey(t)
+	file := writeKnownHosts(t, knownhosts.Line([]string{"other.example.com"}, generateHostKey(t)))
+
+	var recorded ssh.PublicKey
+	policy := HostKeyPolicy{
+		KnownHostsFiles: []string{file},
+		TrustNew:        func(k ssh.PublicKey) { recorded = k },
+	}
+	if err := checkHostKey(t, policy, key); err != nil {
+		t.Fatalf("Unknown host should be trusted on first use, got %v", err)
+	}
+	if recorded == nil || !keyEqual(recorded, key) {
+		t.Error("TrustNew should record the presented key")
+	}
+}
+
+func TestHostKeyUnknownRejected(t *testing.T) {
+	policy := HostKeyPolicy{KnownHostsFiles: []string{writeKnownHosts(t, knownhosts.Line([]string{"other.example.com"}, generateHostKey(t)))}}
+
+	err := checkHostKey(t, policy, generateHostKey(t))
+	if err == nil {
+		t.Fatal("Unknown host should be rejected without TrustNew")
+	}
+	var changed *HostKeyChangedError
+	if errors.As(err, &changed) {
+		t.Errorf("Unknown host should not be reported as changed: %v", err)
+	}
+	if !strings.Contains(err.Error(), "unknown host key") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestHostKeyTrustAny(t *testing.T) {
+	pinned := generateHostKey(t)
+	key := generateHostKey(t)
+
+	var recorded ssh.PublicKey
+	policy := HostKeyPolicy{
+		Pinned:   FormatHostKey(pinned),
+		TrustAny: true,
+		TrustNew: func(k ssh.PublicKey) { recorded = k },
+	}
+	if err := checkHostKey(t, policy, key); err != nil {
+		t.Fatalf("TrustAny should accept any key, got %v", err)
+	}
+	if recorded == nil || !keyEqual(recorded, key) {
+		t.Error("TrustAny should pass the key to TrustNew for re-pinning")
+	}
+}
@@ -0,0 +1,267 @@
+package ssh
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OSRelease holds the fields of /etc/os-release used to pick an install strategy
+type OSRelease struct {
+	ID         string
+	IDLike     []string
+	VersionID  string
+	PrettyName string
+}
+
+// MajorVersion returns the part of VERSION_ID before the first dot
+func (r *OSRelease) MajorVersion() string {
+	major, _, _ := strings.Cut(r.VersionID, ".")
+	return major
+}
+
+func (r *OSRelease) String() string {
+	if r.PrettyName != "" {
+		return r.PrettyName
+	}
+	return strings.TrimSpace(r.ID + " " + r.VersionID)
+}
+
+// InstallStrategy installs WireGuard with one package manager
+type InstallStrategy struct {
+	Name string
+
+	// Commands returns the commands installing wg and wg-quick, plus the
+	// kernel module where the distro ships it separately
+	Commands func(release *OSRelease) []string
+
+	// UserspaceCommands install wireguard-go for kernels without WireGuard,
+	// nil if the distro doesn't package it
+	UserspaceCommands []string
+}
+
+var aptStrategy = &InstallStrategy{
+	Name: "apt",
+	Commands: func(*OSRelease) []string {
+		return []string{
+			"apt update -qq",
+			"DEBIAN_FRONTEND=noninteractive apt install -y -qq wireguard wireguard-tools",
+		}
+	},
+	UserspaceCommands: []string{"DEBIAN_FRONTEND=noninteractive apt install -y -qq wireguard-go"},
+}
+
+var dnfStrategy = &InstallStrategy{
+	Name: "dnf",
+	Commands: func(release *OSRelease) []string {
+		if release.ID == "fedora" {
+			return []string{"dnf install -y wireguard-tools"}
+		}
+		switch release.MajorVersion() {
+		case "7":
+			// The kernel has no WireGuard, ELRepo provides the module
+			return []string{
+				"yum install -y " + epelPackage(release) + " " + elrepoPackage(release),
+				"yum install -y yum-plugin-elrepo",
+				"yum install -y kmod-wireguard wireguard-tools",
+			}
+		case "8":
+			// The kernel has WireGuard since 8.4, the tools come from EPEL
+			return []string{
+				"dnf install -y " + epelPackage(release),
+				"dnf install -y wireguard-tools",
+			}
+		default:
+			return []string{"dnf install -y wireguard-tools"}
+		}
+	},
+}
+
+// epelPackage returns the package enabling EPEL on an Enterprise Linux
+// release. Only the community rebuilds ship epel-release in their own
+// repositories; RHEL installs it from the EPEL site and Oracle Linux has its
+// own package.
+func epelPackage(release *OSRelease) string {
+	switch release.ID {
+	case "rhel":
+		return "https://dl.fedoraproject.org/pub/epel/epel-release-latest-" + release.MajorVersion() + ".noarch.rpm"
+	case "ol":
+		return "oracle-epel-release-el" + release.MajorVersion()
+	default:
+		return "epel-release"
+	}
+}
+
+// elrepoPackage returns the package enabling ELRepo on an Enterprise Linux 7
+// release, which only CentOS ships in its extras repository
+func elrepoPackage(release *OSRelease) string {
+	if release.ID == "centos" {
+		return "elrepo-release"
+	}
+	return "https://www.elrepo.org/elrepo-release-7.el7.elrepo.noarch.rpm"
+}
+
+var apkStrategy = &InstallStrategy{
+	Name: "apk",
+	Commands: func(*OSRelease) []string {
+		// wg-quick needs the full ip from iproute2, not the busybox one
+		return []string{"apk add --no-cache wireguard-tools iproute2"}
+	},
+	UserspaceCommands: []string{"apk add --no-cache wireguard-go"},
+}
+
+var pacmanStrategy = &InstallStrategy{
+	Name: "pacman",
+	Commands: func(*OSRelease) []string {
+		// Refreshing the databases without upgrading is a partial upgrade,
+		// which Arch does not support
+		return []string{"pacman -Syu --noconfirm --needed wireguard-tools"}
+	},
+}
+
+var zypperStrategy = &InstallStrategy{
+	Name: "zypper",
+	Commands: func(*OSRelease) []string {
+		return []string{"zypper --non-interactive install wireguard-tools"}
+	},
+}
+
+// installStrategies maps os-release IDs to strategies. Distros not listed
+// are matched by their ID_LIKE.
+var installStrategies = map[string]*InstallStrategy{
+	"debian":              aptStrategy,
+	"ubuntu":              aptStrategy,
+	"fedora":              dnfStrategy,
+	"rhel":                dnfStrategy,
+	"centos":              dnfStrategy,
+	"rocky":               dnfStrategy,
+	"almalinux":           dnfStrategy,
+	"ol":                  dnfStrategy,
+	"alpine":              apkStrategy,
+	"arch":                pacmanStrategy,
+	"opensuse-leap":       zypperStrategy,
+	"opensuse-tumbleweed": zypperStrategy,
+	"sles":                zypperStrategy,
+	"suse":                zypperStrategy,
+}
+
+// RegisterInstallStrategy adds or replaces the strategy used for an
+// os-release ID
+func RegisterInstallStrategy(id string, strategy *InstallStrategy) {
+	installStrategies[id] = strategy
+}
+
+// FindInstallStrategy returns the strategy for a distro, trying its ID first
+// and then ID_LIKE in order
+func FindInstallStrategy(release *OSRelease) (*InstallStrategy, error) {
+	for _, id := range append([]string{release.ID}, release.IDLike...) {
+		if strategy, ok := installStrategies[id]; ok {
+			return strategy, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported distribution %s (ID=%s, ID_LIKE=%s): install wireguard-tools manually",
+		release, release.ID, strings.Join(release.IDLike, " "))
+}
+
+// DetectOS reads /etc/os-release on the host
+func DetectOS(client *Client) (*OSRelease, error) {
+	output, err := client.Run("cat /etc/os-release 2>/dev/null || cat /usr/lib/os-release")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read os-release: %w", err)
+	}
+	release := ParseOSRelease(output)
+	if release.ID == "" {
+		return nil, fmt.Errorf("os-release has no ID")
+	}
+	return release, nil
+}
+
+// ParseOSRelease parses the KEY=value lines of an os-release file
+func ParseOSRelease(content string) *OSRelease {
+	release := &OSRelease{}
+	for _, line := range strings.Split(content, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(value, `"'`)
+		switch key {
+		case "ID":
+			release.ID = strings.ToLower(value)
+		case "ID_LIKE":
+			release.IDLike = strings.Fields(strings.ToLower(value))
+		case "VERSION_ID":
+			release.VersionID = value
+		case "PRETTY_NAME":
+			release.PrettyName = value
+		}
+	}
+	return release
+}
+
+// EnsureWireGuardInstalled installs wg and wg-quick with the package manager
+// of the host's distribution and makes sure the kernel supports WireGuard,
+// falling back to wireguard-go
+func EnsureWireGuardInstalled(client *Client) error {
+	if hasWireGuardTools(client) && (hasKernelWireGuard(client) || hasWireGuardGo(client)) {
+		return nil
+	}
+
+	release, err := DetectOS(client)
+	if err != nil {
+		return err
+	}
+	strategy, err := FindInstallStrategy(release)
+	if err != nil {
+		return err
+	}
+
+	if !hasWireGuardTools(client) {
+		client.Printf("  Installing WireGuard on %s with %s...\n", release, strategy.Name)
+		if err := runAll(client, strategy.Commands(release)); err != nil {
+			return err
+		}
+		if !hasWireGuardTools(client) {
+			return fmt.Errorf("wg or wg-quick still missing after installing with %s", strategy.Name)
+		}
+	}
+
+	if hasKernelWireGuard(client) || hasWireGuardGo(client) {
+		return nil
+	}
+	if strategy.UserspaceCommands == nil {
+		return fmt.Errorf("the kernel on %s has no WireGuard support and %s has no wireguard-go package: install wireguard-go manually", release, strategy.Name)
+	}
+
+	client.Printf("  Kernel has no WireGuard support, installing wireguard-go...\n")
+	if err := runAll(client, strategy.UserspaceCommands); err != nil {
+		return fmt.Errorf("no kernel WireGuard support and wireguard-go failed to install: %w", err)
+	}
+	if !hasWireGuardGo(client) {
+		return fmt.Errorf("no kernel WireGuard support and wireguard-go is missing after installing it")
+	}
+	return nil
+}
+
+func runAll(client *Client, commands []string) error {
+	for _, cmd := range commands {
+		if _, err := client.Run(cmd); err != nil {
+			return fmt.Errorf("failed to run %q: %w", cmd, err)
+		}
+	}
+	return nil
+}
+
+func hasWireGuardTools(client *Client) bool {
+	return client.RunQuiet("command -v wg && command -v wg-quick") == nil
+}
+
+// hasKernelWireGuard checks for the module, or built-in support, by creating
+// a throwaway interface
+func hasKernelWireGuard(client *Client) bool {
+	return client.RunQuiet("modprobe wireguard 2>/dev/null; ip link add wgmesh-probe type wireguard 2>/dev/null && ip link del wgmesh-probe") == nil
+}
+
+// hasWireGuardGo reports whether wg-quick can fall back to wireguard-go
+func hasWireGuardGo(client *Client) bool {
+	return client.RunQuiet("command -v wireguard-go") == nil
+}
@@ -0,0 +1,157 @@
+package ssh
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseOSRelease(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    OSRelease
+	}{
+		{
+			name: "ubuntu",
+			content: `PRETTY_NAME="Ubuntu 22.04.4 LTS"
+NAME="Ubuntu"
+VERSION_ID="22.04"
+ID=ubuntu
+ID_LIKE=debian
+`,
+			want: OSRelease{ID: "ubuntu", IDLike: []string{"debian"}, VersionID: "22.04", PrettyName: "Ubuntu 22.04.4 LTS"},
+		},
+		{
+			name: "rocky",
+			content: `NAME="Rocky Linux"
+VERSION_ID="9.3"
+ID="rocky"
+ID_LIKE="rhel centos fedora"
+PRETTY_NAME="Rocky Linux 9.3 (Blue Onyx)"`,
+			want: OSRelease{ID: "rocky", IDLike: []string{"rhel", "centos", "fedora"}, VersionID: "9.3", PrettyName: "Rocky Linux 9.3 (Blue Onyx)"},
+		},
+		{
+			name:    "arch without version",
+			content: "NAME=\"Arch Linux\"\nID=arch\n# comment\nBUILD_ID=rolling\n",
+			want:    OSRelease{ID: "arch"},
+		},
+		{
+			name:    "uppercase and single quotes",
+			content: "ID='OL'\nVERSION_ID='8.9'\n",
+			want:    OSRelease{ID: "ol", VersionID: "8.9"},
+		},
+		{
+			name:    "empty",
+			content: "",
+			want:    OSRelease{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ParseOSRelease(tt.content)
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("ParseOSRelease() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindInstallStrategy(t *testing.T) {
+	tests := []struct {
+		name     string
+		release  OSRelease
+		strategy string // empty if unsupported
+		commands []string
+	}{
+		{
+			name:     "debian",
+			release:  OSRelease{ID: "debian", VersionID: "12"},
+			strategy: "apt",
+		},
+		{
+			name:     "fedora",
+			release:  OSRelease{ID: "fedora", VersionID: "40"},
+			strategy: "dnf",
+			commands: []string{"dnf install -y wireguard-tools"},
+		},
+		{
+			name:     "rhel 9 uses the base repositories",
+			release:  OSRelease{ID: "rhel", VersionID: "9.4"},
+			strategy: "dnf",
+			commands: []string{"dnf install -y wireguard-tools"},
+		},
+		{
+			name:     "rhel 8 installs epel from its site",
+			release:  OSRelease{ID: "rhel", VersionID: "8.10"},
+			strategy: "dnf",
+			commands: []string{
+				"dnf install -y https://dl.fedoraproject.org/pub/epel/epel-release-latest-8.noarch.rpm",
+				"dnf install -y wireguard-tools",
+			},
+		},
+		{
+			name:     "oracle linux 8 uses its own epel package",
+			release:  OSRelease{ID: "ol", VersionID: "8.9"},
+			strategy: "dnf",
+			commands: []string{
+				"dnf install -y oracle-epel-release-el8",
+				"dnf install -y wireguard-tools",
+			},
+		},
+		{
+			name:     "centos 7 needs elrepo",
+			release:  OSRelease{ID: "centos", VersionID: "7"},
+			strategy: "dnf",
+			commands: []string{
+				"yum install -y epel-release elrepo-release",
+				"yum install -y yum-plugin-elrepo",
+				"yum install -y kmod-wireguard wireguard-tools",
+			},
+		},
+		{
+			name:     "arch upgrades fully",
+			release:  OSRelease{ID: "arch"},
+			strategy: "pacman",
+			commands: []string{"pacman -Syu --noconfirm --needed wireguard-tools"},
+		},
+		{
+			name:     "derivative matched by ID_LIKE",
+			release:  OSRelease{ID: "linuxmint", IDLike: []string{"ubuntu", "debian"}},
+			strategy: "apt",
+		},
+		{
+			name:     "first ID_LIKE wins",
+			release:  OSRelease{ID: "manjaro", IDLike: []string{"arch"}},
+			strategy: "pacman",
+		},
+		{
+			name:    "unsupported",
+			release: OSRelease{ID: "gentoo"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy, err := FindInstallStrategy(&tt.release)
+			if tt.strategy == "" {
+				if err == nil || !strings.Contains(err.Error(), "unsupported distribution") {
+					t.Fatalf("Expected an unsupported distribution error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FindInstallStrategy failed: %v", err)
+			}
+			if strategy.Name != tt.strategy {
+				t.Errorf("Strategy = %s, want %s", strategy.Name, tt.strategy)
+			}
+			if tt.commands != nil {
+				if got := strategy.Commands(&tt.release); !reflect.DeepEqual(got, tt.commands) {
+					t.Errorf("Commands() = %q, want %q", got, tt.commands)
+				}
+			}
+		})
+	}
+}
@@ -133,11 +133,11 @@ func normalizeNetwork(network string) string {
 func ApplyRouteDiff(client *Client, iface string, toAdd, toRemove []RouteEntry) error {
 	totalChanges := len(toAdd) + len(toRemove)
 	if totalChanges == 0 {
-		fmt.Printf("  No route changes needed (all routes already correct)\n")
+		client.Printf("  No route changes needed (all routes already correct)\n")
 		return nil
 	}
 
-	fmt.Printf("  Route changes: %d to remove, %d to add\n", len(toRemove), len(toAdd))
+	client.Printf("  Route changes: %d to remove, %d to add\n", len(toRemove), len(toAdd))
 
 	if len(toRemove) > 0 {
 		for _, route := range toRemove {
@@ -151,12 +151,12 @@ func ApplyRouteDiff(client *Client, iface string, toAdd, toRemove []RouteEntry)
 			}
 
 			if err := client.RunQuiet(cmd); err != nil {
-				fmt.Printf("    Warning: failed to remove route %s: %v\n", route.Network, err)
+				client.Printf("    Warning: failed to remove route %s: %v\n", route.Network, err)
 			} else {
 				if route.Gateway != "" {
-					fmt.Printf("    Removed route: %s via %s\n", route.Network, route.Gateway)
+					client.Printf("    Removed route: %s via %s\n", route.Network, route.Gateway)
 				} else {
-					fmt.Printf("    Removed route: %s\n", route.Network)
+					client.Printf("    Removed route: %s\n", route.Network)
 				}
 			}
 		}
@@ -178,9 +178,9 @@ func ApplyRouteDiff(client *Client, iface string, toAdd, toRemove []RouteEntry)
 			}
 
 			if route.Gateway != "" {
-				fmt.Printf("    Added route: %s via %s\n", route.Network, route.Gateway)
+				client.Printf("    Added route: %s via %s\n", route.Network, route.Gateway)
 			} else {
-				fmt.Printf("    Added route: %s\n", route.Network)
+				client.Printf("    Added route: %s\n", route.Network)
 			}
 		}
 	}
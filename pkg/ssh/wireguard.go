@@ -5,29 +5,6 @@ import (
 	"strings"
 )
 
-func EnsureWireGuardInstalled(client *Client) error {
-	output, err := client.Run("which wg")
-	if err == nil && strings.Contains(output, "/wg") {
-		return nil
-	}
-
-	fmt.Println("  Installing WireGuard...")
-
-	commands := []string{
-		"apt update -qq",
-		"DEBIAN_FRONTEND=noninteractive apt install -y -qq wireguard wireguard-tools",
-		"modprobe wireguard || true",
-	}
-
-	for _, cmd := range commands {
-		if _, err := client.Run(cmd); err != nil {
-			return fmt.Errorf("failed to run %q: %w", cmd, err)
-		}
-	}
-
-	return nil
-}
-
 func DetectPublicIP(client *Client) (string, error) {
 	output, err := client.Run("curl -s -4 ifconfig.me || curl -s -4 icanhazip.com || true")
 	if err != nil {
@@ -43,7 +20,7 @@ func DetectPublicIP(client *Client) (string, error) {
 }
 
 func UpdateRoutingTable(client *Client, iface string, networks []string) error {
-	fmt.Printf("  Updating routing table...\n")
+	client.Printf("  Updating routing table...\n")
 
 	for _, network := range networks {
 		cmd := fmt.Sprintf("ip route add %s dev %s || ip route replace %s dev %s",
@@ -51,7 +28,7 @@ func UpdateRoutingTable(client *Client, iface string, networks []string) error {
 		if err := client.RunQuiet(cmd); err != nil {
 			return fmt.Errorf("failed to add route for %s: %w", network, err)
 		}
-		fmt.Printf("    Added route: %s\n", network)
+		client.Printf("    Added route: %s\n", network)
 	}
 
 	cmd := "sysctl -w net.ipv4.ip_forward=1 > /dev/null"
@@ -63,7 +40,7 @@ func UpdateRoutingTable(client *Client, iface string, networks []string) error {
 }
 
 func UpdateRoutingTableWithGateways(client *Client, iface string, routes []RouteEntry) error {
-	fmt.Printf("  Updating routing table with gateways...\n")
+	client.Printf("  Updating routing table with gateways...\n")
 
 	for _, route := range routes {
 		cmd := fmt.Sprintf("ip route add %s via %s dev %s || ip route replace %s via %s dev %s",
@@ -71,7 +48,7 @@ func UpdateRoutingTableWithGateways(client *Client, iface string, routes []Route
 		if err := client.RunQuiet(cmd); err != nil {
 			return fmt.Errorf("failed to add route for %s via %s: %w", route.Network, route.Gateway, err)
 		}
-		fmt.Printf("    Added route: %s via %s\n", route.Network, route.Gateway)
+		client.Printf("    Added route: %s via %s\n", route.Network, route.Gateway)
 	}
 
 	cmd := "sysctl -w net.ipv4.ip_forward=1 > /dev/null"
@@ -4,7 +4,9 @@ import (
 	"encoding/base64"
 	"fmt"
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/atvirokodosprendimai/wgmesh/pkg/ssh"
 )
@@ -28,7 +30,7 @@ type WGPeer struct {
 }
 
 func ApplyFullConfiguration(client *ssh.Client, iface string, config *FullConfig) error {
-	fmt.Println("  Creating fresh WireGuard configuration...")
+	client.Println("  Creating fresh WireGuard configuration...")
 
 	if _, err := client.Run(fmt.Sprintf("ip link del %s 2>/dev/null || true", iface)); err != nil {
 	}
@@ -76,7 +78,7 @@ func ApplyFullConfiguration(client *ssh.Client, iface string, config *FullConfig
 			return fmt.Errorf("failed to add peer %s: %w", peer.PublicKey[:16], err)
 		}
 
-		fmt.Printf("    Added peer: %s\n", peer.PublicKey[:16])
+		client.Printf("    Added peer: %s\n", peer.PublicKey[:16])
 	}
 
 	return nil
@@ -147,3 +149,69 @@ func GetPeers(iface string) ([]WGPeer, error) {
 
 	return peers, nil
 }
+
+// PeerStats holds runtime statistics for a peer on the local WireGuard interface
+type PeerStats struct {
+	PublicKey       string
+	Endpoint        string
+	LatestHandshake time.Time // zero if no handshake yet
+	ReceiveBytes    uint64
+	TransmitBytes   uint64
+}
+
+// GetPeerStats returns per-peer statistics from 'wg show <iface> dump'
+func GetPeerStats(iface string) ([]PeerStats, error) {
+	cmd := exec.Command("wg", "show", iface, "dump")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("wg show dump failed: %w", err)
+	}
+
+	return parsePeerStats(string(output))
+}
+
+// parsePeerStats parses 'wg show dump' output. The first line describes the
+// interface, every following line is a tab-separated peer record:
+// pubkey, psk, endpoint, allowed-ips, latest-handshake, rx, tx, keepalive
+func parsePeerStats(dump string) ([]PeerStats, error) {
+	lines := strings.Split(strings.TrimSpace(dump), "\n")
+	if len(lines) <= 1 {
+		return nil, nil
+	}
+
+	var stats []PeerStats
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 8 {
+			return nil, fmt.Errorf("unexpected wg dump line: %q", line)
+		}
+
+		handshake, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid handshake time %q: %w", fields[4], err)
+		}
+		rx, err := strconv.ParseUint(fields[5], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rx bytes %q: %w", fields[5], err)
+		}
+		tx, err := strconv.ParseUint(fields[6], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tx bytes %q: %w", fields[6], err)
+		}
+
+		s := PeerStats{
+			PublicKey:     fields[0],
+			ReceiveBytes:  rx,
+			TransmitBytes: tx,
+		}
+		if fields[2] != "(none)" {
+			s.Endpoint = fields[2]
+		}
+		if handshake > 0 {
+			s.LatestHandshake = time.Unix(handshake, 0)
+		}
+		stats = append(stats, s)
+	}
+
+	return stats, nil
+}
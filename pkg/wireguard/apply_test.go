@@ -0,0 +1,42 @@
+package wireguard
+
+import (
+	"testing"
+)
+
+func TestParsePeerStats(t *testing.T) {
+	dump := "cHJpdmF0ZQ==\tcHVibGlj\t51820\toff\n" +
+		"cGVlcjE=\t(none)\t203.0.113.5:51820\t10.42.0.2/32\t1700000000\t1024\t2048\t25\n" +
+		"cGVlcjI=\t(none)\t(none)\t10.42.0.3/32\t0\t0\t0\t25\n"
+
+	stats, err := parsePeerStats(dump)
+	if err != nil {
+		t.Fatalf("parsePeerStats failed: %v", err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("Expected 2 peers, got %d", len(stats))
+	}
+
+	if stats[0].PublicKey != "cGVlcjE=" || stats[0].Endpoint != "203.0.113.5:51820" {
+		t.Errorf("Unexpected first peer: %+v", stats[0])
+	}
+	if stats[0].LatestHandshake.Unix() != 1700000000 {
+		t.Errorf("Expected handshake 1700000000, got %d", stats[0].LatestHandshake.Unix())
+	}
+	if stats[0].ReceiveBytes != 1024 || stats[0].TransmitBytes != 2048 {
+		t.Errorf("Expected rx=1024 tx=2048, got rx=%d tx=%d", stats[0].ReceiveBytes, stats[0].TransmitBytes)
+	}
+
+	if stats[1].Endpoint != "" {
+		t.Errorf("Expected empty endpoint for (none), got %q", stats[1].Endpoint)
+	}
+	if !stats[1].LatestHandshake.IsZero() {
+		t.Errorf("Expected zero handshake time, got %v", stats[1].LatestHandshake)
+	}
+}
+
+func TestParsePeerStatsMalformed(t *testing.T) {
+	if _, err := parsePeerStats("iface\nbroken\tline\n"); err == nil {
+		t.Error("Expected error for malformed dump line")
+	}
+}
@@ -117,6 +117,12 @@ func (d *ConfigDiff) HasChanges() bool {
 	return d.InterfaceChanged || len(d.AddedPeers) > 0 || len(d.RemovedPeers) > 0 || len(d.ModifiedPeers) > 0
 }
 
+// NeedsRestart reports whether applying the diff restarts wg-quick instead of
+// updating the peers online
+func (d *ConfigDiff) NeedsRestart() bool {
+	return d.InterfaceChanged || !canUseOnlineUpdate(d)
+}
+
 func peersEqual(a, b Peer) bool {
 	if a.Endpoint != b.Endpoint {
 		return false
@@ -154,21 +160,21 @@ func ApplyDiff(client *ssh.Client, iface string, diff *ConfigDiff) error {
 		if _, err := client.Run(cmd); err != nil {
 			return fmt.Errorf("failed to remove peer: %w", err)
 		}
-		fmt.Printf("    Removed peer: %s\n", pubKey[:16])
+		client.Printf("    Removed peer: %s\n", pubKey[:16])
 	}
 
 	for pubKey, peer := range diff.AddedPeers {
 		if err := addOrUpdatePeer(client, iface, pubKey, peer); err != nil {
 			return err
 		}
-		fmt.Printf("    Added peer: %s\n", pubKey[:16])
+		client.Printf("    Added peer: %s\n", pubKey[:16])
 	}
 
 	for pubKey, peer := range diff.ModifiedPeers {
 		if err := addOrUpdatePeer(client, iface, pubKey, peer); err != nil {
 			return err
 		}
-		fmt.Printf("    Updated peer: %s\n", pubKey[:16])
+		client.Printf("    Updated peer: %s\n", pubKey[:16])
 	}
 
 	return nil
@@ -62,32 +62,22 @@ func ApplyPersistentConfig(client *ssh.Client, iface string, config *FullConfig,
 	configContent := GenerateWgQuickConfig(config, routes)
 	configPath := fmt.Sprintf("/etc/wireguard/%s.conf", iface)
 
-	fmt.Printf("  Writing persistent configuration to %s\n", configPath)
+	client.Printf("  Writing persistent configuration to %s\n", configPath)
 
 	if err := client.WriteFile(configPath, []byte(configContent), 0600); err != nil {
 		return fmt.Errorf("failed to write config file: %w", err)
 	}
 
-	fmt.Printf("  Enabling wg-quick@%s service\n", iface)
-	if _, err := client.Run(fmt.Sprintf("systemctl enable wg-quick@%s", iface)); err != nil {
-		return fmt.Errorf("failed to enable systemd service: %w", err)
-	}
-
-	fmt.Printf("  Restarting wg-quick@%s service\n", iface)
-	if _, err := client.Run(fmt.Sprintf("systemctl restart wg-quick@%s", iface)); err != nil {
-		return fmt.Errorf("failed to restart service: %w", err)
-	}
-
-	return nil
+	return enableService(client, iface)
 }
 
 func UpdatePersistentConfig(client *ssh.Client, iface string, config *FullConfig, routes []ssh.RouteEntry, diff *ConfigDiff) error {
-	if diff.InterfaceChanged || !canUseOnlineUpdate(diff) {
-		fmt.Printf("  Significant changes detected, applying full persistent config\n")
+	if diff.NeedsRestart() {
+		client.Printf("  Significant changes detected, applying full persistent config\n")
 		return ApplyPersistentConfig(client, iface, config, routes)
 	}
 
-	fmt.Printf("  Applying online peer updates and updating persistent config\n")
+	client.Printf("  Applying online peer updates and updating persistent config\n")
 
 	configContent := GenerateWgQuickConfig(config, routes)
 	configPath := fmt.Sprintf("/etc/wireguard/%s.conf", iface)
@@ -111,10 +101,7 @@ func canUseOnlineUpdate(diff *ConfigDiff) bool {
 }
 
 func RemovePersistentConfig(client *ssh.Client, iface string) error {
-	fmt.Printf("  Stopping and disabling wg-quick@%s service\n", iface)
-
-	client.RunQuiet(fmt.Sprintf("systemctl stop wg-quick@%s", iface))
-	client.RunQuiet(fmt.Sprintf("systemctl disable wg-quick@%s", iface))
+	disableService(client, iface)
 
 	configPath := fmt.Sprintf("/etc/wireguard/%s.conf", iface)
 	if _, err := client.Run(fmt.Sprintf("rm -f %s", configPath)); err != nil {
@@ -0,0 +1,119 @@
+package wireguard
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/atvirokodosprendimai/wgmesh/pkg/ssh"
+)
+
+// Init systems that can bring the interface up at boot
+const (
+	InitSystemd = "systemd"
+	InitOpenRC  = "openrc"
+)
+
+// DetectInitSystem returns the service manager running on the host
+func DetectInitSystem(client *ssh.Client) (string, error) {
+	output, err := client.Run("if [ -d /run/systemd/system ]; then echo systemd; elif command -v openrc-run >/dev/null || [ -x /sbin/openrc-run ]; then echo openrc; fi")
+	if err != nil {
+		return "", fmt.Errorf("failed to detect init system: %w", err)
+	}
+
+	switch initSystem := strings.TrimSpace(output); initSystem {
+	case InitSystemd, InitOpenRC:
+		return initSystem, nil
+	default:
+		return "", fmt.Errorf("no supported init system found, need systemd or OpenRC")
+	}
+}
+
+// openRCServiceName returns the OpenRC service running wg-quick for iface
+func openRCServiceName(iface string) string {
+	return "wg-quick." + iface
+}
+
+// openRCScript returns an OpenRC service bringing iface up with wg-quick
+func openRCScript(iface string) string {
+	return fmt.Sprintf(`#!/sbin/openrc-run
+# Managed by wgmesh
+
+description="WireGuard interface %[1]s"
+
+depend() {
+	need net
+	after firewall
+}
+
+start() {
+	ebegin "Starting WireGuard interface %[1]s"
+	wg-quick up %[1]s
+	eend $?
+}
+
+stop() {
+	ebegin "Stopping WireGuard interface %[1]s"
+	wg-quick down %[1]s
+	eend $?
+}
+`, iface)
+}
+
+// enableService makes the interface come up at boot and (re)starts it now
+func enableService(client *ssh.Client, iface string) error {
+	initSystem, err := DetectInitSystem(client)
+	if err != nil {
+		return err
+	}
+
+	if initSystem == InitOpenRC {
+		service := openRCServiceName(iface)
+		client.Printf("  Enabling %s OpenRC service\n", service)
+		if err := client.WriteFile("/etc/init.d/"+service, []byte(openRCScript(iface)), 0755); err != nil {
+			return fmt.Errorf("failed to write OpenRC service: %w", err)
+		}
+		if _, err := client.Run(fmt.Sprintf("rc-update add %s default", service)); err != nil {
+			return fmt.Errorf("failed to enable OpenRC service: %w", err)
+		}
+
+		client.Printf("  Restarting %s OpenRC service\n", service)
+		if _, err := client.Run(fmt.Sprintf("rc-service %s restart", service)); err != nil {
+			return fmt.Errorf("failed to restart service: %w", err)
+		}
+		return nil
+	}
+
+	client.Printf("  Enabling wg-quick@%s service\n", iface)
+	if _, err := client.Run(fmt.Sprintf("systemctl enable wg-quick@%s", iface)); err != nil {
+		return fmt.Errorf("failed to enable systemd service: %w", err)
+	}
+
+	client.Printf("  Restarting wg-quick@%s service\n", iface)
+	if _, err := client.Run(fmt.Sprintf("systemctl restart wg-quick@%s", iface)); err != nil {
+		return fmt.Errorf("failed to restart service: %w", err)
+	}
+	return nil
+}
+
+// disableService stops the interface and removes it from boot
+func disableService(client *ssh.Client, iface string) {
+	initSystem, err := DetectInitSystem(client)
+	if err != nil {
+		client.Printf("  Warning: %v, bringing %s down with wg-quick\n", err, iface)
+		client.RunQuiet(fmt.Sprintf("wg-quick down %s", iface))
+		return
+	}
+
+	if initSystem == InitOpenRC {
+		service := openRCServiceName(iface)
+		client.Printf("  Stopping and disabling %s OpenRC service\n", service)
+		client.RunQuiet(fmt.Sprintf("rc-service %s stop", service))
+		client.RunQuiet(fmt.Sprintf("rc-update del %s default", service))
+		client.RunQuiet("rm -f /etc/init.d/" + service)
+		return
+	}
+
+	client.Printf("  Stopping and disabling wg-quick@%s service\n", iface)
+	client.RunQuiet(fmt.Sprintf("systemctl stop wg-quick@%s", iface))
+	client.RunQuiet(fmt.Sprintf("systemctl disable wg-quick@%s", iface))
+}